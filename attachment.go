@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAttachmentNotFound is returned when opening a streamed attachment whose frames are gone
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// ErrAttachmentOverflow ends a streamed attachment whose sender ignored the flow control window
+	ErrAttachmentOverflow = errors.New("attachment: flow control window exceeded")
+	// ErrAttachmentIdle ends a streamed attachment whose sender sent nothing for too long
+	ErrAttachmentIdle = errors.New("attachment: sender idle")
+)
+
+// Attachment streaming parameters
+const (
+	// attachmentFrameSize is the payload size of the binary frames carrying an attachment
+	attachmentFrameSize = 32 << 10
+	// attachmentBacklog is the number of data frames a sender may have unacknowledged, which is
+	// also the number of frames buffered per attachment
+	attachmentBacklog = 16
+	// attachmentTimeout is how long frames of an attachment nobody reads are kept, how long a
+	// sender waits for credit and how long a reader waits for the next frame before giving up
+	attachmentTimeout = 30 * time.Second
+	// attachmentMaxStreams limits the incoming attachments open at once on a connection
+	attachmentMaxStreams = 64
+)
+
+// Binary frame flags, following the 16-byte stream ID at the start of every frame
+//
+// Data, end and error frames go from the sender to the receiver. Credit frames, carrying a 4-byte
+// big-endian frame count, and cancel frames go back from the receiver to the sender.
+const (
+	attachmentData byte = iota
+	attachmentEnd
+	attachmentError
+	attachmentCredit
+	attachmentCancel
+)
+
+// Attachment is a binary value, such as an image or a file, carried in params or data
+//
+// In JSON it encodes as an object with the media type, the size and the base64 content. An
+// attachment bound to a connection with Conn.Attach is instead streamed as raw binary frames
+// when the transport supports them, WebSocket binary frames or length prefixed stdio, and only
+// its stream ID is encoded, so it is never fully buffered.
+type Attachment struct {
+	MediaType string
+	Name      string
+	// Size is the content length in bytes, or -1 when unknown
+	Size int64
+
+	data   []byte
+	r      io.Reader
+	stream string
+}
+
+// attachmentJSON is the JSON encoding of an Attachment
+type attachmentJSON struct {
+	MediaType string `json:"media_type"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size"`
+	Data      []byte `json:"data,omitempty"`
+	Stream    string `json:"stream,omitempty"`
+}
+
+// NewAttachment creates an attachment holding data
+func NewAttachment(mediaType string, data []byte) *Attachment {
+	return &Attachment{MediaType: mediaType, Size: int64(len(data)), data: data}
+}
+
+// NewAttachmentReader creates an attachment reading its content from r, size is -1 when unknown
+func NewAttachmentReader(mediaType string, r io.Reader, size int64) *Attachment {
+	return &Attachment{MediaType: mediaType, Size: size, r: r}
+}
+
+// MarshalJSON encodes the attachment, reading the content of a reader attachment that is not streamed
+func (a *Attachment) MarshalJSON() ([]byte, error) {
+	v := attachmentJSON{MediaType: a.MediaType, Name: a.Name, Size: a.Size, Stream: a.stream}
+	if a.stream == "" {
+		if a.r != nil {
+			data, err := io.ReadAll(a.r)
+			if err != nil {
+				return nil, err
+			}
+			a.data, a.r, a.Size = data, nil, int64(len(data))
+		}
+		v.Data, v.Size = a.data, int64(len(a.data))
+		if v.Data == nil {
+			v.Data = []byte{}
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes an attachment with inline content or a stream ID
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	var v attachmentJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*a = Attachment{MediaType: v.MediaType, Name: v.Name, Size: v.Size, data: v.Data, stream: v.Stream}
+	return nil
+}
+
+// Streamed reports whether the content travels as binary frames
+func (a *Attachment) Streamed() bool {
+	return a.stream != ""
+}
+
+// Open returns a reader over the content
+//
+// Streamed attachments are read from the connection that received the request handled with
+// ctx, clients use Conn.OpenAttachment for attachments in response data.
+func (a *Attachment) Open(ctx context.Context) (io.ReadCloser, error) {
+	if a.stream == "" {
+		if a.r != nil {
+			return io.NopCloser(a.r), nil
+		}
+		return io.NopCloser(bytes.NewReader(a.data)), nil
+	}
+	c := ConnFromContext(ctx)
+	if c == nil {
+		return nil, ErrAttachmentNotFound
+	}
+	return c.OpenAttachment(ctx, a)
+}
+
+// Bytes reads the whole content
+func (a *Attachment) Bytes(ctx context.Context) ([]byte, error) {
+	rc, err := a.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Attach binds a to the connection so that its content is streamed as binary frames, and
+// returns a
+//
+// When the transport cannot carry binary payloads the attachment is left unchanged and its
+// content is inlined as base64. Streaming starts at once, a must be sent in a message right after.
+func (c *Conn) Attach(a *Attachment) (*Attachment, error) {
+	bt, ok := binaryTransport(c.t)
+	if !ok || a.stream != "" {
+		return a, nil
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	a.stream = id
+
+	r := a.r
+	if r == nil {
+		r = bytes.NewReader(a.data)
+	}
+	send := c.attachments.register(id)
+	go c.streamAttachment(bt, send, r)
+	return a, nil
+}
+
+// streamAttachment sends the content read from r as binary frames, ended by an end or error frame
+//
+// Every data frame spends one credit, the receiver grants more as its reader consumes frames.
+// Sending stops when the receiver cancels the stream or grants no credit for attachmentTimeout.
+func (c *Conn) streamAttachment(bt BinaryTransport, send *attachmentSend, r io.Reader) {
+	defer c.attachments.unregister(send)
+	header, _ := hex.DecodeString(send.id)
+	buf := make([]byte, attachmentFrameSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if !send.wait(c.ctx) {
+				return
+			}
+			frame := append(append(append(make([]byte, 0, len(header)+1+n), header...), attachmentData), buf[:n]...)
+			if bt.SendBinary(c.ctx, frame) != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			_ = bt.SendBinary(c.ctx, append(append([]byte(nil), header...), attachmentEnd))
+			return
+		}
+		if err != nil {
+			frame := append(append(append([]byte(nil), header...), attachmentError), err.Error()...)
+			_ = bt.SendBinary(c.ctx, frame)
+			return
+		}
+	}
+}
+
+// OpenAttachment returns a reader over a streamed attachment received on the connection
+//
+// Each streamed attachment can be opened once. Closing the reader before the end discards the
+// remaining frames. Reading fails with ErrAttachmentIdle when the sender sends nothing for
+// attachmentTimeout, for instance because it stopped without ending the stream.
+func (c *Conn) OpenAttachment(ctx context.Context, a *Attachment) (io.ReadCloser, error) {
+	if a.stream == "" {
+		return a.Open(ctx)
+	}
+	s := c.attachments.claim(a.stream)
+	if s == nil {
+		return nil, ErrAttachmentNotFound
+	}
+	return &attachmentReader{s: s, conn: c, ctx: ctx, idle: c.attachments.idle()}, nil
+}
+
+// attachmentTable holds the incoming and outgoing attachment streams of a connection
+type attachmentTable struct {
+	mu      sync.Mutex
+	streams map[string]*attachmentStream
+	// removed holds the IDs of incoming streams that ended recently, so late frames are dropped
+	// instead of opening them again
+	removed map[string]time.Time
+	sends   map[string]*attachmentSend
+	// idleTimeout overrides attachmentTimeout for readers waiting for the next frame
+	idleTimeout time.Duration
+}
+
+// idle returns how long a reader waits for the next frame of a stream
+func (t *attachmentTable) idle() time.Duration {
+	if t.idleTimeout > 0 {
+		return t.idleTimeout
+	}
+	return attachmentTimeout
+}
+
+// attachmentSend is an outgoing attachment waiting for credit from the receiver
+type attachmentSend struct {
+	id       string
+	credit   chan struct{}
+	canceled chan struct{}
+	once     sync.Once
+}
+
+// attachmentStream is an incoming attachment whose frames are queued until read
+type attachmentStream struct {
+	id      string
+	frames  chan []byte
+	closed  chan struct{}
+	created time.Time
+	claimed bool
+
+	once sync.Once
+	err  error
+}
+
+// get returns the stream with the given ID, creating it when needed
+//
+// It returns nil for a stream that already ended and for a new stream while
+// attachmentMaxStreams are open.
+func (t *attachmentTable) get(id string) *attachmentStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.streams == nil {
+		t.streams = make(map[string]*attachmentStream)
+		t.removed = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for sid, s := range t.streams {
+		if !s.claimed && now.Sub(s.created) > attachmentTimeout {
+			s.close(ErrAttachmentNotFound)
+			delete(t.streams, sid)
+			t.removed[sid] = now
+		}
+	}
+	for sid, at := range t.removed {
+		if now.Sub(at) > attachmentTimeout {
+			delete(t.removed, sid)
+		}
+	}
+
+	s, ok := t.streams[id]
+	if !ok {
+		if _, gone := t.removed[id]; gone || len(t.streams) >= attachmentMaxStreams {
+			return nil
+		}
+		s = &attachmentStream{id: id, frames: make(chan []byte, attachmentBacklog), closed: make(chan struct{}), created: now}
+		t.streams[id] = s
+	}
+	return s
+}
+
+// claim marks the stream with the given ID as read, it returns nil when it was already claimed
+// or cannot be opened
+func (t *attachmentTable) claim(id string) *attachmentStream {
+	s := t.get(id)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s == nil || s.claimed {
+		return nil
+	}
+	s.claimed = true
+	return s
+}
+
+// remove forgets a stream, frames arriving for it afterwards are dropped
+func (t *attachmentTable) remove(s *attachmentStream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.streams[s.id] == s {
+		delete(t.streams, s.id)
+		t.removed[s.id] = time.Now()
+	}
+}
+
+// register adds an outgoing stream holding a full window of credit
+func (t *attachmentTable) register(id string) *attachmentSend {
+	send := &attachmentSend{id: id, credit: make(chan struct{}, attachmentBacklog), canceled: make(chan struct{})}
+	for i := 0; i < attachmentBacklog; i++ {
+		send.credit <- struct{}{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sends == nil {
+		t.sends = make(map[string]*attachmentSend)
+	}
+	t.sends[id] = send
+	return send
+}
+
+// unregister forgets an outgoing stream
+func (t *attachmentTable) unregister(send *attachmentSend) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sends, send.id)
+}
+
+// send returns the outgoing stream with the given ID, nil when it is unknown
+func (t *attachmentTable) send(id string) *attachmentSend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sends[id]
+}
+
+// wait spends one credit, waiting for the receiver to grant one, and reports whether sending
+// may go on
+func (s *attachmentSend) wait(ctx context.Context) bool {
+	select {
+	case <-s.credit:
+		return true
+	default:
+	}
+	timer := time.NewTimer(attachmentTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.credit:
+		return true
+	case <-s.canceled:
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return false
+}
+
+// grant adds n credits, never more than a full window
+func (s *attachmentSend) grant(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case s.credit <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// cancel stops the stream at the request of the receiver
+func (s *attachmentSend) cancel() {
+	s.once.Do(func() { close(s.canceled) })
+}
+
+// close stops the stream, readers get err once the queued frames are consumed
+func (s *attachmentStream) close(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.closed)
+	})
+}
+
+// deliverAttachment handles an incoming binary frame without blocking the receive loop
+//
+// Data frames are queued on their stream, the sender holds back once the window is full so a
+// stream whose queue is full has a misbehaving sender and is ended. Frames of ended streams and
+// of streams beyond attachmentMaxStreams are dropped.
+func (c *Conn) deliverAttachment(frame []byte) {
+	if len(frame) < 17 {
+		return
+	}
+	id := hex.EncodeToString(frame[:16])
+	switch frame[16] {
+	case attachmentCredit:
+		if send := c.attachments.send(id); send != nil && len(frame) == 21 {
+			send.grant(int(binary.BigEndian.Uint32(frame[17:])))
+		}
+		return
+	case attachmentCancel:
+		if send := c.attachments.send(id); send != nil {
+			send.cancel()
+		}
+		return
+	}
+
+	s := c.attachments.get(id)
+	if s == nil {
+		return
+	}
+	switch frame[16] {
+	case attachmentData:
+		select {
+		case <-s.closed:
+		case s.frames <- frame[17:]:
+		default:
+			s.close(ErrAttachmentOverflow)
+		}
+	case attachmentEnd:
+		s.close(io.EOF)
+	case attachmentError:
+		s.close(errors.New("attachment: " + string(frame[17:])))
+	}
+}
+
+// sendAttachmentControl sends a credit or cancel frame for the incoming stream id
+func (c *Conn) sendAttachmentControl(ctx context.Context, id string, flag byte, credit int) {
+	bt, ok := binaryTransport(c.t)
+	if !ok {
+		return
+	}
+	frame, _ := hex.DecodeString(id)
+	frame = append(frame, flag)
+	if flag == attachmentCredit {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(credit))
+	}
+	_ = bt.SendBinary(ctx, frame)
+}
+
+// binaryLoop reads binary frames until the transport fails
+func (c *Conn) binaryLoop(bt BinaryTransport) {
+	for {
+		frame, err := bt.ReceiveBinary(c.ctx)
+		if err != nil {
+			var interrupted *InterruptedError
+			if errors.As(err, &interrupted) {
+				continue
+			}
+			return
+		}
+		c.deliverAttachment(frame)
+	}
+}
+
+// attachmentReader reads the frames of a claimed attachment stream
+type attachmentReader struct {
+	s    *attachmentStream
+	conn *Conn
+	ctx  context.Context
+	idle time.Duration
+	buf  []byte
+	// consumed counts the frames read since credit was last granted
+	consumed int
+}
+
+// Read returns the content of the queued frames, waiting for the next one when needed
+func (r *attachmentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		select {
+		case frame := <-r.s.frames:
+			r.next(frame)
+			continue
+		default:
+		}
+		if err := r.wait(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// wait blocks until the next frame is queued, the stream ends or the sender stays idle too long
+func (r *attachmentReader) wait() error {
+	timer := time.NewTimer(r.idle)
+	defer timer.Stop()
+	for {
+		select {
+		case frame := <-r.s.frames:
+			r.next(frame)
+			return nil
+		case <-r.s.closed:
+			// Frames may have been queued right before the stream ended
+			select {
+			case frame := <-r.s.frames:
+				r.next(frame)
+				return nil
+			default:
+			}
+			r.conn.attachments.remove(r.s)
+			return r.s.err
+		case <-timer.C:
+			r.conn.sendAttachmentControl(r.ctx, r.s.id, attachmentCancel, 0)
+			r.s.close(ErrAttachmentIdle)
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
+
+// next makes frame the one being read, granting the sender credit every half window
+func (r *attachmentReader) next(frame []byte) {
+	r.buf = frame
+	if r.consumed++; r.consumed >= attachmentBacklog/2 {
+		r.conn.sendAttachmentControl(r.ctx, r.s.id, attachmentCredit, r.consumed)
+		r.consumed = 0
+	}
+}
+
+// Close discards the rest of the stream and tells the sender to stop
+func (r *attachmentReader) Close() error {
+	select {
+	case <-r.s.closed:
+	default:
+		r.conn.sendAttachmentControl(r.ctx, r.s.id, attachmentCancel, 0)
+	}
+	r.s.close(ErrAttachmentNotFound)
+	r.conn.attachments.remove(r.s)
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentJSON(t *testing.T) {
+	a := NewAttachmentReader("text/plain", strings.NewReader("hello"), -1)
+	a.Name = "hello.txt"
+	data, err := json.Marshal(map[string]*Attachment{"file": a})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if want := `{"file":{"media_type":"text/plain","name":"hello.txt","size":5,"data":"aGVsbG8="}}`; string(data) != want {
+		t.Errorf("Marshal() = %s, want %s", data, want)
+	}
+
+	var v struct {
+		File *Attachment `json:"file"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	got, err := v.File.Bytes(context.Background())
+	if err != nil || string(got) != "hello" || v.File.Streamed() {
+		t.Errorf("Bytes() = %q, %v, want the inline content", got, err)
+	}
+}
+
+func TestAttachmentOverTransports(t *testing.T) {
+	pipeClient, pipeServer := Pipe(nil)
+	tests := []struct {
+		name           string
+		client, server Transport
+		streamed       bool
+	}{
+		{name: "pipe", client: pipeClient, server: pipeServer, streamed: true},
+		{name: "length prefix framing", streamed: true},
+		{name: "newline framing", streamed: false},
+	}
+	for i := range tests {
+		if tests[i].client != nil {
+			continue
+		}
+		framing := NewlineFraming
+		if tests[i].streamed {
+			framing = LengthPrefixFraming
+		}
+		clientRead, serverWrite := io.Pipe()
+		serverRead, clientWrite := io.Pipe()
+		tests[i].client = NewStreamTransport(clientRead, clientWrite, framing)
+		tests[i].server = NewStreamTransport(serverRead, serverWrite, framing)
+	}
+
+	upload := bytes.Repeat([]byte{0, 1, 2, 0xff}, 100<<10)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go ServeTransport(ctx, tt.server, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+				var params struct {
+					File *Attachment `json:"file"`
+				}
+				if err := json.Unmarshal(req.Params, &params); err != nil || params.File.Streamed() != tt.streamed {
+					return NewMCPErrorResponse(StdError(ErrInvalidParams), nil, nil)
+				}
+				got, err := params.File.Bytes(ctx)
+				if err != nil || !bytes.Equal(got, upload) {
+					return NewMCPErrorResponse(StdError(ErrInvalidParams), nil, nil)
+				}
+				thumb, err := ConnFromContext(ctx).Attach(NewAttachment("image/png", []byte("\x89PNG thumbnail")))
+				if err != nil {
+					return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+				}
+				resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]*Attachment{"thumbnail": thumb}, nil, nil)
+				return resp
+			})
+			client := NewClient(tt.client, nil)
+			defer client.Close()
+
+			file, err := client.Conn().Attach(NewAttachmentReader("application/octet-stream", bytes.NewReader(upload), int64(len(upload))))
+			if err != nil {
+				t.Fatalf("Attach() error = %v", err)
+			}
+			resp, err := client.CallMCP(ctx, "image.thumbnail", "", map[string]*Attachment{"file": file})
+			if err != nil {
+				t.Fatalf("CallMCP() error = %v", err)
+			}
+
+			var data struct {
+				Thumbnail *Attachment `json:"thumbnail"`
+			}
+			if err := json.Unmarshal(resp.Data, &data); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if data.Thumbnail.Streamed() != tt.streamed {
+				t.Errorf("Streamed() = %v, want %v", data.Thumbnail.Streamed(), tt.streamed)
+			}
+			rc, err := client.Conn().OpenAttachment(ctx, data.Thumbnail)
+			if err != nil {
+				t.Fatalf("OpenAttachment() error = %v", err)
+			}
+			defer rc.Close()
+			if got, err := io.ReadAll(rc); err != nil || string(got) != "\x89PNG thumbnail" {
+				t.Errorf("thumbnail = %q, %v, want the attached content", got, err)
+			}
+			if data.Thumbnail.MediaType != "image/png" || data.Thumbnail.Size != 14 {
+				t.Errorf("thumbnail = %+v, want media type and size", data.Thumbnail)
+			}
+		})
+	}
+}
+
+func TestAttachmentOpenedOnce(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+	client := NewClient(clientT, nil)
+	defer client.Close()
+	server := newConn(context.Background(), serverT, nil, serveConfig{})
+	defer server.Close()
+
+	a, _ := client.Conn().Attach(NewAttachment("text/plain", []byte("once")))
+	ctx := context.Background()
+	rc, err := server.OpenAttachment(ctx, a)
+	if err != nil {
+		t.Fatalf("OpenAttachment() error = %v", err)
+	}
+	if _, err := server.OpenAttachment(ctx, a); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("second OpenAttachment() error = %v, want %v", err, ErrAttachmentNotFound)
+	}
+	if got, err := io.ReadAll(rc); err != nil || string(got) != "once" {
+		t.Errorf("content = %q, %v, want %q", got, err, "once")
+	}
+}
+
+func TestAttachmentFlowControl(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Many more frames than the window, read only after they had time to pile up
+	upload := bytes.Repeat([]byte("0123456789abcdef"), 4*attachmentBacklog*attachmentFrameSize/16)
+	client := pipeClient(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		var params struct {
+			File *Attachment `json:"file"`
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return NewMCPErrorResponse(StdError(ErrInvalidParams), nil, nil)
+		}
+		got, err := params.File.Bytes(ctx)
+		if err != nil || !bytes.Equal(got, upload) {
+			return NewMCPErrorResponse(StdError(ErrInvalidParams), nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, len(got), nil, nil)
+		return resp
+	})
+
+	file, err := client.Conn().Attach(NewAttachment("application/octet-stream", upload))
+	if err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	if _, err := client.CallMCP(ctx, "file.upload", "", map[string]*Attachment{"file": file}); err != nil {
+		t.Errorf("CallMCP() error = %v, want the whole attachment read", err)
+	}
+}
+
+func TestUnreadAttachmentDoesNotStallConnection(t *testing.T) {
+	srv := httptest.NewServer(WebSocketHandler(echoHandler, nil))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tr, err := DialWebSocket(ctx, wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	client := NewClient(tr, nil)
+	defer client.Close()
+
+	// Nobody opens the attachment, so the server holds one window of its frames
+	upload := bytes.Repeat([]byte{1}, 4*attachmentBacklog*attachmentFrameSize)
+	if _, err := client.Conn().Attach(NewAttachment("application/octet-stream", upload)); err != nil {
+		t.Fatalf("Attach() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.CallMCP(ctx, "echo", "", map[string]int{"i": i}); err != nil {
+			t.Fatalf("CallMCP() next to an unread attachment error = %v", err)
+		}
+	}
+}
+
+func TestAttachmentTableDropsLateFrames(t *testing.T) {
+	var table attachmentTable
+	s := table.get("0102")
+	table.remove(s)
+	if got := table.get("0102"); got != nil {
+		t.Error("get() after remove() reopened the stream, want late frames dropped")
+	}
+
+	for i := 0; i < attachmentMaxStreams; i++ {
+		if table.get(fmt.Sprintf("%032x", i)) == nil {
+			t.Fatalf("get() of stream %d = nil, want it opened", i)
+		}
+	}
+	if got := table.get("ff"); got != nil {
+		t.Errorf("get() beyond %d open streams = %v, want nil", attachmentMaxStreams, got)
+	}
+}
+
+func TestAttachmentReaderIdleTimeout(t *testing.T) {
+	clientT, _ := Pipe(nil)
+	conn := NewConn(clientT, nil)
+	defer conn.Close()
+	conn.attachments.idleTimeout = 20 * time.Millisecond
+
+	id := fmt.Sprintf("%032x", 1)
+	conn.attachments.get(id).frames <- []byte("partial")
+	r, err := conn.OpenAttachment(context.Background(), &Attachment{stream: id})
+	if err != nil {
+		t.Fatalf("OpenAttachment() error = %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if string(got) != "partial" || !errors.Is(err, ErrAttachmentIdle) {
+		t.Errorf("ReadAll() = %q, %v, want the queued frame then %v", got, err, ErrAttachmentIdle)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Credential schemes understood by the built-in authenticators
+const (
+	AuthSchemeBearer = "Bearer"
+	AuthSchemeAPIKey = "ApiKey"
+)
+
+// APIKeyHeader is the HTTP header carrying an API key as an alternative to Authorization
+const APIKeyHeader = "X-API-Key"
+
+var (
+	// ErrNoCredentials is returned when a request carries no credentials
+	ErrNoCredentials = errors.New("missing credentials")
+	// ErrUnsupportedCredentials is returned by an Authenticator for credentials of a scheme it does not handle
+	ErrUnsupportedCredentials = errors.New("unsupported credentials")
+	// ErrInvalidCredentials is returned by an Authenticator for credentials it rejects
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Credentials are what a caller presents to prove its identity
+type Credentials struct {
+	// Scheme is the credential type, such as AuthSchemeBearer or AuthSchemeAPIKey
+	Scheme string
+	Token  string
+	// Request is the HTTP request that opened the connection, nil on other transports
+	Request *http.Request
+	// TLS is the state of the connection when it is secured by TLS
+	TLS *tls.ConnectionState
+}
+
+// Principal is the authenticated identity of a caller
+type Principal struct {
+	ID string `json:"id"`
+	// Scheme is the credential scheme the principal authenticated with
+	Scheme string `json:"scheme,omitempty"`
+	// Scopes are the permissions granted to the principal
+	Scopes []string               `json:"scopes,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// Authenticator verifies credentials and returns the principal they belong to
+//
+// Implementations return an error wrapping ErrUnsupportedCredentials for schemes they do not
+// handle and ErrInvalidCredentials for credentials they reject. They must be safe for concurrent use.
+type Authenticator interface {
+	Authenticate(ctx context.Context, cred *Credentials) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(ctx context.Context, cred *Credentials) (*Principal, error)
+
+// Authenticate calls f
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, cred *Credentials) (*Principal, error) {
+	return f(ctx, cred)
+}
+
+// Authenticators combines auths, the first one handling the scheme of the credentials decides
+func Authenticators(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, cred *Credentials) (*Principal, error) {
+		for _, a := range auths {
+			p, err := a.Authenticate(ctx, cred)
+			if errors.Is(err, ErrUnsupportedCredentials) {
+				continue
+			}
+			return p, err
+		}
+		return nil, ErrUnsupportedCredentials
+	})
+}
+
+// principalKey is the context key holding the Principal of a request
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal authenticated for the request handled with ctx, if any
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Authenticate returns a middleware that authenticates every request with auth and stores the
+// principal in the handler context
+//
+// Credentials are read from the auth metadata field, as "<scheme> <token>" or as an object with
+// scheme and token, and otherwise from the Authorization or X-API-Key header of the HTTP request
+// that opened the connection, and finally from a verified client certificate as AuthSchemeTLS
+// credentials. A principal already authenticated by AuthenticateHTTP is kept.
+// The auth field is removed before the request reaches the next handler, so credentials never
+// show up in logs or stored requests. Failures are answered with AUTHENTICATION_FAILED.
+func Authenticate(auth Authenticator) Middleware {
+	return func(next MCPHandler) MCPHandler {
+		return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+			cred, err := metadataCredentials(req)
+			if err != nil {
+				return NewMCPErrorResponse(authenticationFailed(err), nil, req.ID)
+			}
+			if _, ok := req.Metadata[MetadataAuth]; ok {
+				stripped := *req
+				stripped.Metadata = make(map[string]interface{}, len(req.Metadata)-1)
+				for k, v := range req.Metadata {
+					if k != MetadataAuth {
+						stripped.Metadata[k] = v
+					}
+				}
+				req = &stripped
+			}
+
+			r, state := connRequest(ctx), connTLS(ctx)
+			if cred == nil && PrincipalFromContext(ctx) != nil {
+				return next(ctx, req)
+			}
+			if cred == nil && r != nil {
+				cred = headerCredentials(r.Header)
+			}
+			if cred == nil {
+				cred = tlsCredentials(state)
+			}
+			if cred == nil {
+				return NewMCPErrorResponse(authenticationFailed(ErrNoCredentials), nil, req.ID)
+			}
+			cred.Request, cred.TLS = r, state
+
+			p, err := auth.Authenticate(ctx, cred)
+			if err != nil {
+				return NewMCPErrorResponse(authenticationFailed(err), nil, req.ID)
+			}
+			return next(WithPrincipal(ctx, p), req)
+		}
+	}
+}
+
+// AuthenticateHTTP wraps next, typically a WebSocketHandler, so that requests are authenticated
+// from their Authorization or X-API-Key header, or else their verified client certificate,
+// before they reach it
+//
+// Failures are answered with 401 Unauthorized. The principal is stored in the request context,
+// where the handlers serving the connection find it.
+func AuthenticateHTTP(auth Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred := headerCredentials(r.Header)
+		if cred == nil {
+			cred = tlsCredentials(r.TLS)
+		}
+		if cred == nil {
+			w.Header().Set("WWW-Authenticate", AuthSchemeBearer)
+			http.Error(w, ErrNoCredentials.Error(), http.StatusUnauthorized)
+			return
+		}
+		cred.Request, cred.TLS = r, r.TLS
+		p, err := auth.Authenticate(r.Context(), cred)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", AuthSchemeBearer)
+			http.Error(w, authenticationReason(err), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// metadataCredentials returns the credentials in the auth metadata field, nil when absent
+func metadataCredentials(req *MCPRequest) (*Credentials, error) {
+	switch v := req.Metadata[MetadataAuth].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if cred := parseAuthorization(v); cred != nil {
+			return cred, nil
+		}
+	case map[string]interface{}:
+		scheme, _ := v["scheme"].(string)
+		token, _ := v["token"].(string)
+		if scheme != "" && token != "" {
+			return &Credentials{Scheme: canonicalScheme(scheme), Token: token}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// headerCredentials returns the credentials in HTTP headers, nil when absent
+func headerCredentials(h http.Header) *Credentials {
+	if cred := parseAuthorization(h.Get("Authorization")); cred != nil {
+		return cred
+	}
+	if key := h.Get(APIKeyHeader); key != "" {
+		return &Credentials{Scheme: AuthSchemeAPIKey, Token: key}
+	}
+	return nil
+}
+
+// parseAuthorization parses a "<scheme> <token>" value, nil when malformed
+func parseAuthorization(v string) *Credentials {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(v), " ")
+	token = strings.TrimSpace(token)
+	if !ok || scheme == "" || token == "" {
+		return nil
+	}
+	return &Credentials{Scheme: canonicalScheme(scheme), Token: token}
+}
+
+// canonicalScheme returns the built-in spelling of a case-insensitive scheme name
+func canonicalScheme(scheme string) string {
+	for _, s := range []string{AuthSchemeBearer, AuthSchemeAPIKey} {
+		if strings.EqualFold(scheme, s) {
+			return s
+		}
+	}
+	return scheme
+}
+
+// connRequest returns the HTTP request that opened the connection serving ctx, if any
+func connRequest(ctx context.Context) *http.Request {
+	c := ConnFromContext(ctx)
+	if c == nil {
+		return nil
+	}
+	if t, ok := c.t.(interface{ Request() *http.Request }); ok {
+		return t.Request()
+	}
+	return nil
+}
+
+// authenticationFailed returns the AUTHENTICATION_FAILED error for err
+func authenticationFailed(err error) *Error {
+	e, _ := NewMCPError(MCPErrorAuthentication, ErrMCPExecutionFailed, "Authentication failed", map[string]string{
+		"reason": authenticationReason(err),
+	})
+	return e
+}
+
+// authenticationReason returns the reason shown to callers, without the details of unexpected errors
+func authenticationReason(err error) string {
+	for _, known := range []error{ErrNoCredentials, ErrUnsupportedCredentials, ErrInvalidCredentials} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return ErrInvalidCredentials.Error()
+}
+
+// StaticAuthenticator accepts a fixed set of tokens of one scheme
+//
+// Tokens are kept as SHA-256 hashes, so lookups do not leak them through timing.
+type StaticAuthenticator struct {
+	scheme string
+	tokens map[[sha256.Size]byte]*Principal
+}
+
+// NewAPIKeyAuthenticator creates an authenticator for the API keys in keys, mapped to their principal
+func NewAPIKeyAuthenticator(keys map[string]*Principal) *StaticAuthenticator {
+	return newStaticAuthenticator(AuthSchemeAPIKey, keys)
+}
+
+// NewBearerAuthenticator creates an authenticator for the static bearer tokens in tokens, mapped
+// to their principal
+func NewBearerAuthenticator(tokens map[string]*Principal) *StaticAuthenticator {
+	return newStaticAuthenticator(AuthSchemeBearer, tokens)
+}
+
+// newStaticAuthenticator creates a StaticAuthenticator for scheme
+func newStaticAuthenticator(scheme string, tokens map[string]*Principal) *StaticAuthenticator {
+	a := &StaticAuthenticator{scheme: scheme, tokens: make(map[[sha256.Size]byte]*Principal, len(tokens))}
+	for token, p := range tokens {
+		a.tokens[sha256.Sum256([]byte(token))] = p
+	}
+	return a
+}
+
+// Authenticate returns a copy of the principal of the token
+func (a *StaticAuthenticator) Authenticate(ctx context.Context, cred *Credentials) (*Principal, error) {
+	if cred.Scheme != a.scheme {
+		return nil, ErrUnsupportedCredentials
+	}
+	p, ok := a.tokens[sha256.Sum256([]byte(cred.Token))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	principal := *p
+	principal.Scheme = a.scheme
+	return &principal, nil
+}
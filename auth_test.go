@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testAuthenticator accepts the API key "key-1" and the bearer token "token-1"
+func testAuthenticator() Authenticator {
+	return Authenticators(
+		NewAPIKeyAuthenticator(map[string]*Principal{"key-1": {ID: "service-a"}}),
+		NewBearerAuthenticator(map[string]*Principal{"token-1": {ID: "user-b"}}),
+	)
+}
+
+// whoami answers with the principal of the request and whether credentials reached it
+func whoami(ctx context.Context, req *MCPRequest) *MCPResponse {
+	p := PrincipalFromContext(ctx)
+	_, leaked := req.Metadata[MetadataAuth]
+	resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]interface{}{"principal": p, "leaked": leaked}, nil, nil)
+	return resp
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := Chain(whoami, Authenticate(testAuthenticator()))
+	tests := []struct {
+		name   string
+		auth   interface{}
+		want   string
+		scheme string
+		reason string
+	}{
+		{name: "api key", auth: "ApiKey key-1", want: "service-a", scheme: AuthSchemeAPIKey},
+		{name: "bearer token", auth: "bearer token-1", want: "user-b", scheme: AuthSchemeBearer},
+		{name: "object form", auth: map[string]interface{}{"scheme": "Bearer", "token": "token-1"}, want: "user-b", scheme: AuthSchemeBearer},
+		{name: "unknown token", auth: "Bearer token-2", reason: "invalid credentials"},
+		{name: "unknown scheme", auth: "Basic dXNlcg==", reason: "unsupported credentials"},
+		{name: "malformed", auth: "Bearer", reason: "invalid credentials"},
+		{name: "missing", reason: "missing credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := NewMCPRequest("whoami", nil, nil, "", 1)
+			req.Metadata = map[string]interface{}{MetadataRequestID: "r1"}
+			if tt.auth != nil {
+				req.Metadata[MetadataAuth] = tt.auth
+			}
+			resp := h(context.Background(), req)
+
+			if tt.reason != "" {
+				var details struct {
+					Reason string `json:"reason"`
+				}
+				if resp.Error == nil || resp.Error.Type != MCPErrorAuthentication || json.Unmarshal(resp.Error.Details, &details) != nil || details.Reason != tt.reason {
+					t.Fatalf("error = %+v, want AUTHENTICATION_FAILED because of %s", resp.Error, tt.reason)
+				}
+				return
+			}
+			var data struct {
+				Principal *Principal `json:"principal"`
+				Leaked    bool       `json:"leaked"`
+			}
+			if err := json.Unmarshal(resp.Data, &data); err != nil || data.Principal == nil {
+				t.Fatalf("response = %s %+v, want a principal", resp.Data, resp.Error)
+			}
+			if data.Principal.ID != tt.want || data.Principal.Scheme != tt.scheme || data.Leaked {
+				t.Errorf("principal = %+v, leaked = %v, want %s through %s with credentials stripped", data.Principal, data.Leaked, tt.want, tt.scheme)
+			}
+			if _, ok := req.Metadata[MetadataAuth]; tt.auth != nil && !ok {
+				t.Error("credentials removed from the caller's request, want a stripped copy")
+			}
+		})
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+	go ServeTransport(context.Background(), serverT, Chain(whoami, Authenticate(testAuthenticator())))
+
+	token := "token-0"
+	client := NewClient(clientT, &ClientConfig{
+		Credentials: func(ctx context.Context) (string, error) {
+			return "Bearer " + token, nil
+		},
+	})
+	defer client.Close()
+
+	ctx := context.Background()
+	if _, err := client.CallMCP(ctx, "whoami", "", nil); err == nil {
+		t.Error("CallMCP() with a stale token error = nil, want AUTHENTICATION_FAILED")
+	}
+	token = "token-1"
+	if resp, err := client.CallMCP(ctx, "whoami", "", nil); err != nil || !json.Valid(resp.Data) {
+		t.Errorf("CallMCP() with a refreshed token error = %v", err)
+	}
+}
+
+func TestAuthenticateWebSocket(t *testing.T) {
+	auth := testAuthenticator()
+	h := Chain(whoami, Authenticate(auth))
+	tests := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{name: "handshake authentication", handler: AuthenticateHTTP(auth, WebSocketHandler(h, nil))},
+		{name: "headers read by the middleware", handler: WebSocketHandler(h, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			header := http.Header{APIKeyHeader: {"key-1"}}
+			ws, err := DialWebSocket(ctx, wsURL(srv), &WebSocketConfig{Header: header})
+			if err != nil {
+				t.Fatalf("DialWebSocket() error = %v", err)
+			}
+			client := NewClient(ws, nil)
+			defer client.Close()
+
+			resp, err := client.CallMCP(ctx, "whoami", "", nil)
+			var data struct {
+				Principal *Principal `json:"principal"`
+			}
+			if err != nil || json.Unmarshal(resp.Data, &data) != nil || data.Principal == nil || data.Principal.ID != "service-a" {
+				t.Errorf("CallMCP() = %v, want the principal of the handshake key", err)
+			}
+		})
+	}
+
+	srv := httptest.NewServer(AuthenticateHTTP(auth, WebSocketHandler(h, nil)))
+	defer srv.Close()
+	_, err := DialWebSocket(context.Background(), wsURL(srv), &WebSocketConfig{Header: http.Header{"Authorization": {"Bearer nope"}}})
+	var hsErr *HandshakeError
+	if !errors.As(err, &hsErr) || hsErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("DialWebSocket() with a bad token error = %v, want a 401 handshake error", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff describes an exponential backoff schedule with optional jitter
+type Backoff struct {
+	// Initial is the delay after the first failed attempt
+	Initial time.Duration
+	// Max caps the delay between attempts, zero means no cap
+	Max time.Duration
+	// Multiplier scales the delay after each attempt, values below 1 are treated as 2
+	Multiplier float64
+	// Jitter is the fraction of the delay, between 0 and 1, that is randomly subtracted
+	Jitter float64
+}
+
+// DefaultBackoff starts at 100ms and doubles up to 30s with 20% jitter
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delay returns the delay to wait after the given zero-based failed attempt
+func (b Backoff) Delay(attempt int) time.Duration {
+	initial := b.Initial
+	if initial <= 0 {
+		initial = DefaultBackoff.Initial
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	if attempt < 0 {
+		attempt = 0
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if d > math.MaxInt64 {
+		d = math.MaxInt64
+	}
+	if b.Jitter > 0 {
+		d -= d * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+	if d >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// sleepContext waits for d or until ctx is done, whichever happens first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		attempt int
+		want    time.Duration
+	}{
+		{
+			name:    "first attempt uses initial delay",
+			backoff: Backoff{Initial: 100 * time.Millisecond, Multiplier: 2},
+			attempt: 0,
+			want:    100 * time.Millisecond,
+		},
+		{
+			name:    "delay doubles per attempt",
+			backoff: Backoff{Initial: 100 * time.Millisecond, Multiplier: 2},
+			attempt: 3,
+			want:    800 * time.Millisecond,
+		},
+		{
+			name:    "delay is capped",
+			backoff: Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2},
+			attempt: 10,
+			want:    5 * time.Second,
+		},
+		{
+			name:    "invalid multiplier falls back to doubling",
+			backoff: Backoff{Initial: time.Second},
+			attempt: 2,
+			want:    4 * time.Second,
+		},
+		{
+			name:    "huge attempt without cap does not overflow",
+			backoff: Backoff{Initial: time.Second, Multiplier: 2},
+			attempt: 10000,
+			want:    time.Duration(1<<63 - 1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.backoff.Delay(tt.attempt); got != tt.want {
+				t.Errorf("Delay(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := Backoff{Initial: time.Second, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		got := b.Delay(1)
+		if got < time.Second || got > 2*time.Second {
+			t.Fatalf("Delay(1) = %v, want between 1s and 2s", got)
+		}
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("sleepContext() error = %v, want %v", err, context.Canceled)
+	}
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("sleepContext() error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+var (
+	// ErrEmptyBatch is returned when sending a batch without calls or notifications
+	ErrEmptyBatch = errors.New("empty batch")
+	// ErrBatchSent is returned when sending a batch a second time
+	ErrBatchSent = errors.New("batch already sent")
+)
+
+// Batch queues calls and notifications and sends them as one JSON-RPC batch
+//
+// A Batch is not safe for concurrent use and can be sent only once.
+type Batch struct {
+	conn  *Conn
+	reqs  []*Request
+	calls []*BatchCall
+	err   error
+}
+
+// BatchCall is the future result of a call queued in a Batch
+type BatchCall struct {
+	Method string
+
+	result interface{}
+	id     int64
+	call   *pendingCall
+	done   chan struct{}
+	err    error
+}
+
+// pendingBatch is a sent batch whose responses are still expected
+type pendingBatch struct {
+	calls []*pendingCall
+}
+
+// Batch starts a new batch on the connection
+func (c *Conn) Batch() *Batch {
+	return &Batch{conn: c}
+}
+
+// Batch starts a new batch, batches bypass the retry policy and interceptors of the client
+func (c *Client) Batch() *Batch {
+	return c.conn.Batch()
+}
+
+// Call queues a request, the result of its response is stored in result once the returned call is done
+func (b *Batch) Call(method string, params interface{}, result interface{}) *BatchCall {
+	call := &BatchCall{Method: method, result: result, id: b.conn.nextID.Add(1), done: make(chan struct{})}
+	req, err := NewRequest(method, params, call.id)
+	if err != nil {
+		b.fail(err)
+	}
+	b.reqs = append(b.reqs, req)
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Notify queues a notification
+func (b *Batch) Notify(method string, params interface{}) {
+	req, err := NewNotification(method, params)
+	if err != nil {
+		b.fail(err)
+	}
+	b.reqs = append(b.reqs, req)
+}
+
+// Len returns the number of queued calls and notifications
+func (b *Batch) Len() int {
+	return len(b.reqs)
+}
+
+// Send sends the batch and waits until every call got its response or ctx is done
+//
+// Responses are matched by id whatever their order. When the peer rejects the whole batch with a
+// single error response every call fails with that error, which Send also returns. Per-call
+// errors are reported by each BatchCall only.
+func (b *Batch) Send(ctx context.Context) error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.reqs) == 0 {
+		return ErrEmptyBatch
+	}
+	msg, err := json.Marshal(b.reqs)
+	if err != nil {
+		b.fail(err)
+		return err
+	}
+	b.err = ErrBatchSent
+
+	pb := &pendingBatch{}
+	c := b.conn
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		b.failCalls(c.err)
+		return c.err
+	}
+	for _, call := range b.calls {
+		key, _ := idKey(call.id)
+		call.call = &pendingCall{keys: []string{key}, reply: make(chan connReply, 1)}
+		if err := c.register(call.call); err != nil {
+			c.mu.Unlock()
+			c.forgetBatch(pb)
+			b.failCalls(err)
+			return err
+		}
+		pb.calls = append(pb.calls, call.call)
+	}
+	if len(pb.calls) > 0 {
+		c.batches = append(c.batches, pb)
+	}
+	c.mu.Unlock()
+	defer c.forgetBatch(pb)
+
+	if err := c.t.Send(ctx, msg); err != nil {
+		b.failCalls(err)
+		return err
+	}
+
+	var batchErr error
+	for _, call := range b.calls {
+		select {
+		case r := <-call.call.reply:
+			call.finish(r)
+			if r.batch {
+				batchErr = call.err
+			}
+		case <-ctx.Done():
+			b.failCalls(ctx.Err())
+			return ctx.Err()
+		}
+	}
+	return batchErr
+}
+
+// fail records the first error found while building the batch
+func (b *Batch) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// failCalls completes every unfinished call with err
+func (b *Batch) failCalls(err error) {
+	for _, call := range b.calls {
+		select {
+		case <-call.done:
+		default:
+			call.err = err
+			close(call.done)
+		}
+	}
+}
+
+// Done returns a channel that is closed once the call completed
+func (f *BatchCall) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error of a completed call
+func (f *BatchCall) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the call completed or ctx is done and returns its error
+func (f *BatchCall) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finish decodes the reply into the call result and completes the call
+func (f *BatchCall) finish(r connReply) {
+	f.err = r.err
+	if r.err == nil {
+		f.err = decodeResult(r.msg, f.result)
+	}
+	close(f.done)
+}
+
+// forgetBatch removes a batch and its calls from the pending tables
+func (c *Conn) forgetBatch(pb *pendingBatch) {
+	for _, call := range pb.calls {
+		c.forget(call)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.batches {
+		if p == pb {
+			c.batches = append(c.batches[:i], c.batches[i+1:]...)
+			break
+		}
+	}
+}
+
+// failBatch fails the calls of the batch waiting for responses with an error response that
+// carries no id, which is how a peer rejects a batch as a whole
+//
+// The error is only attributed to a batch when it is the only call outstanding, otherwise it may
+// belong to any of them and is left unmatched.
+func (c *Conn) failBatch(m *connMessage) bool {
+	var batchErr *Error
+	if json.Unmarshal(m.Error, &batchErr) != nil || batchErr == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.batches) != 1 {
+		return false
+	}
+	pb := c.batches[0]
+	calls := make(map[*pendingCall]bool, len(pb.calls))
+	for _, call := range pb.calls {
+		calls[call] = true
+	}
+	for _, call := range c.pending {
+		if !calls[call] {
+			return false
+		}
+	}
+	c.batches = nil
+	for _, call := range pb.calls {
+		for _, key := range call.keys {
+			if c.pending[key] == call {
+				delete(c.pending, key)
+			}
+		}
+		select {
+		case call.reply <- connReply{err: batchErr, batch: true}:
+		default:
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBatchSend(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	notified := make(chan string, 1)
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		switch req.Method {
+		case "slow":
+			time.Sleep(30 * time.Millisecond)
+		case "hello":
+			notified <- string(req.Params)
+			return nil
+		case "missing":
+			return NewMCPErrorResponse(StdError(ErrMethodNotFound), nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, req.Method, nil, nil)
+		return resp
+	})
+
+	client := NewClient(clientT, nil)
+	defer client.Close()
+
+	var slow, fast string
+	batch := client.Batch()
+	slowCall := batch.Call("slow", nil, &slow)
+	batch.Notify("hello", []int{7})
+	fastCall := batch.Call("fast", nil, &fast)
+	missingCall := batch.Call("missing", nil, nil)
+	if batch.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", batch.Len())
+	}
+
+	if err := batch.Send(ctx); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if err := slowCall.Wait(ctx); err != nil || slow != "slow" {
+		t.Errorf("slow call = %q, %v, want %q", slow, err, "slow")
+	}
+	if err := fastCall.Err(); err != nil || fast != "fast" {
+		t.Errorf("fast call = %q, %v, want %q", fast, err, "fast")
+	}
+	var rpcErr *Error
+	if err := missingCall.Err(); !errors.As(err, &rpcErr) || rpcErr.Code != ErrMethodNotFound {
+		t.Errorf("missing call error = %v, want code %d", err, ErrMethodNotFound)
+	}
+	if got := <-notified; got != "[7]" {
+		t.Errorf("notification params = %s, want [7]", got)
+	}
+
+	if err := batch.Send(ctx); !errors.Is(err, ErrBatchSent) {
+		t.Errorf("second Send() error = %v, want %v", err, ErrBatchSent)
+	}
+	if err := client.Batch().Send(ctx); !errors.Is(err, ErrEmptyBatch) {
+		t.Errorf("empty Send() error = %v, want %v", err, ErrEmptyBatch)
+	}
+}
+
+func TestBatchRejectedAsWhole(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		if _, err := serverT.Receive(ctx); err != nil {
+			return
+		}
+		serverT.Send(ctx, []byte(`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`))
+	}()
+
+	client := NewClient(clientT, nil)
+	defer client.Close()
+
+	batch := client.Batch()
+	first := batch.Call("a", nil, nil)
+	second := batch.Call("b", nil, nil)
+
+	var rpcErr *Error
+	if err := batch.Send(ctx); !errors.As(err, &rpcErr) || rpcErr.Code != ErrInvalidRequest {
+		t.Fatalf("Send() error = %v, want code %d", err, ErrInvalidRequest)
+	}
+	for _, call := range []*BatchCall{first, second} {
+		if err := call.Err(); !errors.As(err, &rpcErr) || rpcErr.Code != ErrInvalidRequest {
+			t.Errorf("call %s error = %v, want code %d", call.Method, err, ErrInvalidRequest)
+		}
+	}
+	if n := client.Conn().UnmatchedResponses(); n != 0 {
+		t.Errorf("UnmatchedResponses() = %d, want 0", n)
+	}
+}
+
+func TestBatchNotBlamedForUnrelatedErrors(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		// Wait for the batch and the single call, reject something without an id, then answer both
+		var replies [][]byte
+		for i := 0; i < 2; i++ {
+			msg, err := serverT.Receive(ctx)
+			if err != nil {
+				return
+			}
+			if isBatch(msg) {
+				var reqs []Request
+				json.Unmarshal(msg, &reqs)
+				reply, _ := json.Marshal([]Response{{JSONRPC: Version, Result: json.RawMessage("1"), ID: reqs[0].ID}})
+				replies = append(replies, reply)
+				continue
+			}
+			var req Request
+			json.Unmarshal(msg, &req)
+			reply, _ := json.Marshal(Response{JSONRPC: Version, Result: json.RawMessage("2"), ID: req.ID})
+			replies = append(replies, reply)
+		}
+		serverT.Send(ctx, []byte(`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`))
+		for _, reply := range replies {
+			serverT.Send(ctx, reply)
+		}
+	}()
+
+	client := NewClient(clientT, nil)
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Conn().Call(ctx, "c", nil, nil)
+	}()
+	batch := client.Batch()
+	call := batch.Call("a", nil, nil)
+	if err := batch.Send(ctx); err != nil {
+		t.Fatalf("Send() error = %v, want the batch answered", err)
+	}
+	if err := call.Err(); err != nil {
+		t.Errorf("batch call error = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("single call error = %v", err)
+	}
+	if n := client.Conn().UnmatchedResponses(); n != 1 {
+		t.Errorf("UnmatchedResponses() = %d, want the error without id left unmatched", n)
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		wantArray int
+		wantCode  int
+		wantNone  bool
+	}{
+		{
+			name:      "mixed batch",
+			msg:       `[{"jsonrpc":"2.0","method":"sum","id":"1"},{"jsonrpc":"2.0","method":"notify_hello"},{"jsonrpc":"2.0","action":"foo.get","params":{},"id":"5"}]`,
+			wantArray: 2,
+		},
+		{
+			name:      "invalid elements",
+			msg:       `[1,{"jsonrpc":"2.0","id":2}]`,
+			wantArray: 2,
+		},
+		{
+			name:     "empty batch",
+			msg:      `[]`,
+			wantCode: ErrInvalidRequest,
+		},
+		{
+			name:     "invalid JSON",
+			msg:      `[{"jsonrpc":"2.0","method":"sum"`,
+			wantCode: ErrParse,
+		},
+		{
+			name:     "only notifications",
+			msg:      `[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","method":"b"}]`,
+			wantNone: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientT, serverT := Pipe(nil)
+			defer clientT.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+				resp, _ := NewMCPResponse(MCPStatusSuccess, 7, nil, nil)
+				return resp
+			})
+
+			clientT.Send(ctx, []byte(tt.msg))
+			if tt.wantNone {
+				short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				defer shortCancel()
+				if msg, err := clientT.Receive(short); err == nil {
+					t.Errorf("Receive() = %s, want no response", msg)
+				}
+				return
+			}
+
+			msg, err := clientT.Receive(ctx)
+			if err != nil {
+				t.Fatalf("Receive() error = %v", err)
+			}
+			if tt.wantArray > 0 {
+				var resps []map[string]interface{}
+				if err := json.Unmarshal(msg, &resps); err != nil {
+					t.Fatalf("response %s is not an array: %v", msg, err)
+				}
+				if len(resps) != tt.wantArray {
+					t.Errorf("got %d responses, want %d: %s", len(resps), tt.wantArray, msg)
+				}
+				return
+			}
+
+			var resp Response
+			if err := json.Unmarshal(msg, &resp); err != nil {
+				t.Fatalf("response %s is not an object: %v", msg, err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.wantCode || resp.ID != nil {
+				t.Errorf("response = %s, want code %d with null id", msg, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrBlobNotFound is returned by a BlobStore for an unknown URI
+var ErrBlobNotFound = errors.New("blob not found")
+
+// DefaultMaxBlobSize limits the blobs a client resolves when no limit is configured
+const DefaultMaxBlobSize = 64 << 20
+
+// blobKey is the data key holding a BlobRef in place of inline data
+const blobKey = "$blob"
+
+// MediaTypeJSON is the media type of blobs holding JSON data
+const MediaTypeJSON = "application/json"
+
+// BlobRef is an external reference to a payload that is not inlined in a message
+type BlobRef struct {
+	URI  string `json:"uri"`
+	Size int64  `json:"size"`
+	// Digest is the SHA-256 of the payload, as "sha256:" followed by its hex encoding
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type,omitempty"`
+}
+
+// BlobResolver opens the payload behind a BlobRef URI
+type BlobResolver interface {
+	// Open returns the payload stored under uri, or an error wrapping ErrBlobNotFound
+	Open(ctx context.Context, uri string) (io.ReadCloser, error)
+}
+
+// BlobStore stores payloads referred to by BlobRef
+//
+// Implementations must be safe for concurrent use.
+type BlobStore interface {
+	BlobResolver
+	// Put stores the payload read from r and returns its reference
+	Put(ctx context.Context, r io.Reader, mediaType string) (*BlobRef, error)
+	// Delete removes the payload stored under uri
+	Delete(ctx context.Context, uri string) error
+}
+
+// NewBlobMCPResponse creates an MCPResponse whose data is stored in store as JSON and replaced
+// by a reference to it
+func NewBlobMCPResponse(ctx context.Context, store BlobStore, status MCPStatus, data interface{}, context interface{}, id interface{}) (*MCPResponse, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := store.Put(ctx, bytes.NewReader(payload), MediaTypeJSON)
+	if err != nil {
+		return nil, err
+	}
+	return NewMCPResponse(status, map[string]*BlobRef{blobKey: ref}, context, id)
+}
+
+// ParseBlobRef returns the BlobRef that data stands for, or nil for inline data
+func ParseBlobRef(data json.RawMessage) *BlobRef {
+	if !bytes.Contains(data, []byte(`"`+blobKey+`"`)) {
+		return nil
+	}
+	var v map[string]*BlobRef
+	if json.Unmarshal(data, &v) != nil || len(v) != 1 {
+		return nil
+	}
+	return v[blobKey]
+}
+
+// ResolveBlob reads the payload behind ref, refusing payloads larger than maxSize and checking
+// the size and digest announced by ref
+func ResolveBlob(ctx context.Context, resolver BlobResolver, ref *BlobRef, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBlobSize
+	}
+	if ref.Size > maxSize {
+		return nil, blobInvalid(ref, fmt.Sprintf("size %d exceeds the limit of %d bytes", ref.Size, maxSize))
+	}
+
+	rc, err := resolver.Open(ctx, ref.URI)
+	if err != nil {
+		if errors.Is(err, ErrBlobNotFound) {
+			e, _ := NewMCPError(MCPErrorResourceNotFound, ErrMCPExecutionFailed, "Blob not found", map[string]string{
+				"uri": ref.URI,
+			})
+			return nil, e
+		}
+		return nil, err
+	}
+	defer rc.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(rc, ref.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) != ref.Size {
+		return nil, blobInvalid(ref, "size mismatch")
+	}
+	if blobDigest(payload) != ref.Digest {
+		return nil, blobInvalid(ref, "digest mismatch")
+	}
+	return payload, nil
+}
+
+// resolveBlobData replaces response data that refers to a blob with the payload, JSON blobs are
+// inlined as is and other media types as a base64 string
+func resolveBlobData(ctx context.Context, resolver BlobResolver, data json.RawMessage, maxSize int64) (json.RawMessage, error) {
+	ref := ParseBlobRef(data)
+	if ref == nil {
+		return data, nil
+	}
+	payload, err := ResolveBlob(ctx, resolver, ref, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if ref.MediaType == MediaTypeJSON && json.Valid(payload) {
+		return payload, nil
+	}
+	return json.Marshal(payload)
+}
+
+// blobDigest returns the digest of payload in the BlobRef format
+func blobDigest(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// blobInvalid returns the error for a blob that does not match its reference
+func blobInvalid(ref *BlobRef, reason string) *Error {
+	e, _ := NewMCPError(MCPErrorValidation, ErrMCPExecutionFailed, "Invalid blob: "+reason, map[string]string{
+		"uri": ref.URI,
+	})
+	return e
+}
+
+// MemoryBlobStore is an in-memory, content-addressed BlobStore with mem:// URIs
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemoryBlobStore creates an empty in-memory blob store
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+// Put stores the payload read from r
+func (s *MemoryBlobStore) Put(ctx context.Context, r io.Reader, mediaType string) (*BlobRef, error) {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	digest := blobDigest(payload)
+	uri := "mem://" + strings.TrimPrefix(digest, "sha256:")
+
+	s.mu.Lock()
+	s.blobs[uri] = payload
+	s.mu.Unlock()
+	return &BlobRef{URI: uri, Size: int64(len(payload)), Digest: digest, MediaType: mediaType}, nil
+}
+
+// Open returns the payload stored under uri
+func (s *MemoryBlobStore) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	payload, ok := s.blobs[uri]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, uri)
+	}
+	return io.NopCloser(bytes.NewReader(payload)), nil
+}
+
+// Delete removes the payload stored under uri
+func (s *MemoryBlobStore) Delete(ctx context.Context, uri string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, uri)
+	return nil
+}
+
+// FileBlobStore is a content-addressed BlobStore keeping one file per payload in a directory,
+// with file:// URIs
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates a blob store in dir, creating the directory when needed
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// Put stores the payload read from r, writing to a temporary file that is renamed once complete
+func (s *FileBlobStore) Put(ctx context.Context, r io.Reader, mediaType string) (*BlobRef, error) {
+	tmp, err := os.CreateTemp(s.dir, ".blob-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	path := filepath.Join(s.dir, sum)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	uri := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	return &BlobRef{URI: uri, Size: size, Digest: "sha256:" + sum, MediaType: mediaType}, nil
+}
+
+// Open returns the payload stored under uri, URIs outside the store directory are not found
+func (s *FileBlobStore) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	path, err := s.path(uri)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, uri)
+	}
+	return f, err
+}
+
+// Delete removes the payload stored under uri
+func (s *FileBlobStore) Delete(ctx context.Context, uri string) error {
+	path, err := s.path(uri)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path returns the file of a URI issued by the store
+func (s *FileBlobStore) path(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("%w: %s", ErrBlobNotFound, uri)
+	}
+	path := filepath.FromSlash(u.Path)
+	if filepath.Dir(path) != s.dir || strings.HasPrefix(filepath.Base(path), ".") {
+		return "", fmt.Errorf("%w: %s", ErrBlobNotFound, uri)
+	}
+	return path, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlobStores(t *testing.T) {
+	fileStore, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileBlobStore() error = %v", err)
+	}
+	stores := map[string]BlobStore{
+		"memory": NewMemoryBlobStore(),
+		"file":   fileStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			payload := "file contents"
+			ref, err := store.Put(ctx, strings.NewReader(payload), "text/plain")
+			if err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			if ref.Size != int64(len(payload)) || ref.Digest != blobDigest([]byte(payload)) || ref.MediaType != "text/plain" {
+				t.Errorf("ref = %+v, want size, digest and media type of the payload", ref)
+			}
+
+			got, err := ResolveBlob(ctx, store, ref, 0)
+			if err != nil || string(got) != payload {
+				t.Errorf("ResolveBlob() = %q, %v, want %q", got, err, payload)
+			}
+
+			if err := store.Delete(ctx, ref.URI); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if _, err := store.Open(ctx, ref.URI); !errors.Is(err, ErrBlobNotFound) {
+				t.Errorf("Open() after Delete error = %v, want %v", err, ErrBlobNotFound)
+			}
+		})
+	}
+}
+
+func TestFileBlobStoreRejectsForeignPaths(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileBlobStore(filepath.Join(dir, "blobs"))
+	for _, uri := range []string{
+		"file://" + filepath.ToSlash(filepath.Join(dir, "secret")),
+		"file://" + filepath.ToSlash(filepath.Join(dir, "blobs", "..", "secret")),
+		"http://example.com/blob",
+	} {
+		if _, err := store.Open(context.Background(), uri); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("Open(%s) error = %v, want %v", uri, err, ErrBlobNotFound)
+		}
+	}
+}
+
+// tamperedResolver serves a different payload than the one referenced
+type tamperedResolver struct{}
+
+func (tamperedResolver) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("tampered")), nil
+}
+
+func TestResolveBlobErrors(t *testing.T) {
+	store := NewMemoryBlobStore()
+	ref, _ := store.Put(context.Background(), strings.NewReader("original"), "text/plain")
+
+	tests := []struct {
+		name     string
+		resolver BlobResolver
+		ref      *BlobRef
+		maxSize  int64
+		want     MCPErrorType
+	}{
+		{"too large", store, ref, 4, MCPErrorValidation},
+		{"digest mismatch", tamperedResolver{}, ref, 0, MCPErrorValidation},
+		{"size mismatch", store, &BlobRef{URI: ref.URI, Size: 3, Digest: ref.Digest}, 0, MCPErrorValidation},
+		{"not found", store, &BlobRef{URI: "mem://missing"}, 0, MCPErrorResourceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResolveBlob(context.Background(), tt.resolver, tt.ref, tt.maxSize)
+			var mcpErr *Error
+			if !errors.As(err, &mcpErr) || mcpErr.Type != tt.want {
+				t.Errorf("ResolveBlob() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientResolvesBlobData(t *testing.T) {
+	store := NewMemoryBlobStore()
+	ctx := context.Background()
+	h := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.Action == "image.create" {
+			ref, _ := store.Put(ctx, strings.NewReader("\x89PNG"), "image/png")
+			resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]*BlobRef{blobKey: ref}, nil, nil)
+			return resp
+		}
+		resp, err := NewBlobMCPResponse(ctx, store, MCPStatusSuccess, map[string][]float64{"embedding": {0.1, 0.2}}, nil, nil)
+		if err != nil {
+			return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+		}
+		return resp
+	}
+
+	clientT, serverT := Pipe(nil)
+	go ServeTransport(ctx, serverT, h)
+	client := NewClient(clientT, &ClientConfig{Blobs: store})
+	defer client.Close()
+
+	resp, err := client.CallMCP(ctx, "embeddings.create", "", nil)
+	if err != nil || string(resp.Data) != `{"embedding":[0.1,0.2]}` {
+		t.Errorf("CallMCP() data = %s, %v, want the inlined JSON blob", resp.Data, err)
+	}
+
+	resp, err = client.CallMCP(ctx, "image.create", "", nil)
+	var image []byte
+	if err != nil || json.Unmarshal(resp.Data, &image) != nil || string(image) != "\x89PNG" {
+		t.Errorf("CallMCP() data = %s, %v, want the binary blob as base64", resp.Data, err)
+	}
+
+	raw := pipeClient(t, h)
+	resp, err = raw.CallMCP(ctx, "embeddings.create", "", nil)
+	if err != nil || ParseBlobRef(resp.Data) == nil {
+		t.Errorf("CallMCP() without resolver data = %s, %v, want the reference", resp.Data, err)
+	}
+}
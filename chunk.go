@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ChunkMethod is the method of the notifications carrying the chunks of a large payload
+const ChunkMethod = "notifications/chunk"
+
+// Chunking defaults
+const (
+	DefaultChunkSize    = 256 << 10
+	DefaultMaxChunkSize = 64 << 20
+	DefaultChunkTimeout = 30 * time.Second
+	DefaultMaxChunks    = 1 << 16
+	DefaultMaxTransfers = 64
+)
+
+// Chunk is one part of a large payload, sent as a ChunkMethod notification ahead of the request
+// or response that refers to it
+type Chunk struct {
+	TransferID string `json:"transfer_id"`
+	// Seq is the zero-based position of the chunk in the payload
+	Seq int `json:"seq"`
+	// Total is the number of chunks in the payload
+	Total int `json:"total"`
+	// Size is the size of the whole payload in bytes
+	Size int64  `json:"size"`
+	Data []byte `json:"data"`
+	// Checksum is the hex SHA-256 of Data
+	Checksum string `json:"checksum"`
+}
+
+// ChunkRef refers to the chunks of the params of a request or the data of a response, it is sent
+// in their place under the MetadataChunked metadata key
+type ChunkRef struct {
+	TransferID string `json:"transfer_id"`
+	Chunks     int    `json:"chunks"`
+	Size       int64  `json:"size"`
+	// Checksum is the hex SHA-256 of the whole payload
+	Checksum string `json:"checksum"`
+}
+
+// ChunkConfig limits the reassembly of chunked payloads
+type ChunkConfig struct {
+	// MaxSize limits the size of a reassembled payload, zero uses DefaultMaxChunkSize
+	MaxSize int64
+	// Timeout is how long to wait for a missing chunk, zero uses DefaultChunkTimeout. Incomplete
+	// transfers that received nothing for this long are dropped.
+	Timeout time.Duration
+	// MaxChunks limits the number of chunks of a payload, zero uses DefaultMaxChunks
+	MaxChunks int
+	// MaxTransfers limits the payloads reassembled at once on a connection, zero uses
+	// DefaultMaxTransfers. Chunks of further transfers are dropped.
+	MaxTransfers int
+}
+
+// SplitChunks splits payload into chunks of at most chunkSize bytes, zero using DefaultChunkSize,
+// and returns the reference that stands in for it
+func SplitChunks(payload []byte, chunkSize int) (*ChunkRef, []*Chunk, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	total := max((len(payload)+chunkSize-1)/chunkSize, 1)
+	sum := sha256.Sum256(payload)
+	ref := &ChunkRef{TransferID: id, Chunks: total, Size: int64(len(payload)), Checksum: hex.EncodeToString(sum[:])}
+	chunks := make([]*Chunk, total)
+	for i := range chunks {
+		data := payload[min(i*chunkSize, len(payload)):min((i+1)*chunkSize, len(payload))]
+		sum := sha256.Sum256(data)
+		chunks[i] = &Chunk{TransferID: id, Seq: i, Total: total, Size: ref.Size, Data: data, Checksum: hex.EncodeToString(sum[:])}
+	}
+	return ref, chunks, nil
+}
+
+// NewChunkedMCPRequest creates an MCPRequest like NewMCPRequest, moving params larger than
+// chunkSize into chunks that must be sent with Conn.SendChunks before the request
+//
+// Small params are kept in the request and no chunks are returned.
+func NewChunkedMCPRequest(action MCPAction, params interface{}, context interface{}, tool string, id interface{}, chunkSize int) (*MCPRequest, []*Chunk, error) {
+	req, err := NewMCPRequest(action, params, context, tool, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, chunks, err := chunkPayload(req.Params, chunkSize)
+	if err != nil || ref == nil {
+		return req, nil, err
+	}
+	req.Params = nil
+	req.Metadata = map[string]interface{}{MetadataChunked: ref}
+	return req, chunks, nil
+}
+
+// NewChunkedMCPResponse creates an MCPResponse like NewMCPResponse, moving data larger than
+// chunkSize into chunks that must be sent with Conn.SendChunks before the response
+//
+// Small data is kept in the response and no chunks are returned.
+func NewChunkedMCPResponse(status MCPStatus, data interface{}, context interface{}, id interface{}, chunkSize int) (*MCPResponse, []*Chunk, error) {
+	resp, err := NewMCPResponse(status, data, context, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, chunks, err := chunkPayload(resp.Data, chunkSize)
+	if err != nil || ref == nil {
+		return resp, nil, err
+	}
+	resp.Data = nil
+	resp.Metadata = map[string]interface{}{MetadataChunked: ref}
+	return resp, chunks, nil
+}
+
+// chunkPayload splits a payload larger than chunkSize, returning a nil ChunkRef for payloads
+// small enough to be sent inline
+func chunkPayload(payload json.RawMessage, chunkSize int) (*ChunkRef, []*Chunk, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if len(payload) <= chunkSize {
+		return nil, nil, nil
+	}
+	return SplitChunks(payload, chunkSize)
+}
+
+// parseChunkRef returns the ChunkRef held in metadata, or nil when the payload was sent inline
+func parseChunkRef(metadata map[string]interface{}) (*ChunkRef, error) {
+	v, ok := metadata[MetadataChunked]
+	if !ok {
+		return nil, nil
+	}
+	var ref ChunkRef
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(data, &ref)
+	}
+	if err != nil || ref.TransferID == "" {
+		return nil, chunkInvalid(ref.TransferID, "malformed reference")
+	}
+	return &ref, nil
+}
+
+// claimChunks returns the payload reassembled from the chunks referred to by metadata, or payload
+// itself when it was sent inline
+//
+// Chunks are sent ahead of the message referring to them, so a reference to a transfer without
+// any chunk buffered fails at once instead of waiting for chunks that may never come.
+func (c *Conn) claimChunks(ctx context.Context, metadata map[string]interface{}, payload json.RawMessage) (json.RawMessage, error) {
+	ref, err := parseChunkRef(metadata)
+	if err != nil || ref == nil {
+		return payload, err
+	}
+	delete(metadata, MetadataChunked)
+	if !c.chunks.buffered(ref.TransferID) {
+		return nil, chunkInvalid(ref.TransferID, "no chunks received")
+	}
+	return c.chunks.Claim(ctx, ref)
+}
+
+// SendChunks sends chunks to the peer as ChunkMethod notifications, in order
+func (c *Conn) SendChunks(ctx context.Context, chunks []*Chunk) error {
+	for _, chunk := range chunks {
+		if err := c.Notify(ctx, ChunkMethod, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reassembler collects the chunks of incoming payloads until the request or response referring
+// to them claims the reassembled payload
+type Reassembler struct {
+	cfg ChunkConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	transfers map[string]*transfer
+}
+
+// transfer is a payload being reassembled
+type transfer struct {
+	chunks   [][]byte
+	received int
+	size     int64
+	bytes    int64
+	err      error
+	done     chan struct{}
+	updated  time.Time
+	claimed  bool
+	complete bool
+}
+
+// NewReassembler creates a Reassembler, a nil cfg uses the defaults
+func NewReassembler(cfg *ChunkConfig) *Reassembler {
+	r := &Reassembler{now: time.Now, transfers: make(map[string]*transfer)}
+	if cfg != nil {
+		r.cfg = *cfg
+	}
+	if r.cfg.MaxSize <= 0 {
+		r.cfg.MaxSize = DefaultMaxChunkSize
+	}
+	if r.cfg.Timeout <= 0 {
+		r.cfg.Timeout = DefaultChunkTimeout
+	}
+	if r.cfg.MaxChunks <= 0 {
+		r.cfg.MaxChunks = DefaultMaxChunks
+	}
+	if r.cfg.MaxTransfers <= 0 {
+		r.cfg.MaxTransfers = DefaultMaxTransfers
+	}
+	return r
+}
+
+// Add stores a chunk, errors are reported to the claim of the transfer
+//
+// The announced size and number of chunks are checked against the configured limits before
+// anything is allocated. Chunks starting a new transfer while MaxTransfers are open are dropped.
+func (r *Reassembler) Add(chunk *Chunk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.sweep(now)
+
+	t := r.transfer(chunk.TransferID, now)
+	if t == nil || t.err != nil || t.complete {
+		return
+	}
+	t.updated = now
+
+	sum := sha256.Sum256(chunk.Data)
+	switch {
+	case chunk.Size > r.cfg.MaxSize:
+		t.fail(chunkTooLarge(chunk.Size, r.cfg.MaxSize))
+		return
+	case chunk.Total > r.cfg.MaxChunks:
+		t.fail(chunkInvalid(chunk.TransferID, fmt.Sprintf("%d chunks exceed the limit of %d", chunk.Total, r.cfg.MaxChunks)))
+		return
+	case chunk.Size < 0 || int64(chunk.Total) > max(chunk.Size, 1):
+		// Every chunk but the one of an empty payload carries at least one byte
+		t.fail(chunkInvalid(chunk.TransferID, fmt.Sprintf("%d chunks do not fit a payload of %d bytes", chunk.Total, chunk.Size)))
+		return
+	case chunk.Total <= 0 || chunk.Seq < 0 || chunk.Seq >= chunk.Total || (t.chunks != nil && (chunk.Total != len(t.chunks) || chunk.Size != t.size)):
+		t.fail(chunkInvalid(chunk.TransferID, fmt.Sprintf("chunk %d of %d does not match the transfer", chunk.Seq, chunk.Total)))
+		return
+	case hex.EncodeToString(sum[:]) != chunk.Checksum:
+		t.fail(chunkInvalid(chunk.TransferID, fmt.Sprintf("checksum mismatch in chunk %d", chunk.Seq)))
+		return
+	}
+	if t.chunks == nil {
+		t.chunks = make([][]byte, chunk.Total)
+		t.size = chunk.Size
+	}
+	if t.chunks[chunk.Seq] != nil {
+		return
+	}
+	if t.bytes += int64(len(chunk.Data)); t.bytes > t.size {
+		t.fail(chunkInvalid(chunk.TransferID, "chunks exceed the announced size"))
+		return
+	}
+	t.chunks[chunk.Seq] = chunk.Data
+	if t.received++; t.received == len(t.chunks) {
+		t.complete = true
+		close(t.done)
+	}
+}
+
+// Claim waits until every chunk referred to by ref arrived and returns the reassembled payload
+//
+// It fails with a TIMEOUT_ERROR when a chunk is missing for longer than the configured timeout,
+// and with a VALIDATION_ERROR when the payload is too large or does not match ref.
+func (r *Reassembler) Claim(ctx context.Context, ref *ChunkRef) ([]byte, error) {
+	if ref.Size > r.cfg.MaxSize {
+		r.drop(ref.TransferID)
+		return nil, chunkTooLarge(ref.Size, r.cfg.MaxSize)
+	}
+
+	r.mu.Lock()
+	t := r.transfer(ref.TransferID, r.now())
+	if t == nil {
+		r.mu.Unlock()
+		return nil, chunkInvalid(ref.TransferID, "too many transfers in progress")
+	}
+	t.claimed = true
+	r.mu.Unlock()
+	defer r.drop(ref.TransferID)
+
+	timer := time.NewTimer(r.cfg.Timeout)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		received, updated := t.received, t.updated
+		r.mu.Unlock()
+
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			r.mu.Lock()
+			progressed := t.received != received || !t.updated.Equal(updated)
+			r.mu.Unlock()
+			if progressed {
+				// Chunks keep arriving, wait for the next one
+				timer.Reset(r.cfg.Timeout)
+				continue
+			}
+			e, _ := NewMCPError(MCPErrorTimeout, ErrInvalidParams, "Timed out waiting for chunks", map[string]interface{}{
+				"transfer_id": ref.TransferID,
+				"received":    received,
+				"total":       ref.Chunks,
+			})
+			return nil, e
+		}
+		break
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+	if len(t.chunks) != ref.Chunks || t.size != ref.Size {
+		return nil, chunkInvalid(ref.TransferID, "chunks do not match the reference")
+	}
+	payload := bytes.Join(t.chunks, nil)
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != ref.Checksum {
+		return nil, chunkInvalid(ref.TransferID, "checksum mismatch in the reassembled payload")
+	}
+	return payload, nil
+}
+
+// buffered reports whether chunks of the transfer arrived
+func (r *Reassembler) buffered(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.transfers[id]
+	return ok
+}
+
+// Pending returns the number of transfers being reassembled
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.transfers)
+}
+
+// transfer returns the transfer with the given ID, creating it when needed, with r.mu held
+//
+// It returns nil when the transfer is new and MaxTransfers are already open.
+func (r *Reassembler) transfer(id string, now time.Time) *transfer {
+	t, ok := r.transfers[id]
+	if !ok {
+		if len(r.transfers) >= r.cfg.MaxTransfers {
+			return nil
+		}
+		t = &transfer{done: make(chan struct{}), updated: now}
+		r.transfers[id] = t
+	}
+	return t
+}
+
+// drop forgets a transfer
+func (r *Reassembler) drop(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.transfers, id)
+}
+
+// sweep drops the unclaimed transfers that received nothing for longer than the timeout, with r.mu held
+func (r *Reassembler) sweep(now time.Time) {
+	for id, t := range r.transfers {
+		if !t.claimed && now.Sub(t.updated) > r.cfg.Timeout {
+			delete(r.transfers, id)
+		}
+	}
+}
+
+// fail records the error that ends the transfer and wakes up its claim
+func (t *transfer) fail(err error) {
+	t.err = err
+	t.chunks = nil
+	close(t.done)
+}
+
+// chunkTooLarge returns the error for a payload exceeding the reassembly limit
+func chunkTooLarge(size, maxSize int64) *Error {
+	e, _ := NewMCPError(MCPErrorValidation, ErrInvalidParams, "Chunked payload too large", map[string]int64{
+		"size":     size,
+		"max_size": maxSize,
+	})
+	return e
+}
+
+// chunkInvalid returns the error for a corrupted or inconsistent transfer
+func chunkInvalid(id, reason string) *Error {
+	e, _ := NewMCPError(MCPErrorValidation, ErrInvalidParams, "Invalid chunked payload: "+reason, map[string]string{
+		"transfer_id": id,
+	})
+	return e
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReassemblerRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("embedding "), 100)
+	ref, chunks, err := SplitChunks(payload, 64)
+	if err != nil {
+		t.Fatalf("SplitChunks() error = %v", err)
+	}
+	if len(chunks) != 16 || ref.Chunks != 16 || ref.Size != int64(len(payload)) {
+		t.Fatalf("ref = %+v with %d chunks, want 16 chunks", ref, len(chunks))
+	}
+
+	r := NewReassembler(nil)
+	// Claim before the chunks arrive, in reverse order and with a duplicate
+	done := make(chan []byte)
+	go func() {
+		got, err := r.Claim(context.Background(), ref)
+		if err != nil {
+			t.Errorf("Claim() error = %v", err)
+		}
+		done <- got
+	}()
+	for i := len(chunks) - 1; i >= 0; i-- {
+		r.Add(chunks[i])
+	}
+	r.Add(chunks[3])
+
+	if got := <-done; !bytes.Equal(got, payload) {
+		t.Errorf("reassembled %d bytes, want the %d byte payload", len(got), len(payload))
+	}
+	if n := r.Pending(); n != 0 {
+		t.Errorf("Pending() = %d, want 0 after the claim", n)
+	}
+}
+
+func TestReassemblerErrors(t *testing.T) {
+	payload := []byte(strings.Repeat("x", 100))
+
+	tests := []struct {
+		name   string
+		cfg    *ChunkConfig
+		modify func(ref *ChunkRef, chunks []*Chunk) []*Chunk
+		want   MCPErrorType
+	}{
+		{
+			name: "corrupted chunk",
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk {
+				chunks[1].Data = []byte(strings.Repeat("y", len(chunks[1].Data)))
+				return chunks
+			},
+			want: MCPErrorValidation,
+		},
+		{
+			name: "reference mismatch",
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk {
+				ref.Checksum = "00"
+				return chunks
+			},
+			want: MCPErrorValidation,
+		},
+		{
+			name:   "too large",
+			cfg:    &ChunkConfig{MaxSize: 50},
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk { return chunks },
+			want:   MCPErrorValidation,
+		},
+		{
+			name: "huge total",
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk {
+				chunks[0].Total = 1 << 62
+				return chunks
+			},
+			want: MCPErrorValidation,
+		},
+		{
+			name: "more chunks than bytes",
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk {
+				chunks[0].Total = 101
+				return chunks
+			},
+			want: MCPErrorValidation,
+		},
+		{
+			name:   "too many chunks",
+			cfg:    &ChunkConfig{MaxChunks: 3},
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk { return chunks },
+			want:   MCPErrorValidation,
+		},
+		{
+			name:   "missing chunk",
+			cfg:    &ChunkConfig{Timeout: 20 * time.Millisecond},
+			modify: func(ref *ChunkRef, chunks []*Chunk) []*Chunk { return chunks[1:] },
+			want:   MCPErrorTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, chunks, _ := SplitChunks(payload, 30)
+			chunks = tt.modify(ref, chunks)
+			r := NewReassembler(tt.cfg)
+			for _, chunk := range chunks {
+				r.Add(chunk)
+			}
+			_, err := r.Claim(context.Background(), ref)
+			var mcpErr *Error
+			if !errors.As(err, &mcpErr) || mcpErr.Type != tt.want {
+				t.Errorf("Claim() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReassemblerDropsStaleTransfers(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	r := NewReassembler(&ChunkConfig{Timeout: time.Second})
+	r.now = clock.Now
+
+	_, stale, _ := SplitChunks([]byte("abcdef"), 2)
+	r.Add(stale[0])
+	clock.Advance(2 * time.Second)
+	_, fresh, _ := SplitChunks([]byte("ghijkl"), 2)
+	r.Add(fresh[0])
+
+	if n := r.Pending(); n != 1 {
+		t.Errorf("Pending() = %d, want the stale transfer dropped", n)
+	}
+}
+
+func TestReassemblerLimitsTransfers(t *testing.T) {
+	r := NewReassembler(&ChunkConfig{MaxTransfers: 2})
+	var refs []*ChunkRef
+	for i := 0; i < 3; i++ {
+		ref, chunks, _ := SplitChunks([]byte("abcdef"), 2)
+		r.Add(chunks[0])
+		refs = append(refs, ref)
+	}
+	if n := r.Pending(); n != 2 {
+		t.Errorf("Pending() = %d, want the third transfer dropped", n)
+	}
+	var mcpErr *Error
+	if _, err := r.Claim(context.Background(), refs[2]); !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorValidation {
+		t.Errorf("Claim() beyond the transfer limit error = %v, want %s", err, MCPErrorValidation)
+	}
+}
+
+func TestConnSurvivesHugeChunkTotal(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+	defer clientT.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go ServeTransport(ctx, serverT, echoHandler)
+
+	sum := sha256.Sum256([]byte("x"))
+	chunk := fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":{"transfer_id":"t","seq":0,"total":%d,"size":1,"data":"eA==","checksum":%q}}`,
+		ChunkMethod, int64(1)<<62, hex.EncodeToString(sum[:]))
+	if err := clientT.Send(ctx, []byte(chunk)); err != nil {
+		t.Fatal(err)
+	}
+	client := NewConn(clientT, nil)
+	defer client.Close()
+	if err := client.Call(ctx, "echo", nil, nil); err != nil {
+		t.Errorf("Call() after a chunk with a huge total error = %v, want the connection alive", err)
+	}
+}
+
+func TestNewChunkedMCPRequest(t *testing.T) {
+	req, chunks, err := NewChunkedMCPRequest("file_system.write", map[string]string{"content": "small"}, nil, "", 1, 1024)
+	if err != nil || chunks != nil || req.Params == nil || req.Metadata != nil {
+		t.Errorf("small params = %s with %d chunks, %v, want them inline", req.Params, len(chunks), err)
+	}
+
+	req, chunks, err = NewChunkedMCPRequest("file_system.write", map[string]string{"content": strings.Repeat("a", 4096)}, nil, "", 1, 1024)
+	if err != nil {
+		t.Fatalf("NewChunkedMCPRequest() error = %v", err)
+	}
+	if ref, _ := parseChunkRef(req.Metadata); ref == nil || ref.Chunks != len(chunks) || len(chunks) != 5 || req.Params != nil {
+		t.Errorf("large params = %s with metadata %v and %d chunks, want a reference to 5 chunks", req.Params, req.Metadata, len(chunks))
+	}
+}
+
+func TestChunkedCallOverConn(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	client := pipeClient(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		var params struct {
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.Content != content {
+			return NewMCPErrorResponse(StdError(ErrInvalidParams), nil, nil)
+		}
+		resp, chunks, err := NewChunkedMCPResponse(MCPStatusSuccess, map[string]string{"echo": params.Content}, nil, nil, 4096)
+		if err != nil {
+			return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+		}
+		if err := ConnFromContext(ctx).SendChunks(ctx, chunks); err != nil {
+			return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+		}
+		return resp
+	})
+
+	ctx := context.Background()
+	req, chunks, err := NewChunkedMCPRequest("file_system.echo", map[string]string{"content": content}, nil, "", nil, 4096)
+	if err != nil {
+		t.Fatalf("NewChunkedMCPRequest() error = %v", err)
+	}
+	if err := client.Conn().SendChunks(ctx, chunks); err != nil {
+		t.Fatalf("SendChunks() error = %v", err)
+	}
+	resp, err := client.Conn().CallMCP(ctx, req)
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	var data struct {
+		Echo string `json:"echo"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil || data.Echo != content {
+		t.Errorf("echo of %d bytes, error = %v, want the %d byte content", len(data.Echo), err, len(content))
+	}
+}
+
+func TestConnChunkRefsNeedChunks(t *testing.T) {
+	client := pipeClientWith(t, echoHandler, serveConfig{chunks: &ChunkConfig{Timeout: time.Minute}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Params shaped like a reference are user data
+	params := json.RawMessage(`{"$chunked":{"transfer_id":"t","chunks":1,"size":1,"checksum":"00"}}`)
+	resp, err := client.Conn().CallMCP(ctx, &MCPRequest{Action: "echo", Params: params})
+	if err != nil || !bytes.Contains(resp.Data, []byte(`"$chunked"`)) {
+		t.Errorf("CallMCP() = %+v, %v, want the params echoed", resp, err)
+	}
+
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+	}{
+		{name: "unknown transfer", metadata: map[string]interface{}{MetadataChunked: &ChunkRef{TransferID: "t", Chunks: 1, Size: 1, Checksum: "00"}}},
+		{name: "malformed reference", metadata: map[string]interface{}{MetadataChunked: "t"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, err := client.Conn().CallMCP(ctx, &MCPRequest{Action: "echo", Metadata: tt.metadata})
+			var mcpErr *Error
+			if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorValidation {
+				t.Errorf("CallMCP() error = %v, want %s", err, MCPErrorValidation)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("CallMCP() took %v, want the reference rejected at once", elapsed)
+			}
+		})
+	}
+
+	// The same holds for response data
+	client = pipeClient(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return &MCPResponse{Status: MCPStatusSuccess, Metadata: map[string]interface{}{MetadataChunked: &ChunkRef{TransferID: "t", Chunks: 1, Size: 1, Checksum: "00"}}}
+	})
+	start := time.Now()
+	_, err = client.Conn().CallMCP(ctx, &MCPRequest{Action: "echo"})
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorValidation || time.Since(start) > time.Second {
+		t.Errorf("CallMCP() with an unsolicited response reference error = %v after %v, want %s at once", err, time.Since(start), MCPErrorValidation)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+// Circuit breaker states
+const (
+	// CircuitClosed lets every call through and counts consecutive failures
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails every call fast until the cool-down window has passed
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of trial calls through to probe for recovery
+	CircuitHalfOpen
+)
+
+// String returns the name of the state
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitBreakerConfig configures a CircuitBreaker
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens a circuit, zero uses 5
+	FailureThreshold int
+	// CoolDown is how long a circuit stays open before trial calls are let through, zero uses 30s
+	CoolDown time.Duration
+	// HalfOpenRequests is the number of concurrent trial calls in the half-open state, zero uses 1
+	HalfOpenRequests int
+	// IsFailure reports whether an error counts against an action circuit, nil counts retryable
+	// errors and internal server errors
+	IsFailure func(err error) bool
+	// OnStateChange is called after a circuit changed state, name is the endpoint or
+	// "endpoint/action"
+	OnStateChange func(name string, from, to CircuitState)
+}
+
+// CircuitBreaker fails calls fast while an endpoint or one of its actions keeps failing
+//
+// Every endpoint has a circuit for transport failures and every action on it has a circuit of its
+// own, so one failing tool does not stop calls to the other tools on the same endpoint. While a
+// circuit is open calls fail with a DEPENDENCY_ERROR whose retry_after_seconds detail tells when
+// the circuit will let a trial call through.
+type CircuitBreaker struct {
+	cfg CircuitBreakerConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// circuit tracks the state of one endpoint or action
+type circuit struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	trials   int
+	// generation counts state changes, calls admitted in an earlier generation do not count
+	generation uint64
+}
+
+// NewCircuitBreaker creates a CircuitBreaker, a nil cfg uses the defaults
+func NewCircuitBreaker(cfg *CircuitBreakerConfig) *CircuitBreaker {
+	b := &CircuitBreaker{now: time.Now, circuits: make(map[string]*circuit)}
+	if cfg != nil {
+		b.cfg = *cfg
+	}
+	if b.cfg.FailureThreshold <= 0 {
+		b.cfg.FailureThreshold = 5
+	}
+	if b.cfg.CoolDown <= 0 {
+		b.cfg.CoolDown = 30 * time.Second
+	}
+	if b.cfg.HalfOpenRequests <= 0 {
+		b.cfg.HalfOpenRequests = 1
+	}
+	return b
+}
+
+// Interceptor returns a client Interceptor that guards calls to endpoint
+func (b *CircuitBreaker) Interceptor(endpoint string) Interceptor {
+	return func(ctx context.Context, req *MCPRequest, next Invoker) (*MCPResponse, error) {
+		action := endpoint + "/" + string(req.Action)
+
+		actionGen, err := b.acquire(action)
+		if err != nil {
+			return NewMCPErrorResponse(err, nil, req.ID), err
+		}
+		endpointGen, err := b.acquire(endpoint)
+		if err != nil {
+			b.record(action, actionGen, false, false)
+			return NewMCPErrorResponse(err, nil, req.ID), err
+		}
+
+		resp, callErr := next(ctx, req)
+
+		endpointFailed, actionFailed := b.classify(callErr)
+		b.record(endpoint, endpointGen, callErr == nil || !endpointFailed, endpointFailed)
+		b.record(action, actionGen, callErr == nil || (!actionFailed && !endpointFailed), actionFailed)
+		return resp, callErr
+	}
+}
+
+// State returns the current state of the circuit named endpoint or "endpoint/action"
+func (b *CircuitBreaker) State(name string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[name]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && b.now().Sub(c.openedAt) >= b.cfg.CoolDown {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// classify reports whether err counts as a failure of the endpoint and of the action
+//
+// Errors returned by the peer prove the endpoint is reachable, any other error except a
+// cancelled or expired ctx is an endpoint failure.
+func (b *CircuitBreaker) classify(err error) (endpointFailed, actionFailed bool) {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, false
+	}
+	var interrupted *InterruptedError
+	var mcpErr *Error
+	if errors.As(err, &interrupted) || !errors.As(err, &mcpErr) {
+		return true, false
+	}
+	if b.cfg.IsFailure != nil {
+		return false, b.cfg.IsFailure(err)
+	}
+	return false, IsRetryable(err) || mcpErr.Type == MCPErrorInternalServerError || mcpErr.Code == ErrInternal
+}
+
+// acquire admits a call through the named circuit and returns the generation it was admitted in,
+// or returns the fail-fast error
+func (b *CircuitBreaker) acquire(name string) (uint64, *Error) {
+	b.mu.Lock()
+	c, ok := b.circuits[name]
+	if !ok {
+		c = &circuit{}
+		b.circuits[name] = c
+	}
+
+	var changed func()
+	if c.state == CircuitOpen {
+		wait := b.cfg.CoolDown - b.now().Sub(c.openedAt)
+		if wait > 0 {
+			b.mu.Unlock()
+			return 0, circuitOpenError(name, wait)
+		}
+		changed = b.transition(name, c, CircuitHalfOpen)
+	}
+	if c.state == CircuitHalfOpen {
+		if c.trials >= b.cfg.HalfOpenRequests {
+			b.mu.Unlock()
+			return 0, circuitOpenError(name, 0)
+		}
+		c.trials++
+	}
+	gen := c.generation
+	b.mu.Unlock()
+
+	if changed != nil {
+		changed()
+	}
+	return gen, nil
+}
+
+// record reports the outcome of a call admitted in generation gen, a call that neither succeeded
+// nor failed only releases its trial slot
+//
+// Outcomes of calls admitted before the circuit last changed state are ignored, so a call that was
+// let through while the circuit was closed cannot close or reopen it once it is half-open.
+func (b *CircuitBreaker) record(name string, gen uint64, success, failure bool) {
+	b.mu.Lock()
+	c := b.circuits[name]
+	if c.generation != gen {
+		b.mu.Unlock()
+		return
+	}
+
+	var changed func()
+	if c.state == CircuitHalfOpen && c.trials > 0 {
+		c.trials--
+	}
+	switch {
+	case failure:
+		c.failures++
+		if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= b.cfg.FailureThreshold) {
+			c.openedAt = b.now()
+			changed = b.transition(name, c, CircuitOpen)
+		}
+	case success:
+		c.failures = 0
+		if c.state == CircuitHalfOpen {
+			changed = b.transition(name, c, CircuitClosed)
+		}
+	}
+	b.mu.Unlock()
+
+	if changed != nil {
+		changed()
+	}
+}
+
+// transition moves c to state and returns the callback to run once b.mu is released, the caller holds b.mu
+func (b *CircuitBreaker) transition(name string, c *circuit, state CircuitState) func() {
+	from := c.state
+	c.state = state
+	c.trials = 0
+	c.generation++
+	if state == CircuitClosed {
+		c.failures = 0
+	}
+	if b.cfg.OnStateChange == nil || from == state {
+		return nil
+	}
+	return func() { b.cfg.OnStateChange(name, from, state) }
+}
+
+// circuitOpenError returns the DEPENDENCY_ERROR reported while the named circuit rejects calls
+func circuitOpenError(name string, wait time.Duration) *Error {
+	e, _ := NewMCPError(MCPErrorDependency, ErrMCPToolNotAvailable, fmt.Sprintf("Circuit '%s' is open", name), map[string]interface{}{
+		"circuit":             name,
+		"retry_after_seconds": math.Ceil(wait.Seconds()*1000) / 1000,
+	})
+	return e
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for circuit breaker tests
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// stateChange records a circuit state transition
+type stateChange struct {
+	name     string
+	from, to CircuitState
+}
+
+// newTestBreaker returns a breaker driven by a fake clock that records its state changes
+func newTestBreaker(threshold int) (*CircuitBreaker, *fakeClock, *[]stateChange) {
+	var changes []stateChange
+	b := NewCircuitBreaker(&CircuitBreakerConfig{
+		FailureThreshold: threshold,
+		CoolDown:         time.Minute,
+		OnStateChange: func(name string, from, to CircuitState) {
+			changes = append(changes, stateChange{name, from, to})
+		},
+	})
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	b.now = clock.Now
+	return b, clock, &changes
+}
+
+// invokeWith calls the interceptor for action with an invoker returning err
+func invokeWith(b *CircuitBreaker, action MCPAction, err error) (int, error) {
+	calls := 0
+	_, got := b.Interceptor("tools")(context.Background(), &MCPRequest{Action: action}, func(ctx context.Context, req *MCPRequest) (*MCPResponse, error) {
+		calls++
+		return nil, err
+	})
+	return calls, got
+}
+
+func TestCircuitBreakerOpensPerAction(t *testing.T) {
+	b, clock, changes := newTestBreaker(2)
+	sick := mcpError(MCPErrorTimeout, nil)
+
+	invokeWith(b, "sick.run", sick)
+	invokeWith(b, "sick.run", sick)
+	if got := b.State("tools/sick.run"); got != CircuitOpen {
+		t.Fatalf("State(sick) = %v, want %v", got, CircuitOpen)
+	}
+
+	calls, err := invokeWith(b, "sick.run", nil)
+	var mcpErr *Error
+	if calls != 0 || !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorDependency {
+		t.Errorf("call on open circuit: calls = %d, error = %v, want fast DEPENDENCY_ERROR", calls, err)
+	}
+	if after, ok := RetryAfter(err); !ok || after != time.Minute {
+		t.Errorf("RetryAfter() = %v, %v, want 1m", after, ok)
+	}
+
+	if calls, err := invokeWith(b, "healthy.run", nil); calls != 1 || err != nil {
+		t.Errorf("call to healthy action: calls = %d, error = %v, want it let through", calls, err)
+	}
+	if got := b.State("tools"); got != CircuitClosed {
+		t.Errorf("State(endpoint) = %v, want %v", got, CircuitClosed)
+	}
+
+	clock.Advance(time.Minute)
+	if got := b.State("tools/sick.run"); got != CircuitHalfOpen {
+		t.Errorf("State(sick) after cool-down = %v, want %v", got, CircuitHalfOpen)
+	}
+	if calls, err := invokeWith(b, "sick.run", nil); calls != 1 || err != nil {
+		t.Errorf("trial call: calls = %d, error = %v, want it let through", calls, err)
+	}
+	if got := b.State("tools/sick.run"); got != CircuitClosed {
+		t.Errorf("State(sick) after trial = %v, want %v", got, CircuitClosed)
+	}
+
+	want := []stateChange{
+		{"tools/sick.run", CircuitClosed, CircuitOpen},
+		{"tools/sick.run", CircuitOpen, CircuitHalfOpen},
+		{"tools/sick.run", CircuitHalfOpen, CircuitClosed},
+	}
+	if fmt.Sprint(*changes) != fmt.Sprint(want) {
+		t.Errorf("state changes = %v, want %v", *changes, want)
+	}
+}
+
+func TestCircuitBreakerFailedTrialReopens(t *testing.T) {
+	b, clock, _ := newTestBreaker(1)
+	sick := mcpError(MCPErrorDependency, nil)
+
+	invokeWith(b, "sick.run", sick)
+	clock.Advance(time.Minute)
+	if calls, _ := invokeWith(b, "sick.run", sick); calls != 1 {
+		t.Fatalf("trial calls = %d, want 1", calls)
+	}
+	if got := b.State("tools/sick.run"); got != CircuitOpen {
+		t.Errorf("State() after failed trial = %v, want %v", got, CircuitOpen)
+	}
+	if calls, _ := invokeWith(b, "sick.run", nil); calls != 0 {
+		t.Errorf("calls after failed trial = %d, want 0", calls)
+	}
+}
+
+func TestCircuitBreakerIgnoresLateOutcomes(t *testing.T) {
+	b, clock, _ := newTestBreaker(1)
+	sick := mcpError(MCPErrorDependency, nil)
+	icpt := b.Interceptor("tools")
+
+	// slowCall starts a call that reports the error sent on its channel
+	started, done := make(chan struct{}), make(chan struct{})
+	slowCall := func() chan<- error {
+		release := make(chan error)
+		go func() {
+			icpt(context.Background(), &MCPRequest{Action: "slow.run"}, func(ctx context.Context, req *MCPRequest) (*MCPResponse, error) {
+				started <- struct{}{}
+				return nil, <-release
+			})
+			done <- struct{}{}
+		}()
+		<-started
+		return release
+	}
+
+	// Two calls are admitted while the circuit is closed and report once it is half-open
+	lateSuccess, lateFailure := slowCall(), slowCall()
+	invokeWith(b, "slow.run", sick)
+	clock.Advance(time.Minute)
+	trial := slowCall()
+
+	lateSuccess <- nil
+	<-done
+	if got := b.State("tools/slow.run"); got != CircuitHalfOpen {
+		t.Errorf("State() after a late success = %v, want %v", got, CircuitHalfOpen)
+	}
+	lateFailure <- sick
+	<-done
+	if got := b.State("tools/slow.run"); got != CircuitHalfOpen {
+		t.Errorf("State() after a late failure = %v, want %v", got, CircuitHalfOpen)
+	}
+
+	trial <- nil
+	<-done
+	if got := b.State("tools/slow.run"); got != CircuitClosed {
+		t.Errorf("State() after the trial = %v, want %v", got, CircuitClosed)
+	}
+}
+
+func TestCircuitBreakerEndpointFailures(t *testing.T) {
+	b, _, _ := newTestBreaker(2)
+
+	invokeWith(b, "a.run", ErrConnClosed)
+	invokeWith(b, "b.run", ErrConnClosed)
+	if got := b.State("tools"); got != CircuitOpen {
+		t.Fatalf("State(endpoint) = %v, want %v", got, CircuitOpen)
+	}
+	if got := b.State("tools/a.run"); got != CircuitClosed {
+		t.Errorf("State(action) = %v, want %v for transport failures", got, CircuitClosed)
+	}
+	if calls, err := invokeWith(b, "c.run", nil); calls != 0 || err == nil {
+		t.Errorf("call on open endpoint: calls = %d, error = %v, want fast failure", calls, err)
+	}
+}
+
+func TestCircuitBreakerIgnoresCallerErrors(t *testing.T) {
+	b, _, _ := newTestBreaker(1)
+
+	invokeWith(b, "a.run", mcpError(MCPErrorValidation, nil))
+	invokeWith(b, "a.run", context.Canceled)
+	if got := b.State("tools/a.run"); got != CircuitClosed {
+		t.Errorf("State(action) = %v, want %v", got, CircuitClosed)
+	}
+	if got := b.State("tools"); got != CircuitClosed {
+		t.Errorf("State(endpoint) = %v, want %v", got, CircuitClosed)
+	}
+}
+
+func TestClientWithCircuitBreaker(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mux := NewMux()
+	mux.Handle("sick.run", func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return NewMCPErrorResponse(mcpError(MCPErrorDependency, nil), nil, nil)
+	})
+	mux.Handle("healthy.run", echoHandler)
+	go ServeTransport(ctx, serverT, mux.ServeMCP)
+
+	breaker := NewCircuitBreaker(&CircuitBreakerConfig{FailureThreshold: 1, CoolDown: time.Minute})
+	client := NewClient(clientT, &ClientConfig{Interceptors: []Interceptor{breaker.Interceptor("pipe")}})
+	defer client.Close()
+
+	client.CallMCP(ctx, "sick.run", "", nil)
+	start := time.Now()
+	if _, err := client.CallMCP(ctx, "sick.run", "", nil); err == nil {
+		t.Error("CallMCP() on open circuit error = nil, want DEPENDENCY_ERROR")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("open circuit took %v to fail, want fast failure", elapsed)
+	}
+	if _, err := client.CallMCP(ctx, "healthy.run", "", nil); err != nil {
+		t.Errorf("CallMCP(healthy) error = %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ClientConfig configures a Client
+type ClientConfig struct {
+	// Handler serves requests and notifications sent by the server, nil rejects every request
+	Handler MCPHandler
+	// Retry retries failed calls, nil disables retries
+	Retry *RetryPolicy
+	// Interceptors wrap every attempt of CallMCP, the first one is the outermost
+	Interceptors []Interceptor
+	// MaxReplays limits how often a call interrupted by a reconnection is sent again, zero uses 3
+	// and a negative value disables replays
+	MaxReplays int
+	// Idempotent reports whether an action or method can safely be replayed, nil uses the retry
+	// policy's Idempotent or DefaultIdempotent
+	Idempotent func(action string) bool
+	// Timeout bounds every attempt of a call, zero means no timeout
+	Timeout time.Duration
+	// ActionTimeouts overrides Timeout for specific actions or methods
+	ActionTimeouts map[string]time.Duration
+	// IdempotencyKeys sends a fresh idempotency_key with every MCP call, so that retries and
+	// replays of any action are deduplicated by a server using the Idempotency middleware
+	IdempotencyKeys bool
+	// SessionContext is sent as the context of every MCP request and replaced by the context of
+	// responses, so the session survives reconnections
+	SessionContext interface{}
+	// Chunks limits the reassembly of chunked response data, nil uses the defaults
+	Chunks *ChunkConfig
+	// ProgressInterval is the minimum time between two progress notifications for the same
+	// request served by Handler, zero uses DefaultProgressInterval and a negative value disables
+	// throttling
+	ProgressInterval time.Duration
+	// Blobs resolves response data returned as a BlobRef, nil leaves references to the caller
+	Blobs BlobResolver
+	// MaxBlobSize limits the blobs resolved through Blobs, zero uses DefaultMaxBlobSize
+	MaxBlobSize int64
+	// Credentials returns the value sent in the auth metadata field of every MCP call, such as
+	// "Bearer <token>". It runs before each attempt so refreshed credentials are picked up. Over
+	// WebSocket, credentials can also go in WebSocketConfig.Header.
+	Credentials func(ctx context.Context) (string, error)
+}
+
+// Invoker sends an MCP request and returns its response
+type Invoker func(ctx context.Context, req *MCPRequest) (*MCPResponse, error)
+
+// Interceptor wraps an Invoker, for example to observe, reject or alter calls
+type Interceptor func(ctx context.Context, req *MCPRequest, next Invoker) (*MCPResponse, error)
+
+// Client is a concurrent MCP client
+//
+// Many goroutines can have calls in flight at the same time on one connection, responses are
+// matched to their call by id. When the connection drops every pending call fails with
+// ErrConnClosed. Over a ReconnectingTransport, idempotent calls interrupted by a reconnection
+// are sent again and the others fail with ErrOutcomeUnknown.
+type Client struct {
+	conn   *Conn
+	cfg    ClientConfig
+	invoke Invoker
+
+	mu      sync.Mutex
+	session interface{}
+}
+
+// NewClient creates a Client over t, a nil cfg uses the defaults
+func NewClient(t Transport, cfg *ClientConfig) *Client {
+	c := &Client{}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	c.session = c.cfg.SessionContext
+	c.conn = newConn(context.Background(), t, c.cfg.Handler, serveConfig{chunks: c.cfg.Chunks, progressInterval: c.cfg.ProgressInterval})
+	c.invoke = c.conn.CallMCP
+	for i := len(c.cfg.Interceptors) - 1; i >= 0; i-- {
+		interceptor, next := c.cfg.Interceptors[i], c.invoke
+		c.invoke = func(ctx context.Context, req *MCPRequest) (*MCPResponse, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return c
+}
+
+// Call sends a JSON-RPC request and stores the result of the response in result
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	return c.retry(ctx, method, false, func(ctx context.Context) error {
+		return c.conn.Call(ctx, method, params, result)
+	})
+}
+
+// Notify sends a JSON-RPC notification
+func (c *Client) Notify(ctx context.Context, method string, params interface{}) error {
+	return c.conn.Notify(ctx, method, params)
+}
+
+// CallMCP runs action on tool and returns the response
+//
+// Nil params are sent as an empty object since MCP requires params on every request. When the
+// response has the error status it is returned together with its *Error. With a retry policy the
+// response of the last attempt is returned.
+//
+// The deadline of ctx, or of the action timeout, is sent in the request metadata so the server
+// stops working on the request when the client stops waiting. With IdempotencyKeys every call
+// gets a key that stays the same across retries and replays, which makes them safe for
+// non-idempotent actions. With a Blobs resolver, data returned as a BlobRef is fetched, checked
+// against its digest and inlined.
+func (c *Client) CallMCP(ctx context.Context, action MCPAction, tool string, params interface{}) (*MCPResponse, error) {
+	if params == nil {
+		params = json.RawMessage(`{}`)
+	}
+	req, err := NewMCPRequest(action, params, nil, tool, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keyed := false
+	if c.cfg.IdempotencyKeys {
+		key, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		req.Metadata = map[string]interface{}{MetadataIdempotencyKey: key}
+		keyed = true
+	}
+
+	var resp *MCPResponse
+	err = c.retry(ctx, string(action), keyed, func(ctx context.Context) error {
+		var err error
+		req.Context = c.SessionContext()
+		if c.cfg.Credentials != nil {
+			auth, err := c.cfg.Credentials(ctx)
+			if err != nil {
+				return err
+			}
+			if req.Metadata == nil {
+				req.Metadata = make(map[string]interface{})
+			}
+			req.Metadata[MetadataAuth] = auth
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			req.SetDeadline(deadline)
+		}
+		resp, err = c.invoke(ctx, req)
+		if resp != nil && resp.Context != nil {
+			c.SetSessionContext(resp.Context)
+		}
+		return err
+	})
+	if err == nil && c.cfg.Blobs != nil {
+		if resp.Data, err = resolveBlobData(ctx, c.cfg.Blobs, resp.Data, c.cfg.MaxBlobSize); err != nil {
+			return nil, err
+		}
+	}
+	return resp, err
+}
+
+// SessionContext returns the session context sent with MCP requests
+func (c *Client) SessionContext() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// SetSessionContext replaces the session context sent with MCP requests
+func (c *Client) SetSessionContext(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session = v
+}
+
+// retry runs fn under the configured retry policy, replaying idempotent calls interrupted by a
+// reconnection and bounding every attempt by the action timeout. Keyed calls carry an
+// idempotency key and are always safe to repeat.
+func (c *Client) retry(ctx context.Context, action string, keyed bool, fn func(ctx context.Context) error) error {
+	attempt := func(ctx context.Context) error {
+		timeout := c.timeout(action)
+		if timeout <= 0 {
+			return c.replay(ctx, action, keyed, fn)
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		err := c.replay(attemptCtx, action, keyed, fn)
+		if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+			e, _ := NewMCPError(MCPErrorTimeout, ErrMCPExecutionFailed, fmt.Sprintf("Action '%s' timed out after %v", action, timeout), nil)
+			return e
+		}
+		return err
+	}
+	if c.cfg.Retry == nil {
+		return attempt(ctx)
+	}
+	return c.cfg.Retry.do(ctx, action, keyed, attempt)
+}
+
+// timeout returns the timeout of one attempt of action
+func (c *Client) timeout(action string) time.Duration {
+	if d, ok := c.cfg.ActionTimeouts[action]; ok {
+		return d
+	}
+	return c.cfg.Timeout
+}
+
+// replay runs fn and runs it again while it fails because the transport was interrupted and
+// action is idempotent
+func (c *Client) replay(ctx context.Context, action string, keyed bool, fn func(ctx context.Context) error) error {
+	maxReplays := c.cfg.MaxReplays
+	if maxReplays == 0 {
+		maxReplays = 3
+	}
+	for replays := 0; ; replays++ {
+		err := fn(ctx)
+		var interrupted *InterruptedError
+		if err == nil || !errors.As(err, &interrupted) || replays >= maxReplays || ctx.Err() != nil || !(keyed || c.idempotent(action)) {
+			return err
+		}
+	}
+}
+
+// idempotent reports whether action can safely run more than once
+func (c *Client) idempotent(action string) bool {
+	switch {
+	case c.cfg.Idempotent != nil:
+		return c.cfg.Idempotent(action)
+	case c.cfg.Retry != nil && c.cfg.Retry.Idempotent != nil:
+		return c.cfg.Retry.Idempotent(action)
+	}
+	return DefaultIdempotent(action)
+}
+
+// randomID returns 128 random bits as a hex string, used for idempotency keys and job IDs
+func randomID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Conn returns the underlying connection
+func (c *Client) Conn() *Conn {
+	return c.conn
+}
+
+// Close closes the connection, failing every pending call
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
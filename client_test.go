@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientConcurrentCalls(t *testing.T) {
+	clientT, serverT := Pipe(&PipeOptions{Latency: time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]string{"tool": req.Tool}, nil, nil)
+		return resp
+	})
+
+	client := NewClient(clientT, nil)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tool := fmt.Sprintf("tool-%d", i)
+			resp, err := client.CallMCP(ctx, "tool.run", tool, nil)
+			if err != nil {
+				t.Errorf("CallMCP(%s) error = %v", tool, err)
+				return
+			}
+			if want := fmt.Sprintf(`{"tool":%q}`, tool); string(resp.Data) != want {
+				t.Errorf("CallMCP(%s) data = %s, want %s", tool, resp.Data, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientCallMCPError(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mux := NewMux()
+	mux.Handle("calculator.add", echoHandler)
+	go ServeTransport(ctx, serverT, mux.ServeMCP)
+
+	client := NewClient(clientT, nil)
+	defer client.Close()
+
+	resp, err := client.CallMCP(ctx, "calculator.add", "", nil)
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	if string(resp.Data) != `{}` {
+		t.Errorf("resp.Data = %s, want {} for nil params", resp.Data)
+	}
+
+	resp, err = client.CallMCP(ctx, "calculator.divide", "", nil)
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorActionNotFound {
+		t.Fatalf("CallMCP() error = %v, want %s", err, MCPErrorActionNotFound)
+	}
+	if resp == nil || resp.Status != MCPStatusError {
+		t.Errorf("CallMCP() response = %v, want error status", resp)
+	}
+}
+
+func TestClientCallJSONRPC(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.Method == "fail" {
+			e, _ := NewError(ErrInvalidParams, "bad params", nil)
+			return NewMCPErrorResponse(e, nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, []int{1, 2, 3}, nil, nil)
+		return resp
+	})
+
+	client := NewClient(clientT, nil)
+	defer client.Close()
+
+	var got []int
+	if err := client.Call(ctx, "list", nil, &got); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("Call() result = %v, want [1 2 3]", got)
+	}
+
+	var rpcErr *Error
+	if err := client.Call(ctx, "fail", nil, nil); !errors.As(err, &rpcErr) || rpcErr.Code != ErrInvalidParams {
+		t.Errorf("Call() error = %v, want code %d", err, ErrInvalidParams)
+	}
+}
+
+func TestClientActionTimeouts(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	handlerErr := make(chan error, 1)
+	release := make(chan struct{})
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		deadline, ok := ctx.Deadline()
+		if req.Action == "slow.run" {
+			<-ctx.Done()
+			handlerErr <- ctx.Err()
+			// Answer only after the client gave up, both sides share the same deadline
+			<-release
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]interface{}{
+			"has_deadline": ok,
+			"remaining_ms": time.Until(deadline).Milliseconds(),
+		}, nil, nil)
+		return resp
+	})
+
+	client := NewClient(clientT, &ClientConfig{
+		Timeout:        time.Minute,
+		ActionTimeouts: map[string]time.Duration{"slow.run": 50 * time.Millisecond},
+	})
+	defer client.Close()
+
+	_, err := client.CallMCP(ctx, "slow.run", "", nil)
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorTimeout {
+		t.Fatalf("CallMCP() error = %v, want %s", err, MCPErrorTimeout)
+	}
+	close(release)
+	if err := <-handlerErr; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("handler context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	resp, err := client.CallMCP(ctx, "fast.run", "", nil)
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	var data struct {
+		HasDeadline bool  `json:"has_deadline"`
+		RemainingMS int64 `json:"remaining_ms"`
+	}
+	json.Unmarshal(resp.Data, &data)
+	if !data.HasDeadline || data.RemainingMS > 5000 {
+		t.Errorf("handler deadline = %+v, want the 5s deadline of the caller", data)
+	}
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrConnClosed is returned by calls on a Conn whose receive loop has ended
+	ErrConnClosed = errors.New("connection closed")
+	// ErrOutcomeUnknown is returned by calls in flight when the transport was interrupted, the
+	// peer may or may not have run them
+	ErrOutcomeUnknown = errors.New("connection lost, outcome unknown")
+	// ErrDuplicateID is returned by calls whose id or request_id is already used by a call in flight
+	ErrDuplicateID = errors.New("request id already in flight")
+)
+
+// Conn is a symmetric JSON-RPC peer over a Transport
+//
+// Both ends of a connection can send requests and notifications and serve the requests of the
+// other end. Outgoing requests get ids from a per-connection counter and are correlated through a
+// pending-call table, incoming requests are dispatched to the handler each in its own goroutine.
+// Since requests and responses are told apart by the presence of a method or action, the ids
+// chosen by the two ends never clash.
+type Conn struct {
+	t   Transport
+	h   MCPHandler
+	cfg serveConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	nextID    atomic.Int64
+	inflight  atomic.Int64
+	unmatched atomic.Int64
+
+	chunks      *Reassembler
+	attachments attachmentTable
+
+	mu      sync.Mutex
+	pending map[string]*pendingCall
+	batches []*pendingBatch
+	err     error
+
+	handlers sync.WaitGroup
+	loopErr  error
+	done     chan struct{}
+}
+
+// pendingCall is an outgoing request waiting for its response
+type pendingCall struct {
+	keys  []string
+	reply chan connReply
+	// progress receives the progress notifications of the call, if set
+	progress func(ProgressUpdate)
+	// cancelSend stops a send still waiting for the transport once the call failed, so a call
+	// failed by an interruption is not sent over the connection that replaced the lost one
+	cancelSend context.CancelFunc
+}
+
+// connReply is the outcome of an outgoing request
+type connReply struct {
+	msg []byte
+	err error
+	// batch is set when the peer rejected the whole batch the call belonged to
+	batch bool
+}
+
+// connMessage holds the fields needed to tell requests and responses apart
+type connMessage struct {
+	Method   string                 `json:"method"`
+	Action   MCPAction              `json:"action"`
+	ID       interface{}            `json:"id"`
+	Result   json.RawMessage        `json:"result"`
+	Error    json.RawMessage        `json:"error"`
+	Status   MCPStatus              `json:"status"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// connKey is the context key holding the Conn that received a request
+type connKey struct{}
+
+// NewConn starts a Conn over t that serves incoming requests with h
+//
+// A nil h answers every incoming request with an ACTION_NOT_FOUND error.
+func NewConn(t Transport, h MCPHandler) *Conn {
+	return newConn(context.Background(), t, h, serveConfig{})
+}
+
+// newConn creates a Conn and starts its receive loop
+func newConn(ctx context.Context, t Transport, h MCPHandler, cfg serveConfig) *Conn {
+	c := &Conn{
+		t:       t,
+		h:       h,
+		cfg:     cfg,
+		chunks:  NewReassembler(cfg.chunks),
+		pending: make(map[string]*pendingCall),
+		done:    make(chan struct{}),
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.ctx = context.WithValue(ctx, connKey{}, c)
+	go c.run()
+	if bt, ok := binaryTransport(t); ok {
+		go c.binaryLoop(bt)
+	}
+	return c
+}
+
+// ConnFromContext returns the Conn that received the request handled with ctx, so handlers can
+// send notifications or requests back to the peer
+func ConnFromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
+
+// Call sends a JSON-RPC request and stores the result of the response in result
+//
+// A nil result discards the response. Error responses are returned as *Error.
+func (c *Conn) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	id := c.nextID.Add(1)
+	req, err := NewRequest(method, params, id)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.roundTrip(ctx, id, "", msg)
+	if err != nil {
+		return err
+	}
+	return decodeResult(data, result)
+}
+
+// decodeResult stores the result of a JSON-RPC or MCP response in result, a nil result discards it
+//
+// Error responses are returned as *Error.
+func decodeResult(data []byte, result interface{}) error {
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Data   json.RawMessage `json:"data"`
+		Error  *Error          `json:"error"`
+		Status MCPStatus       `json:"status"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.Status == MCPStatusError {
+		return StdError(ErrInternal)
+	}
+	if result == nil {
+		return nil
+	}
+	raw := resp.Result
+	if raw == nil {
+		raw = resp.Data
+	}
+	if raw == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// Notify sends a JSON-RPC notification, which the peer does not answer
+func (c *Conn) Notify(ctx context.Context, method string, params interface{}) error {
+	req, err := NewNotification(method, params)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := c.closedErr(); err != nil {
+		return err
+	}
+	return c.t.Send(ctx, msg)
+}
+
+// CallMCP sends an MCP request and waits for its response
+//
+// A request without an ID gets one from the connection. When the response has the error status
+// it is returned together with its *Error. Chunked response data is reassembled.
+func (c *Conn) CallMCP(ctx context.Context, req *MCPRequest) (*MCPResponse, error) {
+	r := *req
+	if r.JSONRPC == "" {
+		r.JSONRPC = Version
+	}
+	if r.ID == nil {
+		r.ID = c.nextID.Add(1)
+	}
+	msg, err := json.Marshal(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.roundTrip(ctx, r.ID, r.RequestID(), msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp MCPResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data, err = c.claimChunks(ctx, resp.Metadata, resp.Data); err != nil {
+		return nil, err
+	}
+	if resp.Status == MCPStatusError || resp.Error != nil {
+		if resp.Error == nil {
+			return &resp, StdError(ErrInternal)
+		}
+		return &resp, resp.Error
+	}
+	return &resp, nil
+}
+
+// Close cancels in-flight handlers and closes the transport
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.t.Close()
+}
+
+// Done returns a channel that is closed once the receive loop ended and every handler returned
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the connection is done and returns the error that ended the receive loop
+//
+// It returns nil when the loop was stopped on purpose, for example by a Listener shutting down.
+func (c *Conn) Wait() error {
+	<-c.done
+	return c.loopErr
+}
+
+// UnmatchedResponses returns the number of responses that matched no pending call, such as
+// duplicates or responses to calls that were already abandoned
+func (c *Conn) UnmatchedResponses() int64 {
+	return c.unmatched.Load()
+}
+
+// roundTrip registers a pending call, sends msg and waits for the matching response, delivering
+// progress notifications to the callback registered on ctx with WithProgress
+func (c *Conn) roundTrip(ctx context.Context, id interface{}, requestID string, msg []byte) ([]byte, error) {
+	sendCtx, cancelSend := context.WithCancel(ctx)
+	defer cancelSend()
+	call := &pendingCall{reply: make(chan connReply, 1), progress: progressCallback(ctx), cancelSend: cancelSend}
+	if key, ok := idKey(id); ok {
+		call.keys = append(call.keys, key)
+	}
+	if requestID != "" {
+		call.keys = append(call.keys, requestIDKey(requestID))
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if err := c.register(call); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.mu.Unlock()
+
+	if err := c.t.Send(sendCtx, msg); err != nil {
+		c.forget(call)
+		select {
+		case r := <-call.reply:
+			// Failed while waiting to be sent
+			return r.msg, r.err
+		default:
+		}
+		var interrupted *InterruptedError
+		if errors.As(err, &interrupted) {
+			return nil, fmt.Errorf("%w: %w", ErrOutcomeUnknown, err)
+		}
+		return nil, err
+	}
+
+	select {
+	case r := <-call.reply:
+		return r.msg, r.err
+	case <-ctx.Done():
+		c.forget(call)
+		return nil, ctx.Err()
+	}
+}
+
+// register adds call to the pending table under each of its keys, refusing keys already in use
+// so that a call never silently replaces another one; c.mu must be held
+func (c *Conn) register(call *pendingCall) error {
+	for _, key := range call.keys {
+		if c.pending[key] != nil {
+			return fmt.Errorf("%w: %s", ErrDuplicateID, key)
+		}
+	}
+	for _, key := range call.keys {
+		c.pending[key] = call
+	}
+	return nil
+}
+
+// forget removes call from the pending table
+func (c *Conn) forget(call *pendingCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range call.keys {
+		if c.pending[key] == call {
+			delete(c.pending, key)
+		}
+	}
+}
+
+// closedErr returns the error calls fail with once the receive loop ended
+func (c *Conn) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// failPending fails every pending call with err
+func (c *Conn) failPending(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, call := range c.pending {
+		delete(c.pending, key)
+		select {
+		case call.reply <- connReply{err: err}:
+		default:
+		}
+		if call.cancelSend != nil {
+			call.cancelSend()
+		}
+	}
+}
+
+// run reads messages until the transport fails or the connection is stopped
+func (c *Conn) run() {
+	err := c.receiveLoop()
+
+	closed := ErrConnClosed
+	if err != nil {
+		closed = fmt.Errorf("%w: %w", ErrConnClosed, err)
+	}
+	c.mu.Lock()
+	c.err = closed
+	c.mu.Unlock()
+	c.failPending(closed)
+
+	c.handlers.Wait()
+	c.cancel()
+	c.loopErr = err
+	close(c.done)
+}
+
+// receiveLoop dispatches incoming messages and returns the error that ended the loop
+func (c *Conn) receiveLoop() error {
+	recvCtx, recvCancel := context.WithCancel(c.ctx)
+	defer recvCancel()
+	if c.cfg.stop != nil {
+		go func() {
+			select {
+			case <-c.cfg.stop:
+				recvCancel()
+			case <-recvCtx.Done():
+			}
+		}()
+	}
+
+	for {
+		rctx, rcancel := recvCtx, context.CancelFunc(func() {})
+		if c.cfg.idleTimeout > 0 {
+			rctx, rcancel = context.WithTimeout(recvCtx, c.cfg.idleTimeout)
+		}
+		msg, err := c.t.Receive(rctx)
+		rcancel()
+		if err != nil {
+			var interrupted *InterruptedError
+			switch {
+			case errors.As(err, &interrupted):
+				// The transport recovered but responses in flight are lost
+				c.failPending(fmt.Errorf("%w: %w", ErrOutcomeUnknown, err))
+				continue
+			case recvCtx.Err() != nil && c.ctx.Err() == nil:
+				// Stopped by cfg.stop, let in-flight handlers drain
+				return nil
+			case c.cfg.idleTimeout > 0 && errors.Is(err, context.DeadlineExceeded) && recvCtx.Err() == nil:
+				if c.busy() {
+					continue
+				}
+				return ErrIdleTimeout
+			}
+			return err
+		}
+
+		c.handleMessage(msg)
+	}
+}
+
+// busy reports whether requests are in flight in either direction
+func (c *Conn) busy() bool {
+	if c.inflight.Load() > 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) > 0
+}
+
+// handleMessage routes one incoming message to the pending-call table or to the handler
+func (c *Conn) handleMessage(msg []byte) {
+	if isBatch(msg) {
+		c.handleBatch(msg)
+		return
+	}
+
+	req, mcp, resp := c.route(msg)
+	if resp != nil {
+		c.respond(resp, true)
+		return
+	}
+	if req == nil {
+		return
+	}
+	if req.Method == ProgressMethod && req.ID == nil && c.deliverProgress(req) {
+		return
+	}
+	if req.Method == ChunkMethod && req.ID == nil {
+		// Chunks are stored in the receive loop so they are in place before the message using them
+		var chunk Chunk
+		if json.Unmarshal(req.Params, &chunk) == nil {
+			c.chunks.Add(&chunk)
+		}
+		return
+	}
+
+	c.inflight.Add(1)
+	c.handlers.Add(1)
+	go func() {
+		defer c.handlers.Done()
+		defer c.inflight.Add(-1)
+		if resp := c.dispatch(req); resp != nil {
+			c.respond(resp, mcp)
+		}
+	}()
+}
+
+// handleBatch serves a JSON-RPC batch and answers with one array holding every response
+//
+// The requests of a batch run concurrently. Responses found in a batch are delivered to their
+// pending calls, so a peer may answer a batch with a batch.
+func (c *Conn) handleBatch(msg []byte) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(msg, &items); err != nil {
+		c.respond(NewMCPErrorResponse(StdError(ErrParse), nil, nil), false)
+		return
+	}
+	if len(items) == 0 {
+		c.respond(NewMCPErrorResponse(StdError(ErrInvalidRequest), nil, nil), false)
+		return
+	}
+
+	replies := make([][]byte, len(items))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		req, mcp, resp := c.route(item)
+		if resp != nil {
+			replies[i] = encodeResponse(resp, false)
+			continue
+		}
+		if req == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := c.dispatch(req); resp != nil {
+				replies[i] = encodeResponse(resp, mcp)
+			}
+		}()
+	}
+
+	c.inflight.Add(1)
+	c.handlers.Add(1)
+	go func() {
+		defer c.handlers.Done()
+		defer c.inflight.Add(-1)
+		wg.Wait()
+
+		var out []json.RawMessage
+		for _, reply := range replies {
+			if reply != nil {
+				out = append(out, reply)
+			}
+		}
+		if len(out) == 0 {
+			return
+		}
+		data, _ := json.Marshal(out)
+		_ = c.t.Send(c.ctx, data)
+	}()
+}
+
+// dispatch reassembles chunked params and runs the handler for req, returning nil for notifications
+func (c *Conn) dispatch(req *MCPRequest) *MCPResponse {
+	params, err := c.claimChunks(c.ctx, req.Metadata, req.Params)
+	if err != nil {
+		if req.IsNotification() {
+			return nil
+		}
+		return finishResponse(req, errorResponse(err, req))
+	}
+	req.Params = params
+	return dispatchRequest(c.ctx, req, c.h)
+}
+
+// route classifies one message: responses are delivered to their pending call, requests are
+// decoded and returned with whether they use the MCP envelope, and malformed messages yield the
+// error response to send back
+func (c *Conn) route(msg []byte) (req *MCPRequest, mcp bool, resp *MCPResponse) {
+	if req := scanRequest(msg); req != nil {
+		return req, req.Action != "", nil
+	}
+
+	var m connMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		var probe interface{}
+		if json.Unmarshal(msg, &probe) == nil {
+			// Valid JSON that is not an object, such as a number inside a batch
+			return nil, false, NewMCPErrorResponse(StdError(ErrInvalidRequest), nil, nil)
+		}
+		return nil, true, NewMCPErrorResponse(StdError(ErrParse), nil, nil)
+	}
+
+	if m.Method == "" && m.Action == "" {
+		if m.Result == nil && m.Error == nil && m.Status == "" {
+			return nil, true, NewMCPErrorResponse(StdError(ErrInvalidRequest), nil, m.ID)
+		}
+		c.deliver(&m, msg)
+		return nil, false, nil
+	}
+
+	req = &MCPRequest{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		return nil, true, NewMCPErrorResponse(StdError(ErrInvalidRequest), nil, m.ID)
+	}
+	return req, req.Action != "", nil
+}
+
+// scanRequest decodes msg with the envelope scanner when it is a plain request, returning nil for
+// responses and for messages left to encoding/json
+func scanRequest(msg []byte) *MCPRequest {
+	e, err := ScanEnvelope(msg)
+	if err != nil {
+		return nil
+	}
+	defer e.Release()
+	if e.Extra || (len(e.Method) == 0 && len(e.Action) == 0) {
+		return nil
+	}
+	req, err := e.MCPRequest()
+	if err != nil {
+		return nil
+	}
+	return req
+}
+
+// isBatch reports whether msg is a JSON array
+func isBatch(msg []byte) bool {
+	for _, b := range msg {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// deliver hands a response to the pending call it answers, unknown and duplicate responses are counted and dropped
+func (c *Conn) deliver(m *connMessage, msg []byte) {
+	var keys []string
+	if key, ok := idKey(m.ID); ok {
+		keys = append(keys, key)
+	}
+	if id, ok := m.Metadata[MetadataRequestID].(string); ok && id != "" {
+		keys = append(keys, requestIDKey(id))
+	}
+
+	c.mu.Lock()
+	var call *pendingCall
+	for _, key := range keys {
+		if call = c.pending[key]; call != nil {
+			break
+		}
+	}
+	if call != nil {
+		for _, key := range call.keys {
+			delete(c.pending, key)
+		}
+	}
+	c.mu.Unlock()
+
+	if call == nil {
+		if len(keys) == 0 && m.Error != nil && c.failBatch(m) {
+			return
+		}
+		c.unmatched.Add(1)
+		return
+	}
+	call.reply <- connReply{msg: msg}
+}
+
+// respond sends resp to the peer, encoded as an MCP or a plain JSON-RPC response
+//
+// Streamed data is encoded straight into the outgoing frames of a StreamingTransport. When
+// writing fails the streamed message is abandoned or ends short, so an internal error is sent
+// after it.
+func (c *Conn) respond(resp *MCPResponse, mcp bool) {
+	if st, ok := c.t.(StreamingTransport); ok && resp.stream != nil {
+		err := st.SendStream(c.ctx, func(w io.Writer) error {
+			return writeResponse(w, resp, mcp)
+		})
+		if err == nil {
+			return
+		}
+		resp = NewMCPErrorResponse(StdError(ErrInternal), nil, resp.ID)
+	}
+	_ = c.t.Send(c.ctx, encodeResponse(resp, mcp))
+}
+
+// idKey returns the correlation key of a request ID, numbers compare equal whatever their Go type
+func idKey(id interface{}) (string, bool) {
+	switch v := id.(type) {
+	case string:
+		return `"` + v, true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return strconv.FormatInt(n, 10), true
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", false
+		}
+		return floatKey(f), true
+	case float64:
+		return floatKey(v), true
+	case float32:
+		return floatKey(float64(v)), true
+	case int:
+		return strconv.FormatInt(int64(v), 10), true
+	case int8:
+		return strconv.FormatInt(int64(v), 10), true
+	case int16:
+		return strconv.FormatInt(int64(v), 10), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	}
+	return "", false
+}
+
+// floatKey returns the correlation key of a numeric ID decoded as a float, integral values use
+// the same decimal form as integer IDs
+func floatKey(v float64) string {
+	switch {
+	case v != math.Trunc(v) || math.IsInf(v, 0):
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case v >= -(1<<63) && v < 1<<63:
+		return strconv.FormatInt(int64(v), 10)
+	case v > 0 && v < 1<<64:
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'f', 0, 64)
+}
+
+// requestIDKey returns the correlation key of a request_id metadata value
+func requestIDKey(id string) string {
+	return "request_id:" + id
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// interruptingTransport reports an interruption from Receive for every value sent on interrupt
+type interruptingTransport struct {
+	*PipeTransport
+	interrupt chan struct{}
+}
+
+func (t *interruptingTransport) Receive(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-t.interrupt:
+			close(interrupted)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	msg, err := t.PipeTransport.Receive(ctx)
+	if err != nil {
+		cancel()
+		select {
+		case <-interrupted:
+			return nil, &InterruptedError{Err: errors.New("peer restarted")}
+		default:
+		}
+	}
+	return msg, err
+}
+
+func TestConnServerInitiatedCall(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+	defer clientT.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		var answer struct {
+			Confirmed bool `json:"confirmed"`
+		}
+		if err := ConnFromContext(ctx).Call(ctx, "confirm", map[string]string{"action": string(req.Action)}, &answer); err != nil {
+			return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, answer, nil, nil)
+		return resp
+	})
+
+	client := NewConn(clientT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.Method != "confirm" {
+			return NewMCPErrorResponse(StdError(ErrMethodNotFound), nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]bool{"confirmed": true}, nil, nil)
+		return resp
+	})
+	defer client.Close()
+
+	req, _ := NewMCPRequest("file_system.delete", map[string]string{}, nil, "", nil)
+	resp, err := client.CallMCP(ctx, req)
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	if string(resp.Data) != `{"confirmed":true}` {
+		t.Errorf("resp.Data = %s, want %s", resp.Data, `{"confirmed":true}`)
+	}
+}
+
+func TestConnNotifications(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+	defer clientT.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		for i := 1; i <= 3; i++ {
+			ConnFromContext(ctx).Notify(ctx, "progress", map[string]int{"step": i})
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	})
+
+	progress := make(chan json.RawMessage, 3)
+	client := NewConn(clientT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.IsNotification() {
+			progress <- req.Params
+		}
+		return nil
+	})
+	defer client.Close()
+
+	req, _ := NewMCPRequest("long.task", map[string]string{}, nil, "", nil)
+	if _, err := client.CallMCP(ctx, req); err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	// Notifications are handled concurrently, so only the set of steps is checked
+	steps := make(map[int]bool)
+	for i := 1; i <= 3; i++ {
+		select {
+		case p := <-progress:
+			var got struct{ Step int }
+			json.Unmarshal(p, &got)
+			steps[got.Step] = true
+		case <-ctx.Done():
+			t.Fatalf("notification %d not received", i)
+		}
+	}
+	if len(steps) != 3 || !steps[1] || !steps[2] || !steps[3] {
+		t.Errorf("received steps %v, want 1, 2 and 3", steps)
+	}
+
+	// Notifications never get a response, so nothing is left unmatched on either side
+	if n := client.UnmatchedResponses(); n != 0 {
+		t.Errorf("UnmatchedResponses() = %d, want 0", n)
+	}
+}
+
+func TestConnDuplicateResponses(t *testing.T) {
+	clientT, serverT := Pipe(&PipeOptions{
+		Faults: func(toServer bool, msg []byte) PipeFault {
+			if !toServer {
+				return FaultDuplicate
+			}
+			return FaultNone
+		},
+	})
+	defer clientT.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go ServeTransport(ctx, serverT, echoHandler)
+
+	client := NewConn(clientT, nil)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		var got map[string]int
+		if err := client.Call(ctx, "echo", map[string]int{"i": i}, &got); err != nil {
+			t.Fatalf("Call() error = %v", err)
+		}
+		if got["i"] != i {
+			t.Errorf("Call() result = %v, want i=%d", got, i)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.UnmatchedResponses() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := client.UnmatchedResponses(); n != 3 {
+		t.Errorf("UnmatchedResponses() = %d, want 3", n)
+	}
+}
+
+func TestConnFailsPendingCallsWhenClosed(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var started atomic.Int32
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		started.Add(1)
+		<-ctx.Done()
+		return nil
+	})
+
+	client := NewConn(clientT, nil)
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { errs <- client.Call(ctx, "block", nil, nil) }()
+	}
+	for started.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	serverT.Close()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; !errors.Is(err, ErrConnClosed) {
+			t.Errorf("Call() error = %v, want %v", err, ErrConnClosed)
+		}
+	}
+	if err := client.Wait(); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Wait() error = %v, want %v", err, ErrTransportClosed)
+	}
+	if err := client.Call(ctx, "late", nil, nil); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Call() after close error = %v, want %v", err, ErrConnClosed)
+	}
+}
+
+func TestConnSurvivesInterruptedTransport(t *testing.T) {
+	clientPipe, serverT := Pipe(nil)
+	clientT := &interruptingTransport{PipeTransport: clientPipe, interrupt: make(chan struct{})}
+	defer clientT.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	block := make(chan struct{})
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.Action == "block" {
+			<-block
+		}
+		return echoHandler(ctx, req)
+	})
+
+	client := NewConn(clientT, nil)
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() { errs <- client.Call(ctx, "block", nil, nil) }()
+	for !client.busy() {
+		time.Sleep(time.Millisecond)
+	}
+	clientT.interrupt <- struct{}{}
+
+	var interrupted *InterruptedError
+	if err := <-errs; !errors.As(err, &interrupted) {
+		t.Fatalf("Call() error = %v, want *InterruptedError", err)
+	}
+	close(block)
+
+	var got map[string]string
+	if err := client.Call(ctx, "echo", map[string]string{"k": "v"}, &got); err != nil {
+		t.Fatalf("Call() after interruption error = %v", err)
+	}
+	if got["k"] != "v" {
+		t.Errorf("Call() result = %v, want k=v", got)
+	}
+}
+
+// gatedTransport holds every Send until gate is closed
+type gatedTransport struct {
+	*interruptingTransport
+	gate chan struct{}
+}
+
+func (t *gatedTransport) Send(ctx context.Context, msg []byte) error {
+	select {
+	case <-t.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.interruptingTransport.Send(ctx, msg)
+}
+
+func TestConnDoesNotSendCallsFailedByInterruption(t *testing.T) {
+	clientPipe, serverT := Pipe(nil)
+	clientT := &gatedTransport{
+		interruptingTransport: &interruptingTransport{PipeTransport: clientPipe, interrupt: make(chan struct{})},
+		gate:                  make(chan struct{}),
+	}
+	defer clientT.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var received atomic.Int32
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		received.Add(1)
+		return echoHandler(ctx, req)
+	})
+
+	client := NewConn(clientT, nil)
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() { errs <- client.Call(ctx, "write", nil, nil) }()
+	for !client.busy() {
+		time.Sleep(time.Millisecond)
+	}
+	clientT.interrupt <- struct{}{}
+	if err := <-errs; !errors.Is(err, ErrOutcomeUnknown) {
+		t.Fatalf("Call() waiting to be sent error = %v, want %v", err, ErrOutcomeUnknown)
+	}
+
+	close(clientT.gate)
+	if err := client.Call(ctx, "echo", nil, nil); err != nil {
+		t.Fatalf("Call() after interruption error = %v", err)
+	}
+	if n := received.Load(); n != 1 {
+		t.Errorf("server received %d requests, want only the call made after the interruption", n)
+	}
+}
+
+func TestIDKey(t *testing.T) {
+	tests := []struct {
+		a, b  interface{}
+		equal bool
+	}{
+		{a: int64(7), b: float64(7), equal: true},
+		{a: 7, b: int64(7), equal: true},
+		{a: "7", b: float64(7), equal: false},
+		{a: "abc", b: "abc", equal: true},
+		{a: float64(1.5), b: float64(1.5), equal: true},
+		{a: int32(7), b: float64(7), equal: true},
+		{a: uint(7), b: float64(7), equal: true},
+		{a: uint64(1 << 63), b: float64(1 << 63), equal: true},
+		{a: json.Number("7"), b: float64(7), equal: true},
+		{a: json.Number("7.0"), b: int8(7), equal: true},
+		{a: json.Number("1.5"), b: float32(1.5), equal: true},
+		{a: json.Number("7"), b: "7", equal: false},
+		{a: -7, b: uint(7), equal: false},
+	}
+
+	for _, tt := range tests {
+		a, _ := idKey(tt.a)
+		b, _ := idKey(tt.b)
+		if (a == b) != tt.equal {
+			t.Errorf("idKey(%#v) = %q, idKey(%#v) = %q, want equal %v", tt.a, a, tt.b, b, tt.equal)
+		}
+	}
+	if _, ok := idKey(nil); ok {
+		t.Error("idKey(nil) ok = true, want false")
+	}
+}
+
+func TestConnDuplicateIDs(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+	defer clientT.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	block := make(chan struct{})
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.Action == "block" {
+			<-block
+		}
+		return echoHandler(ctx, req)
+	})
+
+	client := NewConn(clientT, nil)
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.CallMCP(ctx, &MCPRequest{Action: "block", ID: int32(1)})
+		errs <- err
+	}()
+	for !client.busy() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := client.CallMCP(ctx, &MCPRequest{Action: "echo", ID: json.Number("1")}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("CallMCP() with an id in flight error = %v, want %v", err, ErrDuplicateID)
+	}
+	if err := client.Call(ctx, "echo", nil, nil); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Call() whose generated id is in flight error = %v, want %v", err, ErrDuplicateID)
+	}
+	batch := client.Batch()
+	call := batch.Call("echo", nil, nil)
+	batch.Call("echo", nil, nil)
+	if err := batch.Send(ctx); err != nil || call.Wait(ctx) != nil {
+		t.Errorf("Batch.Send() with fresh ids error = %v, %v", err, call.Wait(ctx))
+	}
+
+	close(block)
+	if err := <-errs; err != nil {
+		t.Errorf("CallMCP() of the first call error = %v, want its own response", err)
+	}
+	if err := client.Call(ctx, "echo", nil, nil); err != nil {
+		t.Errorf("Call() once the id is free error = %v", err)
+	}
+}
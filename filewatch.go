@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// statFile returns the stamp of the file at path
+func statFile(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{mod: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// watchedFile tracks the version of a file loaded from disk and reads it again when it changes
+//
+// It is not safe for concurrent use, its owner serializes calls under its own lock.
+type watchedFile struct {
+	path    string
+	refresh time.Duration
+	now     func() time.Time
+
+	stamp   fileStamp
+	loaded  bool
+	checked time.Time
+}
+
+// due reports whether the refresh interval elapsed since the file was last checked
+func (w *watchedFile) due() bool {
+	return w.since() >= w.refresh
+}
+
+// since returns the time elapsed since the file was last checked
+func (w *watchedFile) since() time.Duration {
+	return w.now().Sub(w.checked)
+}
+
+// reload passes the contents of the file to parse when it changed since the last successful
+// parse
+//
+// A file that fails to parse keeps the previous version in use and is read again on the next
+// check.
+func (w *watchedFile) reload(parse func(data []byte) error) error {
+	w.checked = w.now()
+	stamp, err := statFile(w.path)
+	if err != nil {
+		return err
+	}
+	if w.loaded && stamp == w.stamp {
+		return nil
+	}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	if err := parse(data); err != nil {
+		return err
+	}
+	w.stamp, w.loaded = stamp, true
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchedFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(doc string) {
+		if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var parsed []string
+	parse := func(data []byte) error {
+		parsed = append(parsed, string(data))
+		if string(data) == "invalid" {
+			return errors.New("invalid")
+		}
+		return nil
+	}
+
+	w := &watchedFile{path: path, refresh: time.Minute, now: time.Now}
+	write("v1")
+	if err := w.reload(parse); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if err := w.reload(parse); err != nil || len(parsed) != 1 {
+		t.Errorf("reload() of an unchanged file parsed %q, %v, want it skipped", parsed, err)
+	}
+
+	write("invalid")
+	if err := w.reload(parse); err == nil {
+		t.Error("reload() of an invalid file error = nil")
+	}
+	if err := w.reload(parse); err == nil || len(parsed) != 3 {
+		t.Errorf("reload() after a failed parse parsed %q, %v, want the file read again", parsed, err)
+	}
+
+	write("version 2")
+	if err := w.reload(parse); err != nil || parsed[len(parsed)-1] != "version 2" {
+		t.Errorf("reload() of a changed file parsed %q, %v, want the new contents", parsed, err)
+	}
+
+	os.Remove(path)
+	if err := w.reload(parse); err == nil {
+		t.Error("reload() of a missing file error = nil")
+	}
+}
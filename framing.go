@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+)
+
+// Framing selects how messages are delimited on a byte stream
+type Framing int
+
+// Supported framings
+const (
+	// NewlineFraming terminates each message with '\n', the default for stdio
+	NewlineFraming Framing = iota
+	// LengthPrefixFraming precedes each message with its length as a 4-byte big-endian integer.
+	// The top bit of the length marks binary payloads sent next to the JSON messages, the next
+	// one the fragments of a streamed message.
+	LengthPrefixFraming
+)
+
+// Flags of the length prefix
+const (
+	// binaryFrameFlag marks a binary payload
+	binaryFrameFlag = 1 << 31
+	// fragmentFrameFlag marks a fragment of a streamed message, an empty fragment completes the
+	// message and an empty fragment also flagged binary abandons it. Other messages may be sent
+	// between the fragments.
+	fragmentFrameFlag = 1 << 30
+)
+
+// DefaultMaxMessageSize is the message size limit used when none is configured
+const DefaultMaxMessageSize = 16 << 20
+
+// ErrMessageTooLarge is returned when a framed message exceeds the size limit
+var ErrMessageTooLarge = errors.New("message too large")
+
+// FrameReader reads whole messages from a byte stream
+type FrameReader struct {
+	br      *bufio.Reader
+	framing Framing
+	maxSize int
+	// partial holds the fragments of a streamed message received so far
+	partial []byte
+}
+
+// NewFrameReader creates a FrameReader, a maxSize of zero uses DefaultMaxMessageSize
+func NewFrameReader(r io.Reader, framing Framing, maxSize int) *FrameReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	return &FrameReader{br: bufio.NewReader(r), framing: framing, maxSize: maxSize}
+}
+
+// ReadMessage returns the next message, skipping blank lines in newline framing and binary payloads
+func (r *FrameReader) ReadMessage() ([]byte, error) {
+	for {
+		msg, binary, err := r.ReadFrame()
+		if err != nil || !binary {
+			return msg, err
+		}
+	}
+}
+
+// ReadFrame returns the next message or binary payload, binary being set for the latter
+func (r *FrameReader) ReadFrame() (msg []byte, binary bool, err error) {
+	if r.framing == LengthPrefixFraming {
+		return r.readLengthPrefixed()
+	}
+	msg, err = r.readLine()
+	return msg, false, err
+}
+
+// readLine reads a single newline terminated message
+func (r *FrameReader) readLine() ([]byte, error) {
+	var msg []byte
+	for {
+		chunk, err := r.br.ReadSlice('\n')
+		if len(msg)+len(chunk) > r.maxSize+1 {
+			return nil, ErrMessageTooLarge
+		}
+		msg = append(msg, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(bytes.TrimSpace(msg)) == 0) {
+			return nil, err
+		}
+
+		msg = bytes.TrimRight(msg, "\r\n")
+		if len(bytes.TrimSpace(msg)) == 0 {
+			msg = msg[:0]
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// readLengthPrefixed reads a single length prefixed message or binary payload, reassembling
+// the fragments of streamed messages
+func (r *FrameReader) readLengthPrefixed() ([]byte, bool, error) {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r.br, header[:]); err != nil {
+			return nil, false, err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		flags := n & (binaryFrameFlag | fragmentFrameFlag)
+		n &^= binaryFrameFlag | fragmentFrameFlag
+		limit := r.maxSize
+		if flags&fragmentFrameFlag != 0 {
+			limit -= len(r.partial)
+		}
+		if uint64(n) > uint64(limit) {
+			return nil, false, ErrMessageTooLarge
+		}
+
+		var msg []byte
+		fragment := flags == fragmentFrameFlag
+		if fragment {
+			r.partial = slices.Grow(r.partial, int(n))
+			msg = r.partial[len(r.partial) : len(r.partial)+int(n)]
+		} else {
+			msg = make([]byte, n)
+		}
+		if _, err := io.ReadFull(r.br, msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, false, err
+		}
+
+		switch {
+		case flags&fragmentFrameFlag == 0:
+			return msg, flags != 0, nil
+		case fragment && n > 0:
+			r.partial = r.partial[:len(r.partial)+int(n)]
+		case fragment:
+			msg, r.partial = r.partial, nil
+			return msg, false, nil
+		default:
+			// The producer of the streamed message failed, drop what arrived of it
+			r.partial = nil
+		}
+	}
+}
+
+// FrameWriter writes whole messages to a byte stream, it is safe for concurrent use
+type FrameWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	framing Framing
+	gate    streamGate
+}
+
+// NewFrameWriter creates a FrameWriter
+func NewFrameWriter(w io.Writer, framing Framing) *FrameWriter {
+	fw := &FrameWriter{w: w, framing: framing}
+	fw.gate.idle = sync.NewCond(&fw.mu)
+	return fw
+}
+
+// WriteMessage writes msg with its framing in a single write
+//
+// With newline framing, JSON messages containing newlines are compacted first, and messages
+// written while a streamed message is partly written follow it.
+func (w *FrameWriter) WriteMessage(msg []byte) error {
+	if w.framing != LengthPrefixFraming && bytes.ContainsAny(msg, "\r\n") {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, msg); err != nil {
+			return err
+		}
+		msg = buf.Bytes()
+	}
+	frame, err := w.frame(msg)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.framing != LengthPrefixFraming && w.gate.hold(frame) {
+		return nil
+	}
+	_, err = w.w.Write(frame)
+	return err
+}
+
+// frame returns msg with its framing
+func (w *FrameWriter) frame(msg []byte) ([]byte, error) {
+	if w.framing != LengthPrefixFraming {
+		frame := make([]byte, 0, len(msg)+1)
+		frame = append(frame, msg...)
+		return append(frame, '\n'), nil
+	}
+	if uint64(len(msg)) >= fragmentFrameFlag {
+		return nil, ErrMessageTooLarge
+	}
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	return append(frame, msg...), nil
+}
+
+// WriteBinary writes a binary payload in a single write, which only length prefix framing supports
+func (w *FrameWriter) WriteBinary(data []byte) error {
+	if w.framing != LengthPrefixFraming {
+		return ErrBinaryUnsupported
+	}
+	if uint64(len(data)) >= fragmentFrameFlag {
+		return ErrMessageTooLarge
+	}
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data))|binaryFrameFlag)
+	frame = append(frame, data...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.w.Write(frame)
+	return err
+}
+
+// WriteStream writes the message produced by write with its framing, as write produces it
+//
+// A message shorter than streamChunkSize is written in a single frame once write returned and
+// nothing is written when write fails. Longer messages are written in chunks while write runs:
+// with length prefix framing as fragments between which other messages can still be sent, and
+// a failure of write abandons the fragments; with newline framing as one line, with raw newlines
+// replaced by spaces, that other messages follow, and a failure of write ends the line short.
+// write is called without the lock held, so it may send other messages on the same writer.
+func (w *FrameWriter) WriteStream(write func(io.Writer) error) error {
+	started := false
+	cw := &chunkWriter{flush: func(p []byte) error {
+		var frame []byte
+		if w.framing == LengthPrefixFraming {
+			frame = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(p)), uint32(len(p))|fragmentFrameFlag)
+		}
+		frame = append(frame, p...)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if !started {
+			w.gate.begin()
+			started = true
+		}
+		_, err := w.w.Write(frame)
+		return err
+	}}
+	var out io.Writer = cw
+	if w.framing != LengthPrefixFraming {
+		out = lineWriter{cw}
+	}
+	err := write(out)
+	if err == nil {
+		err = cw.err
+	}
+
+	if !started {
+		if err != nil {
+			return err
+		}
+		frame, err := w.frame(cw.buf)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.framing != LengthPrefixFraming && w.gate.hold(frame) {
+			return nil
+		}
+		_, err = w.w.Write(frame)
+		return err
+	}
+
+	var end []byte
+	switch {
+	case w.framing != LengthPrefixFraming:
+		end = append(cw.buf, '\n')
+	case err != nil:
+		end = binary.BigEndian.AppendUint32(nil, fragmentFrameFlag|binaryFrameFlag)
+	default:
+		if len(cw.buf) > 0 {
+			end = binary.BigEndian.AppendUint32(end, uint32(len(cw.buf))|fragmentFrameFlag)
+			end = append(end, cw.buf...)
+		}
+		end = binary.BigEndian.AppendUint32(end, fragmentFrameFlag)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, werr := w.w.Write(end)
+	for _, frame := range w.gate.end() {
+		if werr == nil {
+			_, werr = w.w.Write(frame)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// lineWriter replaces raw newlines with spaces so that a message stays on one line
+type lineWriter struct {
+	w io.Writer
+}
+
+// Write writes p with its newlines replaced
+func (l lineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			m, err := l.w.Write(p)
+			return n + m, err
+		}
+		m, err := l.w.Write(p[:i])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if _, err := io.WriteString(l.w, " "); err != nil {
+			return n, err
+		}
+		n++
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// StreamTransport is a Transport over a pair of byte streams such as stdin and stdout
+//
+// With length prefix framing it is also a BinaryTransport.
+type StreamTransport struct {
+	r       *FrameReader
+	w       *FrameWriter
+	framing Framing
+	conn    net.Conn
+
+	closers []io.Closer
+	msgs    chan []byte
+	binary  chan []byte
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	releaseOnce sync.Once
+	errMu       sync.Mutex
+	err         error
+}
+
+// NewStreamTransport creates a transport reading messages from r and writing them to w
+//
+// Close closes r and w when they implement io.Closer.
+func NewStreamTransport(r io.Reader, w io.Writer, framing Framing) *StreamTransport {
+	return newStreamTransport(r, w, framing, 0)
+}
+
+// newStreamTransport creates a StreamTransport with a custom message size limit
+func newStreamTransport(r io.Reader, w io.Writer, framing Framing, maxSize int) *StreamTransport {
+	t := &StreamTransport{
+		r:       NewFrameReader(r, framing, maxSize),
+		w:       NewFrameWriter(w, framing),
+		framing: framing,
+		msgs:    make(chan []byte),
+		binary:  make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+	if c, ok := r.(net.Conn); ok {
+		t.conn = c
+	}
+	if c, ok := r.(io.Closer); ok {
+		t.closers = append(t.closers, c)
+	}
+	if c, ok := w.(io.Closer); ok && interface{}(w) != interface{}(r) {
+		t.closers = append(t.closers, c)
+	}
+	go t.readLoop()
+	return t
+}
+
+// Send writes msg to the underlying writer
+func (t *StreamTransport) Send(ctx context.Context, msg []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-t.done:
+		return t.Err()
+	default:
+	}
+	return t.w.WriteMessage(msg)
+}
+
+// TLSConnectionState returns the TLS state when the stream is a TLS connection
+func (t *StreamTransport) TLSConnectionState() (tls.ConnectionState, bool) {
+	if c, ok := t.conn.(*tls.Conn); ok {
+		return c.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// RemoteAddr returns the address of the peer when the stream is a network connection, or nil
+func (t *StreamTransport) RemoteAddr() net.Addr {
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.RemoteAddr()
+}
+
+// Receive returns the next message read from the underlying reader
+func (t *StreamTransport) Receive(ctx context.Context) ([]byte, error) {
+	return t.receive(ctx, t.msgs)
+}
+
+// SendStream writes the message produced by write to the underlying writer as it is produced,
+// see FrameWriter.WriteStream
+func (t *StreamTransport) SendStream(ctx context.Context, write func(w io.Writer) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-t.done:
+		return t.Err()
+	default:
+	}
+	return t.w.WriteStream(write)
+}
+
+// SendBinary writes a binary payload, it fails with ErrBinaryUnsupported in newline framing
+func (t *StreamTransport) SendBinary(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-t.done:
+		return t.Err()
+	default:
+	}
+	return t.w.WriteBinary(data)
+}
+
+// ReceiveBinary returns the next binary payload read from the underlying reader
+func (t *StreamTransport) ReceiveBinary(ctx context.Context) ([]byte, error) {
+	return t.receive(ctx, t.binary)
+}
+
+// binaryEnabled reports whether the framing can carry binary payloads
+func (t *StreamTransport) binaryEnabled() bool {
+	return t.framing == LengthPrefixFraming
+}
+
+// receive returns the next item of ch
+func (t *StreamTransport) receive(ctx context.Context, ch chan []byte) ([]byte, error) {
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-t.done:
+		return nil, t.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the underlying streams
+func (t *StreamTransport) Close() error {
+	t.shutdown(ErrTransportClosed)
+	var err error
+	t.releaseOnce.Do(func() {
+		for _, c := range t.closers {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Err returns the error that terminated the transport, or nil while it is open
+func (t *StreamTransport) Err() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return t.err
+}
+
+// shutdown records err and stops the transport
+func (t *StreamTransport) shutdown(err error) {
+	t.closeOnce.Do(func() {
+		t.errMu.Lock()
+		t.err = err
+		t.errMu.Unlock()
+		close(t.done)
+	})
+}
+
+// readLoop reads messages until the stream fails
+func (t *StreamTransport) readLoop() {
+	for {
+		msg, binary, err := t.r.ReadFrame()
+		if err != nil {
+			t.shutdown(err)
+			return
+		}
+		ch := t.msgs
+		if binary {
+			ch = t.binary
+		}
+		select {
+		case ch <- msg:
+		case <-t.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing Framing
+	}{
+		{name: "newline framing", framing: NewlineFraming},
+		{name: "length prefix framing", framing: LengthPrefixFraming},
+	}
+
+	messages := [][]byte{
+		[]byte(`{"action":"file_system.read","params":{}}`),
+		[]byte(`{"action":"echo","params":{"text":"` + strings.Repeat("x", 10000) + `"}}`),
+		[]byte(`{}`),
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewFrameWriter(&buf, tt.framing)
+			for _, msg := range messages {
+				if err := w.WriteMessage(msg); err != nil {
+					t.Fatalf("WriteMessage() error = %v", err)
+				}
+			}
+
+			r := NewFrameReader(&buf, tt.framing, 0)
+			for _, want := range messages {
+				got, err := r.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("ReadMessage() = %q, want %q", got, want)
+				}
+			}
+			if _, err := r.ReadMessage(); err != io.EOF {
+				t.Errorf("ReadMessage() at end error = %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestFrameReaderNewline(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		maxSize int
+		want    []string
+		wantErr error
+	}{
+		{
+			name:  "skips blank lines and carriage returns",
+			input: "\n{\"a\":1}\r\n\n  \n{\"b\":2}\n",
+			want:  []string{`{"a":1}`, `{"b":2}`},
+		},
+		{
+			name:  "last message without newline",
+			input: `{"a":1}`,
+			want:  []string{`{"a":1}`},
+		},
+		{
+			name:    "message too large",
+			input:   `{"a":"0123456789"}` + "\n",
+			maxSize: 8,
+			wantErr: ErrMessageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewFrameReader(strings.NewReader(tt.input), NewlineFraming, tt.maxSize)
+			for _, want := range tt.want {
+				got, err := r.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v", err)
+				}
+				if string(got) != want {
+					t.Errorf("ReadMessage() = %q, want %q", got, want)
+				}
+			}
+			if tt.wantErr != nil {
+				if _, err := r.ReadMessage(); err != tt.wantErr {
+					t.Errorf("ReadMessage() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameReaderLengthPrefixErrors(t *testing.T) {
+	r := NewFrameReader(bytes.NewReader([]byte{0, 0, 1, 0, 'x'}), LengthPrefixFraming, 16)
+	if _, err := r.ReadMessage(); err != ErrMessageTooLarge {
+		t.Errorf("ReadMessage() error = %v, want %v", err, ErrMessageTooLarge)
+	}
+
+	r = NewFrameReader(bytes.NewReader([]byte{0, 0, 0, 4, 'x'}), LengthPrefixFraming, 16)
+	if _, err := r.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadMessage() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestFrameWriterCompactsNewlines(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewFrameWriter(&buf, NewlineFraming)
+	if err := w.WriteMessage([]byte("{\n  \"a\": 1\n}")); err != nil {
+		t.Fatalf("WriteMessage() error = %v", err)
+	}
+	if got, want := buf.String(), "{\"a\":1}\n"; got != want {
+		t.Errorf("written = %q, want %q", got, want)
+	}
+
+	if err := w.WriteMessage([]byte("not\njson")); err == nil {
+		t.Error("WriteMessage() error = nil, want error for non-JSON message with newline")
+	}
+}
+
+func TestStreamTransport(t *testing.T) {
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	client := NewStreamTransport(clientRead, clientWrite, NewlineFraming)
+	server := NewStreamTransport(serverRead, serverWrite, NewlineFraming)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go client.Send(ctx, []byte(`{"action":"ping"}`))
+	msg, err := server.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if string(msg) != `{"action":"ping"}` {
+		t.Errorf("Receive() = %s, want %s", msg, `{"action":"ping"}`)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := client.Receive(ctx); err == nil {
+		t.Error("Receive() after peer close error = nil, want error")
+	}
+	if err := server.Send(ctx, []byte(`{}`)); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Send() after close error = %v, want %v", err, ErrTransportClosed)
+	}
+
+	short, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	idleRead, _ := io.Pipe()
+	idle := NewStreamTransport(idleRead, io.Discard, NewlineFraming)
+	defer idle.Close()
+	if _, err := idle.Receive(short); err != context.DeadlineExceeded {
+		t.Errorf("Receive() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFrameBinary(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewFrameWriter(&buf, LengthPrefixFraming)
+	w.WriteMessage([]byte(`{"a":1}`))
+	w.WriteBinary([]byte{0x89, 'P', 'N', 'G'})
+	w.WriteMessage([]byte(`{"b":2}`))
+
+	r := NewFrameReader(bytes.NewReader(buf.Bytes()), LengthPrefixFraming, 0)
+	for _, want := range []struct {
+		msg    string
+		binary bool
+	}{{`{"a":1}`, false}, {"\x89PNG", true}, {`{"b":2}`, false}} {
+		msg, binary, err := r.ReadFrame()
+		if err != nil || string(msg) != want.msg || binary != want.binary {
+			t.Errorf("ReadFrame() = %q, %v, %v, want %q, %v", msg, binary, err, want.msg, want.binary)
+		}
+	}
+
+	r = NewFrameReader(bytes.NewReader(buf.Bytes()), LengthPrefixFraming, 0)
+	for _, want := range []string{`{"a":1}`, `{"b":2}`} {
+		if msg, err := r.ReadMessage(); err != nil || string(msg) != want {
+			t.Errorf("ReadMessage() = %q, %v, want %q with the binary frame skipped", msg, err, want)
+		}
+	}
+
+	if err := NewFrameWriter(io.Discard, NewlineFraming).WriteBinary([]byte("x")); !errors.Is(err, ErrBinaryUnsupported) {
+		t.Errorf("WriteBinary() with newline framing error = %v, want %v", err, ErrBinaryUnsupported)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// IdempotencyRecord is a completed response stored under an idempotency key
+type IdempotencyRecord struct {
+	// Fingerprint identifies the action and params of the original request
+	Fingerprint string
+	// Response is the response sent for the original request
+	Response *MCPResponse
+}
+
+// IdempotencyStore persists completed responses per idempotency key
+//
+// Keys are scoped by the middleware, they are the escaped principal ID, a colon and the key sent
+// by the client. Implementations must be safe for concurrent use. Requests in flight are tracked by the
+// middleware itself, a store only holds completed responses.
+type IdempotencyStore interface {
+	// Load returns the record stored under key, or nil when there is none or it expired
+	Load(ctx context.Context, key string) (*IdempotencyRecord, error)
+	// Store saves rec under key for ttl
+	Store(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error
+}
+
+// IdempotencyConfig configures the Idempotency middleware
+type IdempotencyConfig struct {
+	// Store holds completed responses, nil uses a new MemoryIdempotencyStore
+	Store IdempotencyStore
+	// TTL is how long a completed response is kept, zero uses 24h
+	TTL time.Duration
+}
+
+// Idempotency returns a middleware that runs each request carrying an idempotency_key at most once
+//
+// A duplicate of a completed request gets the stored response back, marked with the
+// idempotent_replay metadata, and a duplicate that arrives while the original is still in flight
+// waits for the original's result. Reusing a key for a different action or different params is
+// answered with a CONFLICT error. Retryable error responses, such as TIMEOUT_ERROR, are not
+// stored so the retry can run the action again. Keys are scoped to the principal authenticated by
+// Authenticate, so principals cannot replay each other's responses by reusing a key.
+func Idempotency(cfg *IdempotencyConfig) Middleware {
+	var c IdempotencyConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.Store == nil {
+		c.Store = NewMemoryIdempotencyStore()
+	}
+	if c.TTL <= 0 {
+		c.TTL = 24 * time.Hour
+	}
+
+	d := &deduplicator{cfg: c, inflight: make(map[string]*inflightRequest)}
+	return func(next MCPHandler) MCPHandler {
+		return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+			key := req.IdempotencyKey()
+			if key == "" {
+				return next(ctx, req)
+			}
+			return d.serve(ctx, scopedIdempotencyKey(ctx, key), key, req, next)
+		}
+	}
+}
+
+// deduplicator tracks the requests in flight per idempotency key
+type deduplicator struct {
+	cfg IdempotencyConfig
+
+	mu       sync.Mutex
+	inflight map[string]*inflightRequest
+}
+
+// inflightRequest is the first request seen for an idempotency key
+type inflightRequest struct {
+	fingerprint string
+	done        chan struct{}
+	resp        *MCPResponse
+}
+
+// scopedIdempotencyKey returns the key under which requests with the idempotency key are tracked
+// and stored, the escaped principal ID followed by the key
+func scopedIdempotencyKey(ctx context.Context, key string) string {
+	var id string
+	if p := PrincipalFromContext(ctx); p != nil {
+		id = p.ID
+	}
+	return url.QueryEscape(id) + ":" + key
+}
+
+// serve runs req once per scoped key and hands the result to every duplicate, key is the
+// idempotency key as sent by the client
+func (d *deduplicator) serve(ctx context.Context, scoped, key string, req *MCPRequest, next MCPHandler) *MCPResponse {
+	fingerprint := requestFingerprint(req)
+
+	d.mu.Lock()
+	if first, ok := d.inflight[scoped]; ok {
+		d.mu.Unlock()
+		select {
+		case <-first.done:
+		case <-ctx.Done():
+			e, _ := NewMCPError(MCPErrorTimeout, ErrMCPExecutionFailed, "Gave up waiting for the original request", nil)
+			return NewMCPErrorResponse(e, nil, req.ID)
+		}
+		return replayResponse(key, fingerprint, &IdempotencyRecord{Fingerprint: first.fingerprint, Response: first.resp}, req)
+	}
+	first := &inflightRequest{fingerprint: fingerprint, done: make(chan struct{})}
+	d.inflight[scoped] = first
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.inflight, scoped)
+		d.mu.Unlock()
+		close(first.done)
+	}()
+
+	rec, err := d.cfg.Store.Load(ctx, scoped)
+	if err != nil {
+		first.resp = NewMCPErrorResponse(StdError(ErrInternal), nil, req.ID)
+		return first.resp
+	}
+	if rec != nil {
+		first.fingerprint = rec.Fingerprint
+		first.resp = rec.Response
+		return replayResponse(key, fingerprint, rec, req)
+	}
+
+	resp := bufferResponse(callHandler(ctx, req, next))
+	first.resp = cloneResponse(resp)
+	if resp.Error == nil || !IsRetryable(resp.Error) {
+		_ = d.cfg.Store.Store(context.WithoutCancel(ctx), scoped, &IdempotencyRecord{Fingerprint: fingerprint, Response: first.resp}, d.cfg.TTL)
+	}
+	return resp
+}
+
+// replayResponse returns a copy of the stored response for a duplicate of the original request
+func replayResponse(key, fingerprint string, rec *IdempotencyRecord, req *MCPRequest) *MCPResponse {
+	if rec.Fingerprint != fingerprint {
+		e, _ := NewMCPError(MCPErrorConflict, ErrInvalidRequest, "Idempotency key reused with a different request", map[string]string{
+			MetadataIdempotencyKey: key,
+		})
+		return NewMCPErrorResponse(e, nil, req.ID)
+	}
+	resp := cloneResponse(rec.Response)
+	if resp.Metadata == nil {
+		resp.Metadata = make(map[string]interface{})
+	}
+	resp.Metadata[MetadataIdempotentReplay] = true
+	return resp
+}
+
+// cloneResponse copies resp so the caller can stamp it without affecting other copies
+func cloneResponse(resp *MCPResponse) *MCPResponse {
+	if resp == nil {
+		return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+	}
+	c := *resp
+	if resp.Metadata != nil {
+		c.Metadata = make(map[string]interface{}, len(resp.Metadata))
+		for k, v := range resp.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	return &c
+}
+
+// requestFingerprint hashes the parts of a request that must match for a replay
+func requestFingerprint(req *MCPRequest) string {
+	h := sha256.New()
+	h.Write([]byte(req.Action))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Tool))
+	h.Write([]byte{0})
+	dec := json.NewDecoder(bytes.NewReader(req.Params))
+	dec.UseNumber()
+	var params interface{}
+	if dec.Decode(&params) == nil {
+		// Re-encode so that whitespace and key order do not matter, numbers keep their exact text
+		canonical, _ := json.Marshal(params)
+		h.Write(canonical)
+	} else {
+		h.Write(req.Params)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// MemoryIdempotencyStore is an in-memory IdempotencyStore
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]memoryRecord
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+// memoryRecord is a stored record with its expiry time
+type memoryRecord struct {
+	rec     *IdempotencyRecord
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore creates an empty in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: make(map[string]memoryRecord), now: time.Now}
+}
+
+// Load returns the record stored under key, or nil when there is none or it expired
+func (s *MemoryIdempotencyStore) Load(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[key]
+	if !ok {
+		return nil, nil
+	}
+	if !s.now().Before(r.expires) {
+		delete(s.records, key)
+		return nil, nil
+	}
+	return r.rec, nil
+}
+
+// Store saves rec under key for ttl, expired records are dropped at most once a minute
+func (s *MemoryIdempotencyStore) Store(ctx context.Context, key string, rec *IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastSweep) >= time.Minute {
+		s.lastSweep = now
+		for k, r := range s.records {
+			if !now.Before(r.expires) {
+				delete(s.records, k)
+			}
+		}
+	}
+	s.records[key] = memoryRecord{rec: rec, expires: now.Add(ttl)}
+	return nil
+}
+
+// Len returns the number of records held, including expired ones not dropped yet
+func (s *MemoryIdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
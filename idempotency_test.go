@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// keyedRequest builds a request carrying an idempotency key
+func keyedRequest(key string, params string, id interface{}) *MCPRequest {
+	return &MCPRequest{
+		Action:   "file_system.write",
+		Params:   json.RawMessage(params),
+		Metadata: map[string]interface{}{MetadataIdempotencyKey: key},
+		ID:       id,
+	}
+}
+
+func TestIdempotencyReplaysCompletedRequests(t *testing.T) {
+	var runs atomic.Int32
+	h := Chain(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]int32{"run": runs.Add(1)}, nil, nil)
+		return resp
+	}, Idempotency(nil))
+
+	first := dispatchRequest(context.Background(), keyedRequest("k1", `{"path":"/a"}`, 1), h)
+	second := dispatchRequest(context.Background(), keyedRequest("k1", `{ "path" : "/a" }`, 2), h)
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+	if string(second.Data) != string(first.Data) {
+		t.Errorf("replayed data = %s, want %s", second.Data, first.Data)
+	}
+	if second.ID != 2 {
+		t.Errorf("replayed ID = %v, want the ID of the duplicate", second.ID)
+	}
+	if second.Metadata[MetadataIdempotentReplay] != true || first.Metadata[MetadataIdempotentReplay] != nil {
+		t.Errorf("replay markers = %v / %v, want only the duplicate marked", first.Metadata, second.Metadata)
+	}
+
+	dispatchRequest(context.Background(), keyedRequest("k2", `{"path":"/a"}`, 3), h)
+	dispatchRequest(context.Background(), &MCPRequest{Action: "file_system.write", ID: 4}, h)
+	if n := runs.Load(); n != 3 {
+		t.Errorf("handler ran %d times, want 3 for a new key and a request without key", n)
+	}
+}
+
+func TestIdempotencyWaitsForInFlightOriginal(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var runs atomic.Int32
+	h := Chain(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		runs.Add(1)
+		close(started)
+		<-release
+		resp, _ := NewMCPResponse(MCPStatusSuccess, "written", nil, nil)
+		return resp
+	}, Idempotency(nil))
+
+	resps := make([]*MCPResponse, 3)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resps[0] = dispatchRequest(context.Background(), keyedRequest("k", `{}`, 0), h)
+	}()
+	<-started
+	for i := 1; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i] = dispatchRequest(context.Background(), keyedRequest("k", `{}`, i), h)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 1 {
+		t.Errorf("handler ran %d times, want 1", n)
+	}
+	for i, resp := range resps {
+		if resp.Status != MCPStatusSuccess || string(resp.Data) != `"written"` || resp.ID != i {
+			t.Errorf("response %d = %+v, want the original result with ID %d", i, resp, i)
+		}
+	}
+}
+
+func TestIdempotencyConflict(t *testing.T) {
+	h := Chain(echoHandler, Idempotency(nil))
+
+	dispatchRequest(context.Background(), keyedRequest("k", `{"path":"/a"}`, 1), h)
+	resp := dispatchRequest(context.Background(), keyedRequest("k", `{"path":"/b"}`, 2), h)
+	if resp.Error == nil || resp.Error.Type != MCPErrorConflict {
+		t.Errorf("resp.Error = %v, want %s", resp.Error, MCPErrorConflict)
+	}
+}
+
+func TestIdempotencyConflictOnLargeNumbers(t *testing.T) {
+	h := Chain(echoHandler, Idempotency(nil))
+
+	dispatchRequest(context.Background(), keyedRequest("k", `{"amount":9007199254740993}`, 1), h)
+	resp := dispatchRequest(context.Background(), keyedRequest("k", `{"amount":9007199254740992}`, 2), h)
+	if resp.Error == nil || resp.Error.Type != MCPErrorConflict {
+		t.Errorf("resp.Error = %v, want %s for numbers that differ beyond float64 precision", resp.Error, MCPErrorConflict)
+	}
+}
+
+func TestIdempotencyKeysScopedByPrincipal(t *testing.T) {
+	var runs atomic.Int32
+	h := Chain(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]interface{}{"run": runs.Add(1), "principal": PrincipalFromContext(ctx).ID}, nil, nil)
+		return resp
+	}, Idempotency(nil))
+
+	alice := WithPrincipal(context.Background(), &Principal{ID: "alice"})
+	bob := WithPrincipal(context.Background(), &Principal{ID: "bob"})
+	dispatchRequest(alice, keyedRequest("k", `{}`, 1), h)
+	resp := dispatchRequest(bob, keyedRequest("k", `{}`, 2), h)
+	if runs.Load() != 2 || resp.Metadata[MetadataIdempotentReplay] != nil {
+		t.Errorf("another principal's duplicate key = %s after %d runs, want its own run", resp.Data, runs.Load())
+	}
+	if resp := dispatchRequest(alice, keyedRequest("k", `{}`, 3), h); resp.Metadata[MetadataIdempotentReplay] != true || runs.Load() != 2 {
+		t.Errorf("same principal's duplicate key = %s after %d runs, want a replay", resp.Data, runs.Load())
+	}
+}
+
+func TestIdempotencyDoesNotStoreRetryableErrors(t *testing.T) {
+	var runs atomic.Int32
+	h := Chain(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if runs.Add(1) == 1 {
+			return NewMCPErrorResponse(mcpError(MCPErrorTimeout, nil), nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	}, Idempotency(nil))
+
+	dispatchRequest(context.Background(), keyedRequest("k", `{}`, 1), h)
+	resp := dispatchRequest(context.Background(), keyedRequest("k", `{}`, 2), h)
+	if resp.Status != MCPStatusSuccess || runs.Load() != 2 {
+		t.Errorf("retry status = %v after %d runs, want success after 2 runs", resp.Status, runs.Load())
+	}
+}
+
+func TestMemoryIdempotencyStoreTTL(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store.now = clock.Now
+	ctx := context.Background()
+
+	rec := &IdempotencyRecord{Fingerprint: "f"}
+	store.Store(ctx, "a", rec, time.Minute)
+	if got, _ := store.Load(ctx, "a"); got != rec {
+		t.Errorf("Load() = %v, want stored record", got)
+	}
+
+	clock.Advance(time.Minute)
+	if got, _ := store.Load(ctx, "a"); got != nil {
+		t.Errorf("Load() after TTL = %v, want nil", got)
+	}
+
+	store.Store(ctx, "b", rec, time.Second)
+	clock.Advance(2 * time.Minute)
+	store.Store(ctx, "c", rec, time.Minute)
+	if n := store.Len(); n != 1 {
+		t.Errorf("Len() = %d, want expired records swept", n)
+	}
+}
+
+func TestClientIdempotencyKeysMakeRetriesSafe(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var runs atomic.Int32
+	var keys sync.Map
+	h := Chain(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		runs.Add(1)
+		resp, _ := NewMCPResponse(MCPStatusSuccess, "written", nil, nil)
+		return resp
+	}, func(next MCPHandler) MCPHandler {
+		// Lose the first response of every key, as if the connection dropped after the write
+		return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+			resp := next(ctx, req)
+			if _, seen := keys.LoadOrStore(req.IdempotencyKey(), true); !seen {
+				return NewMCPErrorResponse(mcpError(MCPErrorTimeout, nil), nil, nil)
+			}
+			return resp
+		}
+	}, Idempotency(nil))
+	go ServeTransport(ctx, serverT, h)
+
+	client := NewClient(clientT, &ClientConfig{
+		IdempotencyKeys: true,
+		Retry:           &RetryPolicy{Backoff: Backoff{Initial: time.Millisecond}},
+	})
+	defer client.Close()
+
+	resp, err := client.CallMCP(ctx, "file_system.write", "", map[string]string{"path": "/a"})
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	if resp.Metadata[MetadataIdempotentReplay] != true {
+		t.Errorf("resp.Metadata = %v, want a replayed response", resp.Metadata)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("write ran %d times, want 1", n)
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrJobManagerClosed is returned when submitting a job to a closed JobManager
+var ErrJobManagerClosed = errors.New("job manager closed")
+
+// Built-in actions served by a JobManager registered on a Mux
+const (
+	JobActionStatus MCPAction = "job.status"
+	JobActionResult MCPAction = "job.result"
+	JobActionCancel MCPAction = "job.cancel"
+	JobActionList   MCPAction = "job.list"
+)
+
+// JobState is the lifecycle state of a job
+type JobState string
+
+// Job states, a job moves from queued to running and ends in one of the final states
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Done reports whether s is a final state
+func (s JobState) Done() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// valid reports whether s is one of the job states
+func (s JobState) valid() bool {
+	return s == JobQueued || s == JobRunning || s.Done()
+}
+
+// Job is the state of an action running in the background
+type Job struct {
+	ID     string    `json:"job_id"`
+	Action MCPAction `json:"action"`
+	Tool   string    `json:"tool,omitempty"`
+	State  JobState  `json:"state"`
+	// Progress is the completed percentage, from 0 to 100
+	Progress float64 `json:"progress"`
+	// Partial is the latest partial output reported by the job
+	Partial    json.RawMessage `json:"partial,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	// Result is the final response, set once the job is done
+	Result *MCPResponse `json:"result,omitempty"`
+}
+
+// status returns a copy of j without its result, as reported by job.status and job.list
+func (j *Job) status() *Job {
+	c := *j
+	c.Result = nil
+	return &c
+}
+
+// JobStore persists jobs
+//
+// Implementations must be safe for concurrent use and must not retain the jobs passed to Save,
+// since the JobManager keeps updating its own copy.
+type JobStore interface {
+	// Save creates or replaces the job with the ID of job
+	Save(ctx context.Context, job *Job) error
+	// Load returns the job with the given ID, or nil when there is none
+	Load(ctx context.Context, id string) (*Job, error)
+	// List returns every job, oldest first
+	List(ctx context.Context) ([]*Job, error)
+	// Delete removes the job with the given ID
+	Delete(ctx context.Context, id string) error
+}
+
+// JobConfig configures a JobManager
+type JobConfig struct {
+	// Workers is the number of jobs run concurrently, zero uses 4
+	Workers int
+	// QueueSize limits the jobs waiting for a worker, zero uses 100. Submissions beyond it are
+	// refused with RATE_LIMIT_EXCEEDED.
+	QueueSize int
+	// Store holds the jobs, nil uses a new MemoryJobStore
+	Store JobStore
+	// TTL is how long a finished job is kept, zero uses 1h
+	TTL time.Duration
+	// GCInterval is how often finished jobs are garbage collected, zero uses 1m
+	GCInterval time.Duration
+	// Handler runs the requests sent with the submit action, nil leaves submit unregistered
+	Handler MCPHandler
+	// Paginator signs the job.list cursors, nil uses one with a random key
+	Paginator *Paginator
+}
+
+// JobManager runs actions in the background on a bounded worker pool
+//
+// Submitting returns a job ID straight away. The built-in job.status, job.result, job.cancel
+// and job.list actions report the progress, partial output and final response of a job, job.list
+// being paginated.
+type JobManager struct {
+	cfg   JobConfig
+	store JobStore
+	pages *Paginator
+	now   func() time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan *jobRun
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	runs   map[string]*jobRun
+	closed bool
+}
+
+// jobRun is a job that is queued or running
+type jobRun struct {
+	req *MCPRequest
+	h   MCPHandler
+	m   *JobManager
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	job *Job
+}
+
+// jobKey is the context key of the jobRun executing a handler
+type jobKey struct{}
+
+// NewJobManager creates a JobManager and starts its workers
+func NewJobManager(cfg *JobConfig) *JobManager {
+	m := &JobManager{now: time.Now, runs: make(map[string]*jobRun)}
+	if cfg != nil {
+		m.cfg = *cfg
+	}
+	if m.cfg.Workers <= 0 {
+		m.cfg.Workers = 4
+	}
+	if m.cfg.QueueSize <= 0 {
+		m.cfg.QueueSize = 100
+	}
+	if m.cfg.TTL <= 0 {
+		m.cfg.TTL = time.Hour
+	}
+	if m.cfg.GCInterval <= 0 {
+		m.cfg.GCInterval = time.Minute
+	}
+	m.store = m.cfg.Store
+	if m.store == nil {
+		m.store = NewMemoryJobStore()
+	}
+	m.pages = m.cfg.Paginator
+	if m.pages == nil {
+		m.pages = NewPaginator(nil)
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.queue = make(chan *jobRun, m.cfg.QueueSize)
+
+	m.wg.Add(m.cfg.Workers + 1)
+	for i := 0; i < m.cfg.Workers; i++ {
+		go m.work()
+	}
+	go m.collectLoop()
+	return m
+}
+
+// Register serves the built-in job actions on mux, and the submit action when a Handler is configured
+func (m *JobManager) Register(mux *Mux) {
+	mux.Handle(JobActionStatus, m.serveStatus)
+	mux.Handle(JobActionResult, m.serveResult)
+	mux.Handle(JobActionCancel, m.serveCancel)
+	mux.Handle(JobActionList, m.pages.Handler(m.listJobs))
+	if m.cfg.Handler != nil {
+		mux.Handle(MCPActionSubmit, m.Async(m.cfg.Handler))
+	}
+}
+
+// Async returns a handler that submits each request to run h as a job and answers straight
+// away with the queued job
+func (m *JobManager) Async(h MCPHandler) MCPHandler {
+	return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		job, err := m.Submit(ctx, req, h)
+		if err != nil {
+			return errorResponse(err, req)
+		}
+		return dataResponse(job, req)
+	}
+}
+
+// Submit queues req to run h as a job and returns the queued job
+//
+// The job keeps the values of ctx but not its cancellation or deadline, it is cancelled through
+// Cancel or by closing the manager.
+func (m *JobManager) Submit(ctx context.Context, req *MCPRequest, h MCPHandler) (*Job, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	r := &jobRun{
+		req: req,
+		h:   h,
+		m:   m,
+		job: &Job{ID: id, Action: req.Action, Tool: req.Tool, State: JobQueued, CreatedAt: m.now()},
+	}
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	// Every path ending the job cancels it, which also unregisters it from the manager context
+	stop := context.AfterFunc(m.ctx, cancel)
+	r.ctx, r.cancel = jobCtx, func() {
+		stop()
+		cancel()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		r.cancel()
+		return nil, ErrJobManagerClosed
+	}
+	if err := m.store.Save(ctx, r.job.status()); err != nil {
+		r.cancel()
+		return nil, err
+	}
+	queued := r.job.status()
+	m.runs[id] = r
+	select {
+	case m.queue <- r:
+	default:
+		delete(m.runs, id)
+		r.cancel()
+		_ = m.store.Delete(ctx, id)
+		e, _ := NewMCPError(MCPErrorRateLimitExceeded, ErrMCPExecutionFailed, "Job queue is full", map[string]int{
+			"queue_size": m.cfg.QueueSize,
+		})
+		return nil, e
+	}
+	return queued, nil
+}
+
+// Get returns the job with the given ID, or a RESOURCE_NOT_FOUND error
+func (m *JobManager) Get(ctx context.Context, id string) (*Job, error) {
+	job, err := m.store.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, jobNotFound(id)
+	}
+	return job, nil
+}
+
+// Cancel cancels a queued or running job and returns its state
+//
+// A queued job is cancelled at once. A running job has its context cancelled and reaches the
+// cancelled state once its handler returns. Cancelling a finished job is an INVALID_STATE error.
+func (m *JobManager) Cancel(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	r, ok := m.runs[id]
+	m.mu.Unlock()
+	if !ok {
+		job, err := m.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return nil, jobInvalidState(job)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.job.State {
+	case JobQueued:
+		e := &Error{Code: ErrMCPExecutionFailed, Message: "Job cancelled"}
+		r.finish(JobCancelled, NewMCPErrorResponse(e, nil, nil))
+	case JobRunning:
+		r.cancel()
+	default:
+		return nil, jobInvalidState(r.job)
+	}
+	return r.job.status(), nil
+}
+
+// List returns every job without its result, oldest first, optionally only those in state
+func (m *JobManager) List(ctx context.Context, state JobState) ([]*Job, error) {
+	jobs, err := m.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if state == "" || job.State == state {
+			list = append(list, job.status())
+		}
+	}
+	return list, nil
+}
+
+// Close stops the workers, cancels running jobs and marks queued jobs as cancelled
+func (m *JobManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+	close(m.queue)
+	for r := range m.queue {
+		r.mu.Lock()
+		if r.job.State == JobQueued {
+			e := &Error{Code: ErrMCPExecutionFailed, Message: "Job manager closed"}
+			r.finish(JobCancelled, NewMCPErrorResponse(e, nil, nil))
+		}
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// ReportJobProgress records the completed percentage and the latest partial output of the job
+// running in ctx
+//
+// It does nothing when ctx does not belong to a job, so the same handler can run synchronously.
+func ReportJobProgress(ctx context.Context, percent float64, partial interface{}) error {
+	r, ok := ctx.Value(jobKey{}).(*jobRun)
+	if !ok {
+		return nil
+	}
+	var data json.RawMessage
+	if partial != nil {
+		var err error
+		if data, err = json.Marshal(partial); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.job.State != JobRunning {
+		return nil
+	}
+	r.job.Progress = min(max(percent, 0), 100)
+	if data != nil {
+		r.job.Partial = data
+	}
+	return r.m.store.Save(context.WithoutCancel(ctx), r.job.status())
+}
+
+// JobIDFromContext returns the ID of the job running in ctx, if any
+func JobIDFromContext(ctx context.Context) string {
+	if r, ok := ctx.Value(jobKey{}).(*jobRun); ok {
+		return r.job.ID
+	}
+	return ""
+}
+
+// work runs queued jobs until the manager is closed
+func (m *JobManager) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case r := <-m.queue:
+			r.run()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// run executes a queued job and records its final response
+func (r *jobRun) run() {
+	r.mu.Lock()
+	if r.job.State != JobQueued {
+		r.mu.Unlock()
+		return
+	}
+	if r.m.ctx.Err() != nil {
+		// The worker picked the job up while the manager was closing
+		e := &Error{Code: ErrMCPExecutionFailed, Message: "Job manager closed"}
+		r.finish(JobCancelled, NewMCPErrorResponse(e, nil, nil))
+		r.mu.Unlock()
+		return
+	}
+	started := r.m.now()
+	r.job.State = JobRunning
+	r.job.StartedAt = &started
+	_ = r.m.store.Save(context.WithoutCancel(r.ctx), r.job.status())
+	r.mu.Unlock()
+
+	resp := callHandler(context.WithValue(r.ctx, jobKey{}, r), r.req, r.h)
+	resp = cloneResponse(bufferResponse(resp))
+	resp.ID = nil
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case resp.Status == MCPStatusError && r.ctx.Err() != nil:
+		r.finish(JobCancelled, resp)
+	case resp.Status == MCPStatusError:
+		r.finish(JobFailed, resp)
+	default:
+		r.job.Progress = 100
+		r.finish(JobSucceeded, resp)
+	}
+}
+
+// finish moves the job to a final state, it must be called with r.mu held
+func (r *jobRun) finish(state JobState, resp *MCPResponse) {
+	finished := r.m.now()
+	r.job.State = state
+	r.job.FinishedAt = &finished
+	r.job.Result = resp
+	job := *r.job
+	_ = r.m.store.Save(context.WithoutCancel(r.ctx), &job)
+	r.cancel()
+
+	r.m.mu.Lock()
+	delete(r.m.runs, r.job.ID)
+	r.m.mu.Unlock()
+}
+
+// collectLoop garbage collects finished jobs until the manager is closed
+func (m *JobManager) collectLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.cfg.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = m.collect(m.ctx)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// collect deletes the jobs that finished more than TTL ago
+func (m *JobManager) collect(ctx context.Context) error {
+	jobs, err := m.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := m.now()
+	for _, job := range jobs {
+		if job.State.Done() && job.FinishedAt != nil && !now.Before(job.FinishedAt.Add(m.cfg.TTL)) {
+			if err := m.store.Delete(ctx, job.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jobParams are the params of the built-in job actions
+type jobParams struct {
+	JobID string   `json:"job_id"`
+	State JobState `json:"state"`
+}
+
+// decodeJobParams decodes the params of a built-in job action, requiring a job_id when needID is set
+func decodeJobParams(req *MCPRequest, needID bool) (*jobParams, *MCPResponse) {
+	var p jobParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, NewMCPErrorResponse(invalidParams(err), nil, req.ID)
+		}
+	}
+	if needID && p.JobID == "" {
+		e, _ := NewMCPError(MCPErrorParameterMissing, ErrInvalidParams, "Missing required parameter 'job_id'", map[string]string{
+			"parameter": "job_id",
+		})
+		return nil, NewMCPErrorResponse(e, nil, req.ID)
+	}
+	return &p, nil
+}
+
+// serveStatus answers job.status with the state, progress and partial output of a job
+func (m *JobManager) serveStatus(ctx context.Context, req *MCPRequest) *MCPResponse {
+	p, errResp := decodeJobParams(req, true)
+	if errResp != nil {
+		return errResp
+	}
+	job, err := m.Get(ctx, p.JobID)
+	if err != nil {
+		return errorResponse(err, req)
+	}
+	return dataResponse(job.status(), req)
+}
+
+// serveResult answers job.result with the final response of a finished job
+func (m *JobManager) serveResult(ctx context.Context, req *MCPRequest) *MCPResponse {
+	p, errResp := decodeJobParams(req, true)
+	if errResp != nil {
+		return errResp
+	}
+	job, err := m.Get(ctx, p.JobID)
+	if err != nil {
+		return errorResponse(err, req)
+	}
+	if !job.State.Done() || job.Result == nil {
+		return errorResponse(jobInvalidState(job), req)
+	}
+	resp := cloneResponse(job.Result)
+	resp.ID = req.ID
+	return resp
+}
+
+// serveCancel answers job.cancel
+func (m *JobManager) serveCancel(ctx context.Context, req *MCPRequest) *MCPResponse {
+	p, errResp := decodeJobParams(req, true)
+	if errResp != nil {
+		return errResp
+	}
+	job, err := m.Cancel(ctx, p.JobID)
+	if err != nil {
+		return errorResponse(err, req)
+	}
+	return dataResponse(job, req)
+}
+
+// listJobs serves the pages of job.list, optionally filtered by the state param
+//
+// Positions are offsets, so jobs collected between two pages may shift the following page.
+func (m *JobManager) listJobs(ctx context.Context, req *MCPRequest, position string, limit int) (interface{}, string, error) {
+	var p jobParams
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, "", invalidParams(err)
+		}
+	}
+	if p.State != "" && !p.State.valid() {
+		return nil, "", invalidParam("state", fmt.Sprintf("Invalid parameter 'state': unknown job state '%s'", p.State))
+	}
+	jobs, err := m.List(ctx, p.State)
+	if err != nil {
+		return nil, "", err
+	}
+	start, end, next, err := OffsetPage(position, limit, len(jobs))
+	if err != nil {
+		return nil, "", err
+	}
+	return jobs[start:end], next, nil
+}
+
+// jobNotFound returns the error for an unknown or collected job
+func jobNotFound(id string) *Error {
+	e, _ := NewMCPError(MCPErrorResourceNotFound, ErrInvalidParams, fmt.Sprintf("Job '%s' not found", id), map[string]string{
+		"job_id": id,
+	})
+	return e
+}
+
+// jobInvalidState returns the error for an operation the job does not allow in its current state
+func jobInvalidState(job *Job) *Error {
+	e, _ := NewMCPError(MCPErrorInvalidState, ErrInvalidRequest, fmt.Sprintf("Job '%s' is %s", job.ID, job.State), map[string]interface{}{
+		"job_id":   job.ID,
+		"state":    job.State,
+		"progress": job.Progress,
+	})
+	return e
+}
+
+// MemoryJobStore is an in-memory JobStore
+type MemoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewMemoryJobStore creates an empty in-memory job store
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: make(map[string]*Job)}
+}
+
+// Save creates or replaces a copy of job
+func (s *MemoryJobStore) Save(ctx context.Context, job *Job) error {
+	c := *job
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = &c
+	return nil
+}
+
+// Load returns a copy of the job with the given ID, or nil when there is none
+func (s *MemoryJobStore) Load(ctx context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *job
+	return &c, nil
+}
+
+// List returns copies of every job, oldest first
+func (s *MemoryJobStore) List(ctx context.Context) ([]*Job, error) {
+	s.mu.Lock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		c := *job
+		jobs = append(jobs, &c)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// Delete removes the job with the given ID
+func (s *MemoryJobStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// jobCall dispatches a request for action with params to h
+func jobCall(t *testing.T, h MCPHandler, action MCPAction, params interface{}) *MCPResponse {
+	t.Helper()
+	req, err := NewMCPRequest(action, params, nil, "", 1)
+	if err != nil {
+		t.Fatalf("NewMCPRequest() error = %v", err)
+	}
+	return dispatchRequest(context.Background(), req, h)
+}
+
+// submitJob submits a request for action through h and returns the job ID
+func submitJob(t *testing.T, h MCPHandler, action MCPAction) string {
+	t.Helper()
+	resp := jobCall(t, h, action, map[string]string{"prompt": "Write a poem"})
+	var job Job
+	if resp.Status != MCPStatusSuccess || json.Unmarshal(resp.Data, &job) != nil || job.ID == "" {
+		t.Fatalf("submit response = %+v, want a job", resp)
+	}
+	return job.ID
+}
+
+// waitJobState polls the job until it reaches state
+func waitJobState(t *testing.T, m *JobManager, id string, state JobState) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := m.Get(context.Background(), id)
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", id, err)
+		}
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job state = %s, want %s", job.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJobLifecycle(t *testing.T) {
+	m := NewJobManager(nil)
+	defer m.Close()
+
+	reported := make(chan struct{})
+	release := make(chan struct{})
+	mux := NewMux()
+	m.Register(mux)
+	mux.Handle("start_generation", m.Async(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if JobIDFromContext(ctx) == "" {
+			t.Error("JobIDFromContext() is empty inside a job")
+		}
+		ReportJobProgress(ctx, 50, map[string]string{"text_so_far": "Roses are red"})
+		close(reported)
+		<-release
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]string{"text": "Roses are red, violets are blue"}, nil, nil)
+		return resp
+	}))
+
+	id := submitJob(t, mux.ServeMCP, "start_generation")
+	<-reported
+
+	resp := jobCall(t, mux.ServeMCP, JobActionStatus, map[string]string{"job_id": id})
+	var job Job
+	if err := json.Unmarshal(resp.Data, &job); err != nil {
+		t.Fatalf("status data = %s, error = %v", resp.Data, err)
+	}
+	if job.State != JobRunning || job.Progress != 50 || string(job.Partial) != `{"text_so_far":"Roses are red"}` {
+		t.Errorf("status = %+v, want running at 50%% with partial output", job)
+	}
+
+	resp = jobCall(t, mux.ServeMCP, JobActionResult, map[string]string{"job_id": id})
+	if resp.Error == nil || resp.Error.Type != MCPErrorInvalidState {
+		t.Errorf("result before completion error = %v, want %s", resp.Error, MCPErrorInvalidState)
+	}
+
+	close(release)
+	done := waitJobState(t, m, id, JobSucceeded)
+	if done.Progress != 100 || done.FinishedAt == nil {
+		t.Errorf("finished job = %+v, want progress 100 and a finish time", done)
+	}
+
+	resp = jobCall(t, mux.ServeMCP, JobActionResult, map[string]string{"job_id": id})
+	if resp.Status != MCPStatusSuccess || string(resp.Data) != `{"text":"Roses are red, violets are blue"}` || resp.ID != 1 {
+		t.Errorf("result = %+v, want the final response", resp)
+	}
+}
+
+func TestJobActionErrors(t *testing.T) {
+	m := NewJobManager(nil)
+	defer m.Close()
+	mux := NewMux()
+	m.Register(mux)
+
+	tests := []struct {
+		name   string
+		action MCPAction
+		params interface{}
+		want   MCPErrorType
+	}{
+		{"missing job_id", JobActionStatus, map[string]string{}, MCPErrorParameterMissing},
+		{"unknown job", JobActionResult, map[string]string{"job_id": "nope"}, MCPErrorResourceNotFound},
+		{"cancel unknown job", JobActionCancel, map[string]string{"job_id": "nope"}, MCPErrorResourceNotFound},
+		{"invalid params", JobActionList, []int{1}, MCPErrorValidation},
+		{"submit without handler", MCPActionSubmit, nil, MCPErrorActionNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := jobCall(t, mux.ServeMCP, tt.action, tt.params)
+			if resp.Error == nil || resp.Error.Type != tt.want {
+				t.Errorf("error = %v, want %s", resp.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	m := NewJobManager(&JobConfig{Workers: 1, QueueSize: 1})
+	defer m.Close()
+
+	started := make(chan struct{}, 1)
+	mux := NewMux()
+	m.Register(mux)
+	mux.Handle("slow", m.Async(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		started <- struct{}{}
+		<-ctx.Done()
+		return NewMCPErrorResponse(&Error{Code: ErrMCPExecutionFailed, Message: ctx.Err().Error()}, nil, nil)
+	}))
+
+	running := submitJob(t, mux.ServeMCP, "slow")
+	<-started
+	queued := submitJob(t, mux.ServeMCP, "slow")
+
+	resp := jobCall(t, mux.ServeMCP, "slow", nil)
+	if resp.Error == nil || resp.Error.Type != MCPErrorRateLimitExceeded {
+		t.Errorf("submit to a full queue error = %v, want %s", resp.Error, MCPErrorRateLimitExceeded)
+	}
+
+	resp = jobCall(t, mux.ServeMCP, JobActionCancel, map[string]string{"job_id": queued})
+	var job Job
+	if json.Unmarshal(resp.Data, &job) != nil || job.State != JobCancelled {
+		t.Errorf("cancel queued job = %+v, want cancelled at once", resp)
+	}
+
+	jobCall(t, mux.ServeMCP, JobActionCancel, map[string]string{"job_id": running})
+	waitJobState(t, m, running, JobCancelled)
+
+	resp = jobCall(t, mux.ServeMCP, JobActionCancel, map[string]string{"job_id": running})
+	if resp.Error == nil || resp.Error.Type != MCPErrorInvalidState {
+		t.Errorf("cancel finished job error = %v, want %s", resp.Error, MCPErrorInvalidState)
+	}
+	resp = jobCall(t, mux.ServeMCP, JobActionResult, map[string]string{"job_id": running})
+	if resp.Status != MCPStatusError || resp.Error == nil || resp.Error.Message != context.Canceled.Error() {
+		t.Errorf("result of cancelled job = %+v, want the handler error", resp)
+	}
+}
+
+func TestJobSubmitActionAndList(t *testing.T) {
+	m := NewJobManager(&JobConfig{Handler: func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if req.Tool == "fail" {
+			return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, req.Tool, nil, nil)
+		return resp
+	}})
+	defer m.Close()
+	mux := NewMux()
+	m.Register(mux)
+
+	submit := func(tool string) string {
+		req, _ := NewMCPRequest(MCPActionSubmit, map[string]int{}, nil, tool, 1)
+		var job Job
+		if err := json.Unmarshal(dispatchRequest(context.Background(), req, mux.ServeMCP).Data, &job); err != nil {
+			t.Fatalf("submit error = %v", err)
+		}
+		return job.ID
+	}
+	ok := submit("ok")
+	failed := submit("fail")
+	waitJobState(t, m, ok, JobSucceeded)
+	waitJobState(t, m, failed, JobFailed)
+
+	resp := jobCall(t, mux.ServeMCP, JobActionList, map[string]JobState{"state": JobFailed})
+	var list struct {
+		Items []*Job `json:"items"`
+	}
+	if err := json.Unmarshal(resp.Data, &list); err != nil {
+		t.Fatalf("list data = %s, error = %v", resp.Data, err)
+	}
+	if len(list.Items) != 1 || list.Items[0].ID != failed || list.Items[0].Tool != "fail" || list.Items[0].Result != nil {
+		t.Errorf("failed jobs = %+v, want only the failed job without result", list.Items)
+	}
+}
+
+func TestJobListInvalidParams(t *testing.T) {
+	m := NewJobManager(nil)
+	defer m.Close()
+	mux := NewMux()
+	m.Register(mux)
+
+	tests := []struct {
+		name   string
+		params interface{}
+		field  string
+	}{
+		{name: "unknown state", params: map[string]string{"state": "sleeping"}, field: "state"},
+		{name: "state of the wrong type", params: map[string]int{"state": 1}, field: "state"},
+		{name: "params not an object", params: []string{"running"}, field: "params"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := jobCall(t, mux.ServeMCP, JobActionList, tt.params)
+			var details map[string]string
+			if resp.Error == nil || resp.Error.Type != MCPErrorValidation || json.Unmarshal(resp.Error.Details, &details) != nil {
+				t.Fatalf("job.list error = %+v, want VALIDATION_ERROR", resp.Error)
+			}
+			if details["parameter"] != tt.field {
+				t.Errorf("details = %v, want parameter %q", details, tt.field)
+			}
+		})
+	}
+}
+
+func TestJobGarbageCollection(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	m := NewJobManager(&JobConfig{TTL: time.Minute})
+	m.now = clock.Now
+	defer m.Close()
+
+	h := m.Async(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	})
+	id := submitJob(t, h, "quick")
+	waitJobState(t, m, id, JobSucceeded)
+
+	clock.Advance(59 * time.Second)
+	m.collect(context.Background())
+	if _, err := m.Get(context.Background(), id); err != nil {
+		t.Fatalf("Get() before TTL error = %v", err)
+	}
+
+	clock.Advance(time.Second)
+	m.collect(context.Background())
+	if _, err := m.Get(context.Background(), id); err == nil {
+		t.Error("Get() after TTL succeeded, want the job collected")
+	}
+}
+
+func TestJobManagerClose(t *testing.T) {
+	m := NewJobManager(&JobConfig{Workers: 1})
+	started := make(chan struct{})
+	h := m.Async(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		close(started)
+		<-ctx.Done()
+		return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+	})
+	running := submitJob(t, h, "slow")
+	<-started
+	queued := submitJob(t, h, "slow")
+
+	m.Close()
+	for _, id := range []string{running, queued} {
+		if job, _ := m.Get(context.Background(), id); job.State != JobCancelled {
+			t.Errorf("job %s state = %s, want %s", id, job.State, JobCancelled)
+		}
+	}
+	if _, err := m.Submit(context.Background(), &MCPRequest{Action: "slow"}, h); err != ErrJobManagerClosed {
+		t.Errorf("Submit() after Close error = %v, want %v", err, ErrJobManagerClosed)
+	}
+}
@@ -84,10 +84,14 @@ func NewErrorResponse(err *Error, id interface{}) *Response {
 }
 
 // Error represents a JSON-RPC error object
+//
+// Type and Details carry the optional MCP error fields and are omitted from plain JSON-RPC errors.
 type Error struct {
 	Code    int             `json:"code"`
 	Message string          `json:"message"`
 	Data    json.RawMessage `json:"data,omitempty"`
+	Type    MCPErrorType    `json:"type,omitempty"`
+	Details json.RawMessage `json:"details,omitempty"`
 }
 
 // Error returns a string representation of the error
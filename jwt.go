@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWT signing algorithms supported by JWTAuthenticator
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+// DefaultJWTLeeway is the clock skew tolerated on exp and nbf when none is configured
+const DefaultJWTLeeway = time.Minute
+
+// DefaultJWKSRefresh is how often a FileJWKS checks its file for changes when no interval is configured
+const DefaultJWKSRefresh = time.Minute
+
+// minJWKSReload is the minimum time between two checks of a FileJWKS file triggered by unknown
+// kids, so tokens with made up kids cannot make every verification read the file
+const minJWKSReload = 5 * time.Second
+
+// minRSAKeyBits is the smallest RSA modulus accepted for RS256
+const minRSAKeyBits = 2048
+
+// ErrUnknownKey is returned by a JWTKeySet for a kid it does not hold
+var ErrUnknownKey = errors.New("unknown key")
+
+// JWTKeySet returns the verification key of a kid
+type JWTKeySet interface {
+	// Key returns a []byte for HMAC, an *rsa.PublicKey or an *ecdsa.PublicKey, together with the
+	// algorithm the key is restricted to or "". An empty kid selects the only key of the set.
+	Key(ctx context.Context, kid string) (key interface{}, alg string, err error)
+}
+
+// JWTConfig configures a JWTAuthenticator
+type JWTConfig struct {
+	// Keys holds the verification keys, required
+	Keys JWTKeySet
+	// Issuer is the required iss claim, empty accepts any issuer
+	Issuer string
+	// Audience must appear in the aud claim, empty accepts any audience
+	Audience string
+	// Leeway is the clock skew tolerated on exp and nbf, zero uses DefaultJWTLeeway
+	Leeway time.Duration
+	// Algorithms restricts the accepted algorithms, nil accepts HS256, RS256 and ES256
+	Algorithms []string
+}
+
+// JWTAuthenticator authenticates bearer tokens that are JWTs signed with HS256, RS256 or ES256
+//
+// Tokens must carry an exp claim. The sub claim becomes the principal ID, the scope and scp
+// claims, each a space separated string or an array of strings, its scopes, and every claim is
+// kept in Principal.Claims. Bearer tokens that are not JWTs are reported as unsupported, so a
+// JWTAuthenticator can precede a static bearer authenticator in Authenticators.
+type JWTAuthenticator struct {
+	cfg JWTConfig
+	now func() time.Time
+}
+
+// NewJWTAuthenticator creates a JWTAuthenticator
+func NewJWTAuthenticator(cfg *JWTConfig) (*JWTAuthenticator, error) {
+	if cfg == nil || cfg.Keys == nil {
+		return nil, errors.New("jwt: no key set configured")
+	}
+	a := &JWTAuthenticator{cfg: *cfg, now: time.Now}
+	if a.cfg.Leeway <= 0 {
+		a.cfg.Leeway = DefaultJWTLeeway
+	}
+	if a.cfg.Algorithms == nil {
+		a.cfg.Algorithms = []string{JWTAlgHS256, JWTAlgRS256, JWTAlgES256}
+	}
+	return a, nil
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate verifies the bearer token and returns the principal of its subject
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, cred *Credentials) (*Principal, error) {
+	if cred.Scheme != AuthSchemeBearer || strings.Count(cred.Token, ".") != 2 {
+		return nil, ErrUnsupportedCredentials
+	}
+	claims, err := a.Verify(ctx, cred.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Principal{Scheme: AuthSchemeBearer, Claims: claims}
+	p.ID, _ = claims["sub"].(string)
+	p.Scopes = append(claimScopes(claims["scope"]), claimScopes(claims["scp"])...)
+	return p, nil
+}
+
+// claimScopes returns the scopes of a scope claim given as a space separated string or as an
+// array of strings
+func claimScopes(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		var scopes []string
+		for _, s := range claim {
+			if s, ok := s.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
+
+// Verify checks the signature and the registered claims of token and returns its claims
+//
+// Errors wrap ErrInvalidCredentials.
+func (a *JWTAuthenticator) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, jwtInvalid("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, jwtInvalid("malformed header")
+	}
+	if !a.allowed(header.Alg) {
+		return nil, jwtInvalid("algorithm " + header.Alg + " not accepted")
+	}
+
+	key, keyAlg, err := a.cfg.Keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if keyAlg != "" && keyAlg != header.Alg {
+		return nil, jwtInvalid("key " + header.Kid + " is restricted to " + keyAlg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, jwtInvalid("malformed signature")
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, jwtInvalid("malformed claims")
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// allowed reports whether alg is accepted
+func (a *JWTAuthenticator) allowed(alg string) bool {
+	for _, allowed := range a.cfg.Algorithms {
+		if alg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClaims validates exp, nbf, iss and aud
+func (a *JWTAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return jwtInvalid("missing exp claim")
+	}
+	if now.After(numericDate(exp).Add(a.cfg.Leeway)) {
+		return jwtInvalid("token expired")
+	}
+	if v, present := claims["nbf"]; present {
+		nbf, ok := v.(float64)
+		if !ok {
+			return jwtInvalid("malformed nbf claim")
+		}
+		if now.Add(a.cfg.Leeway).Before(numericDate(nbf)) {
+			return jwtInvalid("token not valid yet")
+		}
+	}
+	if a.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.cfg.Issuer {
+			return jwtInvalid("unexpected issuer")
+		}
+	}
+	if a.cfg.Audience != "" && !jwtAudience(claims["aud"], a.cfg.Audience) {
+		return jwtInvalid("unexpected audience")
+	}
+	return nil
+}
+
+// numericDate converts a JWT NumericDate to a time
+func numericDate(v float64) time.Time {
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9))
+}
+
+// jwtAudience reports whether the aud claim, a string or an array of strings, contains audience
+func jwtAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks sig over signed, the key type must match the algorithm
+func verifyJWTSignature(alg string, key interface{}, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case JWTAlgHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return jwtInvalid("key type does not match " + alg)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return jwtInvalid("signature mismatch")
+		}
+	case JWTAlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return jwtInvalid("key type does not match " + alg)
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return jwtInvalid("signature mismatch")
+		}
+	case JWTAlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return jwtInvalid("key type does not match " + alg)
+		}
+		if len(sig) != 64 {
+			return jwtInvalid("malformed signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return jwtInvalid("signature mismatch")
+		}
+	default:
+		return jwtInvalid("algorithm " + alg + " not supported")
+	}
+	return nil
+}
+
+// decodeJWTSegment decodes a base64url JSON segment into v
+func decodeJWTSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtInvalid returns the error for a rejected token
+func jwtInvalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCredentials, reason)
+}
+
+// JWK is a JSON Web Key as found in a JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	// K is the secret of an "oct" key
+	K string `json:"k,omitempty"`
+	// N and E are the modulus and exponent of an "RSA" key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv, X and Y are the curve and coordinates of an "EC" key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwksKey is a parsed verification key
+type jwksKey struct {
+	key interface{}
+	alg string
+}
+
+// JWKS is a static set of verification keys indexed by kid
+type JWKS struct {
+	keys map[string]jwksKey
+}
+
+// ParseJWKS parses a JWKS document, keys whose use is not "sig" are skipped
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var doc struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	set := &JWKS{keys: make(map[string]jwksKey, len(doc.Keys))}
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %w", jwk.Kid, err)
+		}
+		set.keys[jwk.Kid] = jwksKey{key: key, alg: jwk.Alg}
+	}
+	return set, nil
+}
+
+// Key returns the key with the given kid
+func (s *JWKS) Key(ctx context.Context, kid string) (interface{}, string, error) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k.key, k.alg, nil
+		}
+	}
+	k, ok := s.keys[kid]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	return k.key, k.alg, nil
+}
+
+// PublicKey returns the verification key of the JWK
+func (k *JWK) PublicKey() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid oct secret")
+		}
+		return secret, nil
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA parameters")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key shorter than %d bits", minRSAKeyBits)
+		}
+		return pub, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid EC coordinates")
+		}
+		// crypto/ecdh rejects points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// FileJWKS is a JWTKeySet read from a local JWKS file
+//
+// The file is checked for changes every refresh interval, and early when a token names an
+// unknown kid, so keys can be rotated by adding the new kid to the file before issuing tokens
+// with it and removing the old one later.
+type FileJWKS struct {
+	mu   sync.Mutex
+	file watchedFile
+	set  *JWKS
+}
+
+// NewFileJWKS loads the JWKS file at path, a zero refresh uses DefaultJWKSRefresh
+func NewFileJWKS(path string, refresh time.Duration) (*FileJWKS, error) {
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	f := &FileJWKS{file: watchedFile{path: path, refresh: refresh, now: time.Now}}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Key returns the key with the given kid, reloading the file when it changed
+//
+// An unknown kid checks the file right away, at most once per minJWKSReload, so a newly published
+// key is picked up without waiting for the refresh interval.
+func (f *FileJWKS) Key(ctx context.Context, kid string) (interface{}, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file.due() {
+		// Keep serving the last good keys when the file is briefly unreadable
+		_ = f.reload()
+	}
+	key, alg, err := f.set.Key(ctx, kid)
+	if errors.Is(err, ErrUnknownKey) && f.file.since() >= minJWKSReload && f.reload() == nil {
+		key, alg, err = f.set.Key(ctx, kid)
+	}
+	return key, alg, err
+}
+
+// reload parses the file when it changed since the last load
+func (f *FileJWKS) reload() error {
+	return f.file.reload(func(data []byte) error {
+		set, err := ParseJWKS(bytes.TrimSpace(data))
+		if err != nil {
+			return err
+		}
+		f.set = set
+		return nil
+	})
+}
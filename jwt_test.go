@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// jwtKeys are keys generated once for the JWT tests
+var jwtKeys = struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}{secret: []byte("0123456789abcdef0123456789abcdef")}
+
+func init() {
+	var err error
+	if jwtKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if jwtKeys.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+}
+
+// b64 encodes data as base64url without padding
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// testJWKS returns a JWKS document with the public halves of key, indexed by kid
+func testJWKS(t *testing.T, keys map[string]interface{}) []byte {
+	t.Helper()
+	var doc struct {
+		Keys []JWK `json:"keys"`
+	}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case []byte:
+			doc.Keys = append(doc.Keys, JWK{Kty: "oct", Kid: kid, Alg: JWTAlgHS256, K: b64(k)})
+		case *rsa.PrivateKey:
+			doc.Keys = append(doc.Keys, JWK{Kty: "RSA", Kid: kid, Use: "sig", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())})
+		case *ecdsa.PrivateKey:
+			doc.Keys = append(doc.Keys, JWK{Kty: "EC", Kid: kid, Crv: "P-256", X: b64(k.X.FillBytes(make([]byte, 32))), Y: b64(k.Y.FillBytes(make([]byte, 32)))})
+		}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// signJWT returns a token over claims signed with key
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+// writeJWKS writes a JWKS file for keys and returns its path
+func writeJWKS(t *testing.T, path string, keys map[string]interface{}) string {
+	t.Helper()
+	if err := os.WriteFile(path, testJWKS(t, keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	keys, err := ParseJWKS(testJWKS(t, map[string]interface{}{"hs": jwtKeys.secret, "rs": jwtKeys.rsa, "es": jwtKeys.ec}))
+	if err != nil {
+		t.Fatalf("ParseJWKS() error = %v", err)
+	}
+	a, err := NewJWTAuthenticator(&JWTConfig{Keys: keys, Issuer: "https://issuer", Audience: "mcp", Leeway: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.now = func() time.Time { return now }
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "agent-1", "iss": "https://issuer", "aud": "mcp", "exp": now.Add(time.Hour).Unix(), "scope": "tools:read tools:write"}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{name: "HS256", token: signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, claims(nil))},
+		{name: "RS256", token: signJWT(t, JWTAlgRS256, "rs", jwtKeys.rsa, claims(nil))},
+		{name: "ES256", token: signJWT(t, JWTAlgES256, "es", jwtKeys.ec, claims(nil))},
+		{name: "audience list", token: signJWT(t, JWTAlgES256, "es", jwtKeys.ec, claims(map[string]interface{}{"aud": []string{"other", "mcp"}}))},
+		{name: "expired within leeway", token: signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}))},
+		{name: "expired", token: signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), want: ErrInvalidCredentials},
+		{name: "missing exp", token: signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, claims(map[string]interface{}{"exp": nil})), want: ErrInvalidCredentials},
+		{name: "not valid yet", token: signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), want: ErrInvalidCredentials},
+		{name: "valid soon within leeway", token: signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, claims(map[string]interface{}{"nbf": now.Add(10 * time.Second).Unix()}))},
+		{name: "wrong issuer", token: signJWT(t, JWTAlgRS256, "rs", jwtKeys.rsa, claims(map[string]interface{}{"iss": "https://evil"})), want: ErrInvalidCredentials},
+		{name: "wrong audience", token: signJWT(t, JWTAlgRS256, "rs", jwtKeys.rsa, claims(map[string]interface{}{"aud": "other"})), want: ErrInvalidCredentials},
+		{name: "unknown kid", token: signJWT(t, JWTAlgHS256, "nope", jwtKeys.secret, claims(nil)), want: ErrInvalidCredentials},
+		{name: "wrong secret", token: signJWT(t, JWTAlgHS256, "hs", []byte("guess"), claims(nil)), want: ErrInvalidCredentials},
+		{name: "algorithm mismatch", token: signJWT(t, JWTAlgES256, "rs", jwtKeys.ec, claims(nil)), want: ErrInvalidCredentials},
+		{name: "alg none", token: signJWT(t, "none", "hs", nil, claims(nil)), want: ErrInvalidCredentials},
+		{name: "not a JWT", token: "token-1", want: ErrUnsupportedCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(context.Background(), &Credentials{Scheme: AuthSchemeBearer, Token: tt.token})
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("Authenticate() error = %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if p.ID != "agent-1" || p.Scheme != AuthSchemeBearer || !reflect.DeepEqual(p.Scopes, []string{"tools:read", "tools:write"}) || p.Claims["iss"] != "https://issuer" {
+				t.Errorf("principal = %+v, want agent-1 with the token scopes", p)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorMiddleware(t *testing.T) {
+	keys, _ := ParseJWKS(testJWKS(t, map[string]interface{}{"es": jwtKeys.ec}))
+	jwtAuth, _ := NewJWTAuthenticator(&JWTConfig{Keys: keys})
+	h := Chain(whoami, Authenticate(Authenticators(jwtAuth, testAuthenticator())))
+
+	token := signJWT(t, JWTAlgES256, "es", jwtKeys.ec, map[string]interface{}{
+		"sub": "agent-2", "exp": time.Now().Add(time.Hour).Unix(), "scp": []string{"jobs:submit"},
+	})
+	for auth, want := range map[string]string{"Bearer " + token: "agent-2", "Bearer token-1": "user-b"} {
+		req, _ := NewMCPRequest("whoami", nil, nil, "", 1)
+		req.Metadata = map[string]interface{}{MetadataAuth: auth}
+		resp := h(context.Background(), req)
+		var data struct {
+			Principal *Principal `json:"principal"`
+		}
+		if json.Unmarshal(resp.Data, &data) != nil || data.Principal == nil || data.Principal.ID != want {
+			t.Errorf("principal = %s %+v, want %s", resp.Data, resp.Error, want)
+		}
+	}
+}
+
+func TestJWTAuthenticatorScopes(t *testing.T) {
+	keys, _ := ParseJWKS(testJWKS(t, map[string]interface{}{"hs": jwtKeys.secret}))
+	a, _ := NewJWTAuthenticator(&JWTConfig{Keys: keys})
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   []string
+	}{
+		{name: "scope string", claims: map[string]interface{}{"scope": "tools:read tools:write"}, want: []string{"tools:read", "tools:write"}},
+		{name: "scope array", claims: map[string]interface{}{"scope": []string{"tools:read", "tools:write"}}, want: []string{"tools:read", "tools:write"}},
+		{name: "scp string", claims: map[string]interface{}{"scp": "jobs:submit"}, want: []string{"jobs:submit"}},
+		{name: "scp array", claims: map[string]interface{}{"scp": []interface{}{"jobs:submit", 7}}, want: []string{"jobs:submit"}},
+		{name: "both", claims: map[string]interface{}{"scope": []string{"tools:read"}, "scp": "jobs:submit"}, want: []string{"tools:read", "jobs:submit"}},
+		{name: "neither", claims: map[string]interface{}{}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["sub"] = "agent-1"
+			tt.claims["exp"] = time.Now().Add(time.Hour).Unix()
+			token := signJWT(t, JWTAlgHS256, "hs", jwtKeys.secret, tt.claims)
+			p, err := a.Authenticate(context.Background(), &Credentials{Scheme: AuthSchemeBearer, Token: token})
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if !reflect.DeepEqual(p.Scopes, tt.want) {
+				t.Errorf("Scopes = %q, want %q", p.Scopes, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileJWKSRotation(t *testing.T) {
+	path := writeJWKS(t, filepath.Join(t.TempDir(), "jwks.json"), map[string]interface{}{"2026-01": jwtKeys.rsa})
+	keys, err := NewFileJWKS(path, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileJWKS() error = %v", err)
+	}
+	now := time.Now()
+	keys.file.now = func() time.Time { return now }
+	a, _ := NewJWTAuthenticator(&JWTConfig{Keys: keys})
+	claims := map[string]interface{}{"sub": "agent-1", "exp": time.Now().Add(time.Hour).Unix()}
+	verify := func(alg, kid string, key interface{}) error {
+		_, err := a.Verify(context.Background(), signJWT(t, alg, kid, key, claims))
+		return err
+	}
+
+	if err := verify(JWTAlgRS256, "2026-01", jwtKeys.rsa); err != nil {
+		t.Fatalf("Verify() with the current key error = %v", err)
+	}
+	if err := verify(JWTAlgES256, "2026-02", jwtKeys.ec); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Verify() with an unpublished key error = %v, want invalid credentials", err)
+	}
+
+	// Publish the next key next to the current one, then retire the current one
+	writeJWKS(t, path, map[string]interface{}{"2026-01": jwtKeys.rsa, "2026-02": jwtKeys.ec})
+	if err := verify(JWTAlgES256, "2026-02", jwtKeys.ec); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Verify() right after a check for an unknown kid error = %v, want the file not read again", err)
+	}
+	now = now.Add(minJWKSReload)
+	if err := verify(JWTAlgES256, "2026-02", jwtKeys.ec); err != nil {
+		t.Errorf("Verify() with the rotated key error = %v", err)
+	}
+	if err := verify(JWTAlgRS256, "2026-01", jwtKeys.rsa); err != nil {
+		t.Errorf("Verify() with the previous key during rotation error = %v", err)
+	}
+
+	writeJWKS(t, path, map[string]interface{}{"2026-02": jwtKeys.ec})
+	now = now.Add(2 * time.Hour)
+	if err := verify(JWTAlgRS256, "2026-01", jwtKeys.rsa); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Verify() with a retired key error = %v, want invalid credentials", err)
+	}
+}
+
+func TestParseJWKSErrors(t *testing.T) {
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{name: "not JSON", doc: `{"keys":`},
+		{name: "unknown key type", doc: `{"keys":[{"kty":"OKP","kid":"a"}]}`},
+		{name: "short RSA key", doc: `{"keys":[{"kty":"RSA","kid":"a","n":"` + b64(small.N.Bytes()) + `","e":"AQAB"}]}`},
+		{name: "point off the curve", doc: `{"keys":[{"kty":"EC","kid":"a","crv":"P-256","x":"` + b64(make([]byte, 32)) + `","y":"` + b64(make([]byte, 32)) + `"}]}`},
+		{name: "unsupported curve", doc: `{"keys":[{"kty":"EC","kid":"a","crv":"P-384"}]}`},
+	}
+	for _, tt := range tests {
+		if _, err := ParseJWKS([]byte(tt.doc)); err == nil {
+			t.Errorf("ParseJWKS() for %s error = nil", tt.name)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrListenerClosed is returned by Listener.Serve after Shutdown or Close
+var ErrListenerClosed = errors.New("listener closed")
+
+// ListenerConfig configures a Listener
+type ListenerConfig struct {
+	// Framing selects the message framing on each connection
+	Framing Framing
+	// MaxMessageSize limits a single incoming message, zero uses DefaultMaxMessageSize
+	MaxMessageSize int
+	// MaxConnections limits concurrent sessions, connections beyond it are closed immediately
+	MaxConnections int
+	// IdleTimeout closes a session that received no message and has no request in flight for this long
+	IdleTimeout time.Duration
+	// Chunks limits the reassembly of chunked params, nil uses the defaults
+	Chunks *ChunkConfig
+	// ProgressInterval is the minimum time between two progress notifications for the same
+	// request, zero uses DefaultProgressInterval and a negative value disables throttling
+	ProgressInterval time.Duration
+	// TLSConfig secures every connection with TLS, ServerTLSConfig returns one for mutual TLS
+	TLSConfig *tls.Config
+}
+
+// Listener accepts stream connections, such as TCP or Unix domain sockets, and serves one MCP
+// session per connection with the same framing codecs as the stdio transports
+type Listener struct {
+	ln  net.Listener
+	h   MCPHandler
+	cfg ListenerConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+
+	mu       sync.Mutex
+	sessions map[*StreamTransport]struct{}
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+// Listen announces on the local network address and returns a Listener serving h
+//
+// The network must be a stream network such as "tcp", "tcp4", "tcp6" or "unix".
+func Listen(network, address string, h MCPHandler, cfg *ListenerConfig) (*Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, h, cfg), nil
+}
+
+// NewListener creates a Listener serving h on connections accepted from ln
+func NewListener(ln net.Listener, h MCPHandler, cfg *ListenerConfig) *Listener {
+	l := &Listener{
+		ln:       ln,
+		h:        h,
+		stop:     make(chan struct{}),
+		sessions: make(map[*StreamTransport]struct{}),
+	}
+	if cfg != nil {
+		l.cfg = *cfg
+	}
+	if l.cfg.TLSConfig != nil {
+		l.ln = tls.NewListener(ln, l.cfg.TLSConfig)
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+// Addr returns the listener's network address
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Serve accepts connections until Shutdown or Close is called and then returns ErrListenerClosed
+func (l *Listener) Serve() error {
+	var delay time.Duration
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.stop:
+				return ErrListenerClosed
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		t := newStreamTransport(conn, conn, l.cfg.Framing, l.cfg.MaxMessageSize)
+		if !l.track(t) {
+			t.Close()
+			continue
+		}
+		go l.serveSession(t)
+	}
+}
+
+// Shutdown stops accepting connections and new requests, waits for in-flight requests to finish
+// and closes every connection. If ctx expires first the remaining connections are closed
+// forcibly and ctx.Err() is returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.beginStop()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		l.closeSessions()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes the listener and every connection, cancelling in-flight requests
+func (l *Listener) Close() error {
+	err := l.beginStop()
+	l.closeSessions()
+	l.wg.Wait()
+	return err
+}
+
+// beginStop stops accepting connections and reading new requests
+func (l *Listener) beginStop() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return nil
+	}
+	l.stopping = true
+	close(l.stop)
+	return l.ln.Close()
+}
+
+// closeSessions cancels in-flight requests and closes every connection
+func (l *Listener) closeSessions() {
+	l.cancel()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for t := range l.sessions {
+		t.Close()
+	}
+}
+
+// track registers a new session, it returns false when the listener is full or stopping
+func (l *Listener) track(t *StreamTransport) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping || (l.cfg.MaxConnections > 0 && len(l.sessions) >= l.cfg.MaxConnections) {
+		return false
+	}
+	l.sessions[t] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+// serveSession serves requests on one connection until it closes, idles out or the listener stops
+func (l *Listener) serveSession(t *StreamTransport) {
+	defer l.wg.Done()
+
+	_ = newConn(l.ctx, t, l.h, serveConfig{stop: l.stop, idleTimeout: l.cfg.IdleTimeout, chunks: l.cfg.Chunks, progressInterval: l.cfg.ProgressInterval}).Wait()
+	t.Close()
+
+	l.mu.Lock()
+	delete(l.sessions, t)
+	l.mu.Unlock()
+}
+
+// DialStream connects to a Listener over a stream network such as "tcp" or "unix"
+func DialStream(ctx context.Context, network, address string, framing Framing) (*StreamTransport, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamTransport(conn, conn, framing), nil
+}
+
+// DialStreamTLS connects to a Listener over TLS, ClientTLSConfig returns a configuration for mutual TLS
+func DialStreamTLS(ctx context.Context, network, address string, framing Framing, cfg *tls.Config) (*StreamTransport, error) {
+	d := tls.Dialer{Config: cfg}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamTransport(conn, conn, framing), nil
+}
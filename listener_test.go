@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echoHandler answers every request with its params
+func echoHandler(ctx context.Context, req *MCPRequest) *MCPResponse {
+	resp, _ := NewMCPResponse(MCPStatusSuccess, req.Params, nil, nil)
+	return resp
+}
+
+// startListener listens on network and serves h until the test ends
+func startListener(t *testing.T, network, address string, h MCPHandler, cfg *ListenerConfig) *Listener {
+	t.Helper()
+	l, err := Listen(network, address, h, cfg)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestListenerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address string
+		framing Framing
+	}{
+		{name: "tcp newline", network: "tcp", address: "127.0.0.1:0", framing: NewlineFraming},
+		{name: "tcp length prefix", network: "tcp", address: "127.0.0.1:0", framing: LengthPrefixFraming},
+		{name: "unix socket", network: "unix", address: filepath.Join(t.TempDir(), "mcp.sock"), framing: NewlineFraming},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := startListener(t, tt.network, tt.address, echoHandler, &ListenerConfig{Framing: tt.framing})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			client, err := DialStream(ctx, tt.network, l.Addr().String(), tt.framing)
+			if err != nil {
+				t.Fatalf("DialStream() error = %v", err)
+			}
+			defer client.Close()
+
+			for i := 1; i <= 3; i++ {
+				resp := roundTrip(ctx, t, client, i, map[string]int{"i": i})
+				if resp.ID != float64(i) {
+					t.Errorf("resp.ID = %v, want %v", resp.ID, i)
+				}
+			}
+		})
+	}
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	l := startListener(t, "tcp", "127.0.0.1:0", echoHandler, &ListenerConfig{MaxConnections: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer first.Close()
+	roundTrip(ctx, t, first, 1, nil)
+
+	second, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer second.Close()
+	if _, err := second.Receive(ctx); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Receive() on rejected connection error = %v, want connection closed", err)
+	}
+
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	third, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer third.Close()
+	roundTrip(ctx, t, third, 3, nil)
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	l := startListener(t, "tcp", "127.0.0.1:0", echoHandler, &ListenerConfig{IdleTimeout: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer client.Close()
+
+	roundTrip(ctx, t, client, 1, nil)
+	start := time.Now()
+	if _, err := client.Receive(ctx); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Receive() error = %v, want connection closed", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("connection closed after %v, want idle timeout of 50ms", elapsed)
+	}
+}
+
+func TestListenerIdleTimeoutKeepsBusySessions(t *testing.T) {
+	slow := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		time.Sleep(150 * time.Millisecond)
+		return echoHandler(ctx, req)
+	}
+	l := startListener(t, "tcp", "127.0.0.1:0", slow, &ListenerConfig{IdleTimeout: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer client.Close()
+
+	resp := roundTrip(ctx, t, client, 1, nil)
+	if resp.Status != MCPStatusSuccess {
+		t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+	}
+}
+
+func TestListenerShutdownDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	slow := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		if ctx.Err() != nil {
+			return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+		}
+		return echoHandler(ctx, req)
+	}
+	l, err := Listen("tcp", "127.0.0.1:0", slow, nil)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- l.Serve() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer client.Close()
+
+	req, _ := NewMCPRequest("slow", map[string]string{"k": "v"}, nil, "", 1)
+	data, _ := json.Marshal(req)
+	client.Send(ctx, data)
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- l.Shutdown(ctx) }()
+
+	msg, err := client.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v, want drained response", err)
+	}
+	var resp MCPResponse
+	json.Unmarshal(msg, &resp)
+	if resp.Status != MCPStatusSuccess {
+		t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("Serve() error = %v, want %v", err, ErrListenerClosed)
+	}
+	if _, err := client.Receive(ctx); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Receive() after shutdown error = %v, want connection closed", err)
+	}
+	if _, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming); err == nil {
+		t.Error("DialStream() after shutdown error = nil, want error")
+	}
+}
+
+func TestListenerShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	blocked := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		close(started)
+		<-ctx.Done()
+		return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+	}
+	l := startListener(t, "tcp", "127.0.0.1:0", blocked, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialStream(ctx, "tcp", l.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatalf("DialStream() error = %v", err)
+	}
+	defer client.Close()
+
+	req, _ := NewMCPRequest("block", nil, nil, "", 1)
+	data, _ := json.Marshal(req)
+	client.Send(ctx, data)
+	<-started
+
+	short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	if err := l.Shutdown(short); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
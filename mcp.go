@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 )
 
 // MCP-specific types for the Model Context Protocol
@@ -29,23 +32,82 @@ const (
 
 // MCPRequest extends the JSON-RPC Request with MCP-specific fields
 type MCPRequest struct {
-	JSONRPC string          `json:"jsonrpc"`
-	Method  string          `json:"method"`
-	Action  MCPAction       `json:"action"`
-	Params  json.RawMessage `json:"params,omitempty"`
-	Context interface{}     `json:"context,omitempty"`
-	Tool    string          `json:"tool,omitempty"`
-	ID      interface{}     `json:"id,omitempty"`
+	JSONRPC  string                 `json:"jsonrpc"`
+	Method   string                 `json:"method"`
+	Action   MCPAction              `json:"action"`
+	Params   json.RawMessage        `json:"params,omitempty"`
+	Context  interface{}            `json:"context,omitempty"`
+	Tool     string                 `json:"tool,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	ID       interface{}            `json:"id,omitempty"`
+}
+
+// Metadata keys with a meaning defined by mcpkit
+const (
+	// MetadataRequestID is the metadata key used to correlate responses with requests
+	MetadataRequestID = "request_id"
+	// MetadataDeadline is the metadata key holding the RFC 3339 time by which the client stops waiting
+	MetadataDeadline = "deadline"
+	// MetadataIdempotencyKey is the metadata key identifying retries of the same logical request
+	MetadataIdempotencyKey = "idempotency_key"
+	// MetadataIdempotentReplay marks a response that was stored for an earlier request with the same idempotency key
+	MetadataIdempotentReplay = "idempotent_replay"
+	// MetadataAuth is the metadata key carrying credentials on transports without HTTP headers
+	MetadataAuth = "auth"
+	// MetadataChunked is the metadata key holding the ChunkRef of params or data sent as chunks
+	MetadataChunked = "chunked"
+)
+
+// RequestID returns the request_id carried in the request metadata, if any
+func (r *MCPRequest) RequestID() string {
+	id, _ := r.Metadata[MetadataRequestID].(string)
+	return id
+}
+
+// IdempotencyKey returns the idempotency_key carried in the request metadata, if any
+func (r *MCPRequest) IdempotencyKey() string {
+	key, _ := r.Metadata[MetadataIdempotencyKey].(string)
+	return key
+}
+
+// Deadline returns the deadline carried in the request metadata, if any
+func (r *MCPRequest) Deadline() (time.Time, bool) {
+	s, _ := r.Metadata[MetadataDeadline].(string)
+	if s == "" {
+		return time.Time{}, false
+	}
+	deadline, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// SetDeadline stores deadline in the request metadata
+func (r *MCPRequest) SetDeadline(deadline time.Time) {
+	if r.Metadata == nil {
+		r.Metadata = make(map[string]interface{})
+	}
+	r.Metadata[MetadataDeadline] = deadline.UTC().Format(time.RFC3339Nano)
+}
+
+// IsNotification returns true if the request carries neither an ID nor a request_id
+func (r *MCPRequest) IsNotification() bool {
+	return r.ID == nil && r.RequestID() == ""
 }
 
 // MCPResponse extends the JSON-RPC Response with MCP-specific fields
 type MCPResponse struct {
-	JSONRPC string          `json:"jsonrpc"`
-	Status  MCPStatus       `json:"status"`
-	Data    json.RawMessage `json:"data,omitempty"`
-	Error   *Error          `json:"error,omitempty"`
-	Context interface{}     `json:"context,omitempty"`
-	ID      interface{}     `json:"id"`
+	JSONRPC  string                 `json:"jsonrpc"`
+	Status   MCPStatus              `json:"status"`
+	Data     json.RawMessage        `json:"data,omitempty"`
+	Error    *Error                 `json:"error,omitempty"`
+	Context  interface{}            `json:"context,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	ID       interface{}            `json:"id"`
+
+	// stream writes the data when the response is sent, in place of Data
+	stream DataWriter
 }
 
 // NewMCPRequest creates a new MCPRequest with the specified parameters
@@ -101,6 +163,63 @@ func NewMCPErrorResponse(err *Error, context interface{}, id interface{}) *MCPRe
 	}
 }
 
+// MCPErrorType is a machine-readable error category carried in the error "type" field
+type MCPErrorType string
+
+// Error types recommended by the MCP specification
+const (
+	MCPErrorValidation          MCPErrorType = "VALIDATION_ERROR"
+	MCPErrorActionNotFound      MCPErrorType = "ACTION_NOT_FOUND"
+	MCPErrorParameterMissing    MCPErrorType = "PARAMETER_MISSING"
+	MCPErrorAuthentication      MCPErrorType = "AUTHENTICATION_FAILED"
+	MCPErrorAuthorization       MCPErrorType = "AUTHORIZATION_FAILED"
+	MCPErrorResourceNotFound    MCPErrorType = "RESOURCE_NOT_FOUND"
+	MCPErrorRateLimitExceeded   MCPErrorType = "RATE_LIMIT_EXCEEDED"
+	MCPErrorQuotaExceeded       MCPErrorType = "QUOTA_EXCEEDED"
+	MCPErrorInternalServerError MCPErrorType = "INTERNAL_SERVER_ERROR"
+	MCPErrorTimeout             MCPErrorType = "TIMEOUT_ERROR"
+	MCPErrorDependency          MCPErrorType = "DEPENDENCY_ERROR"
+	MCPErrorInvalidState        MCPErrorType = "INVALID_STATE"
+	MCPErrorConflict            MCPErrorType = "CONFLICT"
+)
+
+// NewMCPError creates an Error with an MCP error type and optional details
+func NewMCPError(errType MCPErrorType, code int, message string, details interface{}) (*Error, error) {
+	var detailsJSON json.RawMessage
+	if details != nil {
+		bytes, err := json.Marshal(details)
+		if err != nil {
+			return nil, err
+		}
+		detailsJSON = json.RawMessage(bytes)
+	}
+
+	return &Error{
+		Code:    code,
+		Message: message,
+		Type:    errType,
+		Details: detailsJSON,
+	}, nil
+}
+
+// invalidParams returns the VALIDATION_ERROR for params that do not decode, naming the
+// offending field when the decoder reports one
+func invalidParams(err error) *Error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return invalidParam(typeErr.Field, fmt.Sprintf("Invalid parameter '%s': expected %s", typeErr.Field, typeErr.Type))
+	}
+	return invalidParam("params", "Invalid params: "+err.Error())
+}
+
+// invalidParam returns the VALIDATION_ERROR for the named parameter
+func invalidParam(name, message string) *Error {
+	e, _ := NewMCPError(MCPErrorValidation, ErrInvalidParams, message, map[string]string{
+		"parameter": name,
+	})
+	return e
+}
+
 // MCP-specific error codes
 const (
 	ErrMCPActionNotSupported = -33001
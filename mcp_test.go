@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewMCPRequest(t *testing.T) {
@@ -419,3 +420,124 @@ func TestJSONMarshalMCPResponse(t *testing.T) {
 		t.Errorf("data.result = %v, want %v", respData["result"], "completed")
 	}
 }
+
+func TestMCPRequestIsNotification(t *testing.T) {
+	tests := []struct {
+		name          string
+		req           *MCPRequest
+		wantRequestID string
+		want          bool
+	}{
+		{
+			name: "no id and no metadata",
+			req:  &MCPRequest{Action: "log.write"},
+			want: true,
+		},
+		{
+			name: "JSON-RPC id",
+			req:  &MCPRequest{Action: "file_system.read", ID: 1},
+			want: false,
+		},
+		{
+			name:          "metadata request_id",
+			req:           &MCPRequest{Action: "file_system.read", Metadata: map[string]interface{}{"request_id": "req-1"}},
+			wantRequestID: "req-1",
+			want:          false,
+		},
+		{
+			name: "non-string request_id is ignored",
+			req:  &MCPRequest{Action: "file_system.read", Metadata: map[string]interface{}{"request_id": 5}},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.RequestID(); got != tt.wantRequestID {
+				t.Errorf("RequestID() = %v, want %v", got, tt.wantRequestID)
+			}
+			if got := tt.req.IsNotification(); got != tt.want {
+				t.Errorf("IsNotification() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMCPError(t *testing.T) {
+	tests := []struct {
+		name        string
+		errType     MCPErrorType
+		code        int
+		message     string
+		details     interface{}
+		wantDetails string
+	}{
+		{
+			name:        "error with details",
+			errType:     MCPErrorResourceNotFound,
+			code:        404,
+			message:     "File '/data/file.txt' not found.",
+			details:     map[string]string{"path": "/data/file.txt"},
+			wantDetails: `{"path":"/data/file.txt"}`,
+		},
+		{
+			name:    "error without details",
+			errType: MCPErrorInternalServerError,
+			code:    500,
+			message: "An unexpected error occurred",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err, createErr := NewMCPError(tt.errType, tt.code, tt.message, tt.details)
+			if createErr != nil {
+				t.Fatalf("NewMCPError() error = %v", createErr)
+			}
+			if err.Type != tt.errType {
+				t.Errorf("err.Type = %v, want %v", err.Type, tt.errType)
+			}
+			if err.Code != tt.code {
+				t.Errorf("err.Code = %v, want %v", err.Code, tt.code)
+			}
+			if err.Message != tt.message {
+				t.Errorf("err.Message = %v, want %v", err.Message, tt.message)
+			}
+			if string(err.Details) != tt.wantDetails {
+				t.Errorf("err.Details = %s, want %s", err.Details, tt.wantDetails)
+			}
+
+			data, _ := json.Marshal(err)
+			var unmarshaled map[string]interface{}
+			json.Unmarshal(data, &unmarshaled)
+			if unmarshaled["type"] != string(tt.errType) {
+				t.Errorf("type = %v, want %v", unmarshaled["type"], tt.errType)
+			}
+		})
+	}
+}
+
+func TestMCPRequestDeadline(t *testing.T) {
+	req := &MCPRequest{}
+	if _, ok := req.Deadline(); ok {
+		t.Error("Deadline() ok = true for a request without deadline")
+	}
+
+	want := time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	req.SetDeadline(want)
+	data, _ := json.Marshal(req)
+
+	var decoded MCPRequest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal request: %v", err)
+	}
+	got, ok := decoded.Deadline()
+	if !ok || !got.Equal(want) {
+		t.Errorf("Deadline() = %v, %v, want %v", got, ok, want)
+	}
+
+	decoded.Metadata[MetadataDeadline] = "tomorrow"
+	if _, ok := decoded.Deadline(); ok {
+		t.Error("Deadline() ok = true for an invalid deadline")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuthSchemeTLS is the scheme of credentials taken from a verified client certificate
+const AuthSchemeTLS = "TLS"
+
+// DefaultTLSRefresh is how often certificate files are checked for changes when no interval is configured
+const DefaultTLSRefresh = time.Minute
+
+// TLSFiles names the PEM files of a mutual TLS setup
+type TLSFiles struct {
+	// CertFile and KeyFile hold the certificate chain and private key presented to the peer
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CA certificates the peer's certificate is verified against, required on
+	// servers and falling back to the system roots on clients
+	CAFile string
+	// Refresh is how often the files are checked for changes, zero uses DefaultTLSRefresh
+	Refresh time.Duration
+}
+
+// CertReloader holds a certificate and a CA pool loaded from disk and reloads them when the
+// files change, so certificates can be renewed without restarting servers or clients
+//
+// Files are checked at most once per refresh interval, on the next handshake. A reload that
+// fails, for instance because the key was not written yet, keeps the previous certificate and is
+// retried on the next check.
+type CertReloader struct {
+	files TLSFiles
+	now   func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	stamps  [3]fileStamp
+	checked time.Time
+}
+
+// NewCertReloader loads the files and returns a CertReloader serving them
+func NewCertReloader(files *TLSFiles) (*CertReloader, error) {
+	if files == nil || files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("tls: certificate and key files are required")
+	}
+	r := &CertReloader{files: *files, now: time.Now}
+	if r.files.Refresh <= 0 {
+		r.files.Refresh = DefaultTLSRefresh
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files now
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load(r.stat())
+}
+
+// current returns the certificate and CA pool, reloading them when the files changed
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := r.now(); now.Sub(r.checked) >= r.files.Refresh {
+		r.checked = now
+		if stamps := r.stat(); stamps != r.stamps {
+			_ = r.load(stamps)
+		}
+	}
+	return r.cert, r.pool
+}
+
+// stat returns the current stamps of the files, zero for missing ones
+func (r *CertReloader) stat() [3]fileStamp {
+	var stamps [3]fileStamp
+	for i, path := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if path == "" {
+			continue
+		}
+		stamps[i], _ = statFile(path)
+	}
+	return stamps
+}
+
+// load parses the files and records stamps as their version
+func (r *CertReloader) load(stamps [3]fileStamp) error {
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates in %s", r.files.CAFile)
+		}
+	}
+	r.cert, r.pool, r.stamps = &cert, pool, stamps
+	return nil
+}
+
+// ServerConfig returns a server configuration presenting the current certificate and requiring
+// client certificates signed by the current CA pool
+//
+// Every handshake uses a copy of the returned configuration with the current certificate and CA
+// pool, so settings such as NextProtos or CipherSuites made on it before use apply as well.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := r.current()
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates, c.ClientCAs = []tls.Certificate{*cert}, pool
+		return c, nil
+	}
+	return cfg
+}
+
+// ClientConfig returns a client configuration presenting the current certificate and trusting
+// the CA pool current at the time of the call
+//
+// The client certificate is reloaded at handshake time, while CA changes are picked up by the
+// configurations of later calls, so dial functions of long-lived clients should call it per dial.
+func (r *CertReloader) ClientConfig() *tls.Config {
+	_, pool := r.current()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+}
+
+// ServerTLSConfig returns a server configuration for mutual TLS that reloads files when they change
+//
+// Use it as the TLSConfig of an http.Server serving a WebSocketHandler or of a ListenerConfig.
+func ServerTLSConfig(files *TLSFiles) (*tls.Config, error) {
+	if files == nil || files.CAFile == "" {
+		return nil, errors.New("tls: a CA file is required to verify client certificates")
+	}
+	r, err := NewCertReloader(files)
+	if err != nil {
+		return nil, err
+	}
+	return r.ServerConfig(), nil
+}
+
+// ClientTLSConfig returns a client configuration for mutual TLS that reloads its certificate when
+// the files change
+//
+// Use it with DialStreamTLS, as the TLSConfig of a WebSocketConfig or in an http.Transport.
+func ClientTLSConfig(files *TLSFiles) (*tls.Config, error) {
+	r, err := NewCertReloader(files)
+	if err != nil {
+		return nil, err
+	}
+	return r.ClientConfig(), nil
+}
+
+// connTLS returns the TLS state of the connection serving ctx, if it is secured by TLS
+func connTLS(ctx context.Context) *tls.ConnectionState {
+	c := ConnFromContext(ctx)
+	if c == nil {
+		return nil
+	}
+	if t, ok := c.t.(interface {
+		TLSConnectionState() (tls.ConnectionState, bool)
+	}); ok {
+		if state, ok := t.TLSConnectionState(); ok {
+			return &state
+		}
+	}
+	return nil
+}
+
+// tlsCredentials returns certificate credentials when state holds a verified client certificate
+func tlsCredentials(state *tls.ConnectionState) *Credentials {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return &Credentials{Scheme: AuthSchemeTLS, TLS: state}
+}
+
+// CertificateAuthenticator turns verified client certificates into principals
+type CertificateAuthenticator struct {
+	identity func(cert *x509.Certificate) string
+}
+
+// NewCertificateAuthenticator creates a CertificateAuthenticator
+//
+// identity maps the client certificate to the principal ID, nil uses CertificateIdentity.
+// Certificates mapped to an empty ID are rejected.
+func NewCertificateAuthenticator(identity func(cert *x509.Certificate) string) *CertificateAuthenticator {
+	if identity == nil {
+		identity = CertificateIdentity
+	}
+	return &CertificateAuthenticator{identity: identity}
+}
+
+// CertificateIdentity returns the first URI SAN of cert, such as a SPIFFE ID, or else its first
+// DNS SAN, or else its subject common name
+func CertificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// Authenticate returns the principal of the client certificate verified during the handshake
+func (a *CertificateAuthenticator) Authenticate(ctx context.Context, cred *Credentials) (*Principal, error) {
+	if cred.Scheme != AuthSchemeTLS {
+		return nil, ErrUnsupportedCredentials
+	}
+	if cred.TLS == nil || len(cred.TLS.VerifiedChains) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	cert := cred.TLS.VerifiedChains[0][0]
+	id := a.identity(cert)
+	if id == "" {
+		return nil, ErrInvalidCredentials
+	}
+	uris := make([]string, len(cert.URIs))
+	for i, u := range cert.URIs {
+		uris[i] = u.String()
+	}
+	return &Principal{
+		ID:     id,
+		Scheme: AuthSchemeTLS,
+		Claims: map[string]interface{}{
+			"subject":   cert.Subject.String(),
+			"issuer":    cert.Issuer.String(),
+			"serial":    cert.SerialNumber.String(),
+			"dns_names": cert.DNSNames,
+			"uris":      uris,
+			"not_after": cert.NotAfter.UTC().Format(time.RFC3339),
+		},
+	}, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf certificate for tmpl
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTLSFiles writes a certificate issued by ca for tmpl into dir and returns the file names
+func writeTLSFiles(t *testing.T, dir string, ca *testCA, tmpl *x509.Certificate) *TLSFiles {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, tmpl)
+	files := &TLSFiles{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	for path, data := range map[string][]byte{files.CertFile: certPEM, files.KeyFile: keyPEM, files.CAFile: ca.pem} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+// serverCertificate is the template of a certificate valid for local servers
+func serverCertificate() *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mcp-server"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+}
+
+// agentCertificate is the template of a client certificate carrying a SPIFFE ID
+func agentCertificate(id string) *x509.Certificate {
+	u, _ := url.Parse(id)
+	return &x509.Certificate{Subject: pkix.Name{CommonName: "agent", Organization: []string{"agents"}}, URIs: []*url.URL{u}}
+}
+
+// principalOf calls whoami on client and returns the principal ID
+func principalOf(ctx context.Context, t *testing.T, client *Client) string {
+	t.Helper()
+	resp, err := client.CallMCP(ctx, "whoami", "", nil)
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	var data struct {
+		Principal *Principal `json:"principal"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil || data.Principal == nil {
+		t.Fatalf("response = %s, want a principal", resp.Data)
+	}
+	return data.Principal.ID
+}
+
+func TestMutualTLSListener(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	serverTLS, err := ServerTLSConfig(writeTLSFiles(t, t.TempDir(), ca, serverCertificate()))
+	if err != nil {
+		t.Fatalf("ServerTLSConfig() error = %v", err)
+	}
+	h := Chain(whoami, Authenticate(NewCertificateAuthenticator(nil)))
+	l := startListener(t, "tcp", "127.0.0.1:0", h, &ListenerConfig{TLSConfig: serverTLS})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientTLS, err := ClientTLSConfig(writeTLSFiles(t, t.TempDir(), ca, agentCertificate("spiffe://example.org/agent-1")))
+	if err != nil {
+		t.Fatalf("ClientTLSConfig() error = %v", err)
+	}
+	st, err := DialStreamTLS(ctx, "tcp", l.Addr().String(), NewlineFraming, clientTLS)
+	if err != nil {
+		t.Fatalf("DialStreamTLS() error = %v", err)
+	}
+	client := NewClient(st, nil)
+	defer client.Close()
+	if id := principalOf(ctx, t, client); id != "spiffe://example.org/agent-1" {
+		t.Errorf("principal = %q, want the SPIFFE ID of the client certificate", id)
+	}
+
+	tests := []struct {
+		name string
+		cfg  func() *tls.Config
+	}{
+		{name: "no client certificate", cfg: func() *tls.Config {
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.cert)
+			return &tls.Config{RootCAs: pool}
+		}},
+		{name: "certificate of another CA", cfg: func() *tls.Config {
+			cfg, _ := ClientTLSConfig(writeTLSFiles(t, t.TempDir(), newTestCA(t, "other CA"), agentCertificate("spiffe://example.org/evil")))
+			return cfg
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := DialStreamTLS(ctx, "tcp", l.Addr().String(), NewlineFraming, tt.cfg())
+			if err != nil {
+				return
+			}
+			client := NewClient(st, nil)
+			defer client.Close()
+			callCtx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			if _, err := client.CallMCP(callCtx, "whoami", "", nil); err == nil {
+				t.Error("CallMCP() error = nil, want the handshake to be rejected")
+			}
+		})
+	}
+}
+
+func TestMutualTLSWebSocket(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	serverTLS, err := ServerTLSConfig(writeTLSFiles(t, t.TempDir(), ca, serverCertificate()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewCertificateAuthenticator(nil)
+	srv := httptest.NewUnstartedServer(AuthenticateHTTP(auth, WebSocketHandler(Chain(whoami, Authenticate(auth)), nil)))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientTLS, err := ClientTLSConfig(writeTLSFiles(t, t.TempDir(), ca, agentCertificate("spiffe://example.org/agent-2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := DialWebSocket(ctx, wsURL(srv), &WebSocketConfig{TLSConfig: clientTLS})
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	client := NewClient(ws, nil)
+	defer client.Close()
+	if id := principalOf(ctx, t, client); id != "spiffe://example.org/agent-2" {
+		t.Errorf("principal = %q, want the SPIFFE ID of the client certificate", id)
+	}
+	if state, ok := ws.TLSConnectionState(); !ok || len(state.PeerCertificates) == 0 {
+		t.Error("TLSConnectionState() reports no server certificate")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	serverTLS, err := ServerTLSConfig(writeTLSFiles(t, t.TempDir(), ca, serverCertificate()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := startListener(t, "tcp", "127.0.0.1:0", Chain(whoami, Authenticate(NewCertificateAuthenticator(nil))), &ListenerConfig{TLSConfig: serverTLS})
+
+	dir := t.TempDir()
+	files := writeTLSFiles(t, dir, ca, agentCertificate("spiffe://example.org/agent-1"))
+	files.Refresh = time.Hour
+	reloader, err := NewCertReloader(files)
+	if err != nil {
+		t.Fatalf("NewCertReloader() error = %v", err)
+	}
+	clientTLS := reloader.ClientConfig()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dial := func() string {
+		st, err := DialStreamTLS(ctx, "tcp", l.Addr().String(), NewlineFraming, clientTLS)
+		if err != nil {
+			t.Fatalf("DialStreamTLS() error = %v", err)
+		}
+		client := NewClient(st, nil)
+		defer client.Close()
+		return principalOf(ctx, t, client)
+	}
+
+	writeTLSFiles(t, dir, ca, agentCertificate("spiffe://example.org/agent-1-renewed"))
+	if id := dial(); id != "spiffe://example.org/agent-1" {
+		t.Errorf("principal before the refresh interval = %q, want the loaded certificate", id)
+	}
+	reloader.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if id := dial(); id != "spiffe://example.org/agent-1-renewed" {
+		t.Errorf("principal after the refresh interval = %q, want the renewed certificate", id)
+	}
+
+	// A half-written renewal keeps the last good certificate
+	if err := os.WriteFile(files.KeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloader.now = func() time.Time { return time.Now().Add(4 * time.Hour) }
+	if id := dial(); id != "spiffe://example.org/agent-1-renewed" {
+		t.Errorf("principal after a broken renewal = %q, want the previous certificate", id)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Error("Reload() with a broken key error = nil")
+	}
+}
+
+func TestServerConfigKeepsSettings(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	serverTLS, err := ServerTLSConfig(writeTLSFiles(t, t.TempDir(), ca, serverCertificate()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS.NextProtos = []string{"mcp"}
+	serverTLS.MaxVersion = tls.VersionTLS12
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	clientTLS, err := ClientTLSConfig(writeTLSFiles(t, t.TempDir(), ca, agentCertificate("spiffe://example.org/agent-1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.NextProtos = []string{"mcp"}
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "mcp" {
+		t.Errorf("NegotiatedProtocol = %q, want the NextProtos of the server configuration", state.NegotiatedProtocol)
+	}
+	if state.Version != tls.VersionTLS12 {
+		t.Errorf("Version = %x, want the MaxVersion of the server configuration", state.Version)
+	}
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.org/a")
+	verified := func(cert *x509.Certificate) *tls.ConnectionState {
+		cert.SerialNumber = big.NewInt(7)
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	tests := []struct {
+		name string
+		cred *Credentials
+		want string
+		err  error
+	}{
+		{name: "URI SAN", cred: &Credentials{Scheme: AuthSchemeTLS, TLS: verified(&x509.Certificate{URIs: []*url.URL{u}, DNSNames: []string{"a.example.org"}})}, want: "spiffe://example.org/a"},
+		{name: "DNS SAN", cred: &Credentials{Scheme: AuthSchemeTLS, TLS: verified(&x509.Certificate{DNSNames: []string{"a.example.org"}, Subject: pkix.Name{CommonName: "a"}})}, want: "a.example.org"},
+		{name: "common name", cred: &Credentials{Scheme: AuthSchemeTLS, TLS: verified(&x509.Certificate{Subject: pkix.Name{CommonName: "a"}})}, want: "a"},
+		{name: "no identity", cred: &Credentials{Scheme: AuthSchemeTLS, TLS: verified(&x509.Certificate{})}, err: ErrInvalidCredentials},
+		{name: "unverified", cred: &Credentials{Scheme: AuthSchemeTLS, TLS: &tls.ConnectionState{}}, err: ErrInvalidCredentials},
+		{name: "bearer token", cred: &Credentials{Scheme: AuthSchemeBearer, Token: "t"}, err: ErrUnsupportedCredentials},
+	}
+	a := NewCertificateAuthenticator(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(context.Background(), tt.cred)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Authenticate() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil || p.ID != tt.want || p.Scheme != AuthSchemeTLS || p.Claims["serial"] != "7" {
+				t.Errorf("Authenticate() = %+v, %v, want %s", p, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrCursorRepeated is returned by a PageIterator when the server answers a page with a cursor
+// it already returned, which would otherwise loop forever
+var ErrCursorRepeated = errors.New("pagination: server returned the same cursor again")
+
+// Page size defaults used by a Paginator
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 1000
+)
+
+// PageParams are the pagination params of a list action
+type PageParams struct {
+	// Cursor is the next_cursor of the previous page, empty for the first page
+	Cursor string `json:"cursor,omitempty"`
+	// Limit is the maximum number of items in the page, zero uses the server default
+	Limit int `json:"limit,omitempty"`
+}
+
+// Page is the result envelope of a list action
+type Page struct {
+	Items interface{} `json:"items"`
+	// NextCursor is passed as the cursor param to get the next page, it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListFunc returns up to limit items of a list action starting at position, an empty position
+// being the start of the list
+//
+// items must encode as a JSON array. next is the position of the following page, empty when
+// there is none. Positions are opaque to clients, such as an offset or the key of the last item.
+type ListFunc func(ctx context.Context, req *MCPRequest, position string, limit int) (items interface{}, next string, err error)
+
+// Paginator turns list positions into opaque cursors signed with a secret key, so clients
+// cannot forge or alter them, and serves paginated list actions
+type Paginator struct {
+	key []byte
+	// DefaultLimit is the page size when the request has no limit, zero uses DefaultPageLimit
+	DefaultLimit int
+	// MaxLimit caps the requested page size, zero uses MaxPageLimit
+	MaxLimit int
+}
+
+// NewPaginator creates a Paginator signing cursors with key
+//
+// A nil key uses a random one, so cursors stay valid only as long as the Paginator. Servers
+// behind a load balancer must share the key.
+func NewPaginator(key []byte) *Paginator {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &Paginator{key: key}
+}
+
+// EncodeCursor returns the cursor for position in the list served by action
+func (p *Paginator) EncodeCursor(action MCPAction, position string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(position))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(p.sign(action, payload))
+}
+
+// DecodeCursor returns the position held by a cursor issued for action, and a VALIDATION_ERROR
+// when the cursor was altered or belongs to another action
+func (p *Paginator) DecodeCursor(action MCPAction, cursor string) (string, error) {
+	payload, sig, ok := strings.Cut(cursor, ".")
+	if ok {
+		mac, err := base64.RawURLEncoding.DecodeString(sig)
+		if err == nil && hmac.Equal(mac, p.sign(action, payload)) {
+			if position, err := base64.RawURLEncoding.DecodeString(payload); err == nil {
+				return string(position), nil
+			}
+		}
+	}
+	e, _ := NewMCPError(MCPErrorValidation, ErrInvalidParams, "Invalid cursor", map[string]string{
+		"parameter": "cursor",
+	})
+	return "", e
+}
+
+// sign returns the MAC binding payload to action
+func (p *Paginator) sign(action MCPAction, payload string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(action))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Handler returns a handler serving a paginated list action with list
+//
+// It decodes the cursor and limit params, clamps the limit and answers with a Page. The other
+// params are left to list, which reads them from req.
+func (p *Paginator) Handler(list ListFunc) MCPHandler {
+	return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		var params PageParams
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return NewMCPErrorResponse(invalidParams(err), nil, req.ID)
+			}
+		}
+
+		var position string
+		if params.Cursor != "" {
+			var err error
+			if position, err = p.DecodeCursor(req.Action, params.Cursor); err != nil {
+				return errorResponse(err, req)
+			}
+		}
+
+		items, next, err := list(ctx, req, position, p.limit(params.Limit))
+		if err != nil {
+			return errorResponse(err, req)
+		}
+		page := &Page{Items: items}
+		if page.Items == nil {
+			page.Items = []interface{}{}
+		}
+		if next != "" {
+			page.NextCursor = p.EncodeCursor(req.Action, next)
+		}
+		return dataResponse(page, req)
+	}
+}
+
+// limit returns the page size to use for a requested limit
+func (p *Paginator) limit(requested int) int {
+	limit, maxLimit := p.DefaultLimit, p.MaxLimit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if maxLimit <= 0 {
+		maxLimit = MaxPageLimit
+	}
+	if requested > 0 {
+		limit = requested
+	}
+	return min(limit, maxLimit)
+}
+
+// OffsetPage returns the bounds of the page of an n-item slice starting at an offset position,
+// and the position of the following page, for list actions over in-memory data
+func OffsetPage(position string, limit, n int) (start, end int, next string, err error) {
+	if position != "" {
+		if start, err = strconv.Atoi(position); err != nil || start < 0 {
+			return 0, 0, "", errors.New("pagination: invalid offset position")
+		}
+	}
+	start = min(start, n)
+	end = min(start+limit, n)
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+	return start, end, next, nil
+}
+
+// PageIterator walks the items of a paginated list action, following cursors across pages
+//
+//	it := client.Paginate("file_system.list", "", params, 100)
+//	for it.Next(ctx) {
+//		var f File
+//		if err := it.Decode(&f); err != nil { ... }
+//	}
+//	if err := it.Err(); err != nil { ... }
+type PageIterator struct {
+	client *Client
+	action MCPAction
+	tool   string
+	params map[string]json.RawMessage
+	limit  int
+
+	items  []json.RawMessage
+	item   json.RawMessage
+	cursor string
+	seen   map[string]struct{}
+	done   bool
+	err    error
+}
+
+// Paginate returns an iterator over the items of the list action, requesting pages of limit items
+//
+// params must encode as a JSON object or be nil, the cursor and limit params are added to it. A
+// zero limit uses the server default.
+func (c *Client) Paginate(action MCPAction, tool string, params interface{}, limit int) *PageIterator {
+	it := &PageIterator{client: c, action: action, tool: tool, limit: limit}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err == nil {
+			err = json.Unmarshal(data, &it.params)
+		}
+		if err != nil {
+			it.err = err
+		}
+	}
+	return it
+}
+
+// Next advances to the next item, fetching the following page when needed, and reports whether
+// there is one
+func (it *PageIterator) Next(ctx context.Context) bool {
+	for len(it.items) == 0 {
+		if it.err != nil || it.done {
+			return false
+		}
+		it.fetch(ctx)
+	}
+	it.item, it.items = it.items[0], it.items[1:]
+	return true
+}
+
+// fetch requests the page at the current cursor
+func (it *PageIterator) fetch(ctx context.Context) {
+	params := make(map[string]interface{}, len(it.params)+2)
+	for k, v := range it.params {
+		params[k] = v
+	}
+	if it.cursor != "" {
+		params["cursor"] = it.cursor
+	}
+	if it.limit > 0 {
+		params["limit"] = it.limit
+	}
+
+	resp, err := it.client.CallMCP(ctx, it.action, it.tool, params)
+	if err != nil {
+		it.err = err
+		return
+	}
+	var page struct {
+		Items      []json.RawMessage `json:"items"`
+		NextCursor string            `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(resp.Data, &page); err != nil {
+		it.err = err
+		return
+	}
+	if page.NextCursor != "" {
+		if _, ok := it.seen[page.NextCursor]; ok {
+			it.err = ErrCursorRepeated
+			return
+		}
+		if it.seen == nil {
+			it.seen = make(map[string]struct{})
+		}
+		it.seen[page.NextCursor] = struct{}{}
+	}
+	it.items = page.Items
+	it.cursor = page.NextCursor
+	it.done = page.NextCursor == ""
+}
+
+// Item returns the raw JSON of the current item
+func (it *PageIterator) Item() json.RawMessage {
+	return it.item
+}
+
+// Decode stores the current item in v
+func (it *PageIterator) Decode(v interface{}) error {
+	return json.Unmarshal(it.item, v)
+}
+
+// Cursor returns the cursor of the page following the items fetched so far, which lets a later
+// iteration resume there
+func (it *PageIterator) Cursor() string {
+	return it.cursor
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *PageIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPaginatorCursor(t *testing.T) {
+	p := NewPaginator([]byte("secret"))
+	cursor := p.EncodeCursor("file_system.list", "42")
+
+	if position, err := p.DecodeCursor("file_system.list", cursor); err != nil || position != "42" {
+		t.Errorf("DecodeCursor() = %q, %v, want 42", position, err)
+	}
+
+	payload, sig, _ := strings.Cut(cursor, ".")
+	forged := p.EncodeCursor("file_system.list", "43")
+	_, forgedSig, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name   string
+		action MCPAction
+		cursor string
+	}{
+		{"other action", "job.list", cursor},
+		{"altered position", "file_system.list", forged[:strings.IndexByte(forged, '.')] + "." + sig},
+		{"swapped signature", "file_system.list", payload + "." + forgedSig},
+		{"other key", "file_system.list", NewPaginator([]byte("other")).EncodeCursor("file_system.list", "42")},
+		{"garbage", "file_system.list", "not a cursor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.DecodeCursor(tt.action, tt.cursor)
+			var mcpErr *Error
+			if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorValidation {
+				t.Errorf("DecodeCursor() error = %v, want %s", err, MCPErrorValidation)
+			}
+		})
+	}
+}
+
+func TestOffsetPage(t *testing.T) {
+	tests := []struct {
+		position   string
+		limit, n   int
+		start, end int
+		next       string
+	}{
+		{"", 2, 5, 0, 2, "2"},
+		{"2", 2, 5, 2, 4, "4"},
+		{"4", 2, 5, 4, 5, ""},
+		{"", 10, 5, 0, 5, ""},
+		{"9", 2, 5, 5, 5, ""},
+	}
+	for _, tt := range tests {
+		start, end, next, err := OffsetPage(tt.position, tt.limit, tt.n)
+		if err != nil || start != tt.start || end != tt.end || next != tt.next {
+			t.Errorf("OffsetPage(%q, %d, %d) = %d, %d, %q, %v, want %d, %d, %q",
+				tt.position, tt.limit, tt.n, start, end, next, err, tt.start, tt.end, tt.next)
+		}
+	}
+	if _, _, _, err := OffsetPage("-1", 2, 5); err == nil {
+		t.Error("OffsetPage() with a negative offset succeeded")
+	}
+}
+
+// listNumbers serves the numbers from 1 to n, filtered by the odd param
+func listNumbers(n int) ListFunc {
+	return func(ctx context.Context, req *MCPRequest, position string, limit int) (interface{}, string, error) {
+		var params struct {
+			Odd bool `json:"odd"`
+		}
+		json.Unmarshal(req.Params, &params)
+		var numbers []int
+		for i := 1; i <= n; i++ {
+			if !params.Odd || i%2 == 1 {
+				numbers = append(numbers, i)
+			}
+		}
+		start, end, next, err := OffsetPage(position, limit, len(numbers))
+		if err != nil {
+			return nil, "", err
+		}
+		return numbers[start:end], next, nil
+	}
+}
+
+func TestPaginatorHandler(t *testing.T) {
+	p := NewPaginator(nil)
+	p.MaxLimit = 3
+	h := p.Handler(listNumbers(5))
+
+	call := func(params interface{}) (*Page, *MCPResponse) {
+		req, _ := NewMCPRequest("numbers.list", params, nil, "", 1)
+		resp := dispatchRequest(context.Background(), req, h)
+		var page struct {
+			Items      []int  `json:"items"`
+			NextCursor string `json:"next_cursor"`
+		}
+		json.Unmarshal(resp.Data, &page)
+		return &Page{Items: page.Items, NextCursor: page.NextCursor}, resp
+	}
+
+	first, _ := call(map[string]int{"limit": 10})
+	if len(first.Items.([]int)) != 3 || first.NextCursor == "" {
+		t.Fatalf("first page = %+v, want 3 items clamped by MaxLimit and a cursor", first)
+	}
+	second, _ := call(map[string]interface{}{"cursor": first.NextCursor, "limit": 10})
+	if got := second.Items.([]int); len(got) != 2 || got[0] != 4 || second.NextCursor != "" {
+		t.Errorf("last page = %+v, want [4 5] without cursor", second)
+	}
+
+	_, resp := call(map[string]string{"cursor": first.NextCursor + "x"})
+	if resp.Error == nil || resp.Error.Type != MCPErrorValidation {
+		t.Errorf("tampered cursor error = %v, want %s", resp.Error, MCPErrorValidation)
+	}
+
+	empty := p.Handler(func(ctx context.Context, req *MCPRequest, position string, limit int) (interface{}, string, error) {
+		return nil, "", nil
+	})
+	req, _ := NewMCPRequest("numbers.list", nil, nil, "", 1)
+	if resp := dispatchRequest(context.Background(), req, empty); string(resp.Data) != `{"items":[]}` {
+		t.Errorf("empty page = %s, want an empty items array", resp.Data)
+	}
+}
+
+func TestClientPaginate(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("numbers.list", NewPaginator(nil).Handler(listNumbers(7)))
+	client := pipeClient(t, mux.ServeMCP)
+
+	it := client.Paginate("numbers.list", "", map[string]bool{"odd": true}, 2)
+	var got []int
+	for it.Next(context.Background()) {
+		var n int
+		if err := it.Decode(&n); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		got = append(got, n)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if len(got) != 4 || got[0] != 1 || got[3] != 7 {
+		t.Errorf("items = %v, want [1 3 5 7]", got)
+	}
+
+	it = client.Paginate("missing.list", "", nil, 0)
+	var mcpErr *Error
+	if it.Next(context.Background()) || !errors.As(it.Err(), &mcpErr) || mcpErr.Type != MCPErrorActionNotFound {
+		t.Errorf("Err() = %v, want %s", it.Err(), MCPErrorActionNotFound)
+	}
+
+	if it := client.Paginate("numbers.list", "", []int{1}, 0); it.Next(context.Background()) || it.Err() == nil {
+		t.Error("Paginate() with non-object params succeeded")
+	}
+}
+
+func TestClientPaginateRepeatedCursor(t *testing.T) {
+	tests := []struct {
+		name string
+		next map[string]string
+	}{
+		{name: "same cursor", next: map[string]string{"": "a", "a": "a"}},
+		{name: "cycle", next: map[string]string{"": "a", "a": "b", "b": "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := pipeClient(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+				var params PageParams
+				json.Unmarshal(req.Params, &params)
+				resp, _ := NewMCPResponse(MCPStatusSuccess, Page{Items: []int{1}, NextCursor: tt.next[params.Cursor]}, nil, nil)
+				return resp
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			it := client.Paginate("numbers.list", "", nil, 0)
+			n := 0
+			for it.Next(ctx) {
+				n++
+			}
+			if !errors.Is(it.Err(), ErrCursorRepeated) || n != len(tt.next)-1 {
+				t.Errorf("Next() stopped after %d items with %v, want %d items and %v", n, it.Err(), len(tt.next)-1, ErrCursorRepeated)
+			}
+		})
+	}
+}
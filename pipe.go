@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// PipeFault is a fault injected into a single message travelling through a Pipe
+type PipeFault int
+
+// Faults supported by Pipe
+const (
+	// FaultNone delivers the message unchanged
+	FaultNone PipeFault = iota
+	// FaultDrop silently discards the message
+	FaultDrop
+	// FaultDuplicate delivers the message twice
+	FaultDuplicate
+	// FaultReorder holds the message back until the next message in the same direction was delivered
+	FaultReorder
+)
+
+// PipeOptions configures latency and fault injection for a Pipe
+//
+// Random faults are drawn from a generator seeded with Seed in the order messages are sent,
+// so a test that sends messages sequentially sees the same faults on every run.
+type PipeOptions struct {
+	// Latency delays the delivery of every message
+	Latency time.Duration
+	// DropRate is the probability in [0, 1] that a message is dropped
+	DropRate float64
+	// DuplicateRate is the probability in [0, 1] that a message is delivered twice
+	DuplicateRate float64
+	// ReorderRate is the probability in [0, 1] that a message is delivered after the next one
+	ReorderRate float64
+	// Seed initialises the random generator used for faults
+	Seed uint64
+	// Faults, when set, picks the fault for each message instead of the random rates
+	Faults func(toServer bool, msg []byte) PipeFault
+}
+
+// PipeStats counts the faults injected in one direction of a Pipe
+type PipeStats struct {
+	Sent       int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+}
+
+// PipeTransport is one end of an in-memory Pipe
+type PipeTransport struct {
+	out   *pipeLink
+	in    *pipeLink
+	state *pipeState
+}
+
+// pipeState is shared by both ends of a Pipe
+type pipeState struct {
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// pipeMessage is a message in flight
+type pipeMessage struct {
+	data   []byte
+	binary bool
+	at     time.Time
+}
+
+// pipeLink carries messages in one direction and applies faults to them
+type pipeLink struct {
+	opts     PipeOptions
+	toServer bool
+	state    *pipeState
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	stats   PipeStats
+	held    *pipeMessage
+	pending []pipeMessage
+	wake    chan struct{}
+
+	text   *pipeQueue
+	binary *pipeQueue
+}
+
+// Pipe returns a connected client and server transport pair that exchange messages in memory
+//
+// A nil opts gives a reliable pipe without latency. Closing either end closes both.
+func Pipe(opts *PipeOptions) (client, server *PipeTransport) {
+	var o PipeOptions
+	if opts != nil {
+		o = *opts
+	}
+	state := &pipeState{done: make(chan struct{})}
+	toServer := newPipeLink(o, true, state)
+	toClient := newPipeLink(o, false, state)
+
+	client = &PipeTransport{out: toServer, in: toClient, state: state}
+	server = &PipeTransport{out: toClient, in: toServer, state: state}
+	return client, server
+}
+
+// Send queues msg for delivery to the other end
+func (t *PipeTransport) Send(ctx context.Context, msg []byte) error {
+	return t.out.send(ctx, bytes.Clone(msg), false)
+}
+
+// SendStream queues the message produced by write for delivery to the other end
+//
+// Messages travel through a pipe whole, so it is produced in memory, where it is delivered
+// without a further copy. Nothing is sent when write fails.
+func (t *PipeTransport) SendStream(ctx context.Context, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	return t.out.send(ctx, buf.Bytes(), false)
+}
+
+// SendBinary queues a binary payload for delivery to the other end
+func (t *PipeTransport) SendBinary(ctx context.Context, data []byte) error {
+	return t.out.send(ctx, bytes.Clone(data), true)
+}
+
+// Receive returns the next message sent by the other end
+func (t *PipeTransport) Receive(ctx context.Context) ([]byte, error) {
+	return t.in.text.pop(ctx, t.state.done)
+}
+
+// ReceiveBinary returns the next binary payload sent by the other end
+func (t *PipeTransport) ReceiveBinary(ctx context.Context) ([]byte, error) {
+	return t.in.binary.pop(ctx, t.state.done)
+}
+
+// Close closes both ends of the pipe
+func (t *PipeTransport) Close() error {
+	t.state.closeOnce.Do(func() {
+		close(t.state.done)
+	})
+	return nil
+}
+
+// Stats returns the faults injected into messages sent from this end
+func (t *PipeTransport) Stats() PipeStats {
+	t.out.mu.Lock()
+	defer t.out.mu.Unlock()
+	return t.out.stats
+}
+
+// newPipeLink creates a link and starts its delivery loop
+func newPipeLink(opts PipeOptions, toServer bool, state *pipeState) *pipeLink {
+	seed := opts.Seed
+	if !toServer {
+		seed = ^seed
+	}
+	l := &pipeLink{
+		opts:     opts,
+		toServer: toServer,
+		state:    state,
+		rng:      rand.New(rand.NewPCG(seed, seed>>1|1)),
+		wake:     make(chan struct{}, 1),
+		text:     newPipeQueue(),
+		binary:   newPipeQueue(),
+	}
+	go l.deliver()
+	return l
+}
+
+// send applies faults to msg and queues the resulting deliveries, taking ownership of data
+func (l *pipeLink) send(ctx context.Context, data []byte, binary bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-l.state.done:
+		return ErrTransportClosed
+	default:
+	}
+
+	msg := pipeMessage{data: data, binary: binary}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stats.Sent++
+	switch l.fault(msg.data) {
+	case FaultDrop:
+		l.stats.Dropped++
+		return nil
+	case FaultDuplicate:
+		l.stats.Duplicated++
+		l.enqueue(msg)
+		l.enqueue(msg)
+	case FaultReorder:
+		if l.held == nil {
+			l.stats.Reordered++
+			l.held = &msg
+			return nil
+		}
+		l.enqueue(msg)
+	default:
+		l.enqueue(msg)
+	}
+
+	if l.held != nil && l.held != &msg {
+		l.enqueue(*l.held)
+		l.held = nil
+	}
+	return nil
+}
+
+// fault picks the fault for the next message, the caller holds l.mu
+func (l *pipeLink) fault(data []byte) PipeFault {
+	if l.opts.Faults != nil {
+		return l.opts.Faults(l.toServer, data)
+	}
+	switch r := l.rng.Float64(); {
+	case r < l.opts.DropRate:
+		return FaultDrop
+	case r < l.opts.DropRate+l.opts.DuplicateRate:
+		return FaultDuplicate
+	case r < l.opts.DropRate+l.opts.DuplicateRate+l.opts.ReorderRate:
+		return FaultReorder
+	}
+	return FaultNone
+}
+
+// enqueue schedules msg for delivery after the configured latency, the caller holds l.mu
+func (l *pipeLink) enqueue(msg pipeMessage) {
+	msg.at = time.Now().Add(l.opts.Latency)
+	l.pending = append(l.pending, msg)
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver moves due messages to the receiving queues in order
+func (l *pipeLink) deliver() {
+	for {
+		l.mu.Lock()
+		if len(l.pending) == 0 {
+			l.mu.Unlock()
+			select {
+			case <-l.wake:
+				continue
+			case <-l.state.done:
+				return
+			}
+		}
+		msg := l.pending[0]
+		l.pending = l.pending[1:]
+		l.mu.Unlock()
+
+		if wait := time.Until(msg.at); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-l.state.done:
+				timer.Stop()
+				return
+			}
+		}
+
+		if msg.binary {
+			l.binary.push(msg.data)
+		} else {
+			l.text.push(msg.data)
+		}
+	}
+}
+
+// pipeQueue is an unbounded FIFO of delivered messages
+type pipeQueue struct {
+	mu     sync.Mutex
+	items  [][]byte
+	notify chan struct{}
+}
+
+// newPipeQueue creates an empty queue
+func newPipeQueue() *pipeQueue {
+	return &pipeQueue{notify: make(chan struct{}, 1)}
+}
+
+// push appends a message and wakes a waiting reader
+func (q *pipeQueue) push(data []byte) {
+	q.mu.Lock()
+	q.items = append(q.items, data)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest message, blocking until one is available
+func (q *pipeQueue) pop(ctx context.Context, done chan struct{}) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			data := q.items[0]
+			q.items = q.items[1:]
+			more := len(q.items) > 0
+			q.mu.Unlock()
+			if more {
+				select {
+				case q.notify <- struct{}{}:
+				default:
+				}
+			}
+			return data, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-done:
+			return nil, ErrTransportClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPipeWithDispatcher(t *testing.T) {
+	client, server := Pipe(nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go ServeTransport(ctx, server, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, req.Params, nil, nil)
+		return resp
+	})
+
+	resp := roundTrip(ctx, t, client, 1, map[string]string{"hello": "pipe"})
+	if resp.Status != MCPStatusSuccess {
+		t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+	}
+	if string(resp.Data) != `{"hello":"pipe"}` {
+		t.Errorf("resp.Data = %s, want %s", resp.Data, `{"hello":"pipe"}`)
+	}
+}
+
+func TestPipeFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault PipeFault
+		want  []string
+		stats PipeStats
+	}{
+		{
+			name:  "no fault",
+			fault: FaultNone,
+			want:  []string{"a", "b", "c"},
+			stats: PipeStats{Sent: 3},
+		},
+		{
+			name:  "drop",
+			fault: FaultDrop,
+			want:  []string{"b", "c"},
+			stats: PipeStats{Sent: 3, Dropped: 1},
+		},
+		{
+			name:  "duplicate",
+			fault: FaultDuplicate,
+			want:  []string{"a", "a", "b", "c"},
+			stats: PipeStats{Sent: 3, Duplicated: 1},
+		},
+		{
+			name:  "reorder",
+			fault: FaultReorder,
+			want:  []string{"b", "a", "c"},
+			stats: PipeStats{Sent: 3, Reordered: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := Pipe(&PipeOptions{
+				Faults: func(toServer bool, msg []byte) PipeFault {
+					if toServer && string(msg) == "a" {
+						return tt.fault
+					}
+					return FaultNone
+				},
+			})
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			for _, msg := range []string{"a", "b", "c"} {
+				if err := client.Send(ctx, []byte(msg)); err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+			}
+
+			var got []string
+			for range tt.want {
+				msg, err := server.Receive(ctx)
+				if err != nil {
+					t.Fatalf("Receive() error = %v", err)
+				}
+				got = append(got, string(msg))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("received %v, want %v", got, tt.want)
+			}
+			if stats := client.Stats(); stats != tt.stats {
+				t.Errorf("Stats() = %+v, want %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+func TestPipeSeededFaultsAreDeterministic(t *testing.T) {
+	opts := &PipeOptions{DropRate: 0.2, DuplicateRate: 0.2, ReorderRate: 0.2, Seed: 42}
+
+	run := func() ([]string, PipeStats) {
+		client, server := Pipe(opts)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		for i := 0; i < 50; i++ {
+			client.Send(ctx, []byte(fmt.Sprint(i)))
+		}
+
+		var got []string
+		for {
+			idle, idleCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			msg, err := server.Receive(idle)
+			idleCancel()
+			if err != nil {
+				return got, client.Stats()
+			}
+			got = append(got, string(msg))
+		}
+	}
+
+	first, firstStats := run()
+	second, secondStats := run()
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("runs differ:\n%v\n%v", first, second)
+	}
+	if firstStats != secondStats {
+		t.Errorf("stats differ: %+v vs %+v", firstStats, secondStats)
+	}
+	if firstStats.Dropped == 0 || firstStats.Duplicated == 0 || firstStats.Reordered == 0 {
+		t.Errorf("Stats() = %+v, want every fault kind injected", firstStats)
+	}
+}
+
+func TestPipeLatency(t *testing.T) {
+	client, server := Pipe(&PipeOptions{Latency: 50 * time.Millisecond})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	client.Send(ctx, []byte(`{}`))
+	if _, err := server.Receive(ctx); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("message delivered after %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestPipeDroppedResponseTimesOut(t *testing.T) {
+	client, server := Pipe(&PipeOptions{
+		Faults: func(toServer bool, msg []byte) PipeFault {
+			var resp MCPResponse
+			if !toServer && json.Unmarshal(msg, &resp) == nil && resp.ID == float64(1) {
+				return FaultDrop
+			}
+			return FaultNone
+		},
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go ServeTransport(ctx, server, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	})
+
+	req, _ := NewMCPRequest("echo", nil, nil, "", 1)
+	data, _ := json.Marshal(req)
+	client.Send(ctx, data)
+
+	short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	if _, err := client.Receive(short); err != context.DeadlineExceeded {
+		t.Fatalf("Receive() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	resp := roundTrip(ctx, t, client, 2, nil)
+	if resp.ID != float64(2) {
+		t.Errorf("resp.ID = %v, want 2", resp.ID)
+	}
+}
+
+func TestPipeBinaryAndClose(t *testing.T) {
+	client, server := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client.SendBinary(ctx, []byte{1, 2, 3})
+	got, err := server.ReceiveBinary(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveBinary() error = %v", err)
+	}
+	if !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("ReceiveBinary() = %v, want [1 2 3]", got)
+	}
+
+	server.Close()
+	if _, err := client.Receive(ctx); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Receive() error = %v, want %v", err, ErrTransportClosed)
+	}
+	if err := client.Send(ctx, []byte(`{}`)); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Send() error = %v, want %v", err, ErrTransportClosed)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultPolicyRefresh is how often a FilePolicy checks its file for changes when no interval is configured
+const DefaultPolicyRefresh = 10 * time.Second
+
+// Authorizer decides whether a principal may invoke an action, with a tool for tool-based actions
+//
+// Implementations must be safe for concurrent use.
+type Authorizer interface {
+	Allowed(p *Principal, action, tool string) bool
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(p *Principal, action, tool string) bool
+
+// Allowed calls f
+func (f AuthorizerFunc) Allowed(p *Principal, action, tool string) bool {
+	return f(p, action, tool)
+}
+
+// Authorize returns a middleware that answers requests the principal authenticated by Authenticate
+// may not invoke with AUTHORIZATION_FAILED, naming the denied action and tool in the details
+//
+// Requests without a principal are denied.
+func Authorize(a Authorizer) Middleware {
+	return func(next MCPHandler) MCPHandler {
+		return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+			if !a.Allowed(PrincipalFromContext(ctx), string(req.Action), req.Tool) {
+				return NewMCPErrorResponse(authorizationFailed(req), nil, req.ID)
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// AuthorizeHTTP wraps next, typically a WebSocketHandler behind AuthenticateHTTP, so that only
+// principals allowed action may reach it
+//
+// Other requests, including requests without a principal, are answered with 403 Forbidden and an
+// AUTHORIZATION_FAILED response naming action in the details. The requests sent over the
+// connection are checked one by one by the Authorize middleware.
+func AuthorizeHTTP(a Authorizer, action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.Allowed(PrincipalFromContext(r.Context()), action, "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		req := &MCPRequest{Action: MCPAction(action)}
+		_ = json.NewEncoder(w).Encode(NewMCPErrorResponse(authorizationFailed(req), nil, nil))
+	})
+}
+
+// authorizationFailed returns the AUTHORIZATION_FAILED error for req
+func authorizationFailed(req *MCPRequest) *Error {
+	details := map[string]string{"action": string(req.Action)}
+	if req.Tool != "" {
+		details["tool"] = req.Tool
+	}
+	e, _ := NewMCPError(MCPErrorAuthorization, ErrMCPExecutionFailed, "Not permitted to perform the action", details)
+	return e
+}
+
+// Policy is a role-based access control policy
+//
+// Roles grant and deny actions through rules, and bindings give roles to principals. A request is
+// allowed when a rule of one of the principal's roles allows it and none denies it, so deny rules
+// take precedence and everything not explicitly allowed is denied.
+type Policy struct {
+	Roles    map[string]*Role `json:"roles"`
+	Bindings []RoleBinding    `json:"bindings"`
+}
+
+// Role is a named set of allow and deny rules
+type Role struct {
+	Allow []PolicyRule `json:"allow,omitempty"`
+	Deny  []PolicyRule `json:"deny,omitempty"`
+}
+
+// PolicyRule matches requests by action and tool
+//
+// Patterns use path.Match syntax, so "file_system.*" matches every action of the file_system
+// namespace and "*" every action. Without tool patterns the rule matches any tool.
+type PolicyRule struct {
+	Actions []string `json:"actions"`
+	Tools   []string `json:"tools,omitempty"`
+}
+
+// RoleBinding gives a role to the principals whose ID matches one of Principals, or who hold
+// one of Scopes
+//
+// Principal patterns use path.Match syntax, "spiffe://example.org/ops/*" matches every principal
+// of that path.
+type RoleBinding struct {
+	Role       string   `json:"role"`
+	Principals []string `json:"principals,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+}
+
+// ParsePolicy parses and validates a JSON or YAML policy document
+//
+// Documents starting with { are parsed as JSON, others as YAML. The YAML support covers block and
+// flow mappings and sequences, quoted and plain scalars and comments, which is what policies need;
+// anchors, tags and block scalars are rejected.
+func ParsePolicy(data []byte) (*Policy, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		doc, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that bindings name defined roles and that every pattern is well formed
+func (p *Policy) Validate() error {
+	for name, role := range p.Roles {
+		if role == nil {
+			return fmt.Errorf("policy: role %q is empty", name)
+		}
+		for _, rules := range [][]PolicyRule{role.Allow, role.Deny} {
+			for _, rule := range rules {
+				if len(rule.Actions) == 0 {
+					return fmt.Errorf("policy: role %q has a rule without actions", name)
+				}
+				if err := validPatterns(rule.Actions, rule.Tools); err != nil {
+					return fmt.Errorf("policy: role %q: %w", name, err)
+				}
+			}
+		}
+	}
+	for _, b := range p.Bindings {
+		if _, ok := p.Roles[b.Role]; !ok {
+			return fmt.Errorf("policy: binding to undefined role %q", b.Role)
+		}
+		if err := validPatterns(b.Principals); err != nil {
+			return fmt.Errorf("policy: binding of role %q: %w", b.Role, err)
+		}
+	}
+	return nil
+}
+
+// validPatterns reports the first malformed pattern
+func validPatterns(lists ...[]string) error {
+	for _, patterns := range lists {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the roles bound to principal allow action with tool
+func (p *Policy) Allowed(principal *Principal, action, tool string) bool {
+	if principal == nil {
+		return false
+	}
+	allowed := false
+	for _, b := range p.Bindings {
+		if !b.matches(principal) {
+			continue
+		}
+		role := p.Roles[b.Role]
+		for _, rule := range role.Deny {
+			if rule.matches(action, tool) {
+				return false
+			}
+		}
+		for _, rule := range role.Allow {
+			if rule.matches(action, tool) {
+				allowed = true
+			}
+		}
+	}
+	return allowed
+}
+
+// matches reports whether the binding applies to principal
+func (b *RoleBinding) matches(principal *Principal) bool {
+	if matchAny(b.Principals, principal.ID) {
+		return true
+	}
+	for _, scope := range principal.Scopes {
+		for _, s := range b.Scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches reports whether the rule applies to action and tool
+func (r *PolicyRule) matches(action, tool string) bool {
+	return matchAny(r.Actions, action) && (len(r.Tools) == 0 || matchAny(r.Tools, tool))
+}
+
+// matchAny reports whether one of patterns matches name
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FilePolicy is an Authorizer enforcing a JSON or YAML policy file
+//
+// The file is checked for changes every refresh interval and reloaded when it changed. A file
+// that fails to parse or validate keeps the previous policy in force.
+type FilePolicy struct {
+	mu     sync.Mutex
+	file   watchedFile
+	policy *Policy
+}
+
+// NewFilePolicy loads the policy file at path, a zero refresh uses DefaultPolicyRefresh
+func NewFilePolicy(path string, refresh time.Duration) (*FilePolicy, error) {
+	if refresh <= 0 {
+		refresh = DefaultPolicyRefresh
+	}
+	f := &FilePolicy{file: watchedFile{path: path, refresh: refresh, now: time.Now}}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Policy returns the policy in force, reloading the file when it changed
+func (f *FilePolicy) Policy() *Policy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file.due() {
+		_ = f.reload()
+	}
+	return f.policy
+}
+
+// Allowed reports whether the policy in force allows action with tool
+func (f *FilePolicy) Allowed(p *Principal, action, tool string) bool {
+	return f.Policy().Allowed(p, action, tool)
+}
+
+// reload parses the file when it changed since the last load
+func (f *FilePolicy) reload() error {
+	return f.file.reload(func(data []byte) error {
+		policy, err := ParsePolicy(data)
+		if err != nil {
+			return err
+		}
+		f.policy = policy
+		return nil
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPolicy lets readers read files, operators do anything but delete or format files, and the
+// calc scope run the calculator tool
+const testPolicy = `{
+	"roles": {
+		"reader": {"allow": [{"actions": ["file_system.read", "file_system.list_*"]}]},
+		"operator": {
+			"allow": [{"actions": ["*"]}],
+			"deny": [{"actions": ["file_system.delete"]}]
+		},
+		"calculator": {"allow": [{"actions": ["execute"], "tools": ["calc*"]}]},
+		"guarded": {"deny": [{"actions": ["file_system.format"]}]}
+	},
+	"bindings": [
+		{"role": "reader", "principals": ["agent-1", "spiffe://example.org/readers/*"]},
+		{"role": "operator", "principals": ["ops"]},
+		{"role": "guarded", "principals": ["ops"]},
+		{"role": "calculator", "scopes": ["tools:calc"]}
+	]
+}`
+
+// testPolicyYAML is testPolicy written as YAML
+const testPolicyYAML = `
+# Readers only read
+roles:
+  reader:
+    allow:
+      - actions: [file_system.read, "file_system.list_*"]
+  operator:
+    allow:
+    - actions: ["*"]
+    deny:
+      - actions:
+          - file_system.delete   # never
+  calculator: {allow: [{actions: [execute], tools: ['calc*']}]}
+  guarded:
+    deny: [{actions: [file_system.format]}]
+bindings:
+  - role: reader
+    principals: [agent-1, "spiffe://example.org/readers/*"]
+  - {role: operator, principals: [ops]}
+  - role: guarded
+    principals:
+      - ops
+  - role: calculator
+    scopes: ["tools:calc"]
+`
+
+func TestParsePolicyYAML(t *testing.T) {
+	want, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParsePolicy([]byte(testPolicyYAML))
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("ParsePolicy() = %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	tests := []struct {
+		name      string
+		principal *Principal
+		action    string
+		tool      string
+		want      bool
+	}{
+		{name: "allowed action", principal: &Principal{ID: "agent-1"}, action: "file_system.read", want: true},
+		{name: "glob action", principal: &Principal{ID: "agent-1"}, action: "file_system.list_directory", want: true},
+		{name: "action outside the role", principal: &Principal{ID: "agent-1"}, action: "file_system.write"},
+		{name: "glob principal", principal: &Principal{ID: "spiffe://example.org/readers/a"}, action: "file_system.read", want: true},
+		{name: "glob principal stops at slashes", principal: &Principal{ID: "spiffe://example.org/readers/a/b"}, action: "file_system.read"},
+		{name: "wildcard allow", principal: &Principal{ID: "ops"}, action: "file_system.write", want: true},
+		{name: "deny wins over allow", principal: &Principal{ID: "ops"}, action: "file_system.delete"},
+		{name: "deny of another role wins", principal: &Principal{ID: "ops"}, action: "file_system.format"},
+		{name: "scope binding with tool", principal: &Principal{ID: "x", Scopes: []string{"tools:calc"}}, action: "execute", tool: "calculator", want: true},
+		{name: "scope binding other tool", principal: &Principal{ID: "x", Scopes: []string{"tools:calc"}}, action: "execute", tool: "shell"},
+		{name: "unbound principal", principal: &Principal{ID: "stranger"}, action: "file_system.read"},
+		{name: "anonymous", action: "file_system.read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Allowed(tt.principal, tt.action, tt.tool); got != tt.want {
+				t.Errorf("Allowed(%v, %q, %q) = %v, want %v", tt.principal, tt.action, tt.tool, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"roles": `,
+		`{"bindings": [{"role": "missing", "principals": ["a"]}]}`,
+		`{"roles": {"r": {"allow": [{"tools": ["x"]}]}}}`,
+		`{"roles": {"r": {"allow": [{"actions": ["[a"]}]}}}`,
+		`{"roles": {"r": {}}, "bindings": [{"role": "r", "principals": ["\\"]}]}`,
+		`{"roles": {"r": null}}`,
+		"roles:\n  r:\n    allow: [{actions: [a]}\n",
+		"roles:\n  r:\n    allow:\n      - actions: file_system.read\n",
+		"bindings:\n  - role: missing\n    principals: [a]\n",
+		"roles: &r {}\n",
+	} {
+		if _, err := ParsePolicy([]byte(doc)); err == nil {
+			t.Errorf("ParsePolicy(%s) error = nil", doc)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policy, _ := ParsePolicy([]byte(testPolicy))
+	h := Chain(whoami, Authenticate(NewBearerAuthenticator(map[string]*Principal{"token-1": {ID: "agent-1"}})), Authorize(policy))
+
+	call := func(action MCPAction, tool string) *MCPResponse {
+		req, _ := NewMCPRequest(action, nil, nil, tool, 1)
+		req.Metadata = map[string]interface{}{MetadataAuth: "Bearer token-1"}
+		return h(context.Background(), req)
+	}
+	if resp := call("file_system.read", ""); resp.Error != nil {
+		t.Fatalf("allowed action error = %+v", resp.Error)
+	}
+
+	resp := call("execute", "shell")
+	var details map[string]string
+	if resp.Error == nil || resp.Error.Type != MCPErrorAuthorization || json.Unmarshal(resp.Error.Details, &details) != nil {
+		t.Fatalf("denied action error = %+v, want AUTHORIZATION_FAILED", resp.Error)
+	}
+	if details["action"] != "execute" || details["tool"] != "shell" {
+		t.Errorf("details = %v, want the denied action and tool", details)
+	}
+
+	unauthenticated := Chain(whoami, Authorize(policy))
+	req, _ := NewMCPRequest("file_system.read", nil, nil, "", 1)
+	if resp := unauthenticated(context.Background(), req); resp.Error == nil || resp.Error.Type != MCPErrorAuthorization {
+		t.Errorf("request without principal error = %+v, want AUTHORIZATION_FAILED", resp.Error)
+	}
+}
+
+func TestAuthorizeHTTP(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"roles": {"reader": {"allow": [{"actions": ["file_system.read"]}]}}, "bindings": [{"role": "reader", "principals": ["service-a"]}]}`))
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(AuthenticateHTTP(testAuthenticator(), AuthorizeHTTP(policy, "file_system.read", next)))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "allowed principal", header: "ApiKey key-1", want: http.StatusNoContent},
+		{name: "other principal", header: "Bearer token-1", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Authorization", tt.header)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusForbidden {
+				return
+			}
+			var body MCPResponse
+			var details map[string]string
+			if json.NewDecoder(resp.Body).Decode(&body) != nil || body.Error == nil || body.Error.Type != MCPErrorAuthorization ||
+				json.Unmarshal(body.Error.Details, &details) != nil || details["action"] != "file_system.read" {
+				t.Errorf("403 body = %+v, want AUTHORIZATION_FAILED naming the action", body)
+			}
+		})
+	}
+
+	// Without AuthenticateHTTP there is no principal to allow
+	bare := httptest.NewServer(AuthorizeHTTP(policy, "file_system.read", next))
+	defer bare.Close()
+	resp, err := http.Get(bare.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status without a principal = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestFilePolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	write := func(doc string) {
+		if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(testPolicy)
+	policy, err := NewFilePolicy(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFilePolicy() error = %v", err)
+	}
+	now := time.Now()
+	policy.file.now = func() time.Time { return now }
+	agent := &Principal{ID: "agent-1"}
+
+	if !policy.Allowed(agent, "file_system.read", "") {
+		t.Fatal("Allowed() = false, want the loaded policy to allow reads")
+	}
+	write(`{"roles": {"reader": {"allow": [{"actions": ["file_system.list_*"]}]}}, "bindings": [{"role": "reader", "principals": ["agent-1"]}]}`)
+	if !policy.Allowed(agent, "file_system.read", "") {
+		t.Error("Allowed() before the refresh interval = false, want the previous policy")
+	}
+	now = now.Add(time.Minute)
+	if policy.Allowed(agent, "file_system.read", "") || !policy.Allowed(agent, "file_system.list_directory", "") {
+		t.Error("Allowed() after the refresh interval did not apply the changed policy")
+	}
+
+	write(`{"bindings": [{"role": "nope"}]}`)
+	now = now.Add(time.Minute)
+	if !policy.Allowed(agent, "file_system.list_directory", "") {
+		t.Error("Allowed() after an invalid change = false, want the last valid policy kept")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// ProgressMethod is the method of the notifications that report the progress of a request
+const ProgressMethod = "notifications/progress"
+
+// DefaultProgressInterval is the minimum time between two progress notifications for the same
+// request when the connection does not configure one
+const DefaultProgressInterval = 100 * time.Millisecond
+
+// ProgressUpdate is the payload of a progress notification
+type ProgressUpdate struct {
+	// ID is the ID of the request the progress belongs to
+	ID interface{} `json:"id,omitempty"`
+	// RequestID is the request_id metadata of the request, if any
+	RequestID string `json:"request_id,omitempty"`
+	// Progress is the completed fraction, from 0 to 1
+	Progress float64 `json:"progress"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// progressKey is the context key of the progressReporter of a request
+type progressKey struct{}
+
+// progressCallbackKey is the context key of the callback registered with WithProgress
+type progressCallbackKey struct{}
+
+// progressReporter throttles the progress notifications of one request
+type progressReporter struct {
+	id        interface{}
+	requestID string
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// withProgressReporter returns a ctx in which Progress reports the progress of req
+func withProgressReporter(ctx context.Context, req *MCPRequest) context.Context {
+	if req.IsNotification() {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, &progressReporter{id: req.ID, requestID: req.RequestID()})
+}
+
+// progressInterval returns the minimum time between two progress notifications for the same
+// request sent over c
+func (c *Conn) progressInterval() time.Duration {
+	switch {
+	case c.cfg.progressInterval < 0:
+		return 0
+	case c.cfg.progressInterval == 0:
+		return DefaultProgressInterval
+	}
+	return c.cfg.progressInterval
+}
+
+// Progress reports that the request handled with ctx is fraction done, from 0 to 1
+//
+// The update is sent to the peer as a ProgressMethod notification carrying the request ID.
+// Updates closer than the progress interval of the connection to the previous one are dropped,
+// except the final one with a fraction of 1. Inside a job the update is recorded as the job
+// progress instead, since the request that submitted it has already been answered. Progress does
+// nothing when ctx belongs to neither a request nor a job.
+func Progress(ctx context.Context, fraction float64, message string) error {
+	fraction = min(max(fraction, 0), 1)
+	if JobIDFromContext(ctx) != "" {
+		var partial interface{}
+		if message != "" {
+			partial = message
+		}
+		return ReportJobProgress(ctx, fraction*100, partial)
+	}
+
+	r, ok := ctx.Value(progressKey{}).(*progressReporter)
+	conn := ConnFromContext(ctx)
+	if !ok || conn == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	if fraction < 1 && now.Sub(r.last) < conn.progressInterval() {
+		r.mu.Unlock()
+		return nil
+	}
+	r.last = now
+	r.mu.Unlock()
+
+	return conn.Notify(ctx, ProgressMethod, &ProgressUpdate{
+		ID:        r.id,
+		RequestID: r.requestID,
+		Progress:  fraction,
+		Message:   message,
+	})
+}
+
+// WithProgress returns a ctx that makes the calls sent with it deliver their progress
+// notifications to fn
+//
+// fn runs on the receive loop of the connection, in the order the updates arrive and before the
+// response is delivered, so it must not block.
+func WithProgress(ctx context.Context, fn func(ProgressUpdate)) context.Context {
+	return context.WithValue(ctx, progressCallbackKey{}, fn)
+}
+
+// progressCallback returns the callback registered on ctx with WithProgress, if any
+func progressCallback(ctx context.Context) func(ProgressUpdate) {
+	fn, _ := ctx.Value(progressCallbackKey{}).(func(ProgressUpdate))
+	return fn
+}
+
+// deliverProgress hands a progress notification to the callback of the pending call it refers
+// to, and reports whether it found one
+func (c *Conn) deliverProgress(req *MCPRequest) bool {
+	var update ProgressUpdate
+	if json.Unmarshal(req.Params, &update) != nil {
+		return false
+	}
+	var keys []string
+	if key, ok := idKey(update.ID); ok {
+		keys = append(keys, key)
+	}
+	if update.RequestID != "" {
+		keys = append(keys, requestIDKey(update.RequestID))
+	}
+
+	c.mu.Lock()
+	var call *pendingCall
+	for _, key := range keys {
+		if call = c.pending[key]; call != nil {
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if call == nil || call.progress == nil {
+		return false
+	}
+	call.progress(update)
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// pipeClient serves h over a pipe and returns a client connected to it
+func pipeClient(t *testing.T, h MCPHandler) *Client {
+	return pipeClientWith(t, h, serveConfig{})
+}
+
+// pipeClientWith serves h over a pipe with cfg and returns a client connected to it
+func pipeClientWith(t *testing.T, h MCPHandler, cfg serveConfig) *Client {
+	t.Helper()
+	clientT, serverT := Pipe(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go newConn(ctx, serverT, h, cfg).Wait()
+
+	client := NewClient(clientT, nil)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestProgressNotifications(t *testing.T) {
+	client := pipeClientWith(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		for _, step := range []float64{0.25, 0.5, 1} {
+			if err := Progress(ctx, step, fmt.Sprintf("%.0f%% done", step*100)); err != nil {
+				t.Errorf("Progress() error = %v", err)
+			}
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, "done", nil, nil)
+		return resp
+	}, serveConfig{progressInterval: -1})
+
+	var updates []ProgressUpdate
+	ctx := WithProgress(context.Background(), func(u ProgressUpdate) {
+		updates = append(updates, u)
+	})
+	if _, err := client.CallMCP(ctx, "file_system.copy", "", nil); err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+
+	want := []ProgressUpdate{
+		{Progress: 0.25, Message: "25% done"},
+		{Progress: 0.5, Message: "50% done"},
+		{Progress: 1, Message: "100% done"},
+	}
+	if len(updates) != len(want) {
+		t.Fatalf("got %d updates, want %d: %+v", len(updates), len(want), updates)
+	}
+	for i, u := range updates {
+		if u.Progress != want[i].Progress || u.Message != want[i].Message || u.ID == nil {
+			t.Errorf("update %d = %+v, want %+v with the request ID", i, u, want[i])
+		}
+	}
+
+	// Calls without a callback ignore the notifications
+	if _, err := client.CallMCP(context.Background(), "file_system.copy", "", nil); err != nil {
+		t.Fatalf("CallMCP() without callback error = %v", err)
+	}
+}
+
+func TestProgressThrottling(t *testing.T) {
+	client := pipeClient(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		for i := 0; i <= 1000; i++ {
+			Progress(ctx, float64(i)/1000, "")
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	})
+
+	var updates []ProgressUpdate
+	ctx := WithProgress(context.Background(), func(u ProgressUpdate) {
+		updates = append(updates, u)
+	})
+	if _, err := client.CallMCP(ctx, "index.rebuild", "", nil); err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	if len(updates) == 0 || len(updates) > 10 {
+		t.Fatalf("got %d updates, want a few throttled ones", len(updates))
+	}
+	if last := updates[len(updates)-1]; last.Progress != 1 {
+		t.Errorf("last update = %+v, want the final one", last)
+	}
+}
+
+func TestServeProgressInterval(t *testing.T) {
+	h := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		for i := 0; i < 100; i++ {
+			Progress(ctx, float64(i)/100, "")
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	}
+	clientPipe, serverPipe := Pipe(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeTransportWith(ctx, serverPipe, h, &ServeConfig{ProgressInterval: -1})
+	srv := httptest.NewServer(WebSocketHandler(h, &WebSocketConfig{ProgressInterval: -1}))
+	defer srv.Close()
+	ws, err := DialWebSocket(ctx, wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		t    Transport
+	}{
+		{name: "ServeTransportWith", t: clientPipe},
+		{name: "WebSocketHandler", t: ws},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(tt.t, nil)
+			defer client.Close()
+			n := 0
+			if _, err := client.CallMCP(WithProgress(ctx, func(ProgressUpdate) { n++ }), "index.rebuild", "", nil); err != nil {
+				t.Fatalf("CallMCP() error = %v", err)
+			}
+			if n != 100 {
+				t.Errorf("got %d updates, want all 100 with throttling disabled", n)
+			}
+		})
+	}
+}
+
+func TestProgressOutsideConnection(t *testing.T) {
+	if err := Progress(context.Background(), 0.5, "half"); err != nil {
+		t.Errorf("Progress() without connection error = %v", err)
+	}
+
+	m := NewJobManager(nil)
+	defer m.Close()
+	h := m.Async(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		Progress(ctx, 0.4, "indexing")
+		return NewMCPErrorResponse(StdError(ErrInternal), nil, nil)
+	})
+	id := submitJob(t, h, "index.rebuild")
+	job := waitJobState(t, m, id, JobFailed)
+	if job.Progress != 40 || string(job.Partial) != `"indexing"` {
+		t.Errorf("job = %+v, want the progress recorded on the job", job)
+	}
+}
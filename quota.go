@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QuotaActionGet is the built-in action answering the quota usage of the calling principal
+const QuotaActionGet MCPAction = "quota.get"
+
+// QuotaUnitRequests is the unit counted by the quota middleware itself, one per request
+const QuotaUnitRequests = "requests"
+
+// QuotaPeriod is the calendar period a quota applies to
+type QuotaPeriod string
+
+// Quota periods, counters reset at the start of each day or month
+const (
+	QuotaDaily   QuotaPeriod = "daily"
+	QuotaMonthly QuotaPeriod = "monthly"
+)
+
+// bounds returns the start of the period containing t and the start of the next one
+func (p QuotaPeriod) bounds(t time.Time) (start, reset time.Time) {
+	y, m, d := t.Date()
+	if p == QuotaMonthly {
+		start = time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+// Quota limits the amount of a unit a principal may use per period
+type Quota struct {
+	// Unit is QuotaUnitRequests or a custom unit charged by handlers, such as "tokens" or "bytes"
+	Unit   string      `json:"unit"`
+	Period QuotaPeriod `json:"period"`
+	Limit  int64       `json:"limit"`
+}
+
+// QuotaUsage is the state of a quota in the current period
+type QuotaUsage struct {
+	Quota
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// QuotaStore persists quota counters
+//
+// Implementations must be safe for concurrent use, and Add must be atomic per key.
+type QuotaStore interface {
+	// Get returns the counter stored under key, zero for unknown keys
+	Get(ctx context.Context, key string) (int64, error)
+	// Add adds amount, which may be negative, to the counter under key and returns the new value.
+	// The counter may be dropped after expires.
+	Add(ctx context.Context, key string, amount int64, expires time.Time) (int64, error)
+}
+
+// QuotaConfig configures a QuotaManager
+type QuotaConfig struct {
+	// Quotas apply to every principal
+	Quotas []Quota
+	// For returns the quotas of a principal in place of Quotas, p is nil for unauthenticated requests
+	For func(p *Principal) []Quota
+	// Store holds the counters, nil uses a new MemoryQuotaStore
+	Store QuotaStore
+	// Location is the time zone in which days and months begin, nil uses UTC
+	Location *time.Location
+}
+
+// QuotaManager enforces daily and monthly usage quotas per principal
+//
+// Its middleware counts every request against the requests quotas and refuses requests with
+// QUOTA_EXCEEDED once a quota of any unit is used up, before they run. Handlers report the use of
+// custom units with ChargeQuota. Quota errors carry the unit, period, limit, used, remaining and
+// reset details.
+type QuotaManager struct {
+	cfg QuotaConfig
+	now func() time.Time
+}
+
+// NewQuotaManager creates a QuotaManager
+func NewQuotaManager(cfg *QuotaConfig) *QuotaManager {
+	m := &QuotaManager{now: time.Now}
+	if cfg != nil {
+		m.cfg = *cfg
+	}
+	if m.cfg.Store == nil {
+		m.cfg.Store = NewMemoryQuotaStore()
+	}
+	if m.cfg.Location == nil {
+		m.cfg.Location = time.UTC
+	}
+	return m
+}
+
+// Register serves the built-in quota.get action on mux
+func (m *QuotaManager) Register(mux *Mux) {
+	mux.Handle(QuotaActionGet, m.serveGet)
+}
+
+// serveGet answers quota.get with the usage of the calling principal
+func (m *QuotaManager) serveGet(ctx context.Context, req *MCPRequest) *MCPResponse {
+	usage, err := m.Usage(ctx, PrincipalFromContext(ctx))
+	if err != nil {
+		return errorResponse(err, req)
+	}
+	return dataResponse(map[string]interface{}{"quotas": usage}, req)
+}
+
+// quotaKey is the context key holding the QuotaManager of a request
+type quotaKey struct{}
+
+// Middleware returns a middleware that enforces the quotas of the principal authenticated by
+// Authenticate, place it after Authenticate
+//
+// quota.get requests are not counted, so callers can inspect exhausted quotas.
+func (m *QuotaManager) Middleware() Middleware {
+	return func(next MCPHandler) MCPHandler {
+		return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+			ctx = context.WithValue(ctx, quotaKey{}, m)
+			if req.Action == QuotaActionGet {
+				return next(ctx, req)
+			}
+			if err := m.admit(ctx, PrincipalFromContext(ctx)); err != nil {
+				return errorResponse(err, req)
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// admit refuses a request when a quota of p is used up and otherwise counts it against the
+// requests quotas
+func (m *QuotaManager) admit(ctx context.Context, p *Principal) error {
+	now := m.now().In(m.cfg.Location)
+	quotas := m.quotas(p)
+	for _, q := range quotas {
+		if q.Unit == QuotaUnitRequests {
+			continue
+		}
+		used, err := m.cfg.Store.Get(ctx, m.key(p, q, now))
+		if err != nil {
+			return err
+		}
+		if used >= q.Limit {
+			return quotaExceeded(q, used, now)
+		}
+	}
+
+	var charged []Quota
+	for _, q := range quotas {
+		if q.Unit != QuotaUnitRequests {
+			continue
+		}
+		_, reset := q.Period.bounds(now)
+		used, err := m.cfg.Store.Add(ctx, m.key(p, q, now), 1, reset)
+		if err == nil && used <= q.Limit {
+			charged = append(charged, q)
+			continue
+		}
+		// Give back what this request took, it does not run
+		if err == nil {
+			charged = append(charged, q)
+			err = quotaExceeded(q, used-1, now)
+		}
+		for _, c := range charged {
+			_, reset := c.Period.bounds(now)
+			_, _ = m.cfg.Store.Add(ctx, m.key(p, c, now), -1, reset)
+		}
+		return err
+	}
+	return nil
+}
+
+// Charge counts amount of unit against the quotas of p
+//
+// The amount is recorded even when it exceeds a quota, since the work was already done, and the
+// QUOTA_EXCEEDED *Error of the first exceeded quota is returned.
+func (m *QuotaManager) Charge(ctx context.Context, p *Principal, unit string, amount int64) error {
+	now := m.now().In(m.cfg.Location)
+	var exceeded error
+	for _, q := range m.quotas(p) {
+		if q.Unit != unit {
+			continue
+		}
+		_, reset := q.Period.bounds(now)
+		used, err := m.cfg.Store.Add(ctx, m.key(p, q, now), amount, reset)
+		if err != nil {
+			return err
+		}
+		if used > q.Limit && exceeded == nil {
+			exceeded = quotaExceeded(q, used, now)
+		}
+	}
+	return exceeded
+}
+
+// Usage returns the state of every quota of p in the current period
+func (m *QuotaManager) Usage(ctx context.Context, p *Principal) ([]QuotaUsage, error) {
+	now := m.now().In(m.cfg.Location)
+	quotas := m.quotas(p)
+	usage := make([]QuotaUsage, 0, len(quotas))
+	for _, q := range quotas {
+		used, err := m.cfg.Store.Get(ctx, m.key(p, q, now))
+		if err != nil {
+			return nil, err
+		}
+		_, reset := q.Period.bounds(now)
+		usage = append(usage, QuotaUsage{Quota: q, Used: used, Remaining: max(0, q.Limit-used), Reset: reset})
+	}
+	return usage, nil
+}
+
+// quotas returns the quotas that apply to p
+func (m *QuotaManager) quotas(p *Principal) []Quota {
+	if m.cfg.For != nil {
+		return m.cfg.For(p)
+	}
+	return m.cfg.Quotas
+}
+
+// key returns the counter key of quota q of p for the period containing now
+func (m *QuotaManager) key(p *Principal, q Quota, now time.Time) string {
+	id := "anonymous"
+	if p != nil {
+		id = "principal:" + p.ID
+	}
+	start, _ := q.Period.bounds(now)
+	return fmt.Sprintf("%s|%s|%s|%s", id, q.Unit, q.Period, start.Format("2006-01-02"))
+}
+
+// quotaExceeded returns the QUOTA_EXCEEDED error of q
+func quotaExceeded(q Quota, used int64, now time.Time) *Error {
+	_, reset := q.Period.bounds(now)
+	e, _ := NewMCPError(MCPErrorQuotaExceeded, ErrMCPExecutionFailed, fmt.Sprintf("%s %s quota exceeded", capitalize(string(q.Period)), q.Unit), map[string]interface{}{
+		"unit":      q.Unit,
+		"period":    q.Period,
+		"limit":     q.Limit,
+		"used":      used,
+		"remaining": max(0, q.Limit-used),
+		"reset":     reset.UTC().Format(time.RFC3339),
+	})
+	return e
+}
+
+// capitalize upper-cases the first letter of an ASCII word
+func capitalize(s string) string {
+	if s == "" || s[0] < 'a' || s[0] > 'z' {
+		return s
+	}
+	return string(s[0]-'a'+'A') + s[1:]
+}
+
+// ChargeQuota counts amount of unit against the quotas of the principal of the request handled
+// with ctx
+//
+// It returns a QUOTA_EXCEEDED *Error once a quota is exceeded, which a handler can return with
+// the partial work it did, and nil when ctx is not served through a QuotaManager middleware.
+func ChargeQuota(ctx context.Context, unit string, amount int64) error {
+	m, _ := ctx.Value(quotaKey{}).(*QuotaManager)
+	if m == nil {
+		return nil
+	}
+	return m.Charge(ctx, PrincipalFromContext(ctx), unit, amount)
+}
+
+// MemoryQuotaStore is an in-memory QuotaStore
+type MemoryQuotaStore struct {
+	mu       sync.Mutex
+	counters map[string]*quotaCounter
+	updates  int
+	now      func() time.Time
+}
+
+// quotaCounter is a stored counter and when it may be dropped
+type quotaCounter struct {
+	value   int64
+	expires time.Time
+}
+
+// quotaSweepEvery is the number of updates between sweeps of expired counters
+const quotaSweepEvery = 1024
+
+// NewMemoryQuotaStore creates an empty MemoryQuotaStore
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{counters: make(map[string]*quotaCounter), now: time.Now}
+}
+
+// Get returns the counter under key
+func (s *MemoryQuotaStore) Get(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counters[key]; ok && s.now().Before(c.expires) {
+		return c.value, nil
+	}
+	return 0, nil
+}
+
+// Add adds amount to the counter under key
+func (s *MemoryQuotaStore) Add(ctx context.Context, key string, amount int64, expires time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	s.updates++
+	if s.updates%quotaSweepEvery == 0 {
+		for k, c := range s.counters {
+			if !now.Before(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &quotaCounter{}
+		s.counters[key] = c
+	}
+	c.value += amount
+	c.expires = expires
+	return c.value, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestQuotas returns a quota manager driven by a fake clock, with a mux serving quota.get and
+// a "generate" action that charges the tokens given in its params
+func newTestQuotas(cfg *QuotaConfig) (*QuotaManager, *fakeClock, MCPHandler, *atomic.Int32) {
+	clock := &fakeClock{now: time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)}
+	store := NewMemoryQuotaStore()
+	store.now = clock.Now
+	cfg.Store = store
+	m := NewQuotaManager(cfg)
+	m.now = clock.Now
+
+	var runs atomic.Int32
+	mux := NewMux()
+	m.Register(mux)
+	mux.Handle("generate", func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		runs.Add(1)
+		var p struct {
+			Tokens int64 `json:"tokens"`
+		}
+		_ = json.Unmarshal(req.Params, &p)
+		if err := ChargeQuota(ctx, "tokens", p.Tokens); err != nil {
+			return errorResponse(err, req)
+		}
+		return dataResponse("ok", req)
+	})
+	return m, clock, Chain(mux.ServeMCP, Authenticate(testAuthenticator()), m.Middleware()), &runs
+}
+
+// callAs sends action to h as the principal of the bearer token
+func callAs(h MCPHandler, token string, action MCPAction, params interface{}) *MCPResponse {
+	req, _ := NewMCPRequest(action, params, nil, "", 1)
+	req.Metadata = map[string]interface{}{MetadataAuth: "Bearer " + token}
+	return h(context.Background(), req)
+}
+
+// quotaDetails returns the details of a QUOTA_EXCEEDED response, nil for other responses
+func quotaDetails(resp *MCPResponse) map[string]interface{} {
+	var details map[string]interface{}
+	if resp.Error == nil || resp.Error.Type != MCPErrorQuotaExceeded || json.Unmarshal(resp.Error.Details, &details) != nil {
+		return nil
+	}
+	return details
+}
+
+func TestQuotaRequests(t *testing.T) {
+	_, clock, h, runs := newTestQuotas(&QuotaConfig{Quotas: []Quota{{Unit: QuotaUnitRequests, Period: QuotaDaily, Limit: 2}}})
+
+	for i := 0; i < 2; i++ {
+		if resp := callAs(h, "token-1", "generate", nil); resp.Error != nil {
+			t.Fatalf("request %d error = %+v", i, resp.Error)
+		}
+	}
+	resp := callAs(h, "token-1", "generate", nil)
+	details := quotaDetails(resp)
+	if details == nil {
+		t.Fatalf("third request error = %+v, want QUOTA_EXCEEDED", resp.Error)
+	}
+	if details["unit"] != QuotaUnitRequests || details["period"] != "daily" || details["remaining"] != 0.0 || details["reset"] != "2026-10-19T00:00:00Z" {
+		t.Errorf("details = %v, want the daily requests quota resetting at midnight", details)
+	}
+	if runs.Load() != 2 {
+		t.Errorf("handler ran %d times, want the refused request not to run", runs.Load())
+	}
+
+	clock.Advance(time.Hour)
+	if resp := callAs(h, "token-1", "generate", nil); resp.Error != nil {
+		t.Errorf("request on the next day error = %+v, want a fresh quota", resp.Error)
+	}
+}
+
+func TestQuotaCustomUnits(t *testing.T) {
+	m, clock, h, runs := newTestQuotas(&QuotaConfig{Quotas: []Quota{
+		{Unit: QuotaUnitRequests, Period: QuotaDaily, Limit: 10},
+		{Unit: "tokens", Period: QuotaMonthly, Limit: 100},
+	}})
+	tokens := map[string]int64{"tokens": 60}
+
+	if resp := callAs(h, "token-1", "generate", tokens); resp.Error != nil {
+		t.Fatalf("first request error = %+v", resp.Error)
+	}
+	resp := callAs(h, "token-1", "generate", tokens)
+	if details := quotaDetails(resp); details == nil || details["used"] != 120.0 || details["remaining"] != 0.0 || details["reset"] != "2026-11-01T00:00:00Z" {
+		t.Fatalf("request exceeding the tokens error = %+v, want QUOTA_EXCEEDED charged by the handler", resp.Error)
+	}
+	resp = callAs(h, "token-1", "generate", tokens)
+	if quotaDetails(resp) == nil || runs.Load() != 2 {
+		t.Fatalf("request after the tokens ran out error = %+v, runs = %d, want refused before running", resp.Error, runs.Load())
+	}
+
+	resp = callAs(h, "token-1", QuotaActionGet, nil)
+	var data struct {
+		Quotas []QuotaUsage `json:"quotas"`
+	}
+	if resp.Error != nil || json.Unmarshal(resp.Data, &data) != nil || len(data.Quotas) != 2 {
+		t.Fatalf("quota.get = %s %+v, want both quotas", resp.Data, resp.Error)
+	}
+	if got := data.Quotas[0]; got.Used != 2 || got.Remaining != 8 {
+		t.Errorf("requests usage = %+v, want the refused request and quota.get not counted", got)
+	}
+	if got := data.Quotas[1]; got.Used != 120 || got.Remaining != 0 || !got.Reset.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("tokens usage = %+v, want 120 used until November", got)
+	}
+
+	// Another principal has quotas of its own
+	if usage, _ := m.Usage(context.Background(), &Principal{ID: "service-a"}); usage[1].Used != 0 {
+		t.Errorf("usage of another principal = %+v, want untouched", usage)
+	}
+	clock.Advance(14 * 24 * time.Hour)
+	if resp := callAs(h, "token-1", "generate", tokens); resp.Error != nil {
+		t.Errorf("request in the next month error = %+v, want a fresh quota", resp.Error)
+	}
+}
+
+func TestQuotaPerPrincipal(t *testing.T) {
+	_, _, h, _ := newTestQuotas(&QuotaConfig{For: func(p *Principal) []Quota {
+		if p != nil && p.ID == "user-b" {
+			return []Quota{{Unit: QuotaUnitRequests, Period: QuotaDaily, Limit: 1}, {Unit: QuotaUnitRequests, Period: QuotaMonthly, Limit: 5}}
+		}
+		return nil
+	}})
+	if resp := callAs(h, "token-1", "generate", nil); resp.Error != nil {
+		t.Fatalf("first request error = %+v", resp.Error)
+	}
+	if resp := callAs(h, "token-1", "generate", nil); quotaDetails(resp) == nil {
+		t.Fatalf("second request error = %+v, want QUOTA_EXCEEDED", resp.Error)
+	}
+	resp := callAs(h, "token-1", QuotaActionGet, nil)
+	var data struct {
+		Quotas []QuotaUsage `json:"quotas"`
+	}
+	if json.Unmarshal(resp.Data, &data) != nil || len(data.Quotas) != 2 || data.Quotas[1].Used != 1 {
+		t.Errorf("quota.get = %s, want the monthly charge of the refused request given back", resp.Data)
+	}
+}
+
+func TestChargeQuotaWithoutManager(t *testing.T) {
+	if err := ChargeQuota(context.Background(), "tokens", 10); err != nil {
+		t.Errorf("ChargeQuota() without a quota manager error = %v", err)
+	}
+	m := NewQuotaManager(&QuotaConfig{Quotas: []Quota{{Unit: "bytes", Period: QuotaDaily, Limit: 10}}})
+	err := m.Charge(context.Background(), nil, "bytes", 11)
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorQuotaExceeded {
+		t.Errorf("Charge() over the limit error = %v, want QUOTA_EXCEEDED", err)
+	}
+}
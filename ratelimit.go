@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitAlgorithm selects how a RateLimiter counts requests
+type RateLimitAlgorithm int
+
+// Rate limiting algorithms
+const (
+	// TokenBucket refills Limit tokens per Period up to Burst, every request takes one
+	TokenBucket RateLimitAlgorithm = iota
+	// FixedWindow allows Limit requests per Period-aligned window
+	FixedWindow
+	// SlidingWindow allows Limit requests in any Period, weighting the previous window by how much
+	// of it still overlaps the last Period
+	SlidingWindow
+)
+
+// String returns the name of the algorithm
+func (a RateLimitAlgorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token-bucket"
+	case FixedWindow:
+		return "fixed-window"
+	case SlidingWindow:
+		return "sliding-window"
+	}
+	return fmt.Sprintf("RateLimitAlgorithm(%d)", int(a))
+}
+
+// Rate limit HTTP headers
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// RateLimitState is the stored counter of one rate limit key
+type RateLimitState struct {
+	// Tokens is the token bucket level at Last
+	Tokens float64   `json:"tokens,omitempty"`
+	Last   time.Time `json:"last,omitempty"`
+	// Window is the start of the current window, Count and Previous the requests counted in it and
+	// in the window before
+	Window   time.Time `json:"window,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Previous int       `json:"previous,omitempty"`
+}
+
+// RateLimitStore persists rate limit counters
+//
+// Implementations must be safe for concurrent use, and Update must be atomic per key so that
+// limiters sharing a store count every request exactly once.
+type RateLimitStore interface {
+	// Update calls fn with the state stored under key, a zero state for unknown keys, and stores
+	// the result. The state may be dropped when it was not updated for ttl.
+	Update(ctx context.Context, key string, ttl time.Duration, fn func(state *RateLimitState)) error
+}
+
+// RateLimitKey returns the key a request is counted under, requests with an empty key are not limited
+type RateLimitKey func(ctx context.Context, req *MCPRequest) string
+
+// RateLimitByPrincipal counts requests per authenticated principal, unauthenticated requests
+// share one "anonymous" key
+func RateLimitByPrincipal(ctx context.Context, req *MCPRequest) string {
+	if p := PrincipalFromContext(ctx); p != nil {
+		return "principal:" + p.ID
+	}
+	return "anonymous"
+}
+
+// RateLimitByAction counts requests per action
+func RateLimitByAction(ctx context.Context, req *MCPRequest) string {
+	return "action:" + string(req.Action)
+}
+
+// RateLimitByTool counts requests per tool, requests without a tool are not limited
+func RateLimitByTool(ctx context.Context, req *MCPRequest) string {
+	if req.Tool == "" {
+		return ""
+	}
+	return "tool:" + req.Tool
+}
+
+// RateLimitByRemoteAddr counts requests per remote IP address, requests on connections without
+// a network peer, such as pipes and stdio, are not limited
+func RateLimitByRemoteAddr(ctx context.Context, req *MCPRequest) string {
+	if host := connRemoteHost(ctx); host != "" {
+		return "addr:" + host
+	}
+	return ""
+}
+
+// RateLimitKeys combines keys, for example the principal and the action, the request is not
+// limited when one of them is empty
+func RateLimitKeys(keys ...RateLimitKey) RateLimitKey {
+	return func(ctx context.Context, req *MCPRequest) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			if parts[i] = key(ctx, req); parts[i] == "" {
+				return ""
+			}
+		}
+		return strings.Join(parts, "|")
+	}
+}
+
+// connRemoteHost returns the IP address of the peer of the connection serving ctx, if any
+func connRemoteHost(ctx context.Context) string {
+	c := ConnFromContext(ctx)
+	if c == nil {
+		return ""
+	}
+	t, ok := c.t.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	addr := t.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	return remoteHost(addr.String())
+}
+
+// remoteHost strips the port of a "host:port" address
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// RateLimitConfig configures a RateLimiter
+type RateLimitConfig struct {
+	// Algorithm selects how requests are counted, the zero value is TokenBucket
+	Algorithm RateLimitAlgorithm
+	// Limit is the number of requests allowed per Period, zero allows one
+	Limit int
+	// Period is the length of a window or the time a token bucket takes to refill Limit tokens,
+	// zero uses one minute
+	Period time.Duration
+	// Burst is the token bucket capacity, zero uses Limit
+	Burst int
+	// Key selects what requests are counted under, nil uses RateLimitByPrincipal
+	Key RateLimitKey
+	// Prefix is prepended to keys, so that limiters sharing a store do not share counters
+	Prefix string
+	// Store holds the counters, nil uses a new MemoryRateLimitStore
+	Store RateLimitStore
+}
+
+// RateLimitResult is the outcome of counting one request
+type RateLimitResult struct {
+	Allowed bool
+	// Limit is the number of requests allowed per period
+	Limit int
+	// Remaining is the number of requests still allowed right now
+	Remaining int
+	// Reset is when the limit is fully available again
+	Reset time.Time
+	// RetryAfter is how long a rejected caller has to wait before its next request is allowed
+	RetryAfter time.Duration
+}
+
+// RateLimiter limits the rate of requests per key
+//
+// Rejected MCP requests are answered with RATE_LIMIT_EXCEEDED and a retry_after_seconds detail,
+// rejected HTTP requests with 429 Too Many Requests and the same error body. HTTP responses
+// carry the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers, the latter as
+// Unix seconds, and rejections a Retry-After header.
+type RateLimiter struct {
+	cfg RateLimitConfig
+	now func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter
+func NewRateLimiter(cfg *RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{now: time.Now}
+	if cfg != nil {
+		l.cfg = *cfg
+	}
+	if l.cfg.Limit <= 0 {
+		l.cfg.Limit = 1
+	}
+	if l.cfg.Period <= 0 {
+		l.cfg.Period = time.Minute
+	}
+	if l.cfg.Burst <= 0 {
+		l.cfg.Burst = l.cfg.Limit
+	}
+	if l.cfg.Key == nil {
+		l.cfg.Key = RateLimitByPrincipal
+	}
+	if l.cfg.Store == nil {
+		l.cfg.Store = NewMemoryRateLimitStore()
+	}
+	return l
+}
+
+// Take counts one request under key and reports whether it is allowed
+func (l *RateLimiter) Take(ctx context.Context, key string) (*RateLimitResult, error) {
+	now := l.now()
+	// Keep states until they could no longer affect a decision: two windows, or a full refill
+	ttl := max(2*l.cfg.Period, l.cfg.Period*time.Duration(l.cfg.Burst)/time.Duration(l.cfg.Limit))
+	var res *RateLimitResult
+	err := l.cfg.Store.Update(ctx, l.cfg.Prefix+key, ttl, func(s *RateLimitState) {
+		switch l.cfg.Algorithm {
+		case FixedWindow:
+			res = l.fixedWindow(s, now)
+		case SlidingWindow:
+			res = l.slidingWindow(s, now)
+		default:
+			res = l.tokenBucket(s, now)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// tokenBucket refills the bucket for the time elapsed since the last request and takes a token
+func (l *RateLimiter) tokenBucket(s *RateLimitState, now time.Time) *RateLimitResult {
+	capacity := float64(l.cfg.Burst)
+	perToken := l.cfg.Period.Seconds() / float64(l.cfg.Limit)
+	if s.Last.IsZero() {
+		s.Tokens = capacity
+	} else if elapsed := now.Sub(s.Last).Seconds(); elapsed > 0 {
+		s.Tokens = math.Min(capacity, s.Tokens+elapsed/perToken)
+	}
+	s.Last = now
+
+	res := &RateLimitResult{Limit: l.cfg.Burst}
+	if s.Tokens >= 1 {
+		s.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - s.Tokens) * perToken)
+	}
+	res.Remaining = int(s.Tokens)
+	res.Reset = now.Add(seconds((capacity - s.Tokens) * perToken))
+	return res
+}
+
+// fixedWindow counts the request in the current Period-aligned window
+func (l *RateLimiter) fixedWindow(s *RateLimitState, now time.Time) *RateLimitResult {
+	window := now.Truncate(l.cfg.Period)
+	if !s.Window.Equal(window) {
+		s.Window, s.Count = window, 0
+	}
+	res := &RateLimitResult{Limit: l.cfg.Limit, Reset: window.Add(l.cfg.Period)}
+	if s.Count < l.cfg.Limit {
+		s.Count++
+		res.Allowed = true
+	} else {
+		res.RetryAfter = res.Reset.Sub(now)
+	}
+	res.Remaining = l.cfg.Limit - s.Count
+	return res
+}
+
+// slidingWindow estimates the requests of the last Period from the counts of the current and the
+// previous window and counts the request when the estimate stays within the limit
+func (l *RateLimiter) slidingWindow(s *RateLimitState, now time.Time) *RateLimitResult {
+	period := l.cfg.Period
+	window := now.Truncate(period)
+	switch {
+	case s.Window.Equal(window):
+	case s.Window.Add(period).Equal(window):
+		s.Window, s.Previous, s.Count = window, s.Count, 0
+	default:
+		s.Window, s.Previous, s.Count = window, 0, 0
+	}
+
+	limit := float64(l.cfg.Limit)
+	weight := 1 - float64(now.Sub(window))/float64(period)
+	estimate := float64(s.Previous)*weight + float64(s.Count)
+	res := &RateLimitResult{Limit: l.cfg.Limit, Reset: window.Add(period)}
+	if estimate+1 <= limit {
+		s.Count++
+		estimate++
+		res.Allowed = true
+	} else {
+		// Find when the estimate drops to limit-1: later in this window as the previous window
+		// slides out, or during the next one when this window is already full
+		var at time.Time
+		if float64(s.Count)+1 <= limit {
+			at = window.Add(time.Duration((1 - (limit-1-float64(s.Count))/float64(s.Previous)) * float64(period)))
+		} else {
+			at = window.Add(period).Add(time.Duration((1 - (limit-1)/float64(s.Count)) * float64(period)))
+		}
+		res.RetryAfter = at.Sub(now)
+		if at.After(res.Reset) {
+			res.Reset = at
+		}
+	}
+	res.Remaining = max(0, int(limit-estimate))
+	return res
+}
+
+// seconds converts fractional seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Middleware returns a middleware that counts every request under the configured key and answers
+// rejected ones with RATE_LIMIT_EXCEEDED
+//
+// Place it after Authenticate when limiting by principal. A failing store is answered with an
+// internal error.
+func (l *RateLimiter) Middleware() Middleware {
+	return func(next MCPHandler) MCPHandler {
+		return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+			key := l.cfg.Key(ctx, req)
+			if key == "" {
+				return next(ctx, req)
+			}
+			res, err := l.Take(ctx, key)
+			if err != nil {
+				return NewMCPErrorResponse(StdError(ErrInternal), nil, req.ID)
+			}
+			if !res.Allowed {
+				return NewMCPErrorResponse(rateLimitExceeded(res.RetryAfter), nil, req.ID)
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// Handler wraps next, typically a WebSocketHandler, so that HTTP requests are counted under the
+// key returned by key, nil counting them per remote IP address
+func (l *RateLimiter) Handler(key func(r *http.Request) string, next http.Handler) http.Handler {
+	if key == nil {
+		key = func(r *http.Request) string { return "addr:" + remoteHost(r.RemoteAddr) }
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k := key(r)
+		if k == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		res, err := l.Take(r.Context(), k)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		h := w.Header()
+		h.Set(HeaderRateLimitLimit, strconv.Itoa(res.Limit))
+		h.Set(HeaderRateLimitRemaining, strconv.Itoa(res.Remaining))
+		h.Set(HeaderRateLimitReset, strconv.FormatInt(ceilUnix(res.Reset), 10))
+		if res.Allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set(HeaderRetryAfter, strconv.Itoa(retryAfterSeconds(res.RetryAfter)))
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(NewMCPErrorResponse(rateLimitExceeded(res.RetryAfter), nil, nil))
+	})
+}
+
+// rateLimitExceeded returns the RATE_LIMIT_EXCEEDED error asking the caller to wait retryAfter
+func rateLimitExceeded(retryAfter time.Duration) *Error {
+	e, _ := NewMCPError(MCPErrorRateLimitExceeded, ErrMCPExecutionFailed, "Request rate limit exceeded", map[string]int{
+		"retry_after_seconds": retryAfterSeconds(retryAfter),
+	})
+	return e
+}
+
+// retryAfterSeconds rounds d up to whole seconds, at least one
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// ceilUnix returns t as Unix seconds, rounded up
+func ceilUnix(t time.Time) int64 {
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+	return sec
+}
+
+// MemoryRateLimitStore is an in-memory RateLimitStore
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	states  map[string]*rateLimitEntry
+	updates int
+	now     func() time.Time
+}
+
+// rateLimitEntry is a stored state and when it may be dropped
+type rateLimitEntry struct {
+	state   RateLimitState
+	expires time.Time
+}
+
+// rateLimitSweepEvery is the number of updates between sweeps of expired states
+const rateLimitSweepEvery = 1024
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{states: make(map[string]*rateLimitEntry), now: time.Now}
+}
+
+// Update applies fn to the state of key under the store lock
+func (s *MemoryRateLimitStore) Update(ctx context.Context, key string, ttl time.Duration, fn func(state *RateLimitState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	s.updates++
+	if s.updates%rateLimitSweepEvery == 0 {
+		for k, e := range s.states {
+			if now.After(e.expires) {
+				delete(s.states, k)
+			}
+		}
+	}
+
+	e, ok := s.states[key]
+	if !ok || now.After(e.expires) {
+		e = &rateLimitEntry{}
+		s.states[key] = e
+	}
+	fn(&e.state)
+	e.expires = now.Add(ttl)
+	return nil
+}
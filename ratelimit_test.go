@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAlgorithms(t *testing.T) {
+	// start is aligned on a minute, so windows begin at start
+	start := time.Unix(1_700_000_040, 0)
+	type step struct {
+		advance    time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		cfg   RateLimitConfig
+		steps []step
+	}{
+		{
+			name: "token bucket",
+			cfg:  RateLimitConfig{Algorithm: TokenBucket, Limit: 2, Period: time.Second},
+			steps: []step{
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{retryAfter: 500 * time.Millisecond},
+				{advance: 500 * time.Millisecond, allowed: true, remaining: 0},
+				{advance: 10 * time.Second, allowed: true, remaining: 1},
+			},
+		},
+		{
+			name: "token bucket burst",
+			cfg:  RateLimitConfig{Algorithm: TokenBucket, Limit: 1, Period: time.Second, Burst: 3},
+			steps: []step{
+				{allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{retryAfter: time.Second},
+			},
+		},
+		{
+			name: "fixed window",
+			cfg:  RateLimitConfig{Algorithm: FixedWindow, Limit: 2, Period: time.Minute},
+			steps: []step{
+				{advance: 10 * time.Second, allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				{retryAfter: 50 * time.Second},
+				{advance: 50 * time.Second, allowed: true, remaining: 1},
+			},
+		},
+		{
+			name: "sliding window",
+			cfg:  RateLimitConfig{Algorithm: SlidingWindow, Limit: 4, Period: time.Minute},
+			steps: []step{
+				{allowed: true, remaining: 3},
+				{allowed: true, remaining: 2},
+				{allowed: true, remaining: 1},
+				{allowed: true, remaining: 0},
+				// The full window only slides out a quarter into the next one
+				{retryAfter: 75 * time.Second},
+				{advance: 75 * time.Second, allowed: true, remaining: 0},
+				{retryAfter: 15 * time.Second},
+				{advance: 2 * time.Minute, allowed: true, remaining: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: start}
+			l := NewRateLimiter(&tt.cfg)
+			l.now = clock.Now
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				res, err := l.Take(context.Background(), "k")
+				if err != nil {
+					t.Fatalf("step %d: Take() error = %v", i, err)
+				}
+				if res.Allowed != s.allowed || res.Remaining != s.remaining || res.RetryAfter != s.retryAfter {
+					t.Errorf("step %d: Take() = allowed %v, remaining %d, retry after %v, want %v, %d, %v",
+						i, res.Allowed, res.Remaining, res.RetryAfter, s.allowed, s.remaining, s.retryAfter)
+				}
+				if res.Reset.Before(clock.Now()) {
+					t.Errorf("step %d: reset %v before now", i, res.Reset)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	l := NewRateLimiter(&RateLimitConfig{Algorithm: FixedWindow, Limit: 1, Period: time.Hour})
+	h := Chain(whoami, Authenticate(testAuthenticator()), l.Middleware())
+	call := func(auth string) *MCPResponse {
+		req, _ := NewMCPRequest("whoami", nil, nil, "", 1)
+		req.Metadata = map[string]interface{}{MetadataAuth: auth}
+		return h(context.Background(), req)
+	}
+
+	if resp := call("Bearer token-1"); resp.Error != nil {
+		t.Fatalf("first request error = %+v", resp.Error)
+	}
+	if resp := call("ApiKey key-1"); resp.Error != nil {
+		t.Fatalf("first request of another principal error = %+v", resp.Error)
+	}
+	resp := call("Bearer token-1")
+	if resp.Error == nil || resp.Error.Type != MCPErrorRateLimitExceeded || resp.Error.Message != "Request rate limit exceeded" {
+		t.Fatalf("second request error = %+v, want RATE_LIMIT_EXCEEDED", resp.Error)
+	}
+	var details map[string]interface{}
+	if err := json.Unmarshal(resp.Error.Details, &details); err != nil || len(details) != 1 || details["retry_after_seconds"] == nil {
+		t.Errorf("details = %s, want only retry_after_seconds", resp.Error.Details)
+	}
+	if after, ok := RetryAfter(resp.Error); !ok || after <= 0 || after > time.Hour {
+		t.Errorf("RetryAfter() = %v, %v, want the wait until the next window", after, ok)
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	l := NewRateLimiter(&RateLimitConfig{Algorithm: FixedWindow, Limit: 1, Period: time.Hour, Key: RateLimitKeys(RateLimitByRemoteAddr, RateLimitByTool)})
+	ln := startListener(t, "tcp", "127.0.0.1:0", Chain(echoHandler, l.Middleware()), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := DialStream(ctx, "tcp", ln.Addr().String(), NewlineFraming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(st, nil)
+	defer client.Close()
+
+	tests := []struct {
+		tool    string
+		limited bool
+	}{
+		{tool: "calc"},
+		{tool: "calc", limited: true},
+		{tool: "search"},
+		{tool: ""},
+		{tool: ""},
+	}
+	for i, tt := range tests {
+		_, err := client.CallMCP(ctx, "execute", tt.tool, nil)
+		if _, limited := RetryAfter(err); limited != tt.limited {
+			t.Errorf("call %d with tool %q error = %v, want limited %v", i, tt.tool, err, tt.limited)
+		}
+	}
+}
+
+func TestRateLimiterHandler(t *testing.T) {
+	l := NewRateLimiter(&RateLimitConfig{Algorithm: FixedWindow, Limit: 2, Period: time.Minute})
+	clock := &fakeClock{now: time.Unix(1_700_000_050, 0)}
+	l.now = clock.Now
+	srv := httptest.NewServer(l.Handler(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	defer srv.Close()
+
+	for i, want := range []struct {
+		status    int
+		remaining string
+	}{{http.StatusNoContent, "1"}, {http.StatusNoContent, "0"}, {http.StatusTooManyRequests, "0"}} {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		h := resp.Header
+		if resp.StatusCode != want.status || h.Get(HeaderRateLimitLimit) != "2" || h.Get(HeaderRateLimitRemaining) != want.remaining || h.Get(HeaderRateLimitReset) != "1700000100" {
+			t.Errorf("request %d = %d %v, want %d with %s remaining until 1700000100", i, resp.StatusCode, h, want.status, want.remaining)
+		}
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body MCPResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding the 429 body: %v", err)
+	}
+	var details struct {
+		RetryAfterSeconds int `json:"retry_after_seconds"`
+	}
+	if body.Status != MCPStatusError || body.Error == nil || body.Error.Type != MCPErrorRateLimitExceeded || json.Unmarshal(body.Error.Details, &details) != nil {
+		t.Fatalf("429 body = %+v, want a RATE_LIMIT_EXCEEDED error", body)
+	}
+	if retry := resp.Header.Get(HeaderRetryAfter); retry != "50" || strconv.Itoa(details.RetryAfterSeconds) != retry {
+		t.Errorf("Retry-After = %q, retry_after_seconds = %d, want 50 in both", retry, details.RetryAfterSeconds)
+	}
+}
+
+func TestMemoryRateLimitStoreExpiry(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	clock := &fakeClock{now: time.Now()}
+	s.now = clock.Now
+	ctx := context.Background()
+
+	_ = s.Update(ctx, "k", time.Minute, func(state *RateLimitState) { state.Count = 5 })
+	clock.Advance(2 * time.Minute)
+	_ = s.Update(ctx, "k", time.Minute, func(state *RateLimitState) {
+		if state.Count != 0 {
+			t.Errorf("state after ttl = %+v, want a zero state", state)
+		}
+	})
+	for i := 0; i < rateLimitSweepEvery; i++ {
+		clock.Advance(time.Hour)
+		_ = s.Update(ctx, "other", time.Minute, func(*RateLimitState) {})
+	}
+	if n := len(s.states); n != 1 {
+		t.Errorf("states after sweeping = %d, want only the live key", n)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrReconnectFailed is returned by a ReconnectingTransport that exhausted its dial attempts
+var ErrReconnectFailed = errors.New("reconnect failed")
+
+// ReconnectConfig configures a ReconnectingTransport
+type ReconnectConfig struct {
+	// Dial opens a new connection, it is required
+	Dial func(ctx context.Context) (Transport, error)
+	// Backoff schedules the delay between dial attempts, the zero value uses DefaultBackoff
+	Backoff Backoff
+	// MaxAttempts limits the consecutive dial attempts of one reconnection, zero means unlimited
+	MaxAttempts int
+	// OnReconnect runs on every new connection before it is used, for example to authenticate or
+	// resume a session. An error closes the connection and counts as a failed attempt.
+	OnReconnect func(ctx context.Context, t Transport) error
+}
+
+// ReconnectingTransport is a client Transport that redials with exponential backoff when the
+// connection drops
+//
+// Every outage is reported once by Receive as an *InterruptedError, and the next Receive dials the
+// new connection, so a Conn fails the calls lost with the old connection before any message goes
+// out on the new one. Messages in flight during the outage are lost, a Conn fails the calls
+// waiting for them with ErrOutcomeUnknown. Send waits while a reconnection is in progress.
+type ReconnectingTransport struct {
+	cfg     ReconnectConfig
+	backoff Backoff
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	cur        Transport
+	ready      chan struct{}
+	down       bool
+	err        error
+	closed     bool
+	reconnects int
+}
+
+// NewReconnectingTransport dials the first connection and returns a transport that redials on failure
+func NewReconnectingTransport(ctx context.Context, cfg ReconnectConfig) (*ReconnectingTransport, error) {
+	if cfg.Dial == nil {
+		return nil, errors.New("reconnect: Dial is required")
+	}
+	t := &ReconnectingTransport{cfg: cfg, backoff: cfg.Backoff, ready: make(chan struct{})}
+	if t.backoff == (Backoff{}) {
+		t.backoff = DefaultBackoff
+	}
+
+	cur, err := cfg.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.cur = cur
+	close(t.ready)
+	return t, nil
+}
+
+// Send writes msg over the current connection, waiting for a reconnection in progress
+//
+// A failed write drops the connection so that Receive reconnects, and is returned as an *InterruptedError.
+func (t *ReconnectingTransport) Send(ctx context.Context, msg []byte) error {
+	cur, err := t.current(ctx)
+	if err != nil {
+		return err
+	}
+	if err := cur.Send(ctx, msg); err != nil {
+		if ctx.Err() != nil || t.isClosed() {
+			return err
+		}
+		cur.Close()
+		return &InterruptedError{Err: err}
+	}
+	return nil
+}
+
+// Receive returns the next message, reconnecting when the connection drops
+//
+// A dropped connection is reported as an *InterruptedError right away, the following Receive
+// dials the new one.
+func (t *ReconnectingTransport) Receive(ctx context.Context) ([]byte, error) {
+	if t.isDown() {
+		if err := t.reconnect(); err != nil {
+			return nil, err
+		}
+	}
+	cur, err := t.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := cur.Receive(ctx)
+	if err == nil {
+		return msg, nil
+	}
+	var interrupted *InterruptedError
+	if ctx.Err() != nil || errors.As(err, &interrupted) {
+		return nil, err
+	}
+	if t.isClosed() {
+		return nil, ErrTransportClosed
+	}
+	t.drop(cur)
+	return nil, &InterruptedError{Err: err}
+}
+
+// Close closes the current connection and stops reconnecting
+func (t *ReconnectingTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	cur := t.cur
+	t.mu.Unlock()
+
+	t.cancel()
+	if cur != nil {
+		return cur.Close()
+	}
+	return nil
+}
+
+// Reconnects returns how many times the transport reconnected
+func (t *ReconnectingTransport) Reconnects() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reconnects
+}
+
+// current returns the connection in use, waiting while a reconnection is in progress
+func (t *ReconnectingTransport) current(ctx context.Context) (Transport, error) {
+	for {
+		t.mu.Lock()
+		switch {
+		case t.closed:
+			t.mu.Unlock()
+			return nil, ErrTransportClosed
+		case t.err != nil:
+			err := t.err
+			t.mu.Unlock()
+			return nil, err
+		case t.cur != nil:
+			cur := t.cur
+			t.mu.Unlock()
+			return cur, nil
+		}
+		ready := t.ready
+		t.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-t.ctx.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// isClosed reports whether Close has been called
+func (t *ReconnectingTransport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// isDown reports whether the connection dropped and was not replaced yet
+func (t *ReconnectingTransport) isDown() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.down
+}
+
+// drop closes the failed connection old, Send waits from then on until reconnect replaces it
+func (t *ReconnectingTransport) drop(old Transport) {
+	t.mu.Lock()
+	if t.cur != old {
+		t.mu.Unlock()
+		return
+	}
+	t.cur = nil
+	t.down = true
+	t.ready = make(chan struct{})
+	t.mu.Unlock()
+	old.Close()
+}
+
+// reconnect replaces the dropped connection, it returns an error once the attempts are exhausted
+// or the transport was closed
+func (t *ReconnectingTransport) reconnect() error {
+	t.mu.Lock()
+	ready := t.ready
+	t.mu.Unlock()
+
+	var lastErr error
+	for attempt := 0; t.cfg.MaxAttempts <= 0 || attempt < t.cfg.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(t.ctx, t.backoff.Delay(attempt-1)); err != nil {
+				break
+			}
+		}
+
+		cur, err := t.cfg.Dial(t.ctx)
+		if err == nil && t.cfg.OnReconnect != nil {
+			if err = t.cfg.OnReconnect(t.ctx, cur); err != nil {
+				cur.Close()
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			cur.Close()
+			break
+		}
+		t.cur = cur
+		t.down = false
+		t.reconnects++
+		t.mu.Unlock()
+		close(ready)
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer close(ready)
+	t.down = false
+	if t.closed {
+		return ErrTransportClosed
+	}
+	t.err = fmt.Errorf("%w: %w", ErrReconnectFailed, lastErr)
+	return t.err
+}
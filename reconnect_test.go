@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer hands out pipe connections served by h and can drop the current one
+type flakyServer struct {
+	h     MCPHandler
+	fail  atomic.Bool
+	dials atomic.Int32
+
+	mu   sync.Mutex
+	conn *PipeTransport
+}
+
+// dial connects a new pipe to the server
+func (s *flakyServer) dial(ctx context.Context) (Transport, error) {
+	s.dials.Add(1)
+	if s.fail.Load() {
+		return nil, errors.New("connection refused")
+	}
+	client, server := Pipe(nil)
+	go ServeTransport(context.Background(), server, s.h)
+	s.mu.Lock()
+	s.conn = client
+	s.mu.Unlock()
+	return client, nil
+}
+
+// drop closes the current connection
+func (s *flakyServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.Close()
+}
+
+// blockingHandler answers the first request for each action only once release is closed and
+// counts the requests it received
+func blockingHandler(started chan<- MCPAction, release <-chan struct{}, calls *atomic.Int32) MCPHandler {
+	var once sync.Map
+	return func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		calls.Add(1)
+		if _, loaded := once.LoadOrStore(req.Action, true); !loaded {
+			started <- req.Action
+			<-release
+		}
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]interface{}{"context": req.Context}, "session-2", nil)
+		return resp
+	}
+}
+
+func TestReconnectReplaysIdempotentCalls(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	started := make(chan MCPAction, 1)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := &flakyServer{h: blockingHandler(started, release, &calls)}
+	defer close(release)
+
+	var restored atomic.Int32
+	tr, err := NewReconnectingTransport(ctx, ReconnectConfig{
+		Dial:    srv.dial,
+		Backoff: Backoff{Initial: time.Millisecond},
+		OnReconnect: func(ctx context.Context, t Transport) error {
+			restored.Add(1)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewReconnectingTransport() error = %v", err)
+	}
+	client := NewClient(tr, &ClientConfig{SessionContext: "session-1"})
+	defer client.Close()
+
+	result := make(chan *MCPResponse, 1)
+	go func() {
+		resp, err := client.CallMCP(ctx, "file_system.read", "", nil)
+		if err != nil {
+			t.Errorf("CallMCP() error = %v", err)
+		}
+		result <- resp
+	}()
+	<-started
+	srv.drop()
+
+	resp := <-result
+	if resp == nil {
+		t.FailNow()
+	}
+	if string(resp.Data) != `{"context":"session-1"}` {
+		t.Errorf("replayed request data = %s, want the session context", resp.Data)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("server saw %d calls, want 2", n)
+	}
+	if n := tr.Reconnects(); n != 1 {
+		t.Errorf("Reconnects() = %d, want 1", n)
+	}
+	if n := restored.Load(); n != 1 {
+		t.Errorf("OnReconnect ran %d times, want 1", n)
+	}
+	if got := client.SessionContext(); got != "session-2" {
+		t.Errorf("SessionContext() = %v, want session-2 from the response", got)
+	}
+}
+
+func TestReconnectFailsNonIdempotentCalls(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	started := make(chan MCPAction, 1)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := &flakyServer{h: blockingHandler(started, release, &calls)}
+	defer close(release)
+
+	tr, err := NewReconnectingTransport(ctx, ReconnectConfig{Dial: srv.dial, Backoff: Backoff{Initial: time.Millisecond}})
+	if err != nil {
+		t.Fatalf("NewReconnectingTransport() error = %v", err)
+	}
+	client := NewClient(tr, nil)
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.CallMCP(ctx, "file_system.write", "", nil)
+		errs <- err
+	}()
+	<-started
+	srv.drop()
+
+	if err := <-errs; !errors.Is(err, ErrOutcomeUnknown) {
+		t.Fatalf("CallMCP() error = %v, want %v", err, ErrOutcomeUnknown)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("server saw %d calls, want 1", n)
+	}
+
+	// The connection is usable again after the reconnection
+	if _, err := client.CallMCP(ctx, "file_system.write", "", nil); err != nil {
+		t.Errorf("CallMCP() after reconnect error = %v", err)
+	}
+}
+
+func TestReconnectReportsOutageBeforeDialing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := &flakyServer{h: echoHandler}
+	tr, err := NewReconnectingTransport(ctx, ReconnectConfig{Dial: srv.dial, Backoff: Backoff{Initial: time.Millisecond}})
+	if err != nil {
+		t.Fatalf("NewReconnectingTransport() error = %v", err)
+	}
+	defer tr.Close()
+
+	srv.drop()
+	var interrupted *InterruptedError
+	if _, err := tr.Receive(ctx); !errors.As(err, &interrupted) {
+		t.Fatalf("Receive() error = %v, want *InterruptedError", err)
+	}
+	if n := srv.dials.Load(); n != 1 {
+		t.Errorf("dialled %d times before the outage was reported, want 1", n)
+	}
+
+	// Sends wait for the connection dialled by the next Receive
+	sendCtx, sendCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer sendCancel()
+	if err := tr.Send(sendCtx, []byte(`{"jsonrpc":"2.0","method":"echo","id":1}`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send() during the outage error = %v, want it to wait", err)
+	}
+	received := make(chan error, 1)
+	go func() {
+		_, err := tr.Receive(ctx)
+		received <- err
+	}()
+	if err := tr.Send(ctx, []byte(`{"jsonrpc":"2.0","method":"echo","id":1}`)); err != nil {
+		t.Fatalf("Send() after the reconnection error = %v", err)
+	}
+	if err := <-received; err != nil {
+		t.Errorf("Receive() over the new connection error = %v", err)
+	}
+	if n := tr.Reconnects(); n != 1 {
+		t.Errorf("Reconnects() = %d, want 1", n)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := &flakyServer{h: echoHandler}
+	tr, err := NewReconnectingTransport(ctx, ReconnectConfig{
+		Dial:        srv.dial,
+		Backoff:     Backoff{Initial: time.Millisecond},
+		MaxAttempts: 3,
+	})
+	if err != nil {
+		t.Fatalf("NewReconnectingTransport() error = %v", err)
+	}
+	client := NewClient(tr, nil)
+	defer client.Close()
+
+	srv.fail.Store(true)
+	srv.drop()
+
+	if err := client.Conn().Wait(); !errors.Is(err, ErrReconnectFailed) {
+		t.Errorf("Wait() error = %v, want reconnect failure", err)
+	}
+	if n := srv.dials.Load(); n != 4 {
+		t.Errorf("dialled %d times, want 1 + 3 attempts", n)
+	}
+	if _, err := client.CallMCP(ctx, "file_system.read", "", nil); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("CallMCP() error = %v, want %v", err, ErrConnClosed)
+	}
+}
+
+func TestReconnectingTransportClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := &flakyServer{h: echoHandler}
+	tr, err := NewReconnectingTransport(ctx, ReconnectConfig{Dial: srv.dial})
+	if err != nil {
+		t.Fatalf("NewReconnectingTransport() error = %v", err)
+	}
+	tr.Close()
+
+	if _, err := tr.Receive(ctx); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Receive() error = %v, want %v", err, ErrTransportClosed)
+	}
+	if err := tr.Send(ctx, []byte(`{}`)); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Send() error = %v, want %v", err, ErrTransportClosed)
+	}
+	if n := srv.dials.Load(); n != 1 {
+		t.Errorf("dialled %d times after Close, want 1", n)
+	}
+}
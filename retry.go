@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed call is retried
+//
+// Only retryable errors are retried, see IsRetryable. Calls to actions that are not idempotent
+// are retried only when the error proves the request was not executed, such as
+// RATE_LIMIT_EXCEEDED, unless Idempotent opts them in.
+type RetryPolicy struct {
+	// MaxAttempts caps the total number of attempts including the first one, zero uses 3
+	MaxAttempts int
+	// Backoff schedules the delay between attempts, the zero value uses DefaultBackoff
+	Backoff Backoff
+	// MaxDelay caps the total time spent waiting between attempts, zero means no cap
+	MaxDelay time.Duration
+	// Idempotent reports whether an action or method can safely run more than once, nil uses DefaultIdempotent
+	Idempotent func(action string) bool
+	// Retryable overrides the classification of errors, nil uses IsRetryable
+	Retryable func(err error) bool
+}
+
+// idempotentVerbs are the action verbs DefaultIdempotent treats as safe to repeat
+var idempotentVerbs = map[string]bool{
+	"get":      true,
+	"read":     true,
+	"list":     true,
+	"search":   true,
+	"query":    true,
+	"find":     true,
+	"fetch":    true,
+	"describe": true,
+	"status":   true,
+	"stat":     true,
+	"exists":   true,
+}
+
+// DefaultIdempotent reports whether the verb of a "namespace.verb" action, such as
+// "file_system.read", only reads data and is therefore safe to repeat
+func DefaultIdempotent(action string) bool {
+	verb := action[strings.LastIndexByte(action, '.')+1:]
+	return idempotentVerbs[strings.ToLower(verb)]
+}
+
+// Do runs fn until it succeeds, fails with an error that must not be retried or the attempts,
+// the delay budget or ctx run out, and returns the last error
+func (p *RetryPolicy) Do(ctx context.Context, action string, fn func(ctx context.Context) error) error {
+	return p.do(ctx, action, false, fn)
+}
+
+// do runs Do, treating the call as idempotent when idempotent is set, for example because it
+// carries an idempotency key
+func (p *RetryPolicy) do(ctx context.Context, action string, idempotent bool, fn func(ctx context.Context) error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	backoff := p.Backoff
+	if backoff == (Backoff{}) {
+		backoff = DefaultBackoff
+	}
+
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt+1 >= maxAttempts || ctx.Err() != nil || !p.shouldRetry(action, idempotent, err) {
+			return err
+		}
+
+		delay := backoff.Delay(attempt)
+		if after, ok := RetryAfter(err); ok && after > delay {
+			delay = after
+		}
+		if p.MaxDelay > 0 && waited+delay > p.MaxDelay {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+		waited += delay
+	}
+}
+
+// shouldRetry reports whether a call to action that failed with err can be attempted again
+func (p *RetryPolicy) shouldRetry(action string, idempotent bool, err error) bool {
+	retryable := IsRetryable
+	if p.Retryable != nil {
+		retryable = p.Retryable
+	}
+	if !retryable(err) {
+		return false
+	}
+
+	if idempotent || notExecuted(err) {
+		return true
+	}
+	if p.Idempotent != nil {
+		return p.Idempotent(action)
+	}
+	return DefaultIdempotent(action)
+}
+
+// notExecuted reports whether err proves the peer rejected the request before running it
+func notExecuted(err error) bool {
+	var mcpErr *Error
+	if errors.As(err, &mcpErr) {
+		return mcpErr.Type == MCPErrorRateLimitExceeded || (mcpErr.Type == "" && mcpErr.Code == http.StatusTooManyRequests)
+	}
+	var hsErr *HandshakeError
+	return errors.As(err, &hsErr)
+}
+
+// IsRetryable reports whether err is a transient failure worth retrying
+//
+// Rate limiting, timeouts, unavailable dependencies, interrupted transports, network errors and
+// HTTP 408, 429 and 5xx statuses are retryable. Validation, authentication, authorization and
+// not found errors, as well as a cancelled or expired ctx, are not. An *Error without a type is
+// classified by its code, which may be an HTTP status carried in error.code.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var interrupted *InterruptedError
+	if errors.As(err, &interrupted) {
+		return true
+	}
+	var mcpErr *Error
+	if errors.As(err, &mcpErr) {
+		switch mcpErr.Type {
+		case MCPErrorRateLimitExceeded, MCPErrorTimeout, MCPErrorDependency:
+			return true
+		case "":
+			return retryableCode(mcpErr.Code)
+		}
+		return false
+	}
+	var hsErr *HandshakeError
+	if errors.As(err, &hsErr) {
+		return hsErr.StatusCode == http.StatusRequestTimeout ||
+			hsErr.StatusCode == http.StatusTooManyRequests ||
+			hsErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryableCode classifies the code of an *Error without a type
+//
+// HTTP 429, 503 and 504 and the MCP tool not available code are retryable, HTTP 400, 401, 403,
+// 404 and 405 and every other code are not.
+func retryableCode(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout, ErrMCPToolNotAvailable:
+		return true
+	}
+	return false
+}
+
+// MaxRetryAfter caps the wait a server can ask for before a retry
+const MaxRetryAfter = time.Hour
+
+// RetryAfter returns how long the server asked the client to wait before retrying, taken from the
+// retry_after_seconds error detail or the Retry-After header of a refused handshake
+//
+// The wait is capped at MaxRetryAfter.
+func RetryAfter(err error) (time.Duration, bool) {
+	var mcpErr *Error
+	if errors.As(err, &mcpErr) && len(mcpErr.Details) > 0 {
+		var details struct {
+			RetryAfterSeconds *float64 `json:"retry_after_seconds"`
+		}
+		if json.Unmarshal(mcpErr.Details, &details) == nil && details.RetryAfterSeconds != nil && *details.RetryAfterSeconds >= 0 {
+			// Compare in seconds, converting huge values to a Duration would overflow
+			if seconds := *details.RetryAfterSeconds; seconds < MaxRetryAfter.Seconds() {
+				return time.Duration(seconds * float64(time.Second)), true
+			}
+			return MaxRetryAfter, true
+		}
+	}
+	var hsErr *HandshakeError
+	if errors.As(err, &hsErr) && hsErr.RetryAfter > 0 {
+		return min(hsErr.RetryAfter, MaxRetryAfter), true
+	}
+	return 0, false
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(min(max(seconds, 0), int(MaxRetryAfter/time.Second))) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
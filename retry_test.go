@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mcpError builds an *Error of the given type for tests
+func mcpError(errType MCPErrorType, details interface{}) *Error {
+	e, _ := NewMCPError(errType, ErrMCPExecutionFailed, string(errType), details)
+	return e
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "rate limited", err: mcpError(MCPErrorRateLimitExceeded, nil), want: true},
+		{name: "timeout", err: mcpError(MCPErrorTimeout, nil), want: true},
+		{name: "dependency", err: mcpError(MCPErrorDependency, nil), want: true},
+		{name: "validation", err: mcpError(MCPErrorValidation, nil), want: false},
+		{name: "authentication", err: mcpError(MCPErrorAuthentication, nil), want: false},
+		{name: "authorization", err: mcpError(MCPErrorAuthorization, nil), want: false},
+		{name: "not found", err: mcpError(MCPErrorResourceNotFound, nil), want: false},
+		{name: "tool not available code", err: StdError(ErrMCPToolNotAvailable), want: true},
+		{name: "invalid params code", err: StdError(ErrInvalidParams), want: false},
+		{name: "code 429", err: &Error{Code: 429, Message: "Too Many Requests"}, want: true},
+		{name: "code 503", err: &Error{Code: 503, Message: "Service Unavailable"}, want: true},
+		{name: "code 504", err: &Error{Code: 504, Message: "Gateway Timeout"}, want: true},
+		{name: "code 400", err: &Error{Code: 400, Message: "Bad Request"}, want: false},
+		{name: "code 401", err: &Error{Code: 401, Message: "Unauthorized"}, want: false},
+		{name: "code 403", err: &Error{Code: 403, Message: "Forbidden"}, want: false},
+		{name: "code 404", err: &Error{Code: 404, Message: "Not Found"}, want: false},
+		{name: "code 405", err: &Error{Code: 405, Message: "Method Not Allowed"}, want: false},
+		{name: "code 503 with a terminal type", err: &Error{Code: 503, Type: MCPErrorValidation}, want: false},
+		{name: "interrupted", err: &InterruptedError{Err: errors.New("restart")}, want: true},
+		{name: "network", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{name: "handshake 503", err: &HandshakeError{StatusCode: 503}, want: true},
+		{name: "handshake 429", err: &HandshakeError{StatusCode: 429}, want: true},
+		{name: "handshake 401", err: &HandshakeError{StatusCode: 401}, want: false},
+		{name: "handshake 404", err: &HandshakeError{StatusCode: 404}, want: false},
+		{name: "context cancelled", err: context.Canceled, want: false},
+		{name: "wrapped", err: fmt.Errorf("call: %w", mcpError(MCPErrorTimeout, nil)), want: true},
+		{name: "unknown", err: errors.New("boom"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "details", err: mcpError(MCPErrorRateLimitExceeded, map[string]int{"retry_after_seconds": 30}), want: 30 * time.Second, wantOK: true},
+		{name: "fractional details", err: mcpError(MCPErrorRateLimitExceeded, map[string]float64{"retry_after_seconds": 0.5}), want: 500 * time.Millisecond, wantOK: true},
+		{name: "no details", err: mcpError(MCPErrorRateLimitExceeded, nil), wantOK: false},
+		{name: "huge details", err: mcpError(MCPErrorRateLimitExceeded, map[string]float64{"retry_after_seconds": 1e300}), want: MaxRetryAfter, wantOK: true},
+		{name: "negative details", err: mcpError(MCPErrorRateLimitExceeded, map[string]float64{"retry_after_seconds": -5}), wantOK: false},
+		{name: "handshake header", err: &HandshakeError{StatusCode: 429, RetryAfter: 2 * time.Second}, want: 2 * time.Second, wantOK: true},
+		{name: "long handshake header", err: &HandshakeError{StatusCode: 429, RetryAfter: 48 * time.Hour}, want: MaxRetryAfter, wantOK: true},
+		{name: "plain error", err: errors.New("boom"), wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RetryAfter(tt.err)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("RetryAfter() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "120", want: 2 * time.Minute},
+		{value: " 5 ", want: 5 * time.Second},
+		{value: "Mon, 01 Jan 2024 12:00:30 GMT", want: 30 * time.Second},
+		{value: "Mon, 01 Jan 2024 11:00:00 GMT", want: 0},
+		{value: "-3", want: 0},
+		{value: "99999999999999", want: MaxRetryAfter},
+		{value: "soon", want: 0},
+		{value: "", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultIdempotent(t *testing.T) {
+	tests := map[string]bool{
+		"file_system.read":   true,
+		"database.query":     true,
+		"issues.list":        true,
+		"file_system.write":  false,
+		"payments.charge":    false,
+		"get":                true,
+		"calculator.ReadOut": false,
+	}
+	for action, want := range tests {
+		if got := DefaultIdempotent(action); got != want {
+			t.Errorf("DefaultIdempotent(%q) = %v, want %v", action, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	fast := Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	timeout := mcpError(MCPErrorTimeout, nil)
+
+	tests := []struct {
+		name      string
+		policy    RetryPolicy
+		action    string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "succeeds after transient failures",
+			policy:    RetryPolicy{MaxAttempts: 5, Backoff: fast},
+			action:    "file_system.read",
+			errs:      []error{timeout, timeout, nil},
+			wantCalls: 3,
+		},
+		{
+			name:      "gives up after max attempts",
+			policy:    RetryPolicy{MaxAttempts: 2, Backoff: fast},
+			action:    "file_system.read",
+			errs:      []error{timeout, timeout, nil},
+			wantCalls: 2,
+			wantErr:   timeout,
+		},
+		{
+			name:      "does not retry permanent errors",
+			policy:    RetryPolicy{MaxAttempts: 5, Backoff: fast},
+			action:    "file_system.read",
+			errs:      []error{mcpError(MCPErrorValidation, nil), nil},
+			wantCalls: 1,
+		},
+		{
+			name:      "does not retry non-idempotent actions",
+			policy:    RetryPolicy{MaxAttempts: 5, Backoff: fast},
+			action:    "file_system.write",
+			errs:      []error{timeout, nil},
+			wantCalls: 1,
+			wantErr:   timeout,
+		},
+		{
+			name:      "retries non-idempotent actions that were rejected",
+			policy:    RetryPolicy{MaxAttempts: 5, Backoff: fast},
+			action:    "file_system.write",
+			errs:      []error{mcpError(MCPErrorRateLimitExceeded, nil), nil},
+			wantCalls: 2,
+		},
+		{
+			name: "retries actions that opt in",
+			policy: RetryPolicy{MaxAttempts: 5, Backoff: fast, Idempotent: func(action string) bool {
+				return action == "file_system.write"
+			}},
+			action:    "file_system.write",
+			errs:      []error{timeout, nil},
+			wantCalls: 2,
+		},
+		{
+			name:      "retry after beyond delay budget",
+			policy:    RetryPolicy{MaxAttempts: 5, Backoff: fast, MaxDelay: time.Second},
+			action:    "file_system.read",
+			errs:      []error{mcpError(MCPErrorRateLimitExceeded, map[string]int{"retry_after_seconds": 60}), nil},
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := tt.policy.Do(context.Background(), tt.action, func(ctx context.Context) error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("Do() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && calls == len(tt.errs) && err != nil {
+				t.Errorf("Do() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestClientRetriesRateLimitedCalls(t *testing.T) {
+	clientT, serverT := Pipe(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var calls atomic.Int32
+	go ServeTransport(ctx, serverT, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		if calls.Add(1) == 1 {
+			return NewMCPErrorResponse(mcpError(MCPErrorRateLimitExceeded, map[string]float64{"retry_after_seconds": 0.05}), nil, nil)
+		}
+		return echoHandler(ctx, req)
+	})
+
+	client := NewClient(clientT, &ClientConfig{Retry: &RetryPolicy{Backoff: Backoff{Initial: time.Millisecond}}})
+	defer client.Close()
+
+	start := time.Now()
+	resp, err := client.CallMCP(ctx, "file_system.write", "", map[string]string{"path": "/tmp/x"})
+	if err != nil {
+		t.Fatalf("CallMCP() error = %v", err)
+	}
+	if resp.Status != MCPStatusSuccess {
+		t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("server saw %d calls, want 2", n)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("retried after %v, want retry_after_seconds of 50ms honoured", elapsed)
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalidJSON is returned by ScanEnvelope for messages that are not valid JSON
+	ErrInvalidJSON = errors.New("invalid JSON")
+	// ErrEnvelopeFallback is returned by ScanEnvelope for valid messages outside the fast path,
+	// such as duplicate or mistyped envelope fields, which must be decoded with encoding/json
+	ErrEnvelopeFallback = errors.New("message needs the encoding/json decoder")
+)
+
+// maxScanDepth matches the nesting limit of encoding/json
+const maxScanDepth = 10000
+
+// Envelope fields, as bits of Envelope.seen
+const (
+	fieldJSONRPC = 1 << iota
+	fieldMethod
+	fieldAction
+	fieldParams
+	fieldContext
+	fieldTool
+	fieldMetadata
+	fieldID
+)
+
+// envelopeFields maps the JSON names of the request envelope to their bits
+var envelopeFields = []struct {
+	name string
+	bit  uint16
+}{
+	{"jsonrpc", fieldJSONRPC},
+	{"method", fieldMethod},
+	{"action", fieldAction},
+	{"params", fieldParams},
+	{"context", fieldContext},
+	{"tool", fieldTool},
+	{"metadata", fieldMetadata},
+	{"id", fieldID},
+}
+
+// Envelope is the routing part of a request, scanned without decoding its params
+//
+// String fields hold unescaped values and raw fields the JSON text of their value, nil when
+// absent. They alias the scanned message or a buffer owned by the Envelope, so they are only
+// valid until Release.
+type Envelope struct {
+	JSONRPC []byte
+	Method  []byte
+	Action  []byte
+	Tool    []byte
+
+	ID       json.RawMessage
+	Params   json.RawMessage
+	Context  json.RawMessage
+	Metadata json.RawMessage
+
+	// Extra reports fields outside the request envelope, such as the result of a response
+	Extra bool
+
+	msg  []byte
+	buf  []byte
+	seen uint16
+}
+
+// envelopePool recycles envelopes and their unescape buffers
+var envelopePool = sync.Pool{
+	New: func() interface{} { return new(Envelope) },
+}
+
+// ScanEnvelope scans the request envelope of msg with a hand-written scanner that allocates
+// nothing for typical messages
+//
+// It fails with an error wrapping ErrInvalidJSON for malformed JSON and with ErrEnvelopeFallback
+// for valid messages encoding/json must decode. The Envelope must be released after use.
+func ScanEnvelope(msg []byte) (*Envelope, error) {
+	e := envelopePool.Get().(*Envelope)
+	e.reset()
+	e.msg = msg
+	if err := e.scan(); err != nil {
+		e.Release()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Release returns the Envelope to the pool
+func (e *Envelope) Release() {
+	if cap(e.buf) > 64<<10 {
+		// Do not keep the buffer of an unusually large message alive
+		e.buf = nil
+	}
+	e.reset()
+	envelopePool.Put(e)
+}
+
+// reset clears the fields, keeping the buffer
+func (e *Envelope) reset() {
+	*e = Envelope{buf: e.buf[:0]}
+}
+
+// Request returns the JSON-RPC request held by the envelope, with params sharing the message memory
+func (e *Envelope) Request() (*Request, error) {
+	id, err := e.id()
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		JSONRPC: e.version(),
+		Method:  string(e.Method),
+		Params:  e.Params,
+		ID:      id,
+	}, nil
+}
+
+// MCPRequest returns the MCP request held by the envelope, with params sharing the message memory
+func (e *Envelope) MCPRequest() (*MCPRequest, error) {
+	id, err := e.id()
+	if err != nil {
+		return nil, err
+	}
+	req := &MCPRequest{
+		JSONRPC: e.version(),
+		Method:  string(e.Method),
+		Params:  e.Params,
+		Tool:    string(e.Tool),
+		ID:      id,
+	}
+	if bytes.Equal(e.Action, e.Method) {
+		req.Action = MCPAction(req.Method)
+	} else {
+		req.Action = MCPAction(e.Action)
+	}
+	if e.Context != nil {
+		if err := json.Unmarshal(e.Context, &req.Context); err != nil {
+			return nil, err
+		}
+	}
+	if e.Metadata != nil {
+		if err := json.Unmarshal(e.Metadata, &req.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// version returns the jsonrpc field, without allocating for the current version
+func (e *Envelope) version() string {
+	if string(e.JSONRPC) == Version {
+		return Version
+	}
+	return string(e.JSONRPC)
+}
+
+// id decodes the raw ID the way encoding/json decodes into an interface{}
+func (e *Envelope) id() (interface{}, error) {
+	switch {
+	case e.ID == nil || e.ID[0] == 'n':
+		return nil, nil
+	case e.ID[0] == '"':
+		s, _, err := e.unquote(0, e.ID)
+		return string(s), err
+	case e.ID[0] == '-' || (e.ID[0] >= '0' && e.ID[0] <= '9'):
+		f, err := strconv.ParseFloat(string(e.ID), 64)
+		if err != nil {
+			return nil, ErrEnvelopeFallback
+		}
+		return f, nil
+	}
+	var id interface{}
+	err := json.Unmarshal(e.ID, &id)
+	return id, err
+}
+
+// scan reads the top-level object of the message
+func (e *Envelope) scan() error {
+	i := e.space(0)
+	if i == len(e.msg) {
+		return e.syntax(i)
+	}
+	if e.msg[i] != '{' {
+		// Valid JSON that is not an object is left to encoding/json
+		end, err := e.value(i, 0)
+		if err != nil {
+			return err
+		}
+		if e.space(end) != len(e.msg) {
+			return e.syntax(end)
+		}
+		return ErrEnvelopeFallback
+	}
+
+	fallback := false
+	i = e.space(i + 1)
+	if i < len(e.msg) && e.msg[i] == '}' {
+		return e.end(i + 1)
+	}
+	for {
+		if i >= len(e.msg) || e.msg[i] != '"' {
+			return e.syntax(i)
+		}
+		mark := len(e.buf)
+		key, end, err := e.unquote(i, e.msg)
+		if err != nil {
+			return err
+		}
+		bit := envelopeField(key)
+		e.buf = e.buf[:mark]
+
+		i = e.space(end)
+		if i >= len(e.msg) || e.msg[i] != ':' {
+			return e.syntax(i)
+		}
+		i = e.space(i + 1)
+		start := i
+		if i, err = e.value(i, 1); err != nil {
+			return err
+		}
+		if !e.field(bit, start, i) {
+			fallback = true
+		}
+
+		i = e.space(i)
+		if i >= len(e.msg) {
+			return e.syntax(i)
+		}
+		switch e.msg[i] {
+		case ',':
+			i = e.space(i + 1)
+			continue
+		case '}':
+			if err := e.end(i + 1); err != nil {
+				return err
+			}
+			if fallback {
+				return ErrEnvelopeFallback
+			}
+			return nil
+		}
+		return e.syntax(i)
+	}
+}
+
+// field stores the value of a top-level field found between start and end, it returns false when
+// the field must be decoded by encoding/json
+func (e *Envelope) field(bit uint16, start, end int) bool {
+	if bit == 0 {
+		e.Extra = true
+		return true
+	}
+	if e.seen&bit != 0 {
+		// encoding/json merges some duplicate fields, keep its semantics
+		return false
+	}
+	e.seen |= bit
+
+	raw := e.msg[start:end]
+	switch bit {
+	case fieldJSONRPC, fieldMethod, fieldAction, fieldTool:
+		if raw[0] == 'n' {
+			return true
+		}
+		if raw[0] != '"' {
+			return false
+		}
+		s, _, _ := e.unquote(0, raw)
+		switch bit {
+		case fieldJSONRPC:
+			e.JSONRPC = s
+		case fieldMethod:
+			e.Method = s
+		case fieldAction:
+			e.Action = s
+		default:
+			e.Tool = s
+		}
+	case fieldMetadata:
+		if raw[0] == 'n' {
+			return true
+		}
+		if raw[0] != '{' {
+			return false
+		}
+		e.Metadata = raw
+	case fieldParams:
+		e.Params = raw
+	case fieldContext:
+		e.Context = raw
+	case fieldID:
+		e.ID = raw
+	}
+	return true
+}
+
+// envelopeField returns the bit of an envelope field name, matched like encoding/json does
+func envelopeField(key []byte) uint16 {
+	for _, f := range envelopeFields {
+		if string(key) == f.name {
+			return f.bit
+		}
+	}
+	for _, f := range envelopeFields {
+		if bytes.EqualFold(key, []byte(f.name)) {
+			return f.bit
+		}
+	}
+	return 0
+}
+
+// end checks that only whitespace follows the top-level value
+func (e *Envelope) end(i int) error {
+	if i = e.space(i); i != len(e.msg) {
+		return e.syntax(i)
+	}
+	return nil
+}
+
+// space returns the offset of the first non-whitespace byte at or after i
+func (e *Envelope) space(i int) int {
+	for i < len(e.msg) {
+		switch e.msg[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// syntax returns the error for malformed JSON at offset i
+func (e *Envelope) syntax(i int) error {
+	return fmt.Errorf("%w at offset %d", ErrInvalidJSON, i)
+}
+
+// value validates the JSON value starting at i and returns the offset right after it
+func (e *Envelope) value(i, depth int) (int, error) {
+	if i >= len(e.msg) {
+		return i, e.syntax(i)
+	}
+	switch c := e.msg[i]; {
+	case c == '{':
+		return e.object(i, depth+1)
+	case c == '[':
+		return e.array(i, depth+1)
+	case c == '"':
+		return e.skipString(i)
+	case c == '-' || (c >= '0' && c <= '9'):
+		return e.number(i)
+	case c == 't':
+		return e.literal(i, "true")
+	case c == 'f':
+		return e.literal(i, "false")
+	case c == 'n':
+		return e.literal(i, "null")
+	}
+	return i, e.syntax(i)
+}
+
+// object validates the object starting at i
+func (e *Envelope) object(i, depth int) (int, error) {
+	if depth > maxScanDepth {
+		return i, e.syntax(i)
+	}
+	i = e.space(i + 1)
+	if i < len(e.msg) && e.msg[i] == '}' {
+		return i + 1, nil
+	}
+	var err error
+	for {
+		if i >= len(e.msg) || e.msg[i] != '"' {
+			return i, e.syntax(i)
+		}
+		if i, err = e.skipString(i); err != nil {
+			return i, err
+		}
+		if i = e.space(i); i >= len(e.msg) || e.msg[i] != ':' {
+			return i, e.syntax(i)
+		}
+		if i, err = e.value(e.space(i+1), depth); err != nil {
+			return i, err
+		}
+		if i = e.space(i); i >= len(e.msg) {
+			return i, e.syntax(i)
+		}
+		switch e.msg[i] {
+		case ',':
+			i = e.space(i + 1)
+			continue
+		case '}':
+			return i + 1, nil
+		}
+		return i, e.syntax(i)
+	}
+}
+
+// array validates the array starting at i
+func (e *Envelope) array(i, depth int) (int, error) {
+	if depth > maxScanDepth {
+		return i, e.syntax(i)
+	}
+	i = e.space(i + 1)
+	if i < len(e.msg) && e.msg[i] == ']' {
+		return i + 1, nil
+	}
+	var err error
+	for {
+		if i, err = e.value(i, depth); err != nil {
+			return i, err
+		}
+		if i = e.space(i); i >= len(e.msg) {
+			return i, e.syntax(i)
+		}
+		switch e.msg[i] {
+		case ',':
+			i = e.space(i + 1)
+			continue
+		case ']':
+			return i + 1, nil
+		}
+		return i, e.syntax(i)
+	}
+}
+
+// skipString validates the string starting at i
+func (e *Envelope) skipString(i int) (int, error) {
+	for i++; i < len(e.msg); i++ {
+		switch c := e.msg[i]; {
+		case c == '"':
+			return i + 1, nil
+		case c < 0x20:
+			return i, e.syntax(i)
+		case c == '\\':
+			n, ok := escapeLen(e.msg[i:])
+			if !ok {
+				return i, e.syntax(i)
+			}
+			i += n - 1
+		}
+	}
+	return i, e.syntax(i)
+}
+
+// number validates the number starting at i
+func (e *Envelope) number(i int) (int, error) {
+	start := i
+	if e.msg[i] == '-' {
+		i++
+	}
+	switch {
+	case i < len(e.msg) && e.msg[i] == '0':
+		i++
+	case i < len(e.msg) && e.msg[i] >= '1' && e.msg[i] <= '9':
+		i = e.digits(i)
+	default:
+		return start, e.syntax(i)
+	}
+	if i < len(e.msg) && e.msg[i] == '.' {
+		if i++; i >= len(e.msg) || e.msg[i] < '0' || e.msg[i] > '9' {
+			return start, e.syntax(i)
+		}
+		i = e.digits(i)
+	}
+	if i < len(e.msg) && (e.msg[i] == 'e' || e.msg[i] == 'E') {
+		if i++; i < len(e.msg) && (e.msg[i] == '+' || e.msg[i] == '-') {
+			i++
+		}
+		if i >= len(e.msg) || e.msg[i] < '0' || e.msg[i] > '9' {
+			return start, e.syntax(i)
+		}
+		i = e.digits(i)
+	}
+	return i, nil
+}
+
+// digits returns the offset of the first non-digit byte at or after i
+func (e *Envelope) digits(i int) int {
+	for i < len(e.msg) && e.msg[i] >= '0' && e.msg[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+// literal validates the literal lit starting at i
+func (e *Envelope) literal(i int, lit string) (int, error) {
+	if len(e.msg)-i < len(lit) || string(e.msg[i:i+len(lit)]) != lit {
+		return i, e.syntax(i)
+	}
+	return i + len(lit), nil
+}
+
+// unquote returns the unescaped content of the string starting at i in src and the offset right
+// after it
+//
+// Strings without escapes and with valid UTF-8 are returned as a subslice of src, others are
+// decoded into the envelope buffer like encoding/json does, invalid UTF-8 and unpaired
+// surrogates becoming U+FFFD.
+func (e *Envelope) unquote(i int, src []byte) ([]byte, int, error) {
+	start := i + 1
+	j := start
+	for ; j < len(src); j++ {
+		c := src[j]
+		if c == '"' {
+			return src[start:j], j + 1, nil
+		}
+		if c == '\\' || c < 0x20 || c >= utf8.RuneSelf {
+			break
+		}
+	}
+	if j < len(src) && src[j] >= utf8.RuneSelf {
+		// Non-ASCII without escapes can still be returned as is when valid
+		k := j
+		for ; k < len(src) && src[k] != '"' && src[k] != '\\' && src[k] >= 0x20; k++ {
+		}
+		if k < len(src) && src[k] == '"' && utf8.Valid(src[j:k]) {
+			return src[start:k], k + 1, nil
+		}
+	}
+
+	mark := len(e.buf)
+	e.buf = append(e.buf, src[start:j]...)
+	for j < len(src) {
+		c := src[j]
+		switch {
+		case c == '"':
+			return e.buf[mark:], j + 1, nil
+		case c < 0x20:
+			return nil, j, e.syntax(j)
+		case c == '\\':
+			n, ok := escapeLen(src[j:])
+			if !ok {
+				return nil, j, e.syntax(j)
+			}
+			if src[j+1] != 'u' {
+				e.buf = append(e.buf, unescapeByte(src[j+1]))
+				j += n
+				continue
+			}
+			r := hex4(src[j+2 : j+6])
+			j += 6
+			if utf16.IsSurrogate(r) {
+				r2 := rune(-1)
+				if len(src)-j >= 6 && src[j] == '\\' && src[j+1] == 'u' && isHex4(src[j+2:j+6]) {
+					r2 = hex4(src[j+2 : j+6])
+				}
+				if dec := utf16.DecodeRune(r, r2); dec != utf8.RuneError {
+					r = dec
+					j += 6
+				} else {
+					r = utf8.RuneError
+				}
+			}
+			e.buf = utf8.AppendRune(e.buf, r)
+		case c < utf8.RuneSelf:
+			e.buf = append(e.buf, c)
+			j++
+		default:
+			r, size := utf8.DecodeRune(src[j:])
+			if r == utf8.RuneError && size == 1 {
+				e.buf = utf8.AppendRune(e.buf, utf8.RuneError)
+			} else {
+				e.buf = append(e.buf, src[j:j+size]...)
+			}
+			j += size
+		}
+	}
+	return nil, j, e.syntax(j)
+}
+
+// escapeLen returns the length of the escape sequence at the start of s
+func escapeLen(s []byte) (int, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	switch s[1] {
+	case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		return 2, true
+	case 'u':
+		return 6, len(s) >= 6 && isHex4(s[2:6])
+	}
+	return 0, false
+}
+
+// unescapeByte returns the byte a single character escape stands for
+func unescapeByte(c byte) byte {
+	switch c {
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	}
+	return c
+}
+
+// isHex4 reports whether s holds four hex digits
+func isHex4(s []byte) bool {
+	for _, c := range s[:4] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// hex4 decodes four hex digits
+func hex4(s []byte) rune {
+	var r rune
+	for _, c := range s[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c = c - 'a' + 10
+		default:
+			c = c - 'A' + 10
+		}
+		r = r<<4 | rune(c)
+	}
+	return r
+}
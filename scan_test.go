@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestScanEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		method string
+		action string
+		tool   string
+		id     string
+		params string
+		extra  bool
+	}{
+		{
+			name:   "MCP request",
+			msg:    `{"jsonrpc":"2.0","method":"execute","action":"execute","tool":"calc","params":{"a":[1,2]},"id":7}`,
+			method: "execute", action: "execute", tool: "calc", id: "7", params: `{"a":[1,2]}`,
+		},
+		{
+			name:   "whitespace and escapes",
+			msg:    " {\n\t\"method\" : \"file_system.\\u0072ead\", \"params\" : [ true , null ] , \"id\" : \"a\\\"b\" }\n",
+			method: "file_system.read", id: `"a\"b"`, params: `[ true , null ]`,
+		},
+		{
+			name:   "folded field names",
+			msg:    `{"METHOD":"ping","Action":"ping"}`,
+			method: "ping", action: "ping",
+		},
+		{
+			name: "response fields",
+			msg:  `{"jsonrpc":"2.0","result":{"ok":true},"id":1}`,
+			id:   "1", extra: true,
+		},
+		{
+			name: "null fields",
+			msg:  `{"method":null,"tool":null,"id":null}`,
+			id:   "null",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ScanEnvelope([]byte(tt.msg))
+			if err != nil {
+				t.Fatalf("ScanEnvelope() error = %v", err)
+			}
+			defer e.Release()
+			if string(e.Method) != tt.method || string(e.Action) != tt.action || string(e.Tool) != tt.tool {
+				t.Errorf("method, action, tool = %q, %q, %q, want %q, %q, %q", e.Method, e.Action, e.Tool, tt.method, tt.action, tt.tool)
+			}
+			if string(e.ID) != tt.id || string(e.Params) != tt.params || e.Extra != tt.extra {
+				t.Errorf("id, params, extra = %s, %s, %v, want %s, %s, %v", e.ID, e.Params, e.Extra, tt.id, tt.params, tt.extra)
+			}
+		})
+	}
+}
+
+func TestScanEnvelopeErrors(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want error
+	}{
+		{`{"method":"a",}`, ErrInvalidJSON},
+		{`{"method":"a"`, ErrInvalidJSON},
+		{`{"method":"a"} x`, ErrInvalidJSON},
+		{`{"params":[01]}`, ErrInvalidJSON},
+		{`{"params":"\x"}`, ErrInvalidJSON},
+		{"{\"method\":\"a\tb\"}", ErrInvalidJSON},
+		{``, ErrInvalidJSON},
+		{`{"method":"a","method":"b"}`, ErrEnvelopeFallback},
+		{`{"method":5}`, ErrEnvelopeFallback},
+		{`{"metadata":[]}`, ErrEnvelopeFallback},
+		{`[{"method":"a"}]`, ErrEnvelopeFallback},
+		{`null`, ErrEnvelopeFallback},
+	}
+	for _, tt := range tests {
+		if _, err := ScanEnvelope([]byte(tt.msg)); !errors.Is(err, tt.want) {
+			t.Errorf("ScanEnvelope(%q) error = %v, want %v", tt.msg, err, tt.want)
+		}
+	}
+}
+
+func TestScanEnvelopeAllocations(t *testing.T) {
+	msg := []byte(`{"jsonrpc":"2.0","method":"execute","action":"execute","tool":"calc","params":{"expression":"2+2"},"id":42}`)
+	allocs := testing.AllocsPerRun(100, func() {
+		e, err := ScanEnvelope(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.Release()
+	})
+	if allocs != 0 {
+		t.Errorf("ScanEnvelope() allocations = %v, want 0", allocs)
+	}
+}
+
+func FuzzScanEnvelope(f *testing.F) {
+	for _, seed := range []string{
+		`{"jsonrpc":"2.0","method":"execute","action":"execute","tool":"calc","params":{"a":1},"id":1}`,
+		`{"method":"a😀\ud800x","id":"é","context":{"k":[1.5e3,-0]},"metadata":{"request_id":"r"}}`,
+		`{"Method":"a","METHOD":"b"}`,
+		`{"paramſ":[],"id":1e400}`,
+		"{\"tool\":\"\xff\"}",
+		`{"id":{"x":null},"params":"s"}`,
+		`[1,2]`,
+		`{"method":"a",}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		var want MCPRequest
+		stdErr := json.Unmarshal(msg, &want)
+
+		e, err := ScanEnvelope(msg)
+		if err != nil {
+			if errors.Is(err, ErrInvalidJSON) && json.Valid(msg) {
+				t.Fatalf("ScanEnvelope(%q) rejected valid JSON: %v", msg, err)
+			}
+			return
+		}
+		defer e.Release()
+		if !json.Valid(msg) {
+			t.Fatalf("ScanEnvelope(%q) accepted invalid JSON", msg)
+		}
+
+		got, err := e.MCPRequest()
+		if err != nil {
+			return
+		}
+		if stdErr != nil {
+			t.Fatalf("ScanEnvelope(%q) accepted a message encoding/json rejects: %v", msg, stdErr)
+		}
+		if got.JSONRPC != want.JSONRPC || got.Method != want.Method || got.Action != want.Action || got.Tool != want.Tool {
+			t.Errorf("strings = %q %q %q %q, encoding/json = %q %q %q %q", got.JSONRPC, got.Method, got.Action, got.Tool, want.JSONRPC, want.Method, want.Action, want.Tool)
+		}
+		if !bytes.Equal(got.Params, want.Params) {
+			t.Errorf("params = %q, encoding/json = %q", got.Params, want.Params)
+		}
+		if !reflect.DeepEqual(got.ID, want.ID) || !reflect.DeepEqual(got.Context, want.Context) || !reflect.DeepEqual(got.Metadata, want.Metadata) {
+			t.Errorf("id, context, metadata = %#v %#v %#v, encoding/json = %#v %#v %#v", got.ID, got.Context, got.Metadata, want.ID, want.Context, want.Metadata)
+		}
+
+		var wantReq Request
+		if json.Unmarshal(msg, &wantReq) == nil {
+			req, err := e.Request()
+			if err != nil || req.Method != wantReq.Method || !bytes.Equal(req.Params, wantReq.Params) || !reflect.DeepEqual(req.ID, wantReq.ID) {
+				t.Errorf("Request() = %+v, %v, encoding/json = %+v", req, err, wantReq)
+			}
+		}
+	})
+}
+
+// benchmarkRequest is a typical small request seen by a gateway
+var benchmarkRequest = []byte(`{"jsonrpc":"2.0","method":"execute","action":"execute","tool":"calculator","params":{"expression":"2+2","precision":10},"id":42}`)
+
+func BenchmarkScanEnvelope(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkRequest)))
+	for i := 0; i < b.N; i++ {
+		e, err := ScanEnvelope(benchmarkRequest)
+		if err != nil {
+			b.Fatal(err)
+		}
+		e.Release()
+	}
+}
+
+func BenchmarkParseRequest(b *testing.B) {
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(benchmarkRequest)))
+		for i := 0; i < b.N; i++ {
+			var req Request
+			if err := json.Unmarshal(benchmarkRequest, &req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scanner", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(benchmarkRequest)))
+		for i := 0; i < b.N; i++ {
+			e, err := ScanEnvelope(benchmarkRequest)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := e.Request(); err != nil {
+				b.Fatal(err)
+			}
+			e.Release()
+		}
+	})
+}
+
+func BenchmarkParseMCPRequest(b *testing.B) {
+	b.Run("encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(benchmarkRequest)))
+		for i := 0; i < b.N; i++ {
+			var req MCPRequest
+			if err := json.Unmarshal(benchmarkRequest, &req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scanner", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(benchmarkRequest)))
+		for i := 0; i < b.N; i++ {
+			e, err := ScanEnvelope(benchmarkRequest)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := e.MCPRequest(); err != nil {
+				b.Fatal(err)
+			}
+			e.Release()
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MCPHandler processes a single MCP request and returns the response to send back
+type MCPHandler func(ctx context.Context, req *MCPRequest) *MCPResponse
+
+// Middleware wraps an MCPHandler with additional behaviour
+type Middleware func(next MCPHandler) MCPHandler
+
+// Chain wraps h with mws, the first middleware is the outermost
+func Chain(h MCPHandler, mws ...Middleware) MCPHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// ErrIdleTimeout is returned when a session ends because it stayed idle for too long
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ServeTransport reads MCP and JSON-RPC requests from t and dispatches each one to h in its own
+// goroutine, so many actions can be in flight on a single connection. Responses carry the request
+// ID and echo the request_id metadata so clients can correlate them.
+//
+// ServeTransport returns the error that stopped the receive loop once all in-flight handlers finished.
+func ServeTransport(ctx context.Context, t Transport, h MCPHandler) error {
+	return ServeTransportWith(ctx, t, h, nil)
+}
+
+// ServeConfig configures the sessions served by ServeTransportWith
+type ServeConfig struct {
+	// Chunks limits the reassembly of chunked params, nil uses the defaults
+	Chunks *ChunkConfig
+	// ProgressInterval is the minimum time between two progress notifications for the same
+	// request, zero uses DefaultProgressInterval and a negative value disables throttling
+	ProgressInterval time.Duration
+}
+
+// ServeTransportWith is ServeTransport with a configuration, nil uses the defaults
+func ServeTransportWith(ctx context.Context, t Transport, h MCPHandler, cfg *ServeConfig) error {
+	var c ServeConfig
+	if cfg != nil {
+		c = *cfg
+	}
+	return newConn(ctx, t, h, serveConfig{chunks: c.Chunks, progressInterval: c.ProgressInterval}).Wait()
+}
+
+// serveConfig tunes the receive loop of a Conn for connection oriented servers
+type serveConfig struct {
+	// stop ends the receive loop without cancelling in-flight handlers
+	stop <-chan struct{}
+	// idleTimeout ends the session after this long without messages or in-flight requests
+	idleTimeout time.Duration
+	// chunks limits the reassembly of chunked payloads, nil uses the defaults
+	chunks *ChunkConfig
+	// progressInterval throttles the progress notifications of each request, zero uses
+	// DefaultProgressInterval and a negative value disables throttling
+	progressInterval time.Duration
+}
+
+// Mux routes MCP requests to the handler registered for their action
+type Mux struct {
+	mu       sync.RWMutex
+	handlers map[MCPAction]MCPHandler
+}
+
+// NewMux creates an empty Mux
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[MCPAction]MCPHandler)}
+}
+
+// Handle registers h for action, replacing any previous handler
+func (m *Mux) Handle(action MCPAction, h MCPHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[action] = h
+}
+
+// ServeMCP dispatches req to the handler registered for its action
+//
+// Unknown actions are answered with an ACTION_NOT_FOUND error.
+func (m *Mux) ServeMCP(ctx context.Context, req *MCPRequest) *MCPResponse {
+	m.mu.RLock()
+	h, ok := m.handlers[req.Action]
+	m.mu.RUnlock()
+	if !ok {
+		return actionNotFound(req)
+	}
+	return h(ctx, req)
+}
+
+// actionNotFound returns the error response for an unsupported action
+func actionNotFound(req *MCPRequest) *MCPResponse {
+	e, _ := NewMCPError(MCPErrorActionNotFound, ErrMethodNotFound, fmt.Sprintf("Action '%s' not supported", req.Action), nil)
+	return NewMCPErrorResponse(e, nil, req.ID)
+}
+
+// dispatchMessage decodes msg, runs h and returns the response, or nil for notifications
+func dispatchMessage(ctx context.Context, msg []byte, h MCPHandler) *MCPResponse {
+	var req MCPRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return NewMCPErrorResponse(StdError(ErrParse), nil, nil)
+	}
+	return dispatchRequest(ctx, &req, h)
+}
+
+// dispatchRequest runs h for a decoded request and returns the response, or nil for notifications
+//
+// A deadline in the request metadata bounds the handler context, requests whose deadline has
+// already passed are refused with a TIMEOUT_ERROR without running h. The handler context lets h
+// report its progress with Progress, it stays valid until streamed data has been written.
+func dispatchRequest(ctx context.Context, req *MCPRequest, h MCPHandler) *MCPResponse {
+	if req.Action == "" {
+		req.Action = MCPAction(req.Method)
+	}
+	if req.Action == "" {
+		return finishResponse(req, NewMCPErrorResponse(StdError(ErrInvalidRequest), nil, nil))
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if deadline, ok := req.Deadline(); ok {
+		if !time.Now().Before(deadline) {
+			if req.IsNotification() {
+				return nil
+			}
+			e, _ := NewMCPError(MCPErrorTimeout, ErrMCPExecutionFailed, "Deadline exceeded before execution", map[string]string{
+				MetadataDeadline: deadline.UTC().Format(time.RFC3339Nano),
+			})
+			return finishResponse(req, NewMCPErrorResponse(e, nil, nil))
+		}
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	ctx = withProgressReporter(ctx, req)
+
+	resp := callHandler(ctx, req, h)
+	if req.IsNotification() {
+		cancel()
+		return nil
+	}
+	if resp.stream == nil {
+		cancel()
+	} else {
+		// Streamed data is written after h returns and may still use its context
+		write := resp.stream
+		resp.stream = func(w io.Writer) error {
+			defer cancel()
+			return write(w)
+		}
+	}
+	return finishResponse(req, resp)
+}
+
+// callHandler runs h and converts a panic or a nil response into an internal error
+func callHandler(ctx context.Context, req *MCPRequest, h MCPHandler) (resp *MCPResponse) {
+	if h == nil {
+		return actionNotFound(req)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			resp = NewMCPErrorResponse(&Error{Code: ErrInternal, Message: fmt.Sprint(r)}, nil, req.ID)
+		}
+	}()
+
+	resp = h(ctx, req)
+	if resp == nil {
+		resp = NewMCPErrorResponse(StdError(ErrInternal), nil, req.ID)
+	}
+	return resp
+}
+
+// dataResponse returns a success response carrying data
+func dataResponse(data interface{}, req *MCPRequest) *MCPResponse {
+	resp, err := NewMCPResponse(MCPStatusSuccess, data, nil, req.ID)
+	if err != nil {
+		return NewMCPErrorResponse(StdError(ErrInternal), nil, req.ID)
+	}
+	return resp
+}
+
+// errorResponse returns the error response for err, hiding errors that are not MCP errors
+func errorResponse(err error, req *MCPRequest) *MCPResponse {
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) {
+		mcpErr = StdError(ErrInternal)
+	}
+	return NewMCPErrorResponse(mcpErr, nil, req.ID)
+}
+
+// finishResponse stamps resp with the protocol version, the request ID and the request_id metadata
+func finishResponse(req *MCPRequest, resp *MCPResponse) *MCPResponse {
+	resp.JSONRPC = Version
+	resp.ID = req.ID
+	if id := req.RequestID(); id != "" {
+		if resp.Metadata == nil {
+			resp.Metadata = make(map[string]interface{})
+		}
+		resp.Metadata[MetadataRequestID] = id
+	}
+	return resp
+}
+
+// encodeResponse marshals resp as an MCP response, or as a plain JSON-RPC response when the
+// request did not use the MCP envelope
+func encodeResponse(resp *MCPResponse, mcp bool) []byte {
+	if resp.stream != nil {
+		var buf bytes.Buffer
+		if writeResponse(&buf, resp, mcp) == nil {
+			return buf.Bytes()
+		}
+		resp = NewMCPErrorResponse(StdError(ErrInternal), nil, resp.ID)
+	}
+	var v interface{} = resp
+	if !mcp {
+		r := &Response{JSONRPC: Version, ID: resp.ID}
+		switch {
+		case resp.Status == MCPStatusError || resp.Error != nil:
+			r.Error = resp.Error
+			if r.Error == nil {
+				r.Error = StdError(ErrInternal)
+			}
+		case len(resp.Data) == 0:
+			r.Result = json.RawMessage("null")
+		default:
+			r.Result = resp.Data
+		}
+		v = r
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(NewMCPErrorResponse(StdError(ErrInternal), nil, resp.ID))
+	}
+	return data
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDispatchMessage(t *testing.T) {
+	echo := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]string{"action": string(req.Action)}, nil, nil)
+		return resp
+	}
+
+	tests := []struct {
+		name          string
+		msg           string
+		handler       MCPHandler
+		wantNil       bool
+		wantStatus    MCPStatus
+		wantCode      int
+		wantID        interface{}
+		wantRequestID interface{}
+	}{
+		{
+			name:       "request with id",
+			msg:        `{"jsonrpc":"2.0","action":"file_system.read","params":{},"id":7}`,
+			handler:    echo,
+			wantStatus: MCPStatusSuccess,
+			wantID:     float64(7),
+		},
+		{
+			name:          "request correlated by request_id",
+			msg:           `{"action":"file_system.read","params":{},"metadata":{"request_id":"req-1"}}`,
+			handler:       echo,
+			wantStatus:    MCPStatusSuccess,
+			wantRequestID: "req-1",
+		},
+		{
+			name:       "method used when action is missing",
+			msg:        `{"jsonrpc":"2.0","method":"execute","id":"a"}`,
+			handler:    echo,
+			wantStatus: MCPStatusSuccess,
+			wantID:     "a",
+		},
+		{
+			name:    "notification gets no response",
+			msg:     `{"jsonrpc":"2.0","action":"log.write","params":{}}`,
+			handler: echo,
+			wantNil: true,
+		},
+		{
+			name:       "invalid JSON",
+			msg:        `{"action":`,
+			handler:    echo,
+			wantStatus: MCPStatusError,
+			wantCode:   ErrParse,
+		},
+		{
+			name:       "missing action",
+			msg:        `{"jsonrpc":"2.0","id":1}`,
+			handler:    echo,
+			wantStatus: MCPStatusError,
+			wantCode:   ErrInvalidRequest,
+			wantID:     float64(1),
+		},
+		{
+			name: "handler panic",
+			msg:  `{"action":"boom","id":2}`,
+			handler: func(ctx context.Context, req *MCPRequest) *MCPResponse {
+				panic("boom")
+			},
+			wantStatus: MCPStatusError,
+			wantCode:   ErrInternal,
+			wantID:     float64(2),
+		},
+		{
+			name: "nil response",
+			msg:  `{"action":"nothing","id":3}`,
+			handler: func(ctx context.Context, req *MCPRequest) *MCPResponse {
+				return nil
+			},
+			wantStatus: MCPStatusError,
+			wantCode:   ErrInternal,
+			wantID:     float64(3),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := dispatchMessage(context.Background(), []byte(tt.msg), tt.handler)
+			if tt.wantNil {
+				if resp != nil {
+					t.Errorf("dispatchMessage() = %v, want nil", resp)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("dispatchMessage() = nil, want response")
+			}
+
+			if resp.JSONRPC != Version {
+				t.Errorf("resp.JSONRPC = %v, want %v", resp.JSONRPC, Version)
+			}
+			if resp.Status != tt.wantStatus {
+				t.Errorf("resp.Status = %v, want %v", resp.Status, tt.wantStatus)
+			}
+			if !reflect.DeepEqual(resp.ID, tt.wantID) {
+				t.Errorf("resp.ID = %v, want %v", resp.ID, tt.wantID)
+			}
+			if tt.wantCode != 0 && (resp.Error == nil || resp.Error.Code != tt.wantCode) {
+				t.Errorf("resp.Error = %v, want code %v", resp.Error, tt.wantCode)
+			}
+			if got := resp.Metadata[MetadataRequestID]; !reflect.DeepEqual(got, tt.wantRequestID) {
+				t.Errorf("resp.Metadata[request_id] = %v, want %v", got, tt.wantRequestID)
+			}
+		})
+	}
+}
+
+func TestDispatchMessageEchoesAction(t *testing.T) {
+	h := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]string{"action": string(req.Action)}, nil, nil)
+		return resp
+	}
+
+	resp := dispatchMessage(context.Background(), []byte(`{"action":"calculator.add","id":1}`), h)
+	var data map[string]string
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		t.Fatalf("Failed to unmarshal data: %v", err)
+	}
+	if data["action"] != "calculator.add" {
+		t.Errorf("data.action = %v, want %v", data["action"], "calculator.add")
+	}
+}
+
+func TestMuxServeMCP(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("calculator.add", func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, "added", nil, nil)
+		return resp
+	})
+
+	resp := mux.ServeMCP(context.Background(), &MCPRequest{Action: "calculator.add"})
+	if resp.Status != MCPStatusSuccess {
+		t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+	}
+
+	resp = mux.ServeMCP(context.Background(), &MCPRequest{Action: "calculator.pow", ID: 1})
+	if resp.Error == nil || resp.Error.Type != MCPErrorActionNotFound || resp.Error.Code != ErrMethodNotFound {
+		t.Errorf("resp.Error = %v, want %s", resp.Error, MCPErrorActionNotFound)
+	}
+}
+
+func TestDispatchRequestDeadline(t *testing.T) {
+	var handlerDeadline time.Time
+	var called bool
+	h := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		called = true
+		handlerDeadline, _ = ctx.Deadline()
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	}
+
+	expired := &MCPRequest{Action: "slow.run", ID: 1}
+	expired.SetDeadline(time.Now().Add(-time.Second))
+	resp := dispatchRequest(context.Background(), expired, h)
+	if called {
+		t.Error("handler ran for a request whose deadline passed")
+	}
+	if resp.Error == nil || resp.Error.Type != MCPErrorTimeout {
+		t.Errorf("resp.Error = %v, want %s", resp.Error, MCPErrorTimeout)
+	}
+
+	deadline := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	pending := &MCPRequest{Action: "slow.run", ID: 2}
+	pending.SetDeadline(deadline)
+	resp = dispatchRequest(context.Background(), pending, h)
+	if resp.Status != MCPStatusSuccess {
+		t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+	}
+	if !handlerDeadline.Equal(deadline) {
+		t.Errorf("handler deadline = %v, want %v", handlerDeadline, deadline)
+	}
+}
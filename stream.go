@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DataWriter writes a single JSON value to w, producing the data of a streamed response
+type DataWriter func(w io.Writer) error
+
+// NewStreamingMCPResponse creates an MCPResponse whose data is written by write when the
+// response is sent
+//
+// On a StreamingTransport the data is written to the connection as write produces it. Other
+// transports, batches, jobs and the Idempotency middleware buffer it first. write is called once,
+// outside any send lock, so it may send progress notifications. Its output must be a single JSON
+// value, it is validated on the way out. When write fails or its output is not valid JSON, the
+// part already sent is abandoned and the peer receives an internal error instead.
+func NewStreamingMCPResponse(status MCPStatus, write DataWriter, context interface{}, id interface{}) *MCPResponse {
+	return &MCPResponse{
+		JSONRPC: Version,
+		Status:  status,
+		Context: context,
+		ID:      id,
+		stream:  write,
+	}
+}
+
+// NewReaderMCPResponse creates a streamed MCPResponse whose data is the JSON value read from r
+func NewReaderMCPResponse(status MCPStatus, r io.Reader, context interface{}, id interface{}) *MCPResponse {
+	return NewStreamingMCPResponse(status, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}, context, id)
+}
+
+// Streamed reports whether the data is written when the response is sent
+func (r *MCPResponse) Streamed() bool {
+	return r.stream != nil
+}
+
+// EncodeMCPResponse writes resp as JSON to w, streaming its data
+func EncodeMCPResponse(w io.Writer, resp *MCPResponse) error {
+	return writeResponse(w, resp, true)
+}
+
+// writeResponse writes resp as an MCP or a plain JSON-RPC response, writing streamed data
+// straight to w
+func writeResponse(w io.Writer, resp *MCPResponse, mcp bool) error {
+	if resp.stream != nil && !mcp && (resp.Status == MCPStatusError || resp.Error != nil) {
+		// A plain JSON-RPC error response carries no result
+		c := *resp
+		c.stream = nil
+		resp = &c
+	}
+	if resp.stream == nil {
+		_, err := w.Write(encodeResponse(resp, mcp))
+		return err
+	}
+
+	e := &envelopeWriter{w: w}
+	e.raw(`{"jsonrpc":`)
+	if mcp {
+		e.value(resp.JSONRPC)
+		e.raw(`,"status":`)
+		e.value(resp.Status)
+		e.raw(`,"data":`)
+	} else {
+		e.value(Version)
+		e.raw(`,"result":`)
+	}
+	e.data(resp.stream)
+	if mcp {
+		if resp.Error != nil {
+			e.raw(`,"error":`)
+			e.value(resp.Error)
+		}
+		if resp.Context != nil {
+			e.raw(`,"context":`)
+			e.value(resp.Context)
+		}
+		if len(resp.Metadata) > 0 {
+			e.raw(`,"metadata":`)
+			e.value(resp.Metadata)
+		}
+	}
+	e.raw(`,"id":`)
+	e.value(resp.ID)
+	e.raw(`}`)
+	return e.err
+}
+
+// bufferResponse returns resp with streamed data written to Data, for the paths that keep
+// responses in memory
+func bufferResponse(resp *MCPResponse) *MCPResponse {
+	if resp == nil || resp.stream == nil {
+		return resp
+	}
+	var buf bytes.Buffer
+	e := &envelopeWriter{w: &buf}
+	e.data(resp.stream)
+	if e.err != nil {
+		return NewMCPErrorResponse(StdError(ErrInternal), resp.Context, resp.ID)
+	}
+	c := *resp
+	c.Data, c.stream = buf.Bytes(), nil
+	return &c
+}
+
+// envelopeWriter writes the parts of a message, keeping the first error
+type envelopeWriter struct {
+	w   io.Writer
+	err error
+}
+
+// raw writes s as is
+func (e *envelopeWriter) raw(s string) {
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
+
+// value writes the JSON encoding of v
+func (e *envelopeWriter) value(v interface{}) {
+	if e.err != nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		e.err = err
+		return
+	}
+	_, e.err = e.w.Write(data)
+}
+
+// data runs write, validating its output and writing null when it produced nothing
+func (e *envelopeWriter) data(write DataWriter) {
+	if e.err != nil {
+		return
+	}
+	v := &jsonValidator{w: e.w}
+	if e.err = write(v); e.err == nil {
+		e.err = v.finish()
+	}
+	if e.err == nil && !v.started {
+		e.raw("null")
+	}
+}
+
+// maxJSONDepth limits the nesting of validated JSON values, as encoding/json does
+const maxJSONDepth = 10000
+
+// ErrInvalidStreamedJSON is returned when the data written for a streamed response is not a
+// single JSON value
+var ErrInvalidStreamedJSON = errors.New("streamed data is not a single JSON value")
+
+// jsonState is a state of the jsonValidator
+type jsonState int
+
+// States of the jsonValidator
+const (
+	jsonValue jsonState = iota
+	jsonValueOrArrayEnd
+	jsonKeyOrObjectEnd
+	jsonKey
+	jsonColon
+	jsonAfterValue
+	jsonString
+	jsonEscape
+	jsonUnicode
+	jsonLiteral
+	jsonNumberSign
+	jsonNumberZero
+	jsonNumberInt
+	jsonNumberDot
+	jsonNumberFrac
+	jsonNumberExp
+	jsonNumberExpSign
+	jsonNumberExpDigits
+	jsonDone
+)
+
+// jsonValidator passes through the bytes written to it as long as they form a prefix of a single
+// JSON value
+//
+// Every write is checked before any of it is passed on, so invalid output, such as a reader
+// injecting fields into the envelope, never reaches the underlying writer.
+type jsonValidator struct {
+	w       io.Writer
+	state   jsonState
+	stack   []byte
+	key     bool
+	literal string
+	hex     int
+	started bool
+	err     error
+}
+
+// Write checks p and writes it to the underlying writer
+func (v *jsonValidator) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	for i := 0; i < len(p); i++ {
+		if v.state == jsonString {
+			// Skip the plain characters of strings, which make up most of the data
+			for i < len(p) && p[i] >= 0x20 && p[i] != '"' && p[i] != '\\' {
+				i++
+			}
+			if i == len(p) {
+				break
+			}
+		}
+		if err := v.step(p[i]); err != nil {
+			v.err = err
+			return 0, err
+		}
+	}
+	return v.w.Write(p)
+}
+
+// finish reports whether the bytes written form a complete JSON value, or nothing at all
+func (v *jsonValidator) finish() error {
+	if v.err != nil {
+		return v.err
+	}
+	switch v.state {
+	case jsonNumberZero, jsonNumberInt, jsonNumberFrac, jsonNumberExpDigits:
+		if len(v.stack) == 0 {
+			return nil
+		}
+	case jsonDone:
+		return nil
+	case jsonValue:
+		if !v.started {
+			return nil
+		}
+	}
+	return ErrInvalidStreamedJSON
+}
+
+// step advances the validator by one byte
+func (v *jsonValidator) step(c byte) error {
+	space := c == ' ' || c == '\t' || c == '\n' || c == '\r'
+	switch v.state {
+	case jsonValue, jsonValueOrArrayEnd:
+		switch {
+		case space:
+			return nil
+		case c == ']' && v.state == jsonValueOrArrayEnd:
+			return v.pop(c)
+		}
+		return v.value(c)
+	case jsonKeyOrObjectEnd, jsonKey:
+		switch {
+		case space:
+			return nil
+		case c == '}' && v.state == jsonKeyOrObjectEnd:
+			return v.pop(c)
+		case c == '"':
+			v.state, v.key = jsonString, true
+			return nil
+		}
+	case jsonColon:
+		switch {
+		case space:
+			return nil
+		case c == ':':
+			v.state = jsonValue
+			return nil
+		}
+	case jsonAfterValue:
+		switch {
+		case space:
+			return nil
+		case c == ',' && v.stack[len(v.stack)-1] == '{':
+			v.state = jsonKey
+			return nil
+		case c == ',':
+			v.state = jsonValue
+			return nil
+		case c == '}' || c == ']':
+			return v.pop(c)
+		}
+	case jsonString:
+		switch {
+		case c == '"':
+			if v.key {
+				v.state, v.key = jsonColon, false
+			} else {
+				v.endValue()
+			}
+			return nil
+		case c == '\\':
+			v.state = jsonEscape
+			return nil
+		case c >= 0x20:
+			return nil
+		}
+	case jsonEscape:
+		switch c {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			v.state = jsonString
+			return nil
+		case 'u':
+			v.state, v.hex = jsonUnicode, 0
+			return nil
+		}
+	case jsonUnicode:
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' {
+			if v.hex++; v.hex == 4 {
+				v.state = jsonString
+			}
+			return nil
+		}
+	case jsonLiteral:
+		if c == v.literal[0] {
+			if v.literal = v.literal[1:]; v.literal == "" {
+				v.endValue()
+			}
+			return nil
+		}
+	case jsonNumberSign:
+		switch {
+		case c == '0':
+			v.state = jsonNumberZero
+			return nil
+		case c >= '1' && c <= '9':
+			v.state = jsonNumberInt
+			return nil
+		}
+	case jsonNumberZero, jsonNumberInt:
+		switch {
+		case c >= '0' && c <= '9' && v.state == jsonNumberInt:
+			return nil
+		case c == '.':
+			v.state = jsonNumberDot
+			return nil
+		case c == 'e' || c == 'E':
+			v.state = jsonNumberExp
+			return nil
+		}
+		v.endValue()
+		return v.step(c)
+	case jsonNumberDot, jsonNumberFrac:
+		switch {
+		case c >= '0' && c <= '9':
+			v.state = jsonNumberFrac
+			return nil
+		case v.state == jsonNumberDot:
+		case c == 'e' || c == 'E':
+			v.state = jsonNumberExp
+			return nil
+		default:
+			v.endValue()
+			return v.step(c)
+		}
+	case jsonNumberExp:
+		switch {
+		case c == '+' || c == '-':
+			v.state = jsonNumberExpSign
+			return nil
+		case c >= '0' && c <= '9':
+			v.state = jsonNumberExpDigits
+			return nil
+		}
+	case jsonNumberExpSign, jsonNumberExpDigits:
+		switch {
+		case c >= '0' && c <= '9':
+			v.state = jsonNumberExpDigits
+			return nil
+		case v.state == jsonNumberExpDigits:
+			v.endValue()
+			return v.step(c)
+		}
+	case jsonDone:
+		if space {
+			return nil
+		}
+	}
+	return ErrInvalidStreamedJSON
+}
+
+// value starts the value beginning with c
+func (v *jsonValidator) value(c byte) error {
+	v.started = true
+	switch {
+	case c == '{' || c == '[':
+		if len(v.stack) == maxJSONDepth {
+			return ErrInvalidStreamedJSON
+		}
+		v.stack = append(v.stack, c)
+		v.state = jsonKeyOrObjectEnd
+		if c == '[' {
+			v.state = jsonValueOrArrayEnd
+		}
+	case c == '"':
+		v.state = jsonString
+	case c == '-':
+		v.state = jsonNumberSign
+	case c == '0':
+		v.state = jsonNumberZero
+	case c >= '1' && c <= '9':
+		v.state = jsonNumberInt
+	case c == 't':
+		v.state, v.literal = jsonLiteral, "rue"
+	case c == 'f':
+		v.state, v.literal = jsonLiteral, "alse"
+	case c == 'n':
+		v.state, v.literal = jsonLiteral, "ull"
+	default:
+		return ErrInvalidStreamedJSON
+	}
+	return nil
+}
+
+// pop closes the innermost object or array with c
+func (v *jsonValidator) pop(c byte) error {
+	if open := v.stack[len(v.stack)-1]; (open == '{') != (c == '}') {
+		return ErrInvalidStreamedJSON
+	}
+	v.stack = v.stack[:len(v.stack)-1]
+	v.endValue()
+	return nil
+}
+
+// endValue moves past a complete value
+func (v *jsonValidator) endValue() {
+	v.state = jsonAfterValue
+	if len(v.stack) == 0 {
+		v.state = jsonDone
+	}
+}
+
+// streamChunkSize is the amount of streamed data collected before it is written out
+const streamChunkSize = 32 << 10
+
+// maxHeldDuringStream limits the size of the messages held back while a streamed message is
+// partly written on a connection that cannot interleave them with it
+//
+// Further senders wait until the streamed message is complete, so a producer must not send more
+// than this itself while it streams.
+const maxHeldDuringStream = 1 << 20
+
+// chunkWriter collects the bytes written to it and hands them to flush in chunks of
+// streamChunkSize, keeping the remainder in buf
+type chunkWriter struct {
+	buf   []byte
+	flush func(p []byte) error
+	err   error
+}
+
+// Write collects p, flushing every complete chunk
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n := len(p)
+	for len(c.buf)+len(p) >= streamChunkSize {
+		k := streamChunkSize - len(c.buf)
+		c.buf = append(c.buf, p[:k]...)
+		p = p[k:]
+		if c.err = c.flush(c.buf); c.err != nil {
+			return n - len(p), c.err
+		}
+		c.buf = c.buf[:0]
+	}
+	c.buf = append(c.buf, p...)
+	return n, nil
+}
+
+// streamGate orders a streamed message with the other messages of a connection, its methods are
+// called with the write lock of the connection held
+//
+// Only one streamed message is partly written at a time. On connections whose framing cannot
+// interleave other messages with it, those are held until it is complete.
+type streamGate struct {
+	idle      *sync.Cond
+	streaming bool
+	held      [][]byte
+	heldSize  int
+}
+
+// begin waits until no other streamed message is partly written and claims the connection
+func (g *streamGate) begin() {
+	for g.streaming {
+		g.idle.Wait()
+	}
+	g.streaming = true
+}
+
+// hold keeps frame back while a streamed message is partly written and reports whether it did,
+// waiting for the streamed message to complete instead when too much is held already
+func (g *streamGate) hold(frame []byte) bool {
+	if !g.streaming {
+		return false
+	}
+	if g.heldSize+len(frame) <= maxHeldDuringStream {
+		g.held = append(g.held, frame)
+		g.heldSize += len(frame)
+		return true
+	}
+	for g.streaming {
+		g.idle.Wait()
+	}
+	return false
+}
+
+// end releases the connection and returns the frames held meanwhile, to be written in order
+func (g *streamGate) end() [][]byte {
+	held := g.held
+	g.held, g.heldSize, g.streaming = nil, 0, false
+	g.idle.Broadcast()
+	return held
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeMCPResponse(t *testing.T) {
+	payload := map[string]interface{}{"text": "line\nbreak", "values": []int{1, 2, 3}}
+	buffered, _ := NewMCPResponse(MCPStatusSuccess, payload, map[string]string{"session": "s1"}, 7)
+	buffered.Metadata = map[string]interface{}{"request_id": "r1"}
+	want, _ := json.Marshal(buffered)
+
+	streamed := NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(payload)
+	}, map[string]string{"session": "s1"}, 7)
+	streamed.Metadata = map[string]interface{}{"request_id": "r1"}
+
+	var buf bytes.Buffer
+	if err := EncodeMCPResponse(&buf, streamed); err != nil {
+		t.Fatalf("EncodeMCPResponse() error = %v", err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buf.Bytes()); err != nil || compact.String() != string(want) {
+		t.Errorf("EncodeMCPResponse() = %s, %v, want %s", buf.Bytes(), err, want)
+	}
+
+	tests := []struct {
+		name string
+		resp *MCPResponse
+		mcp  bool
+		want string
+	}{
+		{
+			name: "plain JSON-RPC",
+			resp: NewReaderMCPResponse(MCPStatusSuccess, strings.NewReader(`[1,2]`), nil, 1),
+			want: `{"jsonrpc":"2.0","result":[1,2],"id":1}`,
+		},
+		{
+			name: "plain JSON-RPC error",
+			resp: &MCPResponse{JSONRPC: Version, Status: MCPStatusError, Error: StdError(ErrInternal), ID: 1, stream: func(w io.Writer) error { return nil }},
+			want: `{"jsonrpc":"2.0","error":{"code":-32603,"message":"Internal error"},"id":1}`,
+		},
+		{
+			name: "empty data",
+			resp: NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error { return nil }, nil, "a"),
+			mcp:  true,
+			want: `{"jsonrpc":"2.0","status":"success","data":null,"id":"a"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeResponse(&buf, tt.resp, tt.mcp); err != nil || buf.String() != tt.want {
+				t.Errorf("writeResponse() = %s, %v, want %s", buf.Bytes(), err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferResponse(t *testing.T) {
+	resp := bufferResponse(NewReaderMCPResponse(MCPStatusSuccess, strings.NewReader(`{"a":1}`), nil, 1))
+	if resp.Streamed() || string(resp.Data) != `{"a":1}` {
+		t.Errorf("bufferResponse() data = %s, want the written JSON", resp.Data)
+	}
+
+	resp = bufferResponse(NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error {
+		return errors.New("disk failure")
+	}, nil, 1))
+	if resp.Error == nil || resp.Error.Code != ErrInternal {
+		t.Errorf("bufferResponse() error = %v, want an internal error", resp.Error)
+	}
+}
+
+func TestFrameWriterStream(t *testing.T) {
+	for _, framing := range []Framing{NewlineFraming, LengthPrefixFraming} {
+		var buf bytes.Buffer
+		w := NewFrameWriter(&buf, framing)
+		if err := w.WriteStream(func(w io.Writer) error {
+			_, err := io.WriteString(w, "{\n  \"text\": \"a\\nb\"\r\n}")
+			return err
+		}); err != nil {
+			t.Fatalf("WriteStream() error = %v", err)
+		}
+		w.WriteMessage([]byte(`{}`))
+
+		r := NewFrameReader(&buf, framing, 0)
+		msg, err := r.ReadMessage()
+		var v struct {
+			Text string `json:"text"`
+		}
+		if err != nil || json.Unmarshal(msg, &v) != nil || v.Text != "a\nb" {
+			t.Errorf("ReadMessage() = %q, %v, want the streamed message", msg, err)
+		}
+		if msg, err := r.ReadMessage(); err != nil || string(msg) != `{}` {
+			t.Errorf("ReadMessage() = %q, %v, want the next message", msg, err)
+		}
+	}
+}
+
+func TestFrameWriterStreamFragments(t *testing.T) {
+	large := `{"rows":"` + strings.Repeat("x", 3*streamChunkSize) + `"}`
+	progress := `{"method":"progress"}`
+
+	tests := []struct {
+		name    string
+		framing Framing
+		fail    bool
+		want    []string
+	}{
+		{name: "length prefix", framing: LengthPrefixFraming, want: []string{progress, large, `{}`}},
+		{name: "length prefix failure", framing: LengthPrefixFraming, fail: true, want: []string{progress, `{}`}},
+		{name: "newline", framing: NewlineFraming, want: []string{large, progress, `{}`}},
+		{name: "newline failure", framing: NewlineFraming, fail: true, want: []string{large[:2*streamChunkSize], progress, `{}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewFrameWriter(&buf, tt.framing)
+			err := w.WriteStream(func(out io.Writer) error {
+				if _, err := io.WriteString(out, large[:2*streamChunkSize]); err != nil {
+					return err
+				}
+				if err := w.WriteMessage([]byte(progress)); err != nil {
+					return err
+				}
+				if tt.fail {
+					return errors.New("disk failure")
+				}
+				_, err := io.WriteString(out, large[2*streamChunkSize:])
+				return err
+			})
+			if (err != nil) != tt.fail {
+				t.Errorf("WriteStream() error = %v, want failure %v", err, tt.fail)
+			}
+			w.WriteMessage([]byte(`{}`))
+
+			r := NewFrameReader(&buf, tt.framing, 0)
+			for _, want := range tt.want {
+				if msg, err := r.ReadMessage(); err != nil || string(msg) != want {
+					t.Errorf("ReadMessage() = %d bytes, %v, want %d bytes", len(msg), err, len(want))
+				}
+			}
+			if msg, err := r.ReadMessage(); err != io.EOF {
+				t.Errorf("ReadMessage() = %q, %v, want EOF", msg, err)
+			}
+		})
+	}
+}
+
+func TestFrameReaderLimitsFragments(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewFrameWriter(&buf, LengthPrefixFraming)
+	w.WriteStream(func(out io.Writer) error {
+		_, err := out.Write(bytes.Repeat([]byte("x"), 3*streamChunkSize))
+		return err
+	})
+	if _, err := NewFrameReader(&buf, LengthPrefixFraming, 2*streamChunkSize).ReadMessage(); err != ErrMessageTooLarge {
+		t.Errorf("ReadMessage() error = %v, want %v", err, ErrMessageTooLarge)
+	}
+}
+
+func TestJSONValidator(t *testing.T) {
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{data: "", valid: true},
+		{data: `{"a":[1,-2.5e+3,0,true,false,null,"x\"\u00e9"],"b":{}}`, valid: true},
+		{data: " [ ] \n", valid: true},
+		{data: "12", valid: true},
+		{data: "-0.5E10", valid: true},
+		{data: `1,"status":"error"`},
+		{data: `{"a":1},"id":2`},
+		{data: `{"a":1`},
+		{data: `{"a" 1}`},
+		{data: `{"a":1,}`},
+		{data: `[1,]`},
+		{data: `[1}`},
+		{data: `01`},
+		{data: `1.`},
+		{data: `1e`},
+		{data: `-`},
+		{data: `tru`},
+		{data: `nul1`},
+		{data: `"a` + "\n" + `"`},
+		{data: `"\x"`},
+		{data: `"\u12g4"`},
+		{data: `{1:2}`},
+		{data: `1 2`},
+		{data: strings.Repeat("[", maxJSONDepth+1)},
+	}
+	for _, tt := range tests {
+		// Whole and byte by byte
+		for _, size := range []int{len(tt.data) + 1, 1} {
+			var buf bytes.Buffer
+			v := &jsonValidator{w: &buf}
+			var err error
+			for data := tt.data; err == nil && len(data) > 0; data = data[min(size, len(data)):] {
+				_, err = io.WriteString(v, data[:min(size, len(data))])
+			}
+			if err == nil {
+				err = v.finish()
+			}
+			if (err == nil) != tt.valid {
+				t.Errorf("validating %.40q in writes of %d bytes error = %v, want valid %v", tt.data, size, err, tt.valid)
+			}
+		}
+	}
+}
+
+func TestStreamedResponseRejectsInvalidJSON(t *testing.T) {
+	resp := NewReaderMCPResponse(MCPStatusSuccess, strings.NewReader(`1,"status":"error"`), nil, 1)
+	var buf bytes.Buffer
+	if err := EncodeMCPResponse(&buf, resp); err != ErrInvalidStreamedJSON {
+		t.Errorf("EncodeMCPResponse() error = %v, want %v", err, ErrInvalidStreamedJSON)
+	}
+	if strings.Contains(buf.String(), "error") {
+		t.Errorf("EncodeMCPResponse() wrote %s, want the invalid data held back", buf.Bytes())
+	}
+
+	client := pipeClient(t, func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return NewReaderMCPResponse(MCPStatusSuccess, strings.NewReader(`{"a":1},"status":"error"`), nil, nil)
+	})
+	var mcpErr *Error
+	if _, err := client.CallMCP(context.Background(), "rows.export", "", nil); !errors.As(err, &mcpErr) || mcpErr.Code != ErrInternal {
+		t.Errorf("CallMCP() error = %v, want an internal error", err)
+	}
+}
+
+func TestStreamedResponseOverConn(t *testing.T) {
+	rows := strings.Repeat(`"row",`, 10000) + `"end"`
+	h := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error {
+			_, err := io.WriteString(w, `{"rows":[`+rows+`]}`)
+			return err
+		}, nil, nil)
+	}
+
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	clientStream := NewStreamTransport(clientRead, clientWrite, NewlineFraming)
+	serverStream := NewStreamTransport(serverRead, serverWrite, NewlineFraming)
+	clientPipe, serverPipe := Pipe(nil)
+
+	tests := []struct {
+		name           string
+		client, server Transport
+	}{
+		{name: "streaming transport", client: clientStream, server: serverStream},
+		{name: "pipe", client: clientPipe, server: serverPipe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go ServeTransport(ctx, tt.server, h)
+			client := NewClient(tt.client, nil)
+			defer client.Close()
+
+			resp, err := client.CallMCP(ctx, "rows.export", "", nil)
+			if err != nil {
+				t.Fatalf("CallMCP() error = %v", err)
+			}
+			var data struct {
+				Rows []string `json:"rows"`
+			}
+			if err := json.Unmarshal(resp.Data, &data); err != nil || len(data.Rows) != 10001 {
+				t.Errorf("got %d rows, error = %v, want 10001", len(data.Rows), err)
+			}
+		})
+	}
+}
+
+func TestStreamedResponseSendsProgress(t *testing.T) {
+	h := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error {
+			if _, err := io.WriteString(w, `{"rows":["a",`); err != nil {
+				return err
+			}
+			if err := Progress(ctx, 1, "rows written"); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, `"b"]}`)
+			return err
+		}, nil, nil)
+	}
+
+	tests := []struct {
+		name    string
+		framing Framing
+	}{
+		{name: "newline framing", framing: NewlineFraming},
+		{name: "length prefix framing", framing: LengthPrefixFraming},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			clientRead, serverWrite := io.Pipe()
+			serverRead, clientWrite := io.Pipe()
+			go ServeTransport(ctx, NewStreamTransport(serverRead, serverWrite, tt.framing), h)
+			client := NewClient(NewStreamTransport(clientRead, clientWrite, tt.framing), nil)
+			defer client.Close()
+
+			var updates []ProgressUpdate
+			resp, err := client.CallMCP(WithProgress(ctx, func(u ProgressUpdate) {
+				updates = append(updates, u)
+			}), "rows.export", "", nil)
+			if err != nil {
+				t.Fatalf("CallMCP() error = %v", err)
+			}
+			if string(resp.Data) != `{"rows":["a","b"]}` {
+				t.Errorf("data = %s, want the streamed rows", resp.Data)
+			}
+			if len(updates) != 1 || updates[0].Message != "rows written" {
+				t.Errorf("updates = %+v, want the progress sent while streaming", updates)
+			}
+		})
+	}
+}
+
+func TestStreamedResponseWriteFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	go ServeTransport(ctx, NewStreamTransport(serverRead, serverWrite, NewlineFraming), func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error {
+			io.WriteString(w, `{"rows":[`)
+			return errors.New("disk failure")
+		}, nil, nil)
+	})
+	client := NewClient(NewStreamTransport(clientRead, clientWrite, NewlineFraming), nil)
+	defer client.Close()
+
+	var mcpErr *Error
+	if _, err := client.CallMCP(ctx, "rows.export", "", nil); !errors.As(err, &mcpErr) || mcpErr.Code != ErrInternal {
+		t.Errorf("CallMCP() error = %v, want an internal error", err)
+	}
+}
+
+// benchmarkPayload is a large result, as returned by a search or an embedding action
+func benchmarkPayload() map[string]interface{} {
+	docs := make([]map[string]interface{}, 2000)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"id": i, "text": strings.Repeat("lorem ipsum ", 20), "score": 0.5}
+	}
+	return map[string]interface{}{"documents": docs}
+}
+
+func BenchmarkEncodeMCPResponse(b *testing.B) {
+	payload := benchmarkPayload()
+	b.Run("raw message", func(b *testing.B) {
+		b.ReportAllocs()
+		w := NewFrameWriter(io.Discard, NewlineFraming)
+		for i := 0; i < b.N; i++ {
+			resp, _ := NewMCPResponse(MCPStatusSuccess, payload, nil, i)
+			msg, _ := json.Marshal(resp)
+			if err := w.WriteMessage(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		w := NewFrameWriter(io.Discard, NewlineFraming)
+		for i := 0; i < b.N; i++ {
+			resp := NewStreamingMCPResponse(MCPStatusSuccess, func(w io.Writer) error {
+				return json.NewEncoder(w).Encode(payload)
+			}, nil, i)
+			if err := w.WriteStream(func(w io.Writer) error { return EncodeMCPResponse(w, resp) }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// subprocessDrainTimeout is how long output of an exited tool process is still read
+const subprocessDrainTimeout = time.Second
+
+// SubprocessConfig configures a SubprocessTransport
+type SubprocessConfig struct {
+	// Path and Args name the command to run, as for exec.Command
+	Path string
+	Args []string
+	// Env and Dir are passed to the command unchanged
+	Env []string
+	Dir string
+	// Framing selects the message framing on stdin and stdout
+	Framing Framing
+	// MaxMessageSize limits a single message read from stdout, zero uses DefaultMaxMessageSize
+	MaxMessageSize int
+	// Restart restarts the process with backoff after it exits unexpectedly
+	Restart bool
+	// MaxRestarts limits the number of restarts, zero means unlimited
+	MaxRestarts int
+	// Backoff controls the delay between restarts
+	Backoff Backoff
+	// ShutdownTimeout is how long Close waits for the process to exit after closing stdin, zero uses 5s
+	ShutdownTimeout time.Duration
+	// StderrLines is the number of trailing stderr lines kept for error details, zero uses 20
+	StderrLines int
+	// Logger receives a record for every stderr line, nil disables logging
+	Logger *slog.Logger
+}
+
+// SubprocessTransport is a client Transport that runs an MCP tool as a child process and
+// exchanges framed messages with it over stdin and stdout
+//
+// Stderr output is logged line by line and its tail is attached to the error details when the
+// process exits. With Restart enabled, every crash is reported once by Receive as an
+// *InterruptedError wrapping an *Error of type DEPENDENCY_ERROR and the transport keeps working
+// with the restarted process.
+type SubprocessTransport struct {
+	cfg SubprocessConfig
+
+	incoming chan []byte
+	exits    chan *Error
+
+	mu      sync.Mutex
+	proc    *subprocess
+	ready   chan struct{}
+	closing bool
+	closeCh chan struct{}
+
+	done chan struct{}
+	err  error
+}
+
+// subprocess is a single run of the tool process
+type subprocess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stream *StreamTransport
+	stderr *lineRing
+	// output holds the read ends of stdout and stderr, closed once the process exited and they
+	// were drained
+	output []*os.File
+	// stderrDone is closed once stderr reached EOF
+	stderrDone chan struct{}
+	// exited is closed after the process has been reaped
+	exited chan struct{}
+}
+
+// StartSubprocess starts the configured command and supervises it until Close is called
+func StartSubprocess(cfg SubprocessConfig) (*SubprocessTransport, error) {
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 5 * time.Second
+	}
+	if cfg.StderrLines <= 0 {
+		cfg.StderrLines = 20
+	}
+	if cfg.Backoff == (Backoff{}) {
+		cfg.Backoff = DefaultBackoff
+	}
+
+	t := &SubprocessTransport{
+		cfg:      cfg,
+		incoming: make(chan []byte),
+		exits:    make(chan *Error, 1),
+		ready:    make(chan struct{}),
+		closeCh:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	p, err := t.start()
+	if err != nil {
+		return nil, err
+	}
+	t.proc = p
+	close(t.ready)
+
+	go t.supervise(p)
+	return t, nil
+}
+
+// Send writes msg to the process stdin, waiting for a restart in progress to finish
+func (t *SubprocessTransport) Send(ctx context.Context, msg []byte) error {
+	for {
+		t.mu.Lock()
+		p, ready, closing := t.proc, t.ready, t.closing
+		t.mu.Unlock()
+
+		if closing {
+			return ErrTransportClosed
+		}
+		if p != nil {
+			return p.stream.Send(ctx, msg)
+		}
+
+		select {
+		case <-ready:
+		case <-t.done:
+			return t.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Receive returns the next message written by the process to stdout
+func (t *SubprocessTransport) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-t.incoming:
+		return msg, nil
+	case exitErr := <-t.exits:
+		return nil, &InterruptedError{Err: exitErr}
+	case <-t.done:
+		return nil, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes stdin, waits up to ShutdownTimeout for the process to exit and then kills its
+// process group
+func (t *SubprocessTransport) Close() error {
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		<-t.done
+		return nil
+	}
+	t.closing = true
+	close(t.closeCh)
+	p := t.proc
+	t.mu.Unlock()
+
+	if p != nil {
+		p.stop(t.cfg.ShutdownTimeout)
+	}
+	<-t.done
+	return nil
+}
+
+// Pid returns the process ID of the running process, or 0 while it is restarting
+func (t *SubprocessTransport) Pid() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.proc == nil {
+		return 0
+	}
+	return t.proc.cmd.Process.Pid
+}
+
+// start launches a new run of the tool process
+func (t *SubprocessTransport) start() (*subprocess, error) {
+	cmd := exec.Command(t.cfg.Path, t.cfg.Args...)
+	cmd.Env = t.cfg.Env
+	cmd.Dir = t.cfg.Dir
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Output goes through pipes owned here rather than by cmd, so that Wait reports the exit of
+	// the process without closing them before they are drained
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, err
+	}
+
+	p := &subprocess{
+		cmd:        cmd,
+		stdin:      stdin,
+		stream:     newStreamTransport(stdout, stdin, t.cfg.Framing, t.cfg.MaxMessageSize),
+		stderr:     newLineRing(t.cfg.StderrLines),
+		output:     []*os.File{stdout, stderr},
+		stderrDone: make(chan struct{}),
+		exited:     make(chan struct{}),
+	}
+	go t.captureStderr(p, stderr)
+	return p, nil
+}
+
+// captureStderr logs each stderr line and keeps the most recent ones for error details
+func (t *SubprocessTransport) captureStderr(p *subprocess, r io.Reader) {
+	defer close(p.stderrDone)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		p.stderr.add(line)
+		if t.cfg.Logger != nil {
+			t.cfg.Logger.Info("tool stderr",
+				slog.String("command", t.cfg.Path),
+				slog.Int("pid", p.cmd.Process.Pid),
+				slog.String("line", line),
+			)
+		}
+	}
+	_, _ = io.Copy(io.Discard, r)
+}
+
+// supervise forwards messages from the running process and restarts it after a crash
+func (t *SubprocessTransport) supervise(p *subprocess) {
+	restarts := 0
+	for {
+		waitErr := t.run(p)
+
+		t.mu.Lock()
+		t.proc = nil
+		t.ready = make(chan struct{})
+		closing := t.closing
+		t.mu.Unlock()
+
+		if closing {
+			t.finish(ErrTransportClosed)
+			return
+		}
+
+		restart := t.cfg.Restart && (t.cfg.MaxRestarts == 0 || restarts < t.cfg.MaxRestarts)
+		exitErr := p.exitError(waitErr, restart)
+		if !restart {
+			t.finish(exitErr)
+			return
+		}
+		t.report(exitErr)
+
+		for {
+			select {
+			case <-time.After(t.cfg.Backoff.Delay(restarts)):
+			case <-t.closeCh:
+				t.finish(ErrTransportClosed)
+				return
+			}
+			restarts++
+
+			next, err := t.start()
+			if err == nil {
+				p = next
+				break
+			}
+			if t.cfg.MaxRestarts > 0 && restarts >= t.cfg.MaxRestarts {
+				t.finish(err)
+				return
+			}
+		}
+
+		t.mu.Lock()
+		if t.closing {
+			t.mu.Unlock()
+			go p.stop(t.cfg.ShutdownTimeout)
+			t.run(p)
+			t.finish(ErrTransportClosed)
+			return
+		}
+		t.proc = p
+		close(t.ready)
+		t.mu.Unlock()
+	}
+}
+
+// run forwards messages until the process exits and returns the result of waiting for it
+//
+// Output written before the exit is drained for up to subprocessDrainTimeout, then the pipes are
+// closed, even when a process started by the tool inherited them and keeps them open.
+func (t *SubprocessTransport) run(p *subprocess) error {
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			msg, err := p.stream.Receive(context.Background())
+			if err != nil {
+				return
+			}
+			select {
+			case t.incoming <- msg:
+			case <-t.closeCh:
+			}
+		}
+	}()
+
+	err := p.cmd.Wait()
+	close(p.exited)
+
+	drained := make(chan struct{})
+	go func() {
+		<-forwarded
+		<-p.stderrDone
+		close(drained)
+	}()
+	timer := time.NewTimer(subprocessDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+	}
+	for _, f := range p.output {
+		_ = f.Close()
+	}
+	<-drained
+	return err
+}
+
+// report queues a crash report for Receive, replacing an unread older one
+func (t *SubprocessTransport) report(exitErr *Error) {
+	for {
+		select {
+		case t.exits <- exitErr:
+			return
+		default:
+		}
+		select {
+		case <-t.exits:
+		default:
+		}
+	}
+}
+
+// finish records the terminal error and stops the transport
+func (t *SubprocessTransport) finish(err error) {
+	t.err = err
+	close(t.done)
+}
+
+// stop closes stdin and kills the process group if it does not exit within timeout
+func (p *subprocess) stop(timeout time.Duration) {
+	_ = p.stdin.Close()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.exited:
+		return
+	case <-timer.C:
+	}
+
+	killProcessGroup(p.cmd)
+	<-p.exited
+}
+
+// exitError describes the exit of the process with its exit code and stderr tail
+func (p *subprocess) exitError(waitErr error, restarting bool) *Error {
+	message := "tool process exited"
+	if waitErr != nil {
+		message += ": " + waitErr.Error()
+	}
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	details := map[string]interface{}{
+		"command":    p.cmd.Path,
+		"pid":        p.cmd.Process.Pid,
+		"exit_code":  exitCode,
+		"stderr":     p.stderr.lines(),
+		"restarting": restarting,
+	}
+	e, err := NewMCPError(MCPErrorDependency, ErrMCPToolNotAvailable, message, details)
+	if err != nil {
+		return &Error{Code: ErrMCPToolNotAvailable, Message: message, Type: MCPErrorDependency}
+	}
+	return e
+}
+
+// lineRing keeps the last n lines written to it
+type lineRing struct {
+	mu    sync.Mutex
+	buf   []string
+	size  int
+	start int
+}
+
+// newLineRing creates a lineRing holding up to size lines
+func newLineRing(size int) *lineRing {
+	return &lineRing{size: size}
+}
+
+// add appends a line, dropping the oldest one when full
+func (r *lineRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) < r.size {
+		r.buf = append(r.buf, line)
+		return
+	}
+	r.buf[r.start] = line
+	r.start = (r.start + 1) % r.size
+}
+
+// lines returns the retained lines, oldest first
+func (r *lineRing) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, 0, len(r.buf))
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:r.start]...)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on platforms without process groups
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command itself on platforms without process groups
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
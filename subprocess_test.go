@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helperProcessEnv selects the behaviour of TestSubprocessHelperProcess
+const helperProcessEnv = "MCPKIT_HELPER_PROCESS"
+
+// TestSubprocessHelperProcess is not a real test, it is the tool process started by the tests below
+func TestSubprocessHelperProcess(t *testing.T) {
+	mode := os.Getenv(helperProcessEnv)
+	if mode == "" {
+		return
+	}
+
+	framing := NewlineFraming
+	if os.Getenv("MCPKIT_HELPER_FRAMING") == "length" {
+		framing = LengthPrefixFraming
+	}
+	echo := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, req.Params, nil, nil)
+		return resp
+	}
+
+	switch mode {
+	case "echo":
+		fmt.Fprintln(os.Stderr, "echo tool ready")
+	case "crash":
+		fmt.Fprintln(os.Stderr, "loading config")
+		fmt.Fprintln(os.Stderr, "fatal: config file missing")
+		os.Exit(3)
+	case "crash-once":
+		marker := os.Getenv("MCPKIT_HELPER_MARKER")
+		if _, err := os.Stat(marker); os.IsNotExist(err) {
+			os.WriteFile(marker, nil, 0o600)
+			fmt.Fprintln(os.Stderr, "first run crashes")
+			os.Exit(1)
+		}
+	case "hang":
+		// Ignore stdin EOF and never exit on our own
+		time.Sleep(time.Hour)
+	case "orphan-once":
+		marker := os.Getenv("MCPKIT_HELPER_MARKER")
+		if _, err := os.Stat(marker); os.IsNotExist(err) {
+			os.WriteFile(marker, nil, 0o600)
+			// Leave behind a process holding stdout and stderr open
+			orphan := exec.Command(os.Args[0], "-test.run=^TestSubprocessHelperProcess$")
+			orphan.Env = append(os.Environ(), helperProcessEnv+"=linger")
+			orphan.Stdout, orphan.Stderr = os.Stdout, os.Stderr
+			orphan.Start()
+			os.Exit(1)
+		}
+	case "linger":
+		time.Sleep(10 * time.Second)
+		os.Exit(0)
+	}
+
+	ServeTransport(context.Background(), NewStreamTransport(os.Stdin, os.Stdout, framing), echo)
+	os.Exit(0)
+}
+
+// helperConfig returns a SubprocessConfig running the helper process in the given mode
+func helperConfig(mode string, env ...string) SubprocessConfig {
+	return SubprocessConfig{
+		Path: os.Args[0],
+		Args: []string{"-test.run=^TestSubprocessHelperProcess$"},
+		Env:  append(append(os.Environ(), helperProcessEnv+"="+mode), env...),
+	}
+}
+
+// roundTrip sends an MCP request with the given params and returns the decoded response
+func roundTrip(ctx context.Context, t *testing.T, tr Transport, id int, params interface{}) *MCPResponse {
+	t.Helper()
+	req, _ := NewMCPRequest("echo", params, nil, "", id)
+	data, _ := json.Marshal(req)
+	if err := tr.Send(ctx, data); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	msg, err := tr.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	var resp MCPResponse
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	return &resp
+}
+
+func TestSubprocessRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing Framing
+		env     string
+	}{
+		{name: "newline framing", framing: NewlineFraming, env: "MCPKIT_HELPER_FRAMING=newline"},
+		{name: "length prefix framing", framing: LengthPrefixFraming, env: "MCPKIT_HELPER_FRAMING=length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := helperConfig("echo", tt.env)
+			cfg.Framing = tt.framing
+			tr, err := StartSubprocess(cfg)
+			if err != nil {
+				t.Fatalf("StartSubprocess() error = %v", err)
+			}
+			defer tr.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			resp := roundTrip(ctx, t, tr, 1, map[string]string{"text": "hello"})
+			if resp.Status != MCPStatusSuccess {
+				t.Errorf("resp.Status = %v, want %v", resp.Status, MCPStatusSuccess)
+			}
+			if string(resp.Data) != `{"text":"hello"}` {
+				t.Errorf("resp.Data = %s, want %s", resp.Data, `{"text":"hello"}`)
+			}
+		})
+	}
+}
+
+func TestSubprocessCrashDetails(t *testing.T) {
+	var logs bytes.Buffer
+	cfg := helperConfig("crash")
+	cfg.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	tr, err := StartSubprocess(cfg)
+	if err != nil {
+		t.Fatalf("StartSubprocess() error = %v", err)
+	}
+	defer tr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = tr.Receive(ctx)
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) {
+		t.Fatalf("Receive() error = %v, want *Error", err)
+	}
+	if mcpErr.Type != MCPErrorDependency {
+		t.Errorf("err.Type = %v, want %v", mcpErr.Type, MCPErrorDependency)
+	}
+
+	var details struct {
+		ExitCode   int      `json:"exit_code"`
+		Stderr     []string `json:"stderr"`
+		Restarting bool     `json:"restarting"`
+	}
+	if err := json.Unmarshal(mcpErr.Details, &details); err != nil {
+		t.Fatalf("Failed to unmarshal details: %v", err)
+	}
+	if details.ExitCode != 3 {
+		t.Errorf("details.exit_code = %v, want 3", details.ExitCode)
+	}
+	if want := []string{"loading config", "fatal: config file missing"}; strings.Join(details.Stderr, "|") != strings.Join(want, "|") {
+		t.Errorf("details.stderr = %v, want %v", details.Stderr, want)
+	}
+	if details.Restarting {
+		t.Error("details.restarting = true, want false")
+	}
+
+	if !strings.Contains(logs.String(), `"line":"fatal: config file missing"`) {
+		t.Errorf("logs = %s, want stderr line record", logs.String())
+	}
+	if err := tr.Send(ctx, []byte(`{}`)); err == nil {
+		t.Error("Send() after crash error = nil, want error")
+	}
+}
+
+func TestSubprocessRestart(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "crashed")
+	cfg := helperConfig("crash-once", "MCPKIT_HELPER_MARKER="+marker)
+	cfg.Restart = true
+	cfg.Backoff = Backoff{Initial: 10 * time.Millisecond}
+
+	tr, err := StartSubprocess(cfg)
+	if err != nil {
+		t.Fatalf("StartSubprocess() error = %v", err)
+	}
+	defer tr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = tr.Receive(ctx)
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorDependency {
+		t.Fatalf("Receive() error = %v, want DEPENDENCY_ERROR", err)
+	}
+	if !strings.Contains(string(mcpErr.Details), `"restarting":true`) {
+		t.Errorf("err.Details = %s, want restarting true", mcpErr.Details)
+	}
+
+	resp := roundTrip(ctx, t, tr, 2, map[string]int{"n": 42})
+	if string(resp.Data) != `{"n":42}` {
+		t.Errorf("resp.Data = %s, want %s", resp.Data, `{"n":42}`)
+	}
+}
+
+func TestSubprocessRestartDespiteInheritedPipes(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "crashed")
+	cfg := helperConfig("orphan-once", "MCPKIT_HELPER_MARKER="+marker)
+	cfg.Restart = true
+	cfg.Backoff = Backoff{Initial: 10 * time.Millisecond}
+
+	tr, err := StartSubprocess(cfg)
+	if err != nil {
+		t.Fatalf("StartSubprocess() error = %v", err)
+	}
+	defer tr.Close()
+
+	// The orphan keeps the pipes open for 10s, the restart must not wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	defer cancel()
+
+	_, err = tr.Receive(ctx)
+	var mcpErr *Error
+	if !errors.As(err, &mcpErr) || mcpErr.Type != MCPErrorDependency {
+		t.Fatalf("Receive() error = %v, want DEPENDENCY_ERROR", err)
+	}
+	resp := roundTrip(ctx, t, tr, 2, map[string]int{"n": 42})
+	if string(resp.Data) != `{"n":42}` {
+		t.Errorf("resp.Data = %s, want %s", resp.Data, `{"n":42}`)
+	}
+}
+
+func TestSubprocessShutdownTimeout(t *testing.T) {
+	cfg := helperConfig("hang")
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+
+	tr, err := StartSubprocess(cfg)
+	if err != nil {
+		t.Fatalf("StartSubprocess() error = %v", err)
+	}
+	pid := tr.Pid()
+	if pid == 0 {
+		t.Fatal("Pid() = 0, want running process")
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		tr.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not return after killing the process")
+	}
+	if elapsed := time.Since(start); elapsed < cfg.ShutdownTimeout {
+		t.Errorf("Close() returned after %v, want at least %v", elapsed, cfg.ShutdownTimeout)
+	}
+
+	if _, err := tr.Receive(context.Background()); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Receive() after Close error = %v, want %v", err, ErrTransportClosed)
+	}
+}
+
+func TestLineRing(t *testing.T) {
+	r := newLineRing(3)
+	for i := 1; i <= 5; i++ {
+		r.add(fmt.Sprint(i))
+	}
+	if got := strings.Join(r.lines(), ","); got != "3,4,5" {
+		t.Errorf("lines() = %v, want 3,4,5", got)
+	}
+}
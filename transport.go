@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrTransportClosed is returned by transport operations after Close has been called
+	ErrTransportClosed = errors.New("transport closed")
+	// ErrBinaryUnsupported is returned when sending a binary payload over a transport configured
+	// without binary support
+	ErrBinaryUnsupported = errors.New("binary payloads not supported")
+)
+
+// Transport carries complete MCP messages between two peers
+//
+// Implementations must be safe for one concurrent reader and any number of concurrent writers.
+type Transport interface {
+	// Send writes a single message to the peer
+	Send(ctx context.Context, msg []byte) error
+	// Receive blocks until the next message from the peer is available
+	Receive(ctx context.Context) ([]byte, error)
+	// Close releases the underlying connection
+	Close() error
+}
+
+// BinaryTransport is implemented by transports that can carry raw binary payloads next to JSON messages
+type BinaryTransport interface {
+	Transport
+	// SendBinary writes a binary payload to the peer
+	SendBinary(ctx context.Context, data []byte) error
+	// ReceiveBinary blocks until the next binary payload from the peer is available
+	ReceiveBinary(ctx context.Context) ([]byte, error)
+}
+
+// StreamingTransport is implemented by transports that can encode a message straight into its
+// outgoing frames
+type StreamingTransport interface {
+	Transport
+	// SendStream writes the single message produced by write to the peer as it is produced.
+	// write must be free to send other messages on the same transport, transports that cannot
+	// interleave them with the streamed message send them after it. When write fails, the part
+	// already sent is abandoned where the framing allows it, otherwise the message ends short.
+	SendStream(ctx context.Context, write func(w io.Writer) error) error
+}
+
+// binaryTransport returns t as a BinaryTransport when it can carry binary payloads in its
+// current configuration
+func binaryTransport(t Transport) (BinaryTransport, bool) {
+	bt, ok := t.(BinaryTransport)
+	if !ok {
+		return nil, false
+	}
+	if c, ok := t.(interface{ binaryEnabled() bool }); ok && !c.binaryEnabled() {
+		return nil, false
+	}
+	return bt, true
+}
+
+// InterruptedError is returned by Receive when the connection was interrupted but the transport
+// recovered and can still be used, for example after a supervised subprocess restarted.
+// Messages in flight at the time of the interruption are lost.
+type InterruptedError struct {
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	return "transport interrupted: " + e.Err.Error()
+}
+
+// Unwrap returns the error that caused the interruption
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
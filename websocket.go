@@ -0,0 +1,877 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket close codes as defined by RFC 6455
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// WebSocket frame opcodes
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// maxCloseReason is the longest close reason that fits in a control frame after the status code
+const maxCloseReason = 123
+
+// wsAcceptGUID is the fixed GUID used to derive Sec-WebSocket-Accept
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrHeartbeatTimeout is returned when the peer stopped answering pings
+var ErrHeartbeatTimeout = errors.New("websocket: heartbeat timeout")
+
+// CloseError is returned by Receive after the peer closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+// Error returns a string representation of the close frame
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// HandshakeError is returned by DialWebSocket when the server refused the upgrade
+type HandshakeError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the delay requested by the Retry-After header, zero when absent
+	RetryAfter time.Duration
+}
+
+// Error returns a string representation of the failed handshake
+func (e *HandshakeError) Error() string {
+	return "websocket: handshake failed with status " + e.Status
+}
+
+// WebSocketConfig configures WebSocket transports
+type WebSocketConfig struct {
+	// PingInterval is how often a ping is sent, zero uses 30s and a negative value disables heartbeats
+	PingInterval time.Duration
+	// PongTimeout is how long the peer may stay silent after a ping before the connection is dropped
+	PongTimeout time.Duration
+	// WriteTimeout bounds a single frame write when the context has no deadline
+	WriteTimeout time.Duration
+	// CloseTimeout bounds the closing handshake
+	CloseTimeout time.Duration
+	// MaxMessageSize limits the size of a reassembled message, zero uses 16 MiB
+	MaxMessageSize int64
+	// Header holds extra headers sent with the client handshake
+	Header http.Header
+	// TLSConfig is used when dialing wss:// URLs
+	TLSConfig *tls.Config
+	// Backoff controls the delay between dial attempts
+	Backoff Backoff
+	// MaxDialAttempts limits the number of dial attempts, zero uses 5
+	MaxDialAttempts int
+	// ProgressInterval is the minimum time between two progress notifications for the same
+	// request served by WebSocketHandler, zero uses DefaultProgressInterval and a negative value
+	// disables throttling
+	ProgressInterval time.Duration
+}
+
+// withDefaults returns a copy of c with zero fields replaced by defaults
+func (c *WebSocketConfig) withDefaults() WebSocketConfig {
+	var cfg WebSocketConfig
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = 30 * time.Second
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = 10 * time.Second
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10 * time.Second
+	}
+	if cfg.CloseTimeout <= 0 {
+		cfg.CloseTimeout = 5 * time.Second
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = 16 << 20
+	}
+	if cfg.Backoff == (Backoff{}) {
+		cfg.Backoff = DefaultBackoff
+	}
+	if cfg.MaxDialAttempts <= 0 {
+		cfg.MaxDialAttempts = 5
+	}
+	return cfg
+}
+
+// WebSocketTransport is a Transport over a single WebSocket connection
+//
+// JSON messages travel as text frames and binary payloads as binary frames. Pings are answered
+// automatically, and the connection is dropped when the peer stops responding to heartbeats.
+type WebSocketTransport struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	cfg     WebSocketConfig
+	client  bool
+	request *http.Request
+
+	writeMu   sync.Mutex
+	gate      streamGate
+	closeSent atomic.Bool
+	lastRead  atomic.Int64
+
+	text   chan []byte
+	binary chan []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+	errMu     sync.Mutex
+	err       error
+}
+
+// newWebSocketTransport wraps an established connection and starts its reader and heartbeat loops
+func newWebSocketTransport(conn net.Conn, br *bufio.Reader, cfg WebSocketConfig, client bool, r *http.Request) *WebSocketTransport {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	t := &WebSocketTransport{
+		conn:    conn,
+		br:      br,
+		cfg:     cfg,
+		client:  client,
+		request: r,
+		text:    make(chan []byte, 16),
+		binary:  make(chan []byte, 16),
+		done:    make(chan struct{}),
+	}
+	t.gate.idle = sync.NewCond(&t.writeMu)
+	t.lastRead.Store(time.Now().UnixNano())
+
+	go t.readLoop()
+	if cfg.PingInterval > 0 {
+		go t.heartbeat()
+	}
+	return t
+}
+
+// Request returns the HTTP request that opened a server-side connection, or nil on the client side
+func (t *WebSocketTransport) Request() *http.Request {
+	return t.request
+}
+
+// RemoteAddr returns the address of the peer
+func (t *WebSocketTransport) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+// TLSConnectionState returns the TLS state of wss:// connections
+func (t *WebSocketTransport) TLSConnectionState() (tls.ConnectionState, bool) {
+	if c, ok := t.conn.(*tls.Conn); ok {
+		return c.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// Send writes msg as a single text frame
+func (t *WebSocketTransport) Send(ctx context.Context, msg []byte) error {
+	return t.writeData(ctx, wsOpText, msg)
+}
+
+// SendStream writes the message produced by write as a text message, in fragments while write
+// produces it
+//
+// A message shorter than streamChunkSize is sent in a single frame once write returned and
+// nothing is sent when write fails. Longer messages are sent as fragments while write runs, text
+// and binary messages sent meanwhile follow the final fragment, and a failure of write ends the
+// message short.
+func (t *WebSocketTransport) SendStream(ctx context.Context, write func(w io.Writer) error) error {
+	if err := t.writable(ctx); err != nil {
+		return err
+	}
+	op, started := byte(wsOpText), false
+	cw := &chunkWriter{flush: func(p []byte) error {
+		frame, err := t.encodeFrame(false, op, p)
+		if err != nil {
+			return err
+		}
+		t.writeMu.Lock()
+		defer t.writeMu.Unlock()
+		if !started {
+			t.gate.begin()
+			started = true
+		}
+		op = wsOpContinuation
+		return t.writeLocked(frame, t.writeDeadline(ctx))
+	}}
+	err := write(cw)
+	if err == nil {
+		err = cw.err
+	}
+	if !started {
+		if err != nil {
+			return err
+		}
+		return t.writeData(ctx, wsOpText, cw.buf)
+	}
+
+	frame, werr := t.encodeFrame(true, wsOpContinuation, cw.buf)
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if werr == nil {
+		werr = t.writeLocked(frame, t.writeDeadline(ctx))
+	}
+	for _, frame := range t.gate.end() {
+		if werr == nil {
+			werr = t.writeLocked(frame, time.Now().Add(t.cfg.WriteTimeout))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// SendBinary writes data as a single binary frame
+func (t *WebSocketTransport) SendBinary(ctx context.Context, data []byte) error {
+	return t.writeData(ctx, wsOpBinary, data)
+}
+
+// Receive returns the next text message
+func (t *WebSocketTransport) Receive(ctx context.Context) ([]byte, error) {
+	return t.receive(ctx, t.text)
+}
+
+// ReceiveBinary returns the next binary message
+func (t *WebSocketTransport) ReceiveBinary(ctx context.Context) ([]byte, error) {
+	return t.receive(ctx, t.binary)
+}
+
+// Close performs a normal closing handshake
+func (t *WebSocketTransport) Close() error {
+	return t.CloseWithCode(CloseNormal, "")
+}
+
+// CloseWithCode sends a close frame with the given code and reason, waits for the peer
+// to acknowledge it and closes the connection
+func (t *WebSocketTransport) CloseWithCode(code int, reason string) error {
+	select {
+	case <-t.done:
+		return nil
+	default:
+	}
+
+	t.setErr(ErrTransportClosed)
+	err := t.writeClose(code, reason)
+
+	timer := time.NewTimer(t.cfg.CloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+	case <-timer.C:
+	}
+	t.shutdown(ErrTransportClosed)
+	return err
+}
+
+// Err returns the error that terminated the connection, or nil while it is open
+func (t *WebSocketTransport) Err() error {
+	select {
+	case <-t.done:
+	default:
+		return nil
+	}
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return t.err
+}
+
+// receive returns the next message queued on ch
+func (t *WebSocketTransport) receive(ctx context.Context, ch chan []byte) ([]byte, error) {
+	select {
+	case msg := <-ch:
+		return msg, nil
+	default:
+	}
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-t.done:
+		return nil, t.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// setErr records the terminal error unless one is already set
+func (t *WebSocketTransport) setErr(err error) {
+	t.errMu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.errMu.Unlock()
+}
+
+// shutdown records err and tears down the connection
+func (t *WebSocketTransport) shutdown(err error) {
+	t.setErr(err)
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.conn.Close()
+	})
+}
+
+// fail sends a close frame with code and tears down the connection
+func (t *WebSocketTransport) fail(code int, err error) {
+	t.setErr(err)
+	_ = t.writeClose(code, err.Error())
+	t.shutdown(err)
+}
+
+// readLoop reads frames, answers control frames and queues reassembled messages
+func (t *WebSocketTransport) readLoop() {
+	var (
+		msgOp   byte
+		msg     []byte
+		inFrame bool
+	)
+
+	for {
+		fin, op, payload, err := t.readFrame()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				t.fail(closeErr.Code, closeErr)
+				return
+			}
+			t.shutdown(&CloseError{Code: CloseAbnormal, Reason: err.Error()})
+			return
+		}
+		t.lastRead.Store(time.Now().UnixNano())
+
+		switch op {
+		case wsOpPing:
+			_ = t.writeControl(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			if len(payload) == 1 {
+				t.fail(CloseProtocolError, errors.New("websocket: truncated close payload"))
+				return
+			}
+			code, reason := parseClosePayload(payload)
+			if !t.closeSent.Load() {
+				echo := code
+				if echo == CloseNoStatus {
+					echo = CloseNormal
+				}
+				_ = t.writeClose(echo, "")
+			}
+			t.shutdown(&CloseError{Code: code, Reason: reason})
+			return
+		case wsOpText, wsOpBinary:
+			if inFrame {
+				t.fail(CloseProtocolError, errors.New("websocket: expected continuation frame"))
+				return
+			}
+			msgOp = op
+			msg = payload
+		case wsOpContinuation:
+			if !inFrame {
+				t.fail(CloseProtocolError, errors.New("websocket: unexpected continuation frame"))
+				return
+			}
+			msg = append(msg, payload...)
+		default:
+			t.fail(CloseProtocolError, fmt.Errorf("websocket: unknown opcode %d", op))
+			return
+		}
+
+		if int64(len(msg)) > t.cfg.MaxMessageSize {
+			t.fail(CloseMessageTooBig, errors.New("websocket: message too big"))
+			return
+		}
+		inFrame = !fin
+		if inFrame {
+			continue
+		}
+
+		ch := t.binary
+		if msgOp == wsOpText {
+			if !utf8.Valid(msg) {
+				t.fail(CloseInvalidPayload, errors.New("websocket: invalid UTF-8 in text message"))
+				return
+			}
+			ch = t.text
+		}
+		select {
+		case ch <- msg:
+		case <-t.done:
+			return
+		}
+		msg = nil
+	}
+}
+
+// heartbeat pings the peer and drops the connection when it stays silent for too long
+func (t *WebSocketTransport) heartbeat() {
+	ticker := time.NewTicker(t.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+
+		silence := time.Since(time.Unix(0, t.lastRead.Load()))
+		if silence > t.cfg.PingInterval+t.cfg.PongTimeout {
+			t.fail(CloseGoingAway, ErrHeartbeatTimeout)
+			return
+		}
+		_ = t.writeControl(wsOpPing, nil)
+	}
+}
+
+// readFrame reads and unmasks a single frame
+func (t *WebSocketTransport) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(t.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	}
+	masked := header[1]&0x80 != 0
+	if masked == t.client {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid frame masking"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(t.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(t.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if op >= wsOpClose && (length > 125 || !fin) {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+	}
+	if length > uint64(t.cfg.MaxMessageSize) {
+		return false, 0, nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(t.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(t.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, op, payload, nil
+}
+
+// writeData writes a data frame, honouring the context deadline
+//
+// A data frame sent while a streamed message is partly written follows its final fragment.
+func (t *WebSocketTransport) writeData(ctx context.Context, op byte, payload []byte) error {
+	if err := t.writable(ctx); err != nil {
+		return err
+	}
+	frame, err := t.encodeFrame(true, op, payload)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.gate.hold(frame) {
+		return nil
+	}
+	return t.writeLocked(frame, t.writeDeadline(ctx))
+}
+
+// writable returns the error preventing data from being sent
+func (t *WebSocketTransport) writable(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.closeSent.Load() {
+		return ErrTransportClosed
+	}
+	return t.Err()
+}
+
+// writeDeadline returns the deadline of a data frame write
+func (t *WebSocketTransport) writeDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(t.cfg.WriteTimeout)
+}
+
+// writeControl writes a control frame with the configured write timeout
+func (t *WebSocketTransport) writeControl(op byte, payload []byte) error {
+	return t.writeFrame(op, payload, time.Now().Add(t.cfg.WriteTimeout))
+}
+
+// writeClose sends a close frame once
+func (t *WebSocketTransport) writeClose(code int, reason string) error {
+	if !t.closeSent.CompareAndSwap(false, true) {
+		return nil
+	}
+	if len(reason) > maxCloseReason {
+		// Cut on a rune boundary, a close reason must be valid UTF-8
+		n := maxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return t.writeControl(wsOpClose, payload)
+}
+
+// writeFrame encodes and writes a single final frame
+func (t *WebSocketTransport) writeFrame(op byte, payload []byte, deadline time.Time) error {
+	frame, err := t.encodeFrame(true, op, payload)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.writeLocked(frame, deadline)
+}
+
+// encodeFrame encodes a frame, masking it on the client side
+func (t *WebSocketTransport) encodeFrame(fin bool, op byte, payload []byte) ([]byte, error) {
+	frame := make([]byte, 0, 14+len(payload))
+	if fin {
+		op |= 0x80
+	}
+	frame = append(frame, op)
+
+	maskBit := byte(0)
+	if t.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if !t.client {
+		return append(frame, payload...), nil
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return nil, err
+	}
+	frame = append(frame, mask[:]...)
+	start := len(frame)
+	frame = append(frame, payload...)
+	maskBytes(mask, frame[start:])
+	return frame, nil
+}
+
+// writeLocked writes an encoded frame, with t.writeMu held
+func (t *WebSocketTransport) writeLocked(frame []byte, deadline time.Time) error {
+	if err := t.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := t.conn.Write(frame)
+	return err
+}
+
+// maskBytes applies the WebSocket masking key to b in place
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// parseClosePayload extracts the status code and reason from a close frame
+func parseClosePayload(payload []byte) (int, string) {
+	if len(payload) < 2 {
+		return CloseNoStatus, ""
+	}
+	return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+}
+
+// computeAcceptKey derives the Sec-WebSocket-Accept value for a handshake key
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken reports whether a comma separated header contains token
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket performs the server side of the WebSocket handshake
+//
+// On failure an HTTP error has already been written to w.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request, cfg *WebSocketConfig) (*WebSocketTransport, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: upgrade requires GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "invalid websocket key", http.StatusBadRequest)
+		return nil, errors.New("websocket: Sec-WebSocket-Key is not a base64 encoded 16-byte nonce")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response writer cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	c := cfg.withDefaults()
+	_ = conn.SetDeadline(time.Now().Add(c.WriteTimeout))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\n")
+	brw.WriteString("Connection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return newWebSocketTransport(conn, brw.Reader, c, false, r), nil
+}
+
+// WebSocketHandler returns an http.Handler that upgrades each request and serves MCP requests on it with h
+func WebSocketHandler(h MCPHandler, cfg *WebSocketConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := UpgradeWebSocket(w, r, cfg)
+		if err != nil {
+			return
+		}
+		defer t.Close()
+		_ = ServeTransportWith(r.Context(), t, h, &ServeConfig{ProgressInterval: t.cfg.ProgressInterval})
+	})
+}
+
+// DialWebSocket connects to a ws:// or wss:// URL, retrying with exponential backoff until the
+// handshake succeeds, the attempts are exhausted or ctx is done
+//
+// Handshakes rejected with a 4xx status other than 408 and 429 are not retried, a Retry-After
+// header longer than the backoff delay is honoured.
+func DialWebSocket(ctx context.Context, rawURL string, cfg *WebSocketConfig) (*WebSocketTransport, error) {
+	c := cfg.withDefaults()
+
+	var lastErr error
+	for attempt := 0; attempt < c.MaxDialAttempts; attempt++ {
+		if attempt > 0 {
+			delay := c.Backoff.Delay(attempt - 1)
+			if after, ok := RetryAfter(lastErr); ok && after > delay {
+				delay = after
+			}
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+
+		t, err := dialWebSocket(ctx, rawURL, c)
+		if err == nil {
+			return t, nil
+		}
+		lastErr = err
+
+		var hsErr *HandshakeError
+		if errors.As(err, &hsErr) && !IsRetryable(hsErr) {
+			break
+		}
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialWebSocket performs a single connection attempt and client handshake
+func dialWebSocket(ctx context.Context, rawURL string, cfg WebSocketConfig) (*WebSocketTransport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, &url.Error{Op: "dial", URL: rawURL, Err: errors.New("unsupported scheme " + u.Scheme)}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(cfg.WriteTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if u.Scheme == "wss" {
+		tlsCfg := &tls.Config{}
+		if cfg.TLSConfig != nil {
+			tlsCfg = cfg.TLSConfig.Clone()
+		}
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	for name, values := range cfg.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		conn.Close()
+		return nil, &HandshakeError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	if !headerContainsToken(resp.Header, "Upgrade", "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(key) {
+		conn.Close()
+		return nil, errors.New("websocket: invalid handshake response")
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return newWebSocketTransport(conn, br, cfg, true, nil), nil
+}
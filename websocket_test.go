@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// wsURL converts an httptest server URL into a ws:// URL
+func wsURL(s *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func TestComputeAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	got := computeAcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("computeAcceptKey() = %v, want %v", got, want)
+	}
+}
+
+func TestWebSocketPipeRoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	cfg := WebSocketConfig{PingInterval: -1}
+	client := newWebSocketTransport(clientConn, nil, cfg.withDefaults(), true, nil)
+	server := newWebSocketTransport(serverConn, nil, cfg.withDefaults(), false, nil)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages := [][]byte{
+		[]byte(`{"action":"ping"}`),
+		bytes.Repeat([]byte("a"), 300),
+		bytes.Repeat([]byte("b"), 70000),
+	}
+	for _, msg := range messages {
+		go client.Send(ctx, msg)
+		got, err := server.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Receive() returned %d bytes, want %d", len(got), len(msg))
+		}
+	}
+}
+
+func TestWebSocketMultiplexedRequests(t *testing.T) {
+	handler := func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		var params struct {
+			N     int `json:"n"`
+			Delay int `json:"delay_ms"`
+		}
+		json.Unmarshal(req.Params, &params)
+		time.Sleep(time.Duration(params.Delay) * time.Millisecond)
+		resp, _ := NewMCPResponse(MCPStatusSuccess, map[string]int{"square": params.N * params.N}, nil, nil)
+		return resp
+	}
+	srv := httptest.NewServer(WebSocketHandler(handler, nil))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := DialWebSocket(ctx, wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	defer client.Close()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		req, _ := NewMCPRequest("math.square", map[string]int{"n": i, "delay_ms": (n - i) * 5}, nil, "", nil)
+		req.Metadata = map[string]interface{}{MetadataRequestID: fmt.Sprintf("req-%d", i)}
+		data, _ := json.Marshal(req)
+		if err := client.Send(ctx, data); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+
+	var order []string
+	for i := 0; i < n; i++ {
+		msg, err := client.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		var resp MCPResponse
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		requestID, _ := resp.Metadata[MetadataRequestID].(string)
+		var num int
+		fmt.Sscanf(requestID, "req-%d", &num)
+
+		var data map[string]int
+		json.Unmarshal(resp.Data, &data)
+		if data["square"] != num*num {
+			t.Errorf("response for %s square = %d, want %d", requestID, data["square"], num*num)
+		}
+		order = append(order, requestID)
+	}
+
+	if order[0] == "req-0" {
+		t.Errorf("responses arrived in request order %v, want concurrent handling", order)
+	}
+}
+
+func TestWebSocketSendStream(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	cfg := WebSocketConfig{PingInterval: -1}
+	client := newWebSocketTransport(clientConn, nil, cfg.withDefaults(), true, nil)
+	server := newWebSocketTransport(serverConn, nil, cfg.withDefaults(), false, nil)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A long message goes out in fragments, a message sent meanwhile follows it
+	large := bytes.Repeat([]byte("x"), 3*streamChunkSize+10)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.SendStream(ctx, func(w io.Writer) error {
+			if _, err := w.Write(large[:2*streamChunkSize]); err != nil {
+				return err
+			}
+			if err := client.Send(ctx, []byte(`{"method":"progress"}`)); err != nil {
+				return err
+			}
+			_, err := w.Write(large[2*streamChunkSize:])
+			return err
+		})
+	}()
+	for _, want := range [][]byte{large, []byte(`{"method":"progress"}`)} {
+		got, err := server.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Receive() returned %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("SendStream() error = %v", err)
+	}
+
+	// A short message that fails is not sent at all
+	if err := client.SendStream(ctx, func(w io.Writer) error {
+		io.WriteString(w, `{"partial":`)
+		return errors.New("disk failure")
+	}); err == nil {
+		t.Error("SendStream() error = nil, want the write error")
+	}
+	go client.Send(ctx, []byte(`{}`))
+	if got, err := server.Receive(ctx); err != nil || string(got) != `{}` {
+		t.Errorf("Receive() = %q, %v, want the next message", got, err)
+	}
+}
+
+func TestWebSocketBinaryFrames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, err := UpgradeWebSocket(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer tr.Close()
+		data, err := tr.ReceiveBinary(r.Context())
+		if err != nil {
+			return
+		}
+		tr.SendBinary(r.Context(), append(data, 0xff))
+		tr.Receive(r.Context())
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialWebSocket(ctx, wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	defer client.Close()
+
+	payload := []byte{0x00, 0x01, 0xfe, 0x80}
+	if err := client.SendBinary(ctx, payload); err != nil {
+		t.Fatalf("SendBinary() error = %v", err)
+	}
+	got, err := client.ReceiveBinary(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveBinary() error = %v", err)
+	}
+	if want := append(payload, 0xff); !bytes.Equal(got, want) {
+		t.Errorf("ReceiveBinary() = %v, want %v", got, want)
+	}
+}
+
+func TestWebSocketCloseCode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, err := UpgradeWebSocket(w, r, nil)
+		if err != nil {
+			return
+		}
+		tr.CloseWithCode(CloseGoingAway, "server shutdown")
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialWebSocket(ctx, wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Receive(ctx)
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("Receive() error = %v, want *CloseError", err)
+	}
+	if closeErr.Code != CloseGoingAway {
+		t.Errorf("closeErr.Code = %v, want %v", closeErr.Code, CloseGoingAway)
+	}
+	if closeErr.Reason != "server shutdown" {
+		t.Errorf("closeErr.Reason = %q, want %q", closeErr.Reason, "server shutdown")
+	}
+	if err := client.Send(ctx, []byte(`{}`)); err == nil {
+		t.Error("Send() after close error = nil, want error")
+	}
+}
+
+func TestWebSocketCloseReasonTruncated(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	cfg := WebSocketConfig{PingInterval: -1, CloseTimeout: 100 * time.Millisecond}
+	client := newWebSocketTransport(clientConn, nil, cfg.withDefaults(), true, nil)
+	server := newWebSocketTransport(serverConn, nil, cfg.withDefaults(), false, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go server.CloseWithCode(CloseGoingAway, strings.Repeat("é", 100))
+	_, err := client.Receive(ctx)
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+		t.Fatalf("Receive() error = %v, want close code %d", err, CloseGoingAway)
+	}
+	if !utf8.ValidString(closeErr.Reason) || len(closeErr.Reason) != 122 {
+		t.Errorf("close reason = %q (%d bytes), want 61 whole runes", closeErr.Reason, len(closeErr.Reason))
+	}
+}
+
+func TestWebSocketRejectsOneByteClosePayload(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	cfg := WebSocketConfig{PingInterval: -1, CloseTimeout: 100 * time.Millisecond}
+	server := newWebSocketTransport(serverConn, nil, cfg.withDefaults(), false, nil)
+	defer server.Close()
+	defer clientConn.Close()
+
+	// A masked close frame carrying a single byte, too short for a status code
+	go clientConn.Write([]byte{0x88, 0x81, 0, 0, 0, 0, 0x03})
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, header); err != nil {
+		t.Fatalf("reading the close frame: %v", err)
+	}
+	if header[0] != 0x88 || binary.BigEndian.Uint16(header[2:]) != CloseProtocolError {
+		t.Errorf("close frame = %x, want close code %d", header, CloseProtocolError)
+	}
+}
+
+func TestWebSocketHeartbeatTimeout(t *testing.T) {
+	// The server completes the handshake and then never reads or answers pings
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: " + computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		brw.Flush()
+		<-release
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &WebSocketConfig{PingInterval: 20 * time.Millisecond, PongTimeout: 20 * time.Millisecond, CloseTimeout: 50 * time.Millisecond}
+	client, err := DialWebSocket(ctx, wsURL(srv), cfg)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Receive(ctx); !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Errorf("Receive() error = %v, want %v", err, ErrHeartbeatTimeout)
+	}
+}
+
+func TestWebSocketHeartbeatKeepsConnectionAlive(t *testing.T) {
+	cfg := &WebSocketConfig{PingInterval: 10 * time.Millisecond, PongTimeout: 20 * time.Millisecond}
+	srv := httptest.NewServer(WebSocketHandler(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		resp, _ := NewMCPResponse(MCPStatusSuccess, nil, nil, nil)
+		return resp
+	}, cfg))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialWebSocket(ctx, wsURL(srv), cfg)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	defer client.Close()
+
+	time.Sleep(150 * time.Millisecond)
+	if err := client.Err(); err != nil {
+		t.Fatalf("client.Err() = %v, want nil", err)
+	}
+	if err := client.Send(ctx, []byte(`{"action":"ping","id":1}`)); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if _, err := client.Receive(ctx); err != nil {
+		t.Errorf("Receive() error = %v", err)
+	}
+}
+
+func TestWebSocketMessageTooBig(t *testing.T) {
+	received := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr, err := UpgradeWebSocket(w, r, &WebSocketConfig{MaxMessageSize: 16})
+		if err != nil {
+			return
+		}
+		defer tr.Close()
+		_, err = tr.Receive(r.Context())
+		received <- err
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := DialWebSocket(ctx, wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket() error = %v", err)
+	}
+	defer client.Close()
+
+	client.Send(ctx, bytes.Repeat([]byte("x"), 64))
+	if err := <-received; err == nil {
+		t.Fatal("server Receive() error = nil, want error")
+	}
+
+	_, err = client.Receive(ctx)
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseMessageTooBig {
+		t.Errorf("client Receive() error = %v, want close code %d", err, CloseMessageTooBig)
+	}
+}
+
+func TestDialWebSocketRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int32
+		failStatus   int
+		wantErr      bool
+		wantAttempts int32
+	}{
+		{
+			name:         "retries unavailable server",
+			failures:     2,
+			failStatus:   http.StatusServiceUnavailable,
+			wantErr:      false,
+			wantAttempts: 3,
+		},
+		{
+			name:         "does not retry unauthorized",
+			failures:     10,
+			failStatus:   http.StatusUnauthorized,
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		{
+			name:         "gives up after max attempts",
+			failures:     10,
+			failStatus:   http.StatusServiceUnavailable,
+			wantErr:      true,
+			wantAttempts: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			var mu sync.Mutex
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if attempts.Add(1) <= tt.failures {
+					w.WriteHeader(tt.failStatus)
+					return
+				}
+				tr, err := UpgradeWebSocket(w, r, nil)
+				if err == nil {
+					tr.Close()
+				}
+			}))
+			defer srv.Close()
+
+			cfg := &WebSocketConfig{
+				Backoff:         Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond},
+				MaxDialAttempts: 4,
+			}
+			client, err := DialWebSocket(context.Background(), wsURL(srv), cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialWebSocket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				client.Close()
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attempts = %v, want %v", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestUpgradeWebSocketRejectsInvalidKeys(t *testing.T) {
+	srv := httptest.NewServer(WebSocketHandler(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return nil
+	}, nil))
+	defer srv.Close()
+
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("handshake with key %q error = %v", key, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("handshake with key %q status = %d, want %d", key, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUpgradeWebSocketRejectsPlainRequests(t *testing.T) {
+	srv := httptest.NewServer(WebSocketHandler(func(ctx context.Context, req *MCPRequest) *MCPResponse {
+		return nil
+	}, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("http.Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("StatusCode = %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document without its indentation and comment
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// yamlParser parses the block structure of a YAML document line by line
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses the subset of YAML used by configuration files into the values
+// json.Unmarshal produces for the equivalent JSON document
+//
+// The subset covers block mappings and sequences, flow mappings and sequences, plain, single and
+// double quoted scalars and comments. Anchors, aliases, tags, block scalars, multi-line scalars
+// and multiple documents are rejected.
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed in indentation", i+1)
+		}
+		indent := len(raw) - len(text)
+		text = strings.TrimRight(stripYAMLComment(text), " \t")
+		if text == "" || (len(p.lines) == 0 && text == "---") {
+			continue
+		}
+		if text == "---" || text == "..." {
+			return nil, fmt.Errorf("yaml: line %d: multiple documents are not supported", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: indent, text: text})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+// stripYAMLComment removes a comment from text, a # starts one at the beginning or after a space
+// outside of quoted scalars
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '\'' && c == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,:-", text[i-1]) >= 0):
+			quote = c
+		}
+	}
+	return text
+}
+
+// errorf returns a parse error located at the current line
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	line := p.lines[len(p.lines)-1].num
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].num
+	}
+	return fmt.Errorf("yaml: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// block parses the sequence or mapping starting at the current line, indented by indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if line.indent != indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok && line.text[0] != '[' && line.text[0] != '{' {
+		return p.mapping(indent)
+	}
+	if p.pos+1 < len(p.lines) && p.lines[p.pos+1].indent >= indent {
+		p.pos++
+		return nil, p.errorf("multi-line scalars are not supported")
+	}
+	p.pos++
+	return parseYAMLValue(line.text)
+}
+
+// nested parses the value of a mapping key or sequence item without an inline value, which is
+// the block indented under it or null
+func (p *yamlParser) nested(parent int, sequenceAllowed bool) (interface{}, error) {
+	if p.pos == len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > parent || (sequenceAllowed && next.indent == parent && (next.text == "-" || strings.HasPrefix(next.text, "- "))) {
+		return p.block(next.indent)
+	}
+	return nil, nil
+}
+
+// sequence parses the block sequence items indented by indent
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+			// A sequence may share the indentation of the key it is the value of
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		// The item content continues as a block indented at its own column, so "- key: v"
+		// starts a mapping whose following keys line up with key
+		p.lines[p.pos] = yamlLine{num: line.num, indent: indent + len(line.text) - len(rest), text: rest}
+		v, err := p.block(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+// mapping parses the block mapping entries indented by indent
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		key, value, ok := splitYAMLKey(p.lines[p.pos].text)
+		if !ok {
+			return nil, p.errorf("expected a mapping key")
+		}
+		k, err := parseYAMLKey(key)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if _, dup := m[k]; dup {
+			return nil, p.errorf("duplicate key %q", k)
+		}
+		var v interface{}
+		if value == "" {
+			p.pos++
+			v, err = p.nested(indent, true)
+		} else {
+			v, err = parseYAMLValue(value)
+			if err != nil {
+				err = p.errorf("%v", err)
+			}
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// splitYAMLKey splits a mapping entry into its key and inline value
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	end := 0
+	if text[0] == '"' || text[0] == '\'' {
+		_, n, err := parseYAMLQuoted(text)
+		if err != nil {
+			return "", "", false
+		}
+		end = n
+	}
+	for i := end; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimRight(text[:i], " "), strings.TrimLeft(text[i+1:], " "), true
+		}
+		if end > 0 && text[i] != ' ' {
+			return "", "", false
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLKey returns the string of a mapping key
+func parseYAMLKey(key string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	if key[0] == '"' || key[0] == '\'' {
+		s, _, err := parseYAMLQuoted(key)
+		return s, err
+	}
+	if strings.ContainsAny(key[:1], "[{?&*!|>%@`") {
+		return "", fmt.Errorf("unsupported key %q", key)
+	}
+	return key, nil
+}
+
+// parseYAMLValue parses an inline value, a flow collection or a scalar
+func parseYAMLValue(text string) (interface{}, error) {
+	switch text[0] {
+	case '|', '>':
+		return nil, fmt.Errorf("block scalars are not supported")
+	case '&', '*', '!':
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	}
+	f := &yamlFlow{text: text}
+	v, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+	if f.skipSpace(); f.pos < len(f.text) {
+		return nil, fmt.Errorf("unexpected %q after value", f.text[f.pos:])
+	}
+	return v, nil
+}
+
+// yamlFlow parses an inline value
+type yamlFlow struct {
+	text  string
+	pos   int
+	depth int
+}
+
+// skipSpace advances past spaces
+func (f *yamlFlow) skipSpace() {
+	for f.pos < len(f.text) && (f.text[f.pos] == ' ' || f.text[f.pos] == '\t') {
+		f.pos++
+	}
+}
+
+// value parses the value at the current position
+func (f *yamlFlow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.pos == len(f.text) {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch f.text[f.pos] {
+	case '[':
+		return f.sequence()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		s, n, err := parseYAMLQuoted(f.text[f.pos:])
+		f.pos += n
+		return s, err
+	}
+	start := f.pos
+	for f.pos < len(f.text) {
+		c := f.text[f.pos]
+		if f.depth > 0 && (c == ',' || c == ']' || c == '}' || (c == ':' && f.pos+1 < len(f.text) && f.text[f.pos+1] == ' ')) {
+			break
+		}
+		f.pos++
+	}
+	return parseYAMLScalar(strings.TrimRight(f.text[start:f.pos], " \t")), nil
+}
+
+// sequence parses a flow sequence
+func (f *yamlFlow) sequence() (interface{}, error) {
+	f.pos++
+	f.depth++
+	items := []interface{}{}
+	for {
+		if f.skipSpace(); f.pos < len(f.text) && f.text[f.pos] == ']' {
+			f.pos++
+			f.depth--
+			return items, nil
+		}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mapping parses a flow mapping
+func (f *yamlFlow) mapping() (interface{}, error) {
+	f.pos++
+	f.depth++
+	m := map[string]interface{}{}
+	for {
+		if f.skipSpace(); f.pos < len(f.text) && f.text[f.pos] == '}' {
+			f.pos++
+			f.depth--
+			return m, nil
+		}
+		k, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		if f.skipSpace(); f.pos == len(f.text) || f.text[f.pos] != ':' {
+			return nil, fmt.Errorf("missing : after key %q", key)
+		}
+		f.pos++
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+		m[key] = v
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator consumes the comma between flow items, leaving the closing bracket in place
+func (f *yamlFlow) separator(closing byte) error {
+	f.skipSpace()
+	switch {
+	case f.pos == len(f.text):
+		return fmt.Errorf("missing %q", closing)
+	case f.text[f.pos] == ',':
+		f.pos++
+		return nil
+	case f.text[f.pos] == closing:
+		return nil
+	}
+	return fmt.Errorf("unexpected %q in flow collection", f.text[f.pos:])
+}
+
+// parseYAMLQuoted parses the quoted scalar at the start of text and returns its length
+func parseYAMLQuoted(text string) (string, int, error) {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			if quote == '\'' {
+				return strings.ReplaceAll(text[1:i], "''", "'"), i + 1, nil
+			}
+			var s string
+			if err := json.Unmarshal([]byte(text[:i+1]), &s); err != nil {
+				return "", 0, fmt.Errorf("invalid double quoted scalar %s", text[:i+1])
+			}
+			return s, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted scalar %s", text)
+}
+
+// parseYAMLScalar resolves a plain scalar to null, a boolean, a number or a string
+func parseYAMLScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil && strings.Trim(s, "+-.0123456789eE") == "" {
+		return n
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want interface{}
+	}{
+		{name: "empty", doc: "# nothing\n", want: nil},
+		{name: "scalars", doc: "s: text\nq: \"a\\tb # c\"\nsq: 'it''s'\nn: 1.5\nb: true\nz: ~\nurl: spiffe://example.org/a # id\n", want: map[string]interface{}{
+			"s": "text", "q": "a\tb # c", "sq": "it's", "n": 1.5, "b": true, "z": nil, "url": "spiffe://example.org/a",
+		}},
+		{name: "nested mapping", doc: "---\na:\n  b:\n    c: d\n  e: f\n", want: map[string]interface{}{
+			"a": map[string]interface{}{"b": map[string]interface{}{"c": "d"}, "e": "f"},
+		}},
+		{name: "sequence of mappings", doc: "- a: 1\n  b: 2\n-\n  c: 3\n- - x\n  - y\n", want: []interface{}{
+			map[string]interface{}{"a": 1.0, "b": 2.0}, map[string]interface{}{"c": 3.0}, []interface{}{"x", "y"},
+		}},
+		{name: "sequence at key indentation", doc: "a:\n- 1\n- 2\nb: x\n", want: map[string]interface{}{
+			"a": []interface{}{1.0, 2.0}, "b": "x",
+		}},
+		{name: "flow collections", doc: "a: [x, 'y, z', {k: [1, 2]}, []]\n\"quoted key\": {}\n", want: map[string]interface{}{
+			"a": []interface{}{"x", "y, z", map[string]interface{}{"k": []interface{}{1.0, 2.0}}, []interface{}{}}, "quoted key": map[string]interface{}{},
+		}},
+		{name: "empty value", doc: "a:\nb: 1\n", want: map[string]interface{}{"a": nil, "b": 1.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("parseYAML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, doc := range []string{
+		"a: 1\na: 2\n",
+		"a:\n  b: 1\n c: 2\n",
+		"a: [1, 2\n",
+		"a: {b 1}\n",
+		"a: \"open\n",
+		"a: |\n  text\n",
+		"a: &x 1\n",
+		"a: !!str 1\n",
+		"\ta: 1\n",
+		"a: 1\n---\nb: 2\n",
+		"a: b\n  c\n",
+		"- a\nb: 1\n",
+	} {
+		if v, err := parseYAML([]byte(doc)); err == nil {
+			t.Errorf("parseYAML(%q) = %#v, want an error", doc, v)
+		}
+	}
+}